@@ -0,0 +1,91 @@
+package panda
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrAborted is wrapped by the *AbortError returned when the peer has aborted
+// the exchange.
+var ErrAborted = errors.New("panda: exchange aborted by peer")
+
+// ErrComplete is returned when the peer's abort, or in a fragmented exchange
+// any fragment, arrives after the exchange has already completed. The
+// exchange is unaffected.
+var ErrComplete = errors.New("panda: exchange already complete")
+
+// MaxAbortReasonLen is the longest reason that can be passed to Abort.
+const MaxAbortReasonLen = 256
+
+// An AbortError carries the reason that the peer gave for aborting, and when
+// they did so according to their clock.
+type AbortError struct {
+	Reason string
+	Time   time.Time
+}
+
+func (e *AbortError) Error() string {
+	return "panda: exchange aborted by peer: " + e.Reason
+}
+
+func (e *AbortError) Unwrap() error {
+	return ErrAborted
+}
+
+// abortKey returns the key used to seal tombstones in the current round. It
+// is distinct from the key used for bodies so that a tombstone can never be
+// mistaken for one.
+func (ex *Exchange) abortKey() *[32]byte {
+	roundKey := &ex.key
+	if ex.haveSharedKey {
+		roundKey = &ex.sharedKey
+	}
+	var key [32]byte
+	keySlice := deriveKey(roundKey, ex.context("abort"))
+	copy(key[:], keySlice)
+	wipe(keySlice)
+	return &key
+}
+
+// Abort marks ex as failed with FailureAborted and returns a tombstone that
+// tells the peer why. The tombstone is posted under tag, in place of the body
+// from NextRequest, and only authenticates for a peer in the same round.
+func (ex *Exchange) Abort(reason string, now time.Time) (tag, body []byte, err error) {
+	if ex.complete {
+		return nil, nil, errors.New("panda: cannot abort a completed exchange")
+	}
+	if len(reason) > MaxAbortReasonLen {
+		return nil, nil, errors.New("panda: abort reason too long")
+	}
+
+	if tag, _, err = ex.NextRequestErr(); err != nil {
+		return nil, nil, err
+	}
+	tombstone := make([]byte, 8, 8+len(reason))
+	binary.BigEndian.PutUint64(tombstone, uint64(now.Unix()))
+	tombstone = append(tombstone, reason...)
+	round := 1
+	if ex.haveSharedKey {
+		round = 2
+	}
+	if body, err = ex.box(round, ex.abortKey(), tombstone); err != nil {
+		return nil, nil, err
+	}
+
+	ex.Fail(&FailureError{Code: FailureAborted, Message: reason})
+	return tag, body, nil
+}
+
+// openTombstone returns the peer's abort if reply is an authentic tombstone
+// for the current round.
+func (ex *Exchange) openTombstone(reply []byte) (*AbortError, bool) {
+	tombstone, err := unbox(ex.suite, ex.version, ex.abortKey(), reply)
+	if err != nil || len(tombstone) < 8 {
+		return nil, false
+	}
+	return &AbortError{
+		Reason: string(tombstone[8:]),
+		Time:   time.Unix(int64(binary.BigEndian.Uint64(tombstone)), 0),
+	}, true
+}
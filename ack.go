@@ -0,0 +1,123 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+)
+
+// The labels of the tag and key of acknowledgments in the version 2 key
+// schedule, expanded from the shared key.
+const (
+	labelAckTag = "ack tag"
+	labelAckKey = "ack key"
+)
+
+// ackContentLen is the length of the contents of an acknowledgment: the
+// SHA-256 hash of the sender's public value, which tells the two apart, and
+// the hash of the message that the sender received.
+const ackContentLen = 2 * sha256.Size
+
+// ackTag returns the tag under which both parties post acknowledgments.
+func (ex *Exchange) ackTag() []byte {
+	if ex.version >= ProtocolVersion2 {
+		return ex.scheduleKey(&ex.sharedKey, labelAckTag, 32)
+	}
+	return deriveKey(&ex.sharedKey, ex.context("ack tag"))
+}
+
+// ackKey returns the key that seals acknowledgments.
+func (ex *Exchange) ackKey() *[32]byte {
+	var keySlice []byte
+	if ex.version >= ProtocolVersion2 {
+		keySlice = ex.scheduleKey(&ex.sharedKey, labelAckKey, 32)
+	} else {
+		keySlice = deriveKey(&ex.sharedKey, ex.context("ack key"))
+	}
+	var key [32]byte
+	copy(key[:], keySlice)
+	wipe(keySlice)
+	return &key
+}
+
+// ackLen returns the size of an acknowledgment, which, unlike a body, isn't
+// padded.
+func (ex *Exchange) ackLen() int {
+	return 24 /* nonce */ + secretbox.Overhead + lengthFieldLen(ex.version) + ackContentLen
+}
+
+// Acknowledgment returns a receipt that tells the peer that the exchange has
+// completed on our side, and the tag under which to post it. Acknowledgments
+// are optional: the exchange is complete without them, but a party that
+// completes first can't otherwise learn whether the peer has received its
+// message. Both parties post under the same tag and each passes the peer's
+// receipt, when it arrives, to ProcessAcknowledgment. The receipt is
+// deterministic, so posting it again, such as after a restart, is
+// idempotent. It is an error to call Acknowledgment before the exchange is
+// complete.
+func (ex *Exchange) Acknowledgment() (tag, body []byte, err error) {
+	if !ex.complete {
+		return nil, nil, errors.New("panda: cannot acknowledge an incomplete exchange")
+	}
+	if ex.peerMessageHash == [32]byte{} {
+		return nil, nil, errors.New("panda: exchange doesn't record the received message")
+	}
+	publicHash := sha256.Sum256(ex.public)
+	content := append(publicHash[:], ex.peerMessageHash[:]...)
+	if body, err = padAndBoxTo(ex.suite, ex.version, ex.ackKey(), roundAck, content, ex.ackLen()); err != nil {
+		return nil, nil, err
+	}
+	return ex.ackTag(), body, nil
+}
+
+// ErrAckMismatch is returned by ProcessAcknowledgment when the peer's receipt
+// is authentic but names a message other than the one that we sent.
+var ErrAckMismatch = errors.New("panda: peer acknowledged a different message")
+
+// ProcessAcknowledgment processes a reply from the tag given by
+// Acknowledgment. If it is the peer's receipt, Acknowledged returns true
+// from then on. Like Process, it returns ErrOwnMessage for our own receipt.
+func (ex *Exchange) ProcessAcknowledgment(reply []byte) error {
+	if !ex.complete {
+		return errors.New("panda: cannot process an acknowledgment before the exchange is complete")
+	}
+	if len(reply) != ex.ackLen() {
+		return &ReplySizeError{Got: len(reply), Want: []int{ex.ackLen()}}
+	}
+	content, err := unbox(ex.suite, ex.version, ex.ackKey(), reply)
+	if err != nil {
+		return err
+	}
+	if len(content) != ackContentLen {
+		return errors.New("panda: corrupt but authentic acknowledgment found")
+	}
+	publicHash := sha256.Sum256(ex.public)
+	if bytes.Equal(content[:sha256.Size], publicHash[:]) {
+		return ErrOwnMessage
+	}
+	messageHash := ex.sentMessageHash()
+	if subtle.ConstantTimeCompare(content[sha256.Size:], messageHash[:]) != 1 {
+		return ErrAckMismatch
+	}
+	ex.peerAcknowledged = true
+	return nil
+}
+
+// Acknowledged returns true once the peer's acknowledgment has been
+// processed, which confirms that the peer completed the exchange with our
+// message.
+func (ex *Exchange) Acknowledged() bool {
+	return ex.peerAcknowledged
+}
+
+// sentMessageHash returns the hash of our message as sent, which the peer's
+// acknowledgment names.
+func (ex *Exchange) sentMessageHash() [32]byte {
+	if ex.multi() {
+		return hashMessages(ex.messages)
+	}
+	return sha256.Sum256(ex.sentMessage())
+}
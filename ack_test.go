@@ -0,0 +1,93 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestAcknowledgment(t *testing.T) {
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion4} {
+		a, b := newPair(t, WithProtocolVersion(version))
+		if _, _, err := a.Acknowledgment(); err == nil {
+			t.Errorf("version %d: incomplete exchange was acknowledged", version)
+		}
+		runExchange(t, a, b)
+
+		aTag, aAck, err := a.Acknowledgment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bTag, bAck, err := b.Acknowledgment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(aTag, bTag) || bytes.Equal(aAck, bAck) || len(aAck) >= 128 {
+			t.Errorf("version %d: got tags %x and %x, receipts of %d bytes", version, aTag, bTag, len(aAck))
+		}
+		if _, again, _ := a.Acknowledgment(); !bytes.Equal(again, aAck) {
+			t.Errorf("version %d: acknowledgment isn't deterministic", version)
+		}
+
+		if err := a.ProcessAcknowledgment(aAck); err != ErrOwnMessage {
+			t.Errorf("version %d: got %v for our own receipt, want ErrOwnMessage", version, err)
+		}
+		corrupt := append([]byte(nil), bAck...)
+		corrupt[len(corrupt)-1] ^= 1
+		if err := a.ProcessAcknowledgment(corrupt); err == nil {
+			t.Errorf("version %d: corrupt receipt was accepted", version)
+		}
+		if err := a.ProcessAcknowledgment(append(bAck, 0)); !errors.Is(err, ErrBadReplySize) {
+			t.Errorf("version %d: got %v for an oversized receipt, want ErrBadReplySize", version, err)
+		}
+		if a.Acknowledged() {
+			t.Errorf("version %d: acknowledged without the peer's receipt", version)
+		}
+		if err := a.ProcessAcknowledgment(bAck); err != nil {
+			t.Fatal(err)
+		}
+		a = marshalUnmarshal(a)
+		if !a.Acknowledged() || b.Acknowledged() {
+			t.Errorf("version %d: acknowledgment wasn't recorded", version)
+		}
+		if info, err := PeekStateInfo(a.Marshal()); err != nil || !info.Acknowledged {
+			t.Errorf("version %d: PeekStateInfo gave %+v, %v", version, info, err)
+		}
+	}
+}
+
+func TestAcknowledgmentMismatch(t *testing.T) {
+	a, b := newPair(t, WithProtocolVersion(ProtocolVersion2))
+	runExchange(t, a, b)
+	_, bAck, err := b.Acknowledgment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A receipt for a different message, as though from a party that
+	// received something other than what a sent.
+	a.message = []byte("not a")
+	if err := a.ProcessAcknowledgment(bAck); err != ErrAckMismatch {
+		t.Errorf("got %v, want ErrAckMismatch", err)
+	}
+
+	// Key-only parties send the same, empty, message in both directions
+	// but their receipts are still distinct.
+	opts := []Option{WithProtocolVersion(ProtocolVersion2), fastKDF}
+	c, err := New(rand.Reader, []byte("foo"), nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(rand.Reader, []byte("foo"), nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runExchange(t, c, d)
+	_, cAck, err := c.Acknowledgment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ProcessAcknowledgment(cAck); err != nil || !d.Acknowledged() {
+		t.Errorf("key-only receipt gave %v", err)
+	}
+}
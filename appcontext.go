@@ -0,0 +1,28 @@
+package panda
+
+import "strconv"
+
+// WithContext binds the exchange to an application, named by appLabel, so
+// that two applications whose users happen to choose the same secret can't
+// match each other's exchanges on a shared meeting place. The label is mixed
+// into both the KDF input and the derivation of every tag and key, and is
+// recorded in serialized state. Both parties must use the same label. An
+// empty label is the same as not using the option.
+func WithContext(appLabel string) Option {
+	return func(c *config) {
+		c.appLabel = appLabel
+	}
+}
+
+// scopeSecret returns the KDF input for secret, scoped to the given
+// application and validity window. The result is always a new buffer, which
+// the caller should wipe.
+func scopeSecret(secret []byte, appLabel, window string) []byte {
+	input := windowSecret(secret, window)
+	if len(appLabel) == 0 {
+		return input
+	}
+	defer wipe(input)
+	prefix := "PANDA app " + strconv.Itoa(len(appLabel)) + ":" + appLabel + "\x00"
+	return append([]byte(prefix), input...)
+}
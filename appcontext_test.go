@@ -0,0 +1,65 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestAppContext(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithContext("one"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithContext("two"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.appLabel != "one" {
+		t.Errorf("label lost in round trip: %q", a.appLabel)
+	}
+	if info, _ := PeekStateInfo(a.Marshal()); info.AppLabel != "one" {
+		t.Errorf("PeekStateInfo reported label %q", info.AppLabel)
+	}
+
+	aTag, aBody := a.NextRequest()
+	bTag, _ := b.NextRequest()
+	if bytes.Equal(aTag, bTag) {
+		t.Errorf("tags are shared between applications")
+	}
+	if _, err := b.Process(aBody); err == nil {
+		t.Errorf("body was accepted by another application")
+	}
+	if bytes.Equal(a.roundTag(2), b.roundTag(2)) {
+		t.Errorf("second round tags are shared between applications")
+	}
+
+	b, err = New(rand.Reader, []byte("foo"), []byte("b"), WithContext("one"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
+
+func TestEmptyAppContext(t *testing.T) {
+	labelled, err := New(rand.Reader, []byte("foo"), nil, WithContext(""), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := New(rand.Reader, []byte("foo"), nil, fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labelled.key != plain.key {
+		t.Errorf("empty label changed the key")
+	}
+	labelledTag, _ := labelled.NextRequest()
+	plainTag, _ := plain.NextRequest()
+	if !bytes.Equal(labelledTag, plainTag) {
+		t.Errorf("empty label changed the tag")
+	}
+}
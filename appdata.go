@@ -0,0 +1,82 @@
+package panda
+
+import (
+	"errors"
+	"sort"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// MaxAppDataLen is the maximum total length, in bytes, of the keys and values
+// stored with SetAppData.
+const MaxAppDataLen = 4096
+
+// SetAppData stores metadata belonging to the application, such as a nickname
+// for the peer, with the exchange. It is kept in the serialized state as
+// plaintext, is never sent to the peer and never affects the exchange itself.
+// Setting a key to the empty string removes it. It is an error for the total
+// length of all keys and values to exceed MaxAppDataLen.
+func (ex *Exchange) SetAppData(key, value string) error {
+	total := 0
+	for k, v := range ex.appData {
+		if k != key {
+			total += len(k) + len(v)
+		}
+	}
+	if len(value) > 0 {
+		total += len(key) + len(value)
+	}
+	if total > MaxAppDataLen {
+		return errors.New("panda: application data too large")
+	}
+
+	if len(value) == 0 {
+		delete(ex.appData, key)
+		return nil
+	}
+	if ex.appData == nil {
+		ex.appData = make(map[string]string)
+	}
+	ex.appData[key] = value
+	return nil
+}
+
+// AppData returns a copy of the metadata stored with SetAppData.
+func (ex *Exchange) AppData() map[string]string {
+	appData := make(map[string]string)
+	for k, v := range ex.appData {
+		appData[k] = v
+	}
+	return appData
+}
+
+// marshalAppData returns the entries of appData sorted by key so that the
+// serialized state is deterministic.
+func marshalAppData(appData map[string]string) []*stateproto.State_AppDataEntry {
+	var keys []string
+	for k := range appData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var entries []*stateproto.State_AppDataEntry
+	for _, k := range keys {
+		entries = append(entries, &stateproto.State_AppDataEntry{
+			Key:   proto.String(k),
+			Value: proto.String(appData[k]),
+		})
+	}
+	return entries
+}
+
+func unmarshalAppData(s *stateproto.State) map[string]string {
+	if len(s.AppData) == 0 {
+		return nil
+	}
+	appData := make(map[string]string)
+	for _, entry := range s.AppData {
+		appData[entry.GetKey()] = entry.GetValue()
+	}
+	return appData
+}
@@ -0,0 +1,109 @@
+// Package meetingplace implements a PANDA meeting place on App Engine as an
+// http.Handler that can be mounted in any mux. The handler itself is that of
+// package rendezvous; this package stores its postings in the datastore.
+package meetingplace
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/agl/panda/rendezvous"
+)
+
+// NewHandler returns a handler that serves the meeting place endpoints,
+// storing postings in the datastore. It performs no global registration.
+func NewHandler(opts ...rendezvous.Option) http.Handler {
+	return rendezvous.NewHandler(datastoreStorage{}, opts...)
+}
+
+// InviteUsage records the number of tags that an invite code has been spent
+// on. It is keyed by the code's ID.
+type InviteUsage struct {
+	Used int64
+}
+
+// datastoreStorage keeps postings, of kind "Posting", keyed by the hex of
+// their tag.
+type datastoreStorage struct{}
+
+type datastoreTx struct {
+	c appengine.Context
+}
+
+func (tx datastoreTx) Posting(tag []byte) (*rendezvous.Posting, error) {
+	var p rendezvous.Posting
+	err := datastore.Get(tx.c, postingKey(tx.c, tag), &p)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (tx datastoreTx) PutPosting(tag []byte, p *rendezvous.Posting) error {
+	_, err := datastore.Put(tx.c, postingKey(tx.c, tag), p)
+	return err
+}
+
+func (tx datastoreTx) InviteUsage(id [16]byte) (int64, error) {
+	var usage InviteUsage
+	if err := datastore.Get(tx.c, inviteKey(tx.c, id), &usage); err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+	return usage.Used, nil
+}
+
+func (tx datastoreTx) PutInviteUsage(id [16]byte, used int64) error {
+	_, err := datastore.Put(tx.c, inviteKey(tx.c, id), &InviteUsage{used})
+	return err
+}
+
+func postingKey(c appengine.Context, tag []byte) *datastore.Key {
+	return datastore.NewKey(c, "Posting", hex.EncodeToString(tag), 0, nil)
+}
+
+func inviteKey(c appengine.Context, id [16]byte) *datastore.Key {
+	return datastore.NewKey(c, "InviteUsage", hex.EncodeToString(id[:]), 0, nil)
+}
+
+func (datastoreStorage) RunInTransaction(r *http.Request, f func(tx rendezvous.Tx) error) error {
+	// Spending an invite code touches a second entity group.
+	txOptions := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(appengine.NewContext(r), func(c appengine.Context) error {
+		return f(datastoreTx{c})
+	}, txOptions)
+}
+
+func (datastoreStorage) DeleteExpired(r *http.Request, expired func(p *rendezvous.Posting) bool) ([][]byte, error) {
+	c := appengine.NewContext(r)
+	q := datastore.NewQuery("Posting").Order("-Time").Limit(256)
+	var toDelete []*datastore.Key
+	for t := q.Run(c); ; {
+		var p rendezvous.Posting
+		key, err := t.Next(&p)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !expired(&p) {
+			break
+		}
+		toDelete = append(toDelete, key)
+	}
+	if err := datastore.DeleteMulti(c, toDelete); err != nil {
+		return nil, err
+	}
+	var tags [][]byte
+	for _, key := range toDelete {
+		tag, _ := hex.DecodeString(key.StringID())
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
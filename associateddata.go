@@ -0,0 +1,53 @@
+package panda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/agl/panda/stateproto"
+)
+
+// WithAssociatedData binds the exchange to application metadata, such as the
+// identities of the two accounts or the purpose of the exchange, without
+// sending it. A hash of ad is mixed into the keys that seal the bodies of both
+// rounds, so a body can't be replayed into an exchange with different
+// metadata. Both parties must supply the same ad: otherwise they still find
+// each other's posts, since the tags don't depend on it, but Process fails to
+// authenticate the peer's first round body. Only the hash is kept, including
+// in serialized state. Unlike WithContext, it doesn't affect the KDF.
+func WithAssociatedData(ad []byte) Option {
+	h := sha256.New()
+	h.Write([]byte("PANDA associated data v1\x00"))
+	h.Write(ad)
+	var adHash [32]byte
+	copy(adHash[:], h.Sum(nil))
+
+	return func(c *config) {
+		c.adHash = &adHash
+	}
+}
+
+// bindAssociatedData returns key, which seals bodies, bound to the hash of
+// the associated data, if any. key itself is never changed.
+func (ex *Exchange) bindAssociatedData(key *[32]byte) *[32]byte {
+	if ex.adHash == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(ex.context("associated data")))
+	mac.Write(ex.adHash[:])
+	var bound [32]byte
+	copy(bound[:], mac.Sum(nil))
+	return &bound
+}
+
+// unmarshalAssociatedData returns the hash of the associated data recorded
+// in s, if any.
+func unmarshalAssociatedData(s *stateproto.State) *[32]byte {
+	if len(s.AssociatedDataHash) != 32 {
+		return nil
+	}
+	var adHash [32]byte
+	copy(adHash[:], s.AssociatedDataHash)
+	return &adHash
+}
@@ -0,0 +1,45 @@
+package panda
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssociatedData(t *testing.T) {
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion4} {
+		ad := WithAssociatedData([]byte("alice@example.com bob@example.com"))
+		a, b := newPair(t, WithProtocolVersion(version), ad)
+		aResult, bResult := runExchange(t, marshalUnmarshal(a), b)
+		if string(aResult) != "b" || string(bResult) != "a" {
+			t.Errorf("version %d: exchange with the same associated data failed", version)
+		}
+		if a.adHash == nil || marshalUnmarshal(a).adHash == nil || *marshalUnmarshal(a).adHash != *a.adHash {
+			t.Errorf("version %d: associated data wasn't recorded", version)
+		}
+	}
+}
+
+func TestAssociatedDataMismatch(t *testing.T) {
+	for _, opts := range [][2]Option{
+		{WithAssociatedData([]byte("purpose: backup")), WithAssociatedData([]byte("purpose: contact"))},
+		{WithAssociatedData([]byte("purpose: backup")), WithProtocolVersion(ProtocolVersion1)},
+		{WithAssociatedData(nil), WithProtocolVersion(ProtocolVersion1)},
+	} {
+		a, _ := newPair(t, opts[0])
+		_, b := newPair(t, opts[1])
+		aTag, aBody := a.NextRequest()
+		bTag, bBody := b.NextRequest()
+		if !bytes.Equal(aTag, bTag) {
+			t.Fatalf("associated data changed the tags")
+		}
+		if _, err := a.Process(bBody); err == nil {
+			t.Errorf("first round body with different associated data was accepted")
+		}
+		if _, err := b.Process(aBody); err == nil {
+			t.Errorf("first round body with different associated data was accepted")
+		}
+		if a.haveSharedKey || b.haveSharedKey {
+			t.Errorf("mismatch wasn't caught in the first round")
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Package attachment exchanges large payloads over PANDA by sending a
+// descriptor, rather than the payload itself, as the exchange's message. The
+// payload is encrypted, uploaded to any HTTP host and fetched by the peer
+// using the URL and key in the descriptor.
+//
+// Encryption hides the payload from the storage host but not its existence,
+// size or the times that it was uploaded and fetched. Anyone who learns the
+// URL, including the host, can see that it has been fetched.
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"github.com/agl/panda"
+)
+
+// chunkSize is the amount of plaintext in each encrypted chunk.
+const chunkSize = 1 << 16
+
+// A Descriptor tells the peer where to fetch an attachment and how to decrypt
+// and check it.
+type Descriptor struct {
+	URL string
+	// Key is the secretbox key that the attachment is encrypted with.
+	Key [32]byte
+	// Hash is the SHA-256 hash of the plaintext.
+	Hash [32]byte
+	// Size is the length of the plaintext.
+	Size int64
+}
+
+// NewDescriptor returns a Descriptor for an attachment encrypted with Encrypt.
+func NewDescriptor(url string, key, hash [32]byte, size int64) *Descriptor {
+	return &Descriptor{URL: url, Key: key, Hash: hash, Size: size}
+}
+
+// Marshal encodes d as a panda.Bundle, for use as an exchange's message. As
+// with Bundle.Marshal, the encoding must not be longer than maxLen.
+func (d *Descriptor) Marshal(maxLen int) ([]byte, error) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(d.Size))
+	return panda.NewBundle().
+		Add("attachment-url", []byte(d.URL)).
+		Add("attachment-key", d.Key[:]).
+		Add("attachment-hash", d.Hash[:]).
+		Add("attachment-size", size[:]).
+		Marshal(maxLen)
+}
+
+// ParseDescriptor decodes a message produced by Descriptor.Marshal.
+func ParseDescriptor(msg []byte) (*Descriptor, error) {
+	b, err := panda.ParseBundle(msg)
+	if err != nil {
+		return nil, err
+	}
+	url, ok1 := b.Get("attachment-url")
+	key, ok2 := b.Get("attachment-key")
+	hash, ok3 := b.Get("attachment-hash")
+	size, ok4 := b.Get("attachment-size")
+	if !ok1 || !ok2 || !ok3 || !ok4 || len(key) != 32 || len(hash) != 32 || len(size) != 8 {
+		return nil, errors.New("attachment: malformed descriptor")
+	}
+	d := &Descriptor{URL: string(url), Size: int64(binary.BigEndian.Uint64(size))}
+	if d.Size < 0 {
+		return nil, errors.New("attachment: malformed descriptor")
+	}
+	copy(d.Key[:], key)
+	copy(d.Hash[:], hash)
+	return d, nil
+}
+
+// chunkNonce returns the nonce for the given chunk. The last chunk is marked
+// so that a truncated attachment can't be mistaken for a complete one.
+func chunkNonce(counter uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[:], counter)
+	if last {
+		nonce[23] = 1
+	}
+	return &nonce
+}
+
+// Encrypt reads plaintext from r and writes it, encrypted with key, to w. It
+// returns the size and hash of the plaintext for use in a Descriptor. The key
+// must be random and must never be used for another attachment.
+func Encrypt(w io.Writer, r io.Reader, key *[32]byte) (size int64, hash [32]byte, err error) {
+	h := sha256.New()
+	buf := make([]byte, chunkSize+1)
+	// One byte beyond a chunk is read ahead so that the last chunk is
+	// known when it is sealed.
+	n, err := io.ReadFull(r, buf)
+	for counter := uint64(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, hash, err
+		}
+		last := n <= chunkSize
+		chunk := buf[:n]
+		if !last {
+			chunk = buf[:chunkSize]
+		}
+		h.Write(chunk)
+		size += int64(len(chunk))
+		if _, err := w.Write(secretbox.Seal(nil, chunk, chunkNonce(counter, last), key)); err != nil {
+			return 0, hash, err
+		}
+		if last {
+			break
+		}
+		buf[0] = buf[chunkSize]
+		n, err = io.ReadFull(r, buf[1:])
+		n++
+	}
+	copy(hash[:], h.Sum(nil))
+	return size, hash, nil
+}
+
+// Fetch downloads the attachment described by d using client, which may be
+// nil to use http.DefaultClient, and writes the plaintext to w. Each chunk is
+// authenticated before it is written, so w never receives data that wasn't
+// encrypted with d.Key. The size and hash are checked as the data arrives;
+// any mismatch, truncation or trailing data is an error. Since the hash can
+// only be confirmed at the end, callers should treat w's contents as
+// incomplete unless Fetch returns nil.
+func Fetch(ctx context.Context, d *Descriptor, client *http.Client, w io.Writer) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", d.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("attachment: server returned status " + strconv.Itoa(resp.StatusCode))
+	}
+	return decrypt(w, resp.Body, d)
+}
+
+func decrypt(w io.Writer, r io.Reader, d *Descriptor) error {
+	h := sha256.New()
+	var written int64
+	buf := make([]byte, chunkSize+secretbox.Overhead+1)
+	n, err := io.ReadFull(r, buf)
+	for counter := uint64(0); ; counter++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n <= chunkSize+secretbox.Overhead
+		box := buf[:n]
+		if !last {
+			box = buf[:chunkSize+secretbox.Overhead]
+		}
+		chunk, ok := secretbox.Open(nil, box, chunkNonce(counter, last), &d.Key)
+		if !ok {
+			return errors.New("attachment: chunk " + strconv.FormatUint(counter, 10) + " failed to authenticate")
+		}
+		if written += int64(len(chunk)); written > d.Size {
+			return errors.New("attachment: larger than described")
+		}
+		h.Write(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+		buf[0] = buf[chunkSize+secretbox.Overhead]
+		n, err = io.ReadFull(r, buf[1:])
+		n++
+	}
+
+	if written != d.Size {
+		return errors.New("attachment: smaller than described")
+	}
+	if !bytes.Equal(h.Sum(nil), d.Hash[:]) {
+		return errors.New("attachment: hash mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/agl/panda"
+)
+
+func encrypt(t *testing.T, plaintext []byte) ([]byte, *Descriptor) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	var blob bytes.Buffer
+	size, hash, err := Encrypt(&blob, bytes.NewReader(plaintext), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob.Bytes(), NewDescriptor("", key, hash, size)
+}
+
+func TestDescriptorRoundTrip(t *testing.T) {
+	var key, hash [32]byte
+	key[0], hash[0] = 1, 2
+	d := NewDescriptor("https://example.com/blob", key, hash, 12345)
+	msg, err := d.Marshal(panda.MaxMessageLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseDescriptor(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *d {
+		t.Errorf("got %+v, want %+v", parsed, d)
+	}
+	if _, err := ParseDescriptor(msg[:len(msg)-1]); err == nil {
+		t.Errorf("truncated descriptor was accepted")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	blob, d := encrypt(t, plaintext)
+
+	truncatedAtChunk := blob[:2*(chunkSize+16)]
+	tampered := append([]byte(nil), blob...)
+	tampered[chunkSize+100] ^= 1
+	extended := append(append([]byte(nil), blob...), 0)
+
+	blobs := map[string][]byte{
+		"/good":               blob,
+		"/truncated":          blob[:len(blob)-10],
+		"/truncated-at-chunk": truncatedAtChunk,
+		"/tampered":           tampered,
+		"/extended":           extended,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, ok := blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	}))
+	defer server.Close()
+
+	for path := range blobs {
+		d.URL = server.URL + path
+		var out bytes.Buffer
+		err := Fetch(context.Background(), d, nil, &out)
+		if path == "/good" {
+			if err != nil {
+				t.Errorf("%s: %s", path, err)
+			} else if !bytes.Equal(out.Bytes(), plaintext) {
+				t.Errorf("%s: plaintext differs", path)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: no error", path)
+		}
+		if !bytes.HasPrefix(plaintext, out.Bytes()) {
+			t.Errorf("%s: unauthenticated data was written", path)
+		}
+	}
+
+	// A descriptor that doesn't match the blob.
+	d.URL = server.URL + "/good"
+	for _, modify := range []func(*Descriptor){
+		func(d *Descriptor) { d.Size-- },
+		func(d *Descriptor) { d.Size++ },
+		func(d *Descriptor) { d.Hash[0] ^= 1 },
+	} {
+		wrong := *d
+		modify(&wrong)
+		if err := Fetch(context.Background(), &wrong, nil, new(bytes.Buffer)); err == nil {
+			t.Errorf("mismatched descriptor %+v was accepted", wrong)
+		}
+	}
+	missing := *d
+	missing.URL = server.URL + "/missing"
+	if err := Fetch(context.Background(), &missing, nil, new(bytes.Buffer)); err == nil {
+		t.Errorf("missing blob was accepted")
+	}
+}
+
+func TestEncryptSizes(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2 * chunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		blob, d := encrypt(t, plaintext)
+		var out bytes.Buffer
+		if err := decrypt(&out, bytes.NewReader(blob), d); err != nil {
+			t.Errorf("size %d: %s", size, err)
+		} else if !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("size %d: plaintext differs", size)
+		}
+	}
+}
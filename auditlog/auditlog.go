@@ -0,0 +1,286 @@
+// Package auditlog implements a tamper-evident log of meeting place
+// operations.
+//
+// The log is a sequence of JSON records, one per line. Each record contains
+// the hash of the one before it and its own hash covers that value, so
+// removing or altering any record breaks the chain from that point onwards.
+// Records never contain tags, bodies or client identities, only truncated
+// hashes of them, so the log gives no help in decrypting exchanges. Client
+// identities, which are drawn from a space small enough to search, are hashed
+// with a key that the operator supplies; see NewEvent.
+//
+// When a log is rotated, the new file starts with a continuation record that
+// carries on the chain from the end of the previous one. Optionally, the head
+// of the chain is also written to a separate checkpoint stream at regular
+// intervals so that truncation of the log can be detected.
+package auditlog
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hashLen is the number of bytes kept from the hashes of tags, bodies and
+// client identities.
+const hashLen = 16
+
+// Operations recorded in the log.
+const (
+	OpPost     = "post"
+	OpPoll     = "poll"
+	OpConflict = "conflict"
+	OpGC       = "gc"
+)
+
+// An Event is a single operation recorded in the log.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	TagHash  string    `json:"tag,omitempty"`
+	BodyHash string    `json:"body,omitempty"`
+	Client   string    `json:"client,omitempty"`
+}
+
+// NewEvent returns an Event for the given operation, replacing the tag, body
+// and client identity with truncated hashes. Any of them may be empty.
+//
+// The client identity is hashed with HMAC-SHA256 under clientKey, which
+// should be at least 32 random bytes kept apart from the log: a plain hash of
+// an IP address can be reversed by trying every address. Events hashed under
+// the same key can be linked to one client, and events under different keys
+// cannot. To rotate the key, start using a new one at the same time as the log
+// is rotated, so that each file is under a single key, and destroy the old key
+// once there is no further need to match the files written under it against
+// a known address.
+func NewEvent(t time.Time, op string, tag, body []byte, client string, clientKey []byte) Event {
+	return Event{
+		Time:     t.UTC(),
+		Op:       op,
+		TagHash:  truncatedHash(tag),
+		BodyHash: truncatedHash(body),
+		Client:   keyedHash(clientKey, []byte(client)),
+	}
+}
+
+func truncatedHash(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:hashLen])
+}
+
+func keyedHash(key, b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)[:hashLen])
+}
+
+// Head identifies the end of a chain.
+type Head struct {
+	// Seq is the sequence number of the last record.
+	Seq uint64
+	// Hash is the hash of the last record.
+	Hash [sha256.Size]byte
+}
+
+type record struct {
+	Seq          uint64 `json:"seq"`
+	Prev         string `json:"prev"`
+	Continuation bool   `json:"continuation,omitempty"`
+	Event        *Event `json:"event,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of r, which covers every field but Hash.
+func (r record) hash() [sha256.Size]byte {
+	r.Hash = ""
+	encoded, _ := json.Marshal(r)
+	return sha256.Sum256(encoded)
+}
+
+type checkpoint struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// A Log appends events to a chain. It is safe for concurrent use.
+type Log struct {
+	mu              sync.Mutex
+	w               io.Writer
+	head            Head
+	checkpoints     io.Writer
+	checkpointEvery uint64
+}
+
+// New starts a new chain, written to w.
+func New(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Resume continues the chain ending at head, such as after a restart, in a
+// new file written to w. It writes a continuation record to w.
+func Resume(w io.Writer, head Head) (*Log, error) {
+	l := &Log{head: head}
+	if err := l.Rotate(w); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetCheckpoints causes the head of the chain to be written to w after
+// every n records.
+func (l *Log) SetCheckpoints(w io.Writer, n uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checkpoints = w
+	l.checkpointEvery = n
+}
+
+// Head returns the end of the chain so far.
+func (l *Log) Head() Head {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// Append adds e to the log.
+func (l *Log) Append(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.append(l.w, record{Event: &e})
+}
+
+// Rotate switches the log to w, which should be a new file. The chain
+// continues from the previous file via a continuation record written to w.
+func (l *Log) Rotate(w io.Writer) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w = w
+	return l.append(w, record{Continuation: true})
+}
+
+func (l *Log) append(w io.Writer, r record) error {
+	r.Seq = l.head.Seq + 1
+	r.Prev = hex.EncodeToString(l.head.Hash[:])
+	h := r.hash()
+	r.Hash = hex.EncodeToString(h[:])
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.head = Head{Seq: r.Seq, Hash: h}
+
+	if l.checkpoints != nil && l.checkpointEvery > 0 && r.Seq%l.checkpointEvery == 0 {
+		line, _ := json.Marshal(checkpoint{Seq: r.Seq, Hash: r.Hash})
+		if _, err := l.checkpoints.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks the integrity of the chain in one log file and returns its
+// head. If start is not nil, the file must continue the chain from there,
+// which is how rotated files are linked to their predecessors. Otherwise the
+// file is only checked for internal consistency.
+func Verify(r io.Reader, start *Head) (Head, error) {
+	return verify(r, start, nil)
+}
+
+// VerifyCheckpoints checks the chain across the log files read, in order,
+// from logs and that every checkpoint read from checkpoints matches a record
+// in them.
+func VerifyCheckpoints(checkpoints io.Reader, logs ...io.Reader) error {
+	hashes := make(map[uint64]Head)
+	record := func(h Head) {
+		hashes[h.Seq] = h
+	}
+
+	var head *Head
+	for _, r := range logs {
+		h, err := verify(r, head, record)
+		if err != nil {
+			return err
+		}
+		head = &h
+	}
+
+	scanner := bufio.NewScanner(checkpoints)
+	for scanner.Scan() {
+		var c checkpoint
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return errors.New("auditlog: malformed checkpoint: " + err.Error())
+		}
+		h, ok := hashes[c.Seq]
+		if !ok || hex.EncodeToString(h.Hash[:]) != c.Hash {
+			return errors.New("auditlog: checkpoint " + strconv.FormatUint(c.Seq, 10) + " does not match the log")
+		}
+	}
+	return scanner.Err()
+}
+
+// verify implements Verify, calling f, if not nil, with the head after each
+// record.
+func verify(r io.Reader, start *Head, f func(Head)) (Head, error) {
+	var head Head
+	if start != nil {
+		head = *start
+	}
+	first := true
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return head, errors.New("auditlog: malformed record after " + strconv.FormatUint(head.Seq, 10) + ": " + err.Error())
+		}
+		seq := strconv.FormatUint(rec.Seq, 10)
+
+		prev, err := hex.DecodeString(rec.Prev)
+		if err != nil || len(prev) != sha256.Size {
+			return head, errors.New("auditlog: malformed previous hash in record " + seq)
+		}
+		if first && start == nil {
+			// Accept whatever this file claims to continue from.
+			copy(head.Hash[:], prev)
+			head.Seq = rec.Seq - 1
+		}
+		first = false
+
+		if rec.Seq != head.Seq+1 {
+			return head, errors.New("auditlog: record " + seq + " is out of sequence")
+		}
+		if string(prev) != string(head.Hash[:]) {
+			return head, errors.New("auditlog: record " + seq + " does not follow from its predecessor")
+		}
+		if rec.Continuation == (rec.Event != nil) {
+			return head, errors.New("auditlog: record " + seq + " is malformed")
+		}
+		h := rec.hash()
+		if hex.EncodeToString(h[:]) != rec.Hash {
+			return head, errors.New("auditlog: record " + seq + " has been altered")
+		}
+		head = Head{Seq: rec.Seq, Hash: h}
+		if f != nil {
+			f(head)
+		}
+	}
+	return head, scanner.Err()
+}
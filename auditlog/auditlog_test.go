@@ -0,0 +1,115 @@
+package auditlog
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func simulateTraffic(t *testing.T, l *Log, n int) {
+	now := time.Unix(1000000, 0)
+	ops := []string{OpPost, OpPoll, OpConflict, OpGC}
+	for i := 0; i < n; i++ {
+		tag := []byte{byte(i)}
+		e := NewEvent(now.Add(time.Duration(i)*time.Second), ops[i%len(ops)], tag, []byte("body"), "192.0.2.1", []byte("client key"))
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	simulateTraffic(t, l, 10)
+
+	if strings.Contains(buf.String(), "192.0.2.1") {
+		t.Errorf("client identity appears in the log")
+	}
+
+	head, err := Verify(bytes.NewReader(buf.Bytes()), &Head{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != l.Head() {
+		t.Errorf("Verify returned %+v, log head is %+v", head, l.Head())
+	}
+}
+
+func TestTamperedEntry(t *testing.T) {
+	var buf bytes.Buffer
+	simulateTraffic(t, New(&buf), 10)
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	tampered := strings.Replace(lines[4], `"op":"post"`, `"op":"poll"`, 1)
+	if tampered == lines[4] {
+		t.Fatalf("failed to tamper with %s", lines[4])
+	}
+
+	lines[4] = tampered
+	if _, err := Verify(strings.NewReader(strings.Join(lines, "")), &Head{}); err == nil {
+		t.Errorf("altered record was not detected")
+	}
+
+	lines = append(lines[:4], lines[5:]...)
+	if _, err := Verify(strings.NewReader(strings.Join(lines, "")), &Head{}); err == nil {
+		t.Errorf("removed record was not detected")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	var first, second, checkpoints bytes.Buffer
+	l := New(&first)
+	l.SetCheckpoints(&checkpoints, 3)
+	simulateTraffic(t, l, 5)
+	if err := l.Rotate(&second); err != nil {
+		t.Fatal(err)
+	}
+	simulateTraffic(t, l, 5)
+
+	head, err := Verify(bytes.NewReader(first.Bytes()), &Head{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(second.Bytes()), &head); err != nil {
+		t.Errorf("rotated file does not continue the chain: %s", err)
+	}
+	if _, err := Verify(bytes.NewReader(second.Bytes()), &Head{}); err == nil {
+		t.Errorf("rotated file verified as the start of a chain")
+	}
+	if err := VerifyCheckpoints(bytes.NewReader(checkpoints.Bytes()), bytes.NewReader(first.Bytes()), bytes.NewReader(second.Bytes())); err != nil {
+		t.Errorf("checkpoints: %s", err)
+	}
+	if checkpoints.Len() == 0 {
+		t.Errorf("no checkpoints were written")
+	}
+
+	// A restarted server resumes from the head of the last file.
+	var third bytes.Buffer
+	head = l.Head()
+	resumed, err := Resume(&third, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	simulateTraffic(t, resumed, 2)
+	if _, err := Verify(bytes.NewReader(third.Bytes()), &head); err != nil {
+		t.Errorf("resumed file does not continue the chain: %s", err)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	a := NewEvent(now, OpPost, nil, nil, "192.0.2.1", []byte("key one"))
+	b := NewEvent(now, OpPost, nil, nil, "192.0.2.1", []byte("key one"))
+	c := NewEvent(now, OpPost, nil, nil, "192.0.2.1", []byte("key two"))
+	if a.Client != b.Client {
+		t.Errorf("the same client under the same key hashed to %s and %s", a.Client, b.Client)
+	}
+	if a.Client == c.Client {
+		t.Errorf("the same client under different keys hashed to %s both times", a.Client)
+	}
+	if a.Client == truncatedHash([]byte("192.0.2.1")) {
+		t.Errorf("client hash is not keyed")
+	}
+}
@@ -0,0 +1,176 @@
+package panda
+
+import (
+	"context"
+	"crypto/elliptic"
+	"errors"
+	"io"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// augmentedRole is a party's side of a SPAKE2+ exchange. The values are
+// recorded in serialized states.
+type augmentedRole int32
+
+const (
+	// roleProver knows the secret.
+	roleProver augmentedRole = 1
+	// roleVerifier holds only a Verifier.
+	roleVerifier augmentedRole = 2
+)
+
+// WithAugmentedPeer is used, along with WithSuite(SuiteP256), by the party
+// that knows the secret when the other party is a service that holds only a
+// Verifier, created with NewVerifier, rather than the secret. The exchange
+// then runs SPAKE2+, in which the service can't be impersonated by anyone
+// who steals its Verifier, although they can still use it to mount a
+// dictionary attack on the secret. Such exchanges have their own tags and
+// never meet symmetric ones.
+func WithAugmentedPeer() Option {
+	return func(c *config) {
+		c.augmented = true
+	}
+}
+
+// A Verifier is what a service stores in place of the secret so that it can
+// take part in exchanges with a party that knows it. See WithAugmentedPeer.
+type Verifier struct {
+	key    [32]byte
+	l      []byte
+	config config
+}
+
+// NewVerifier derives a Verifier from the secret. The options must be those
+// that the other party passes to New, including WithAugmentedPeer, which is
+// implied if missing. It takes as long as New.
+func NewVerifier(secret []byte, opts ...Option) (*Verifier, error) {
+	config := newConfig(opts)
+	config.augmented = true
+	if config.wipeSecret {
+		defer wipe(secret)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	key, err := precomputeKey(context.Background(), secret, config)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Wipe()
+
+	ex := config.exchange(nil)
+	ex.keyMaterial = &keyMaterial{key: key.key}
+	defer ex.Destroy()
+	ex.augmentKey()
+	curve := elliptic.P256()
+	Lx, Ly := curve.ScalarBaseMult(ex.w1[:])
+	return &Verifier{
+		key:    ex.key,
+		l:      elliptic.MarshalCompressed(curve, Lx, Ly),
+		config: *config,
+	}, nil
+}
+
+// augmentKey replaces ex.key, the output of the KDF, with the key that both
+// parties to a SPAKE2+ exchange hold, and sets w1, if ex knows the secret.
+// Otherwise it does nothing.
+func (ex *Exchange) augmentKey() {
+	if ex.role != roleProver {
+		return
+	}
+	w1 := ex.p256Scalar("spake2+ w1")
+	w1.FillBytes(ex.w1[:])
+	wipeInt(w1)
+	key := deriveKey(&ex.key, ex.context("spake2+ key"))
+	copy(ex.key[:], key)
+	wipe(key)
+}
+
+// NewFromVerifier is used by a service to start an exchange with a party
+// that knows the secret from which v was derived.
+func NewFromVerifier(r io.Reader, v *Verifier, message []byte) (*Exchange, error) {
+	if err := v.config.checkNew(r, message); err != nil {
+		return nil, err
+	}
+	ex := v.config.exchange(message)
+	ex.role = roleVerifier
+	ex.verifierL = v.l
+	if err := ex.allocKeyMaterial(v.config.lockedMemory); err != nil {
+		return nil, err
+	}
+	ex.key = v.key
+	if err := ex.generateX(r); err != nil {
+		ex.Destroy()
+		return nil, err
+	}
+	return ex, nil
+}
+
+// Wipe zeros the verifier. The Verifier must not be used afterwards.
+func (v *Verifier) Wipe() {
+	v.key = [32]byte{}
+	wipe(v.l)
+}
+
+// Marshal serializes v. The result must be stored as carefully as a password
+// hash since it allows a dictionary attack on the secret.
+func (v *Verifier) Marshal() []byte {
+	state := &stateproto.State{
+		Key:         v.key[:],
+		Message:     []byte{},
+		XBytes:      []byte{},
+		PublicBytes: []byte{},
+		VerifierL:   v.l,
+	}
+	v.config.marshal(state)
+	state.AugmentedRole = proto.Int32(int32(roleVerifier))
+	s, err := proto.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// UnmarshalVerifier creates a Verifier from the result of calling Marshal.
+func UnmarshalVerifier(data []byte) (*Verifier, error) {
+	s, err := parseState(data, "verifier")
+	if err != nil {
+		return nil, err
+	}
+	if augmentedRole(s.GetAugmentedRole()) != roleVerifier || len(s.PublicBytes) > 0 {
+		return nil, errors.New("panda: serialized state is not a verifier")
+	}
+	if err := checkAugmentedState(s, roleVerifier, unmarshalSuite(s)); err != nil {
+		return nil, err
+	}
+	v := &Verifier{l: s.VerifierL}
+	copy(v.key[:], s.Key)
+	if err := v.config.unmarshal(s); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// checkAugmentedState checks the SPAKE2+ values in s for the given role.
+func checkAugmentedState(s *stateproto.State, role augmentedRole, suite Suite) error {
+	switch role {
+	case 0:
+		return nil
+	case roleProver:
+		if len(s.W1) != scalarLen {
+			return errors.New("panda: serialized state is corrupt: bad w1")
+		}
+	case roleVerifier:
+		if x, _ := elliptic.UnmarshalCompressed(elliptic.P256(), s.VerifierL); x == nil {
+			return errors.New("panda: serialized state is corrupt: bad verifier")
+		}
+	default:
+		return errors.New("panda: serialized state is corrupt: unknown augmented role")
+	}
+	if suite != SuiteP256 {
+		return errors.New("panda: augmented exchanges require SuiteP256")
+	}
+	return nil
+}
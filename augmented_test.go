@@ -0,0 +1,132 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestAugmented(t *testing.T) {
+	opts := []Option{WithSuite(SuiteP256), WithAugmentedPeer(), WithServerBinding("https://example.com"), fastKDF}
+	v, err := NewVerifier([]byte("foo"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err = UnmarshalVerifier(v.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalKey(v.Marshal()); err == nil {
+		t.Errorf("UnmarshalKey accepted a verifier")
+	}
+
+	human, err := New(rand.Reader, []byte("foo"), []byte("human"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewFromVerifier(rand.Reader, v, []byte("service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	human, service = marshalUnmarshal(human), marshalUnmarshal(service)
+
+	humanTag, _ := human.NextRequest()
+	serviceTag, _ := service.NextRequest()
+	if !bytes.Equal(humanTag, serviceTag) {
+		t.Errorf("tags differ")
+	}
+	symmetric, err := New(rand.Reader, []byte("foo"), nil, WithSuite(SuiteP256), WithServerBinding("https://example.com"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if symmetricTag, _ := symmetric.NextRequest(); bytes.Equal(symmetricTag, humanTag) {
+		t.Errorf("augmented exchange shares a tag with a symmetric one")
+	}
+	tags, err := WindowTags([]byte("foo"), []string{""}, opts...)
+	if err != nil || !bytes.Equal(tags[0], humanTag) {
+		t.Errorf("WindowTags gave a different tag: %v", err)
+	}
+
+	humanResult, serviceResult := runExchange(t, human, service)
+	if string(humanResult) != "service" || string(serviceResult) != "human" {
+		t.Errorf("got %q and %q", humanResult, serviceResult)
+	}
+
+	// A service whose verifier came from a different secret must fail.
+	wrong, err := NewVerifier([]byte("bar"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongService, err := NewFromVerifier(rand.Reader, wrong, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(rand.Reader, []byte("foo"), nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherBody := other.NextRequest()
+	if _, err := wrongService.Process(otherBody); err == nil {
+		t.Errorf("service accepted a body for a different secret")
+	}
+	_, serviceBody := wrongService.NextRequest()
+	if _, err := symmetric.Process(serviceBody); err == nil {
+		t.Errorf("symmetric exchange accepted an augmented body")
+	}
+
+	if _, err := NewVerifier([]byte("foo"), fastKDF); err == nil {
+		t.Errorf("augmented exchange accepted the MODP suite")
+	}
+}
+
+func TestAugmentedStolenVerifier(t *testing.T) {
+	opts := []Option{WithSuite(SuiteP256), WithAugmentedPeer(), fastKDF}
+	v, err := NewVerifier([]byte("foo"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewFromVerifier(rand.Reader, v, []byte("service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An attacker with a stolen verifier has the shared key and so can
+	// compute tags and round one bodies, but must guess w1.
+	attacker := &Exchange{
+		keyMaterial: new(keyMaterial),
+		message:     []byte("attacker"),
+		kdf:         v.config.kdf,
+		suite:       SuiteP256,
+		role:        roleProver,
+		bodySize:    bodySize,
+	}
+	attacker.key = v.key
+	if _, err := rand.Read(attacker.w1[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := attacker.generateX(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	attackerTag, attackerBody := attacker.NextRequest()
+	serviceTag, serviceBody := service.NextRequest()
+	if !bytes.Equal(attackerTag, serviceTag) {
+		t.Fatalf("attacker failed to compute the tag")
+	}
+	if _, err := service.Process(attackerBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := attacker.Process(serviceBody); err != nil {
+		t.Fatal(err)
+	}
+	if attacker.sharedKey == service.sharedKey {
+		t.Fatalf("attacker agreed a key without w1")
+	}
+	_, attackerBody = attacker.NextRequest()
+	_, serviceBody = service.NextRequest()
+	if _, err := service.Process(attackerBody); err == nil {
+		t.Errorf("service accepted the attacker's message")
+	}
+	if _, err := attacker.Process(serviceBody); err == nil {
+		t.Errorf("attacker read the service's message")
+	}
+}
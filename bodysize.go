@@ -0,0 +1,168 @@
+package panda
+
+import (
+	"errors"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// The sizes to which bodies may be padded. See WithBodySize.
+const (
+	BodySize4K   = 1 << 12
+	BodySize16K  = 1 << 14
+	BodySize128K = 1 << 17
+)
+
+// bodySizes lists the allowed body sizes in increasing order.
+var bodySizes = []int{BodySize4K, BodySize16K, BodySize128K}
+
+// WithBodySize pads every body to size bytes, which must be one of
+// BodySize4K, BodySize16K and BodySize128K, the default. Smaller bodies suit
+// slow transports when the messages are small, such as public keys;
+// MaxMessageLenFor gives the largest message that fits. Both parties must
+// use the same size, unless WithPeerBodySizes says otherwise, and Process
+// returns ErrBadReplySize for a reply of any other size.
+//
+// From ProtocolVersion5, size is the largest body. Each body is padded to the
+// smallest of the allowed sizes, up to size, that fits its contents, and
+// replies of any of those sizes are accepted. The length of a body then
+// reveals which size its contents needed, but not more.
+func WithBodySize(size int) Option {
+	return func(c *config) {
+		c.bodySize = size
+	}
+}
+
+// WithPeerBodySizes accepts replies padded as if the peer had passed any of
+// sizes, each one of the allowed sizes, to WithBodySize, as well as those
+// padded to our own size. It is for a peer that may still be configured
+// with an older size, such as during an upgrade. Replies of any size that
+// none of those configurations could produce, at our protocol version, are
+// still rejected with ErrBadReplySize. Our own bodies are always padded to
+// the size given by WithBodySize, and Result.BodySize reports the size of
+// each reply that was consumed.
+//
+// Fragmented messages are split according to the body size, so this can't
+// be combined with WithFragmentation.
+func WithPeerBodySizes(sizes ...int) Option {
+	return func(c *config) {
+		c.peerBodySizes = append([]int(nil), sizes...)
+	}
+}
+
+// validateBodySize returns an error if size isn't one of the allowed sizes.
+func validateBodySize(size int) error {
+	switch size {
+	case BodySize4K, BodySize16K, BodySize128K:
+		return nil
+	}
+	return errors.New("panda: unsupported body size")
+}
+
+// validatePeerBodySizes returns an error if any of sizes isn't one of the
+// allowed sizes, or if there are any and fragmentation is offered.
+func validatePeerBodySizes(sizes []int, fragmentation bool) error {
+	for _, size := range sizes {
+		if err := validateBodySize(size); err != nil {
+			return err
+		}
+	}
+	if len(sizes) > 0 && fragmentation {
+		return errors.New("panda: peer body sizes can't be combined with fragmentation")
+	}
+	return nil
+}
+
+// marshalBodySize records size in s, unless it's the default.
+func marshalBodySize(size int, s *stateproto.State) {
+	if size != bodySize {
+		s.BodySize = proto.Int32(int32(size))
+	}
+}
+
+// unmarshalBodySize returns the body size recorded in s.
+func unmarshalBodySize(s *stateproto.State) int {
+	if s.BodySize == nil {
+		return bodySize
+	}
+	return int(*s.BodySize)
+}
+
+// marshalPeerBodySizes records sizes in s.
+func marshalPeerBodySizes(sizes []int, s *stateproto.State) {
+	for _, size := range sizes {
+		s.PeerBodySizes = append(s.PeerBodySizes, int32(size))
+	}
+}
+
+// unmarshalPeerBodySizes returns the peer body sizes recorded in s.
+func unmarshalPeerBodySizes(s *stateproto.State) []int {
+	var sizes []int
+	for _, size := range s.PeerBodySizes {
+		sizes = append(sizes, int(size))
+	}
+	return sizes
+}
+
+// box pads body to the size of our bodies and seals it with key for the
+// given round.
+func (ex *Exchange) box(round int, key *[32]byte, body []byte) ([]byte, error) {
+	return padAndBoxTo(ex.suite, ex.version, key, round, body, ex.bodySizeFor(len(body)))
+}
+
+// bodySizeFor returns the size of a body whose contents are n bytes long,
+// not counting the nonce, AEAD overhead and length field. Before version 5
+// it is always the size given by WithBodySize.
+func (ex *Exchange) bodySizeFor(n int) int {
+	if ex.version < ProtocolVersion5 {
+		return ex.bodySize
+	}
+	for _, size := range bodySizes {
+		if size >= ex.bodySize || n <= size-24-secretbox.Overhead-lengthFieldLen(ex.version) {
+			return size
+		}
+	}
+	return ex.bodySize
+}
+
+// isBodySize returns whether a body of n bytes could be one of ours or,
+// given WithPeerBodySizes, one of the peer's.
+func (ex *Exchange) isBodySize(n int) bool {
+	for _, size := range ex.bodySizesAccepted() {
+		if n == size {
+			return true
+		}
+	}
+	return false
+}
+
+// bodySizesAccepted returns the sizes, in increasing order, that a body of
+// ours could be, or a body of the peer's given any of the sizes passed to
+// WithPeerBodySizes.
+func (ex *Exchange) bodySizesAccepted() []int {
+	var sizes []int
+	for _, size := range bodySizes {
+		if ex.paddedTo(size, ex.bodySize) {
+			sizes = append(sizes, size)
+			continue
+		}
+		for _, peerSize := range ex.peerBodySizes {
+			if ex.paddedTo(size, peerSize) {
+				sizes = append(sizes, size)
+				break
+			}
+		}
+	}
+	return sizes
+}
+
+// paddedTo returns whether a party that passed limit to WithBodySize could pad
+// a body to size at our protocol version.
+func (ex *Exchange) paddedTo(size, limit int) bool {
+	if ex.version < ProtocolVersion5 {
+		return size == limit
+	}
+	return size <= limit
+}
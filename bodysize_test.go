@@ -0,0 +1,282 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+)
+
+func TestBodySize(t *testing.T) {
+	for _, size := range []int{BodySize4K, BodySize16K, BodySize128K} {
+		for _, extra := range [][]Option{nil, {WithHybridKEM(), WithKeyConfirmation(), WithProtocolVersion(ProtocolVersion4)}} {
+			opts := append([]Option{WithBodySize(size)}, extra...)
+			limit, err := MaxMessageLenFor(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message := make([]byte, limit)
+			rand.Read(message)
+			a, err := New(rand.Reader, []byte("foo"), message, append(opts, fastKDF)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := New(rand.Reader, []byte("foo"), []byte("b"), append(opts, fastKDF)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := New(rand.Reader, []byte("foo"), make([]byte, limit+1), append(opts, fastKDF)...); err == nil {
+				t.Errorf("size %d: message over the limit was accepted", size)
+			}
+			if _, body := a.NextRequest(); len(body) != size {
+				t.Errorf("size %d: body is %d bytes", size, len(body))
+			}
+			a = marshalUnmarshal(a)
+			aResult, bResult := runExchange(t, a, b)
+			if string(aResult) != "b" || !bytes.Equal(bResult, message) {
+				t.Errorf("size %d: messages weren't exchanged intact", size)
+			}
+			if _, body := a.NextRequest(); len(body) != size {
+				t.Errorf("size %d: second round body is %d bytes", size, len(body))
+			}
+			info, err := PeekStateInfo(a.Marshal())
+			if err != nil || info.BodySize != size {
+				t.Errorf("size %d: PeekStateInfo gave %d, %v", size, info.BodySize, err)
+			}
+		}
+	}
+
+	if _, err := MaxMessageLenFor(WithBodySize(1000)); err == nil {
+		t.Errorf("unsupported body size was accepted")
+	}
+}
+
+func TestBodySizeMismatch(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithBodySize(BodySize4K), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("got %v for a larger body, want ErrBadReplySize", err)
+	}
+	if _, err := b.Process(aBody); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("got %v for a smaller body, want ErrBadReplySize", err)
+	}
+	if _, err := b.ProcessFrom(bytes.NewReader(aBody)); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("ProcessFrom gave %v, want ErrBadReplySize", err)
+	}
+	if _, err := b.ProcessAny([][]byte{aBody}); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("ProcessAny gave %v, want ErrBadReplySize", err)
+	}
+}
+
+func TestBodySizeBuckets(t *testing.T) {
+	capacity := func(size int) int {
+		return maxMessageLenWith(ProtocolVersion5, size, false, false)
+	}
+	for i, size := range bodySizes {
+		lens := []int{capacity(size)}
+		if i+1 < len(bodySizes) {
+			lens = append(lens, capacity(size)+1)
+		}
+		for j, n := range lens {
+			want := bodySizes[i+j]
+			message := make([]byte, n)
+			rand.Read(message)
+			a, b := newPair(t, WithProtocolVersion(ProtocolVersion5))
+			a.message = message
+			_, aBody := a.NextRequest()
+			_, bBody := b.NextRequest()
+			if len(aBody) != BodySize4K {
+				t.Errorf("first round body is %d bytes", len(aBody))
+			}
+			if _, err := a.Process(bBody); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Process(aBody); err != nil {
+				t.Fatal(err)
+			}
+			a = marshalUnmarshal(a)
+			_, aBody = a.NextRequest()
+			if len(aBody) != want {
+				t.Errorf("%d byte message: body is %d bytes, want %d", n, len(aBody), want)
+			}
+			if result, err := b.Process(aBody); err != nil || !bytes.Equal(result, message) {
+				t.Errorf("%d byte message: got %d bytes, %v", n, len(result), err)
+			}
+		}
+	}
+
+	// Key confirmation takes room from the message.
+	n := capacity(BodySize4K) - confirmationLen
+	for _, m := range []int{n, n + 1} {
+		a, b := newPair(t, WithProtocolVersion(ProtocolVersion5), WithKeyConfirmation())
+		a.message = make([]byte, m)
+		runExchange(t, a, b)
+		if _, body := a.NextRequest(); (len(body) == BodySize4K) != (m == n) {
+			t.Errorf("%d byte message with key confirmation: body is %d bytes", m, len(body))
+		}
+	}
+}
+
+func TestBodySizeBucketsLimit(t *testing.T) {
+	opts := []Option{WithProtocolVersion(ProtocolVersion5), fastKDF}
+	small, err := New(rand.Reader, []byte("foo"), []byte("a"), append(opts, WithBodySize(BodySize16K))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, err := New(rand.Reader, []byte("foo"), make([]byte, BodySize16K), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, smallBody := small.NextRequest()
+	_, bigBody := big.NextRequest()
+	if _, err := small.Process(bigBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := big.Process(smallBody); err != nil {
+		t.Fatal(err)
+	}
+	_, bigBody = big.NextRequest()
+	if len(bigBody) != BodySize128K {
+		t.Fatalf("body is %d bytes", len(bigBody))
+	}
+	if _, err := small.Process(bigBody); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("got %v for a body over our largest size, want ErrBadReplySize", err)
+	}
+	_, smallBody = small.NextRequest()
+	if result, err := big.Process(smallBody); err != nil || string(result) != "a" {
+		t.Errorf("got %q, %v", result, err)
+	}
+}
+
+func TestReplySize(t *testing.T) {
+	for _, test := range []struct {
+		version int
+		want    []int
+	}{
+		{ProtocolVersion1, []int{BodySize16K}},
+		{ProtocolVersion5, []int{BodySize4K, BodySize16K}},
+	} {
+		a, b := newPair(t, WithProtocolVersion(test.version), WithBodySize(BodySize16K))
+		_, bBody := b.NextRequest()
+		minimal := make([]byte, 24+secretbox.Overhead+lengthFieldLen(test.version))
+		for _, reply := range [][]byte{
+			minimal,
+			bBody[:len(bBody)-1],
+			append(append([]byte(nil), bBody...), bBody...),
+			append(append([]byte(nil), bBody...), 0),
+		} {
+			_, err := a.Process(reply)
+			var sizeErr *ReplySizeError
+			if !errors.As(err, &sizeErr) || !errors.Is(err, ErrBadReplySize) {
+				t.Errorf("version %d: got %v for a %d-byte reply", test.version, err, len(reply))
+				continue
+			}
+			if sizeErr.Got != len(reply) || !reflect.DeepEqual(sizeErr.Want, test.want) {
+				t.Errorf("version %d: got %+v for a %d-byte reply", test.version, sizeErr, len(reply))
+			}
+		}
+
+		// A reply of the right size is opened, and garbage fails to
+		// authenticate rather than being rejected for its size.
+		if _, err := a.Process(make([]byte, len(bBody))); err == nil || errors.Is(err, ErrBadReplySize) {
+			t.Errorf("version %d: got %v for garbage of the right size", test.version, err)
+		}
+		if result, err := a.ProcessDetailed(bBody); err != nil || !result.KeyAgreed {
+			t.Errorf("version %d: got %+v, %v for the peer's body", test.version, result, err)
+		}
+	}
+}
+
+// TestPeerBodySizes simulates an upgrade in which each party pads to a
+// different size and tolerates the other's.
+func TestPeerBodySizes(t *testing.T) {
+	for _, version := range []int{ProtocolVersion4, ProtocolVersion6} {
+		for _, aSize := range bodySizes {
+			for _, bSize := range bodySizes {
+				if aSize == bSize {
+					continue
+				}
+				base := []Option{WithProtocolVersion(version), WithSuite(SuiteRistretto255), fastKDF}
+				newParty := func(size, peerSize int, peerSizes bool) *Exchange {
+					opts := append([]Option{WithBodySize(size)}, base...)
+					limit, err := MaxMessageLenFor(opts...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if peerSizes {
+						opts = append(opts, WithPeerBodySizes(peerSize))
+					}
+					ex, err := New(rand.Reader, []byte("foo"), bytes.Repeat([]byte{byte(size >> 12)}, limit), opts...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return marshalUnmarshal(ex)
+				}
+				a, b := newParty(aSize, bSize, true), newParty(bSize, aSize, true)
+				strict := newParty(aSize, bSize, false)
+
+				_, aBody := a.NextRequest()
+				_, bBody := b.NextRequest()
+				if result, err := a.ProcessDetailed(bBody); err != nil || result.BodySize != len(bBody) {
+					t.Fatalf("version %d, sizes %d and %d: round one gave %+v, %v", version, aSize, bSize, result, err)
+				}
+				if _, err := b.Process(aBody); err != nil {
+					t.Fatalf("version %d, sizes %d and %d: round one: %s", version, aSize, bSize, err)
+				}
+
+				// Full messages are padded to the largest size
+				// that each party allows.
+				_, aBody = a.NextRequest()
+				_, bBody = b.NextRequest()
+				if len(aBody) != aSize || len(bBody) != bSize {
+					t.Fatalf("version %d, sizes %d and %d: second round bodies are %d and %d bytes", version, aSize, bSize, len(aBody), len(bBody))
+				}
+				aResult, err := a.ProcessDetailed(bBody)
+				if err != nil || !aResult.Completed || aResult.BodySize != bSize || len(aResult.Message) == 0 || aResult.Message[0] != byte(bSize>>12) {
+					t.Errorf("version %d, sizes %d and %d: a got %d bytes, %v", version, aSize, bSize, aResult.BodySize, err)
+				}
+				bResult, err := b.ProcessDetailed(aBody)
+				if err != nil || !bResult.Completed || bResult.BodySize != aSize {
+					t.Errorf("version %d, sizes %d and %d: b got %d bytes, %v", version, aSize, bSize, bResult.BodySize, err)
+				}
+
+				// Without WithPeerBodySizes, the peer's body is
+				// rejected for its size unless ours could be that
+				// size too.
+				_, err = strict.Process(bBody)
+				if want := version < ProtocolVersion5 || bSize > aSize; errors.Is(err, ErrBadReplySize) != want {
+					t.Errorf("version %d, sizes %d and %d: strict party got %v", version, aSize, bSize, err)
+				}
+
+				// Sizes that neither party's configuration could
+				// produce are still rejected.
+				for _, size := range append(bodySizes, BodySize4K+1) {
+					if size == aSize || size == bSize || version >= ProtocolVersion5 && size <= max(aSize, bSize) {
+						continue
+					}
+					if _, err := a.Process(make([]byte, size)); !errors.Is(err, ErrBadReplySize) {
+						t.Errorf("version %d, sizes %d and %d: got %v for a %d-byte reply", version, aSize, bSize, err, size)
+					}
+				}
+			}
+		}
+	}
+
+	if _, err := New(rand.Reader, []byte("foo"), []byte("a"), WithPeerBodySizes(1000), fastKDF); err == nil {
+		t.Errorf("unsupported peer body size was accepted")
+	}
+	if _, err := New(rand.Reader, []byte("foo"), []byte("a"), WithPeerBodySizes(BodySize4K), WithFragmentation(), WithProtocolVersion(ProtocolVersion6), fastKDF); err == nil {
+		t.Errorf("peer body sizes were accepted with fragmentation")
+	}
+}
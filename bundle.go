@@ -0,0 +1,140 @@
+package panda
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A Bundle packs several named payloads into a single PANDA message.
+//
+// The encoding starts with a version byte, currently one, followed by a
+// sequence of records. Each record is a type byte, the length of the record's
+// value as a uvarint and then the value itself. Records of type one carry a
+// named payload and their value is the length of the name as a uvarint, the
+// name and then the payload. Records of any other type are reserved for future
+// use: readers must skip them and preserve them when re-encoding.
+type Bundle struct {
+	records []bundleRecord
+}
+
+type bundleRecord struct {
+	typ  byte
+	name string
+	// data is the payload of a named record or, for records of an unknown
+	// type, the whole value.
+	data []byte
+}
+
+const (
+	bundleVersion   = 1
+	bundleNamedType = 1
+)
+
+// NewBundle returns an empty Bundle.
+func NewBundle() *Bundle {
+	return new(Bundle)
+}
+
+// Add appends a named payload to b and returns b. Errors, such as a duplicate
+// name, are reported by Marshal.
+func (b *Bundle) Add(name string, data []byte) *Bundle {
+	b.records = append(b.records, bundleRecord{
+		typ:  bundleNamedType,
+		name: name,
+		data: append([]byte(nil), data...),
+	})
+	return b
+}
+
+// Names returns the names of the payloads in b in the order that they were
+// added.
+func (b *Bundle) Names() []string {
+	var names []string
+	for _, r := range b.records {
+		if r.typ == bundleNamedType {
+			names = append(names, r.name)
+		}
+	}
+	return names
+}
+
+// Get returns the payload with the given name.
+func (b *Bundle) Get(name string) ([]byte, bool) {
+	for _, r := range b.records {
+		if r.typ == bundleNamedType && r.name == name {
+			return r.data, true
+		}
+	}
+	return nil, false
+}
+
+// Marshal returns the encoding of b, suitable for passing to New as the
+// message. It fails if the encoding is longer than maxLen, which should be
+// the value returned by MaxMessageLenFor with the options of the exchange.
+func (b *Bundle) Marshal(maxLen int) ([]byte, error) {
+	seen := make(map[string]bool)
+	out := []byte{bundleVersion}
+	var lenBuf [binary.MaxVarintLen64]byte
+
+	for _, r := range b.records {
+		value := r.data
+		if r.typ == bundleNamedType {
+			if len(r.name) == 0 {
+				return nil, errors.New("panda: bundle payload has an empty name")
+			}
+			if seen[r.name] {
+				return nil, errors.New("panda: duplicate bundle payload name: " + r.name)
+			}
+			seen[r.name] = true
+			n := binary.PutUvarint(lenBuf[:], uint64(len(r.name)))
+			value = append(append(lenBuf[:n:n], r.name...), r.data...)
+		}
+		out = append(out, r.typ)
+		n := binary.PutUvarint(lenBuf[:], uint64(len(value)))
+		out = append(out, lenBuf[:n]...)
+		out = append(out, value...)
+	}
+
+	if len(out) > maxLen {
+		return nil, errors.New("panda: bundle too large")
+	}
+	return out, nil
+}
+
+// ParseBundle decodes a message produced by Bundle.Marshal.
+func ParseBundle(msg []byte) (*Bundle, error) {
+	if len(msg) == 0 || msg[0] != bundleVersion {
+		return nil, errors.New("panda: unknown bundle version")
+	}
+	msg = msg[1:]
+
+	b := new(Bundle)
+	seen := make(map[string]bool)
+	for len(msg) > 0 {
+		typ := msg[0]
+		length, n := binary.Uvarint(msg[1:])
+		if n <= 0 || length > uint64(len(msg)-1-n) {
+			return nil, errors.New("panda: truncated bundle record")
+		}
+		value := msg[1+n : 1+n+int(length)]
+		msg = msg[1+n+int(length):]
+
+		r := bundleRecord{typ: typ, data: value}
+		if typ == bundleNamedType {
+			nameLen, n := binary.Uvarint(value)
+			if n <= 0 || nameLen == 0 || nameLen > uint64(len(value)-n) {
+				return nil, errors.New("panda: malformed bundle payload name")
+			}
+			r.name = string(value[n : n+int(nameLen)])
+			r.data = value[n+int(nameLen):]
+			if seen[r.name] {
+				return nil, errors.New("panda: duplicate bundle payload name: " + r.name)
+			}
+			seen[r.name] = true
+		}
+		r.data = append([]byte(nil), r.data...)
+		b.records = append(b.records, r)
+	}
+
+	return b, nil
+}
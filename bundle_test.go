@@ -0,0 +1,101 @@
+package panda
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	msg, err := NewBundle().
+		Add("identity", []byte{1, 2, 3}).
+		Add("prekeys", bytes.Repeat([]byte{4}, 300)).
+		Add("name", []byte("Alice")).
+		Marshal(MaxMessageLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ParseBundle(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := b.Names(); !reflect.DeepEqual(names, []string{"identity", "prekeys", "name"}) {
+		t.Errorf("got names %q", names)
+	}
+	if data, ok := b.Get("name"); !ok || string(data) != "Alice" {
+		t.Errorf("got %q, %t for name", data, ok)
+	}
+	if _, ok := b.Get("missing"); ok {
+		t.Errorf("found a payload that was never added")
+	}
+
+	remarshaled, err := b.Marshal(MaxMessageLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, remarshaled) {
+		t.Errorf("encoding changed after round trip")
+	}
+}
+
+func TestBundleRejects(t *testing.T) {
+	if _, err := NewBundle().Add("a", nil).Add("a", nil).Marshal(MaxMessageLen); err == nil {
+		t.Errorf("duplicate names were accepted by Marshal")
+	}
+	if _, err := NewBundle().Add("a", make([]byte, MaxMessageLen)).Marshal(MaxMessageLen); err == nil {
+		t.Errorf("oversized bundle was accepted")
+	}
+	limit, err := MaxMessageLenFor(WithBodySize(BodySize4K))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBundle().Add("a", make([]byte, limit)).Marshal(limit); err == nil {
+		t.Errorf("bundle larger than the configured limit was accepted")
+	}
+	if _, err := NewBundle().Add("a", make([]byte, limit)).Marshal(MaxMessageLen); err != nil {
+		t.Errorf("bundle within the default limit was rejected: %v", err)
+	}
+
+	duplicate := []byte{bundleVersion, 1, 2, 1, 'a', 1, 2, 1, 'a'}
+	if _, err := ParseBundle(duplicate); err == nil {
+		t.Errorf("duplicate names were accepted by ParseBundle")
+	}
+	truncated := []byte{bundleVersion, 1, 5, 1, 'a'}
+	if _, err := ParseBundle(truncated); err == nil {
+		t.Errorf("truncated bundle was accepted")
+	}
+	if _, err := ParseBundle([]byte{2}); err == nil {
+		t.Errorf("unknown version was accepted")
+	}
+}
+
+func TestBundleUnknownRecords(t *testing.T) {
+	// This fixture is what a newer writer might produce: a named payload,
+	// a record of an unknown type and another named payload.
+	fixture := []byte{
+		bundleVersion,
+		1, 4, 1, 'a', 'x', 'y',
+		7, 3, 0xde, 0xad, 0x00,
+		1, 3, 1, 'b', 'z',
+	}
+
+	b, err := ParseBundle(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := b.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("got names %q", names)
+	}
+	if data, _ := b.Get("a"); string(data) != "xy" {
+		t.Errorf("got %q for a", data)
+	}
+
+	remarshaled, err := b.Marshal(MaxMessageLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(remarshaled, fixture) {
+		t.Errorf("unknown record was not preserved: got %x, want %x", remarshaled, fixture)
+	}
+}
@@ -0,0 +1,104 @@
+package panda
+
+import (
+	"errors"
+	"time"
+
+	"code.google.com/p/go.crypto/scrypt"
+)
+
+// A ScryptCost is a set of scrypt parameters, as chosen by CalibrateKDF.
+type ScryptCost struct {
+	N, R, P int
+}
+
+// Option returns an Option that sets these parameters. Both parties must use
+// the same parameters, so a calibrated cost has to be shared with the peer,
+// for example in a pairing URI by setting the ScryptN, ScryptR and ScryptP
+// fields of a PairingConfig.
+func (c ScryptCost) Option() Option {
+	return WithScryptCost(c.N, c.R, c.P)
+}
+
+// MemoryBytes returns the approximate amount of memory that scrypt uses with
+// these parameters.
+func (c ScryptCost) MemoryBytes() int64 {
+	return 128 * int64(c.R) * int64(c.N)
+}
+
+const (
+	// MinScryptN and calibratedScryptR give the security floor for
+	// CalibrateKDF: 16MiB of memory and a single pass. CalibrateKDF never
+	// returns a cost below it.
+	MinScryptN        = 1 << 14
+	calibratedScryptR = 8
+	// probeScryptN is the cost of each probe invocation, which takes about
+	// 4MiB of memory.
+	probeScryptN = 1 << 12
+	probes       = 3
+)
+
+// probeScrypt runs scrypt with the given parameters and returns how long it
+// took. It is a variable so that tests can replace the clock.
+var probeScrypt = func(N, r int) time.Duration {
+	start := time.Now()
+	scrypt.Key([]byte("PANDA calibration"), nil, N, r, 1, 32)
+	return time.Since(start)
+}
+
+// probe returns the fastest of a few small scrypt invocations, since slower
+// ones were likely interrupted.
+func probe() time.Duration {
+	var fastest time.Duration
+	for i := 0; i < probes; i++ {
+		if d := probeScrypt(probeScryptN, calibratedScryptR); i == 0 || d < fastest {
+			fastest = d
+		}
+	}
+	return fastest
+}
+
+// estimate scales the time taken by a probe to the given cost, since scrypt's
+// running time is proportional to N*r*p.
+func (c ScryptCost) estimate(probeTime time.Duration) time.Duration {
+	return probeTime * time.Duration(c.N) * time.Duration(c.R) * time.Duration(c.P) / (probeScryptN * calibratedScryptR)
+}
+
+// CalibrateKDF benchmarks this machine and returns the most expensive scrypt
+// cost that takes no longer than target and uses no more than maxMemoryBytes.
+// Memory is the more valuable cost, so N is raised first and then p, which
+// adds time but not memory. The result is never below MinScryptN with r=8,
+// even if that exceeds target; an error is returned only if the memory limit
+// is below that floor.
+func CalibrateKDF(target time.Duration, maxMemoryBytes int64) (ScryptCost, error) {
+	cost := ScryptCost{N: MinScryptN, R: calibratedScryptR, P: 1}
+	if cost.MemoryBytes() > maxMemoryBytes {
+		return ScryptCost{}, errors.New("panda: memory limit is below the minimum scrypt cost")
+	}
+
+	probeTime := probe()
+	for cost.N < 1<<22 {
+		next := cost
+		next.N <<= 1
+		if next.MemoryBytes() > maxMemoryBytes || next.estimate(probeTime) > target {
+			break
+		}
+		cost = next
+	}
+	for cost.P < 16 {
+		next := cost
+		next.P++
+		if next.estimate(probeTime) > target {
+			break
+		}
+		cost = next
+	}
+	return cost, nil
+}
+
+// EstimateKDFDuration returns an estimate of how long scrypt with the given
+// cost will take on this machine, for example so that a UI can show progress.
+// It runs a few quick probes each time that it's called.
+func EstimateKDFDuration(cost ScryptCost) time.Duration {
+	return cost.estimate(probe())
+}
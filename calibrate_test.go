@@ -0,0 +1,74 @@
+package panda
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeProbe replaces the scrypt probe with one that takes perUnit for each
+// unit of N*r.
+func fakeProbe(perUnit time.Duration) func() {
+	orig := probeScrypt
+	probeScrypt = func(N, r int) time.Duration {
+		return perUnit * time.Duration(N*r)
+	}
+	return func() { probeScrypt = orig }
+}
+
+func TestCalibrateKDF(t *testing.T) {
+	// With 1µs per unit, N=2^16 and r=8 takes about 0.52s.
+	defer fakeProbe(time.Microsecond)()
+
+	tests := []struct {
+		target    time.Duration
+		maxMemory int64
+		want      ScryptCost
+	}{
+		{1100 * time.Millisecond, 1 << 30, ScryptCost{1 << 17, 8, 1}},
+		{600 * time.Millisecond, 1 << 30, ScryptCost{1 << 16, 8, 1}},
+		// Limited to 32MiB, the spare time goes into p.
+		{time.Second, 32 << 20, ScryptCost{1 << 15, 8, 3}},
+		// Too little time still gets the floor.
+		{time.Millisecond, 1 << 30, ScryptCost{MinScryptN, 8, 1}},
+		{time.Hour, 1 << 40, ScryptCost{1 << 22, 8, 16}},
+	}
+	for _, test := range tests {
+		got, err := CalibrateKDF(test.target, test.maxMemory)
+		if err != nil {
+			t.Errorf("%v, %d: %v", test.target, test.maxMemory, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%v, %d: got %+v, want %+v", test.target, test.maxMemory, got, test.want)
+		}
+		if got.MemoryBytes() > test.maxMemory {
+			t.Errorf("%v, %d: %+v exceeds the memory limit", test.target, test.maxMemory, got)
+		}
+		if err := newConfig([]Option{got.Option()}).validate(); err != nil {
+			t.Errorf("%+v isn't a valid cost", got)
+		}
+	}
+
+	if _, err := CalibrateKDF(time.Second, 8<<20); err == nil {
+		t.Errorf("memory limit below the floor was accepted")
+	}
+
+	if d := EstimateKDFDuration(ScryptCost{1 << 16, 16, 4}); d != time.Microsecond*(1<<16)*16*4 {
+		t.Errorf("EstimateKDFDuration returned %v", d)
+	}
+}
+
+func TestCalibrateKDFProbes(t *testing.T) {
+	// The fastest probe is used, as slower ones were likely interrupted.
+	orig := probeScrypt
+	defer func() { probeScrypt = orig }()
+	durations := []time.Duration{time.Second, 3 * time.Millisecond, time.Second}
+	probeScrypt = func(N, r int) time.Duration {
+		d := durations[0]
+		durations = durations[1:]
+		return d
+	}
+	if d := EstimateKDFDuration(ScryptCost{probeScryptN, calibratedScryptR, 2}); d != 6*time.Millisecond {
+		t.Errorf("got %v, want 6ms", d)
+	}
+}
@@ -0,0 +1,101 @@
+package panda
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A CardStack is an ordered sequence of distinct playing cards, such as the
+// top of a deck that both parties shuffled together. Unlike the cards in a
+// SharedSecret, the order is part of the secret.
+type CardStack []Card
+
+// A CardStackError reports a problem with one card of a stack.
+type CardStackError struct {
+	// Position counts cards from one.
+	Position int
+	Token    string
+	Reason   string
+}
+
+func (e *CardStackError) Error() string {
+	return "panda: card " + strconv.Itoa(e.Position) + " (" + strconv.Quote(e.Token) + ") " + e.Reason
+}
+
+// isCardSeparator returns true for the runes that may separate cards.
+func isCardSeparator(r rune) bool {
+	return r == ',' || r == ';' || r == '-' || r == '/' || unicode.IsSpace(r)
+}
+
+// ParseCardStack parses a list of cards, each as accepted by ParseCard,
+// separated by spaces, commas, semicolons, hyphens or slashes. Duplicate and
+// malformed cards are reported with a *CardStackError.
+func ParseCardStack(s string) (CardStack, error) {
+	tokens := strings.FieldsFunc(s, isCardSeparator)
+	if len(tokens) == 0 {
+		return nil, errors.New("panda: card stack is empty")
+	}
+	stack := make(CardStack, 0, len(tokens))
+	seen := make(map[Card]int)
+	for i, token := range tokens {
+		c, err := ParseCard(token)
+		if err != nil {
+			return nil, &CardStackError{i + 1, token, "is malformed"}
+		}
+		if first, ok := seen[c]; ok {
+			return nil, &CardStackError{i + 1, token, "repeats card " + strconv.Itoa(first)}
+		}
+		seen[c] = i + 1
+		stack = append(stack, c)
+	}
+	return stack, nil
+}
+
+// String returns the canonical form of the stack, for example "2C TD JS AH",
+// which ParseCardStack accepts. Two users can compare it to check that they
+// entered the same stack.
+func (s CardStack) String() string {
+	cards := make([]string, len(s))
+	for i, c := range s {
+		cards[i] = c.String()
+	}
+	return strings.Join(cards, " ")
+}
+
+// cardStackContext begins every encoded CardStack.
+const cardStackContext = "PANDA card stack v1\x00"
+
+// Encode returns the canonical encoding of the stack, for use as the secret
+// passed to New.
+func (s CardStack) Encode() ([]byte, error) {
+	if len(s) == 0 {
+		return nil, errors.New("panda: card stack is empty")
+	}
+	seen := make(map[Card]bool)
+	out := []byte(cardStackContext)
+	for i, c := range s {
+		if !c.valid() {
+			return nil, &CardStackError{i + 1, c.String(), "is invalid"}
+		}
+		if seen[c] {
+			return nil, &CardStackError{i + 1, c.String(), "is repeated"}
+		}
+		seen[c] = true
+		out = append(out, byte(c.Suit), byte(c.Rank))
+	}
+	return out, nil
+}
+
+// Entropy returns the entropy, in bits, of a stack of this many cards drawn
+// from a well-shuffled deck. Each card adds a little under six bits: 12 cards
+// give over 64 bits and 25 cards over 128.
+func (s CardStack) Entropy() float64 {
+	bits := 0.0
+	for i := 0; i < len(s) && i < 52; i++ {
+		bits += math.Log2(float64(52 - i))
+	}
+	return bits
+}
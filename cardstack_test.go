@@ -0,0 +1,80 @@
+package panda
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseCardStack(t *testing.T) {
+	stack, err := ParseCardStack("2C 10d,jS ;ah")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stack.String(); s != "2C TD JS AH" {
+		t.Errorf("got %q", s)
+	}
+	again, err := ParseCardStack(stack.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != stack.String() {
+		t.Errorf("canonical form didn't round-trip: %q", again)
+	}
+
+	enc1, err := stack.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc2, _ := again.Encode()
+	if !bytes.Equal(enc1, enc2) {
+		t.Errorf("equal stacks encoded differently")
+	}
+	reordered, _ := ParseCardStack("TD 2C JS AH")
+	if enc3, _ := reordered.Encode(); bytes.Equal(enc1, enc3) {
+		t.Errorf("order of the stack didn't affect the encoding")
+	}
+
+	tests := []struct {
+		in       string
+		position int
+	}{
+		{"2C 1D JS", 2},
+		{"2C 10X", 2},
+		{"QQ", 1},
+		{"AS 2S 3S as", 4},
+	}
+	for _, test := range tests {
+		_, err := ParseCardStack(test.in)
+		var stackErr *CardStackError
+		if !errors.As(err, &stackErr) {
+			t.Errorf("%q: got %v, want a CardStackError", test.in, err)
+			continue
+		}
+		if stackErr.Position != test.position {
+			t.Errorf("%q: error at card %d, want %d: %v", test.in, stackErr.Position, test.position, err)
+		}
+	}
+	if _, err := ParseCardStack(" ,, "); err == nil {
+		t.Errorf("empty stack was accepted")
+	}
+}
+
+func TestCardStackEntropy(t *testing.T) {
+	for _, test := range []struct {
+		cards    int
+		min, max float64
+	}{
+		{0, 0, 0},
+		{1, 5.70, 5.71},
+		{11, 61, 62},
+		{12, 66, 67},
+		{25, 132, 133},
+		{52, 225, 226},
+	} {
+		stack := make(CardStack, test.cards)
+		if bits := stack.Entropy(); bits < test.min || bits > test.max {
+			t.Errorf("%d cards: got %f bits", test.cards, bits)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package panda
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// DefaultChecksumDigits is the length of the checksum from SecretChecksum.
+const DefaultChecksumDigits = 4
+
+// maxChecksumDigits is the longest checksum, since each digit reveals more
+// of the secret.
+const maxChecksumDigits = 8
+
+// ErrSecretChecksum is returned by New when the secret doesn't match the
+// checksum given with WithSecretChecksum.
+var ErrSecretChecksum = errors.New("panda: secret doesn't match its checksum")
+
+// SecretChecksum returns a short decimal checksum of secret that the two
+// parties can read to each other, before starting an exchange, to check that
+// they typed the same secret. It is SecretChecksumDigits with
+// DefaultChecksumDigits.
+func SecretChecksum(secret []byte) string {
+	return SecretChecksumDigits(secret, DefaultChecksumDigits)
+}
+
+// SecretChecksumDigits returns a checksum of secret with the given number of
+// digits, at most eight, or an empty string if digits isn't positive. The
+// checksum is a cheap hash and so reveals about 3.3 bits of the secret per
+// digit to anyone who hears it: four digits take about 13 bits from the
+// secret's strength. If the exchange uses WithSecretNormalization, the
+// checksum should be of the normalized secret.
+func SecretChecksumDigits(secret []byte, digits int) string {
+	if digits <= 0 {
+		return ""
+	}
+	if digits > maxChecksumDigits {
+		digits = maxChecksumDigits
+	}
+	h := sha256.New()
+	h.Write([]byte("PANDA secret checksum v1\x00"))
+	h.Write(secret)
+	modulus := uint64(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	// The bias from reducing a 64-bit value is negligible.
+	checksum := strconv.FormatUint(binary.BigEndian.Uint64(h.Sum(nil))%modulus, 10)
+	return strings.Repeat("0", digits-len(checksum)) + checksum
+}
+
+// WithSecretChecksum makes New check the secret against a checksum from
+// SecretChecksumDigits, of any length, before the expensive KDF and return
+// ErrSecretChecksum if they don't match. If the option WithSecretNormalization
+// is also given, the normalized secret is checked.
+func WithSecretChecksum(expected string) Option {
+	return func(c *config) {
+		c.checksum = expected
+	}
+}
@@ -0,0 +1,50 @@
+package panda
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestSecretChecksum(t *testing.T) {
+	// These values are pinned since peers may run different versions.
+	for _, test := range []struct {
+		secret string
+		digits int
+		want   string
+	}{
+		{"foo", 4, "4936"},
+		{"foo", 8, "98734936"},
+		{"correct-horse", 4, "3110"},
+		{"", 6, "434425"},
+		{"foo", 0, ""},
+		{"foo", -1, ""},
+	} {
+		if got := SecretChecksumDigits([]byte(test.secret), test.digits); got != test.want {
+			t.Errorf("%q, %d: got %q, want %q", test.secret, test.digits, got, test.want)
+		}
+	}
+	for digits := 1; digits <= 10; digits++ {
+		want := digits
+		if want > 8 {
+			want = 8
+		}
+		if got := SecretChecksumDigits([]byte("foo"), digits); len(got) != want {
+			t.Errorf("%d digits: got %q", digits, got)
+		}
+	}
+}
+
+func TestSecretChecksumOption(t *testing.T) {
+	checksum := SecretChecksum([]byte("foo"))
+	if _, err := New(rand.Reader, []byte("foo"), nil, WithSecretChecksum(checksum), fastKDF); err != nil {
+		t.Errorf("matching checksum: %v", err)
+	}
+	if _, err := New(rand.Reader, []byte("fob"), nil, WithSecretChecksum(SecretChecksumDigits([]byte("foo"), 8)), fastKDF); err != ErrSecretChecksum {
+		t.Errorf("mismatched checksum: got %v", err)
+	}
+
+	normalized, _ := NormalizeSecret([]byte(" FOO "))
+	if _, err := New(rand.Reader, []byte(" FOO "), nil, WithSecretNormalization(), WithSecretChecksum(SecretChecksum(normalized)), fastKDF); err != nil {
+		t.Errorf("checksum of normalized secret: %v", err)
+	}
+}
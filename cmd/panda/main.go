@@ -0,0 +1,55 @@
+// Command panda provides tools for working with PANDA meeting places.
+//
+// Usage:
+//
+//	panda checkserver URL
+//
+// checkserver runs the checks of package conformance against the meeting
+// place at URL, prints a report and exits with a non-zero status if any check
+// failed.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/agl/panda/conformance"
+)
+
+const usage = "usage: panda checkserver URL"
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "checkserver":
+		os.Exit(checkServer(os.Args[2:]))
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// checkServer runs the checkserver subcommand and returns the exit status.
+func checkServer(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	report, err := conformance.RunConformance(ctx, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "panda: %s\n", err)
+		return 1
+	}
+	fmt.Print(report)
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
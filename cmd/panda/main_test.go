@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/agl/panda/rendezvous"
+)
+
+func TestCheckServer(t *testing.T) {
+	server := httptest.NewServer(rendezvous.NewHandler(rendezvous.NewMemoryStorage()))
+	defer server.Close()
+
+	if status := checkServer([]string{server.URL}); status != 0 {
+		t.Errorf("got status %d against the reference meeting place", status)
+	}
+	if status := checkServer(nil); status != 2 {
+		t.Errorf("got status %d without a URL", status)
+	}
+}
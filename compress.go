@@ -0,0 +1,104 @@
+package panda
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// ErrCompressionUnsupported is returned by Process when our message only
+// fits once compressed and the peer didn't offer compression.
+var ErrCompressionUnsupported = errors.New("panda: message needs compression, which the peer didn't offer")
+
+var (
+	errUnknownEncoding      = errors.New("panda: peer's message has an unknown encoding")
+	errCorruptCompression   = errors.New("panda: peer's compressed message is corrupt")
+	errDecompressedTooLarge = errors.New("panda: peer's compressed message expands beyond MaxMessageLen")
+)
+
+// The flag bytes that begin a message sent with compression.
+const (
+	// encodingStored is followed by the message itself.
+	encodingStored = 0
+	// encodingDeflate is followed by the message compressed with DEFLATE.
+	encodingDeflate = 1
+)
+
+// WithCompression offers to compress messages with DEFLATE. If the peer
+// offers it too, each message is sent with a flag byte that says whether it
+// is compressed, which it is only if that makes it smaller, and the receiver
+// refuses any that expand beyond MaxMessageLen. New then accepts messages
+// longer than MaxMessageLenFor, up to MaxMessageLen, that compress to fit,
+// but Process returns ErrCompressionUnsupported once the peer's first round
+// body arrives if the peer didn't offer compression and the message doesn't
+// fit without it. It requires protocol version 2 or later, since the offer
+// is carried in the first round header.
+func WithCompression() Option {
+	return func(c *config) {
+		c.compression = true
+	}
+}
+
+// encodeMessage returns message as it is sent when compression is in use.
+func encodeMessage(message []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(encodingDeflate)
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(message)
+	w.Close()
+	if buf.Len() < 1+len(message) {
+		return buf.Bytes()
+	}
+	return append([]byte{encodingStored}, message...)
+}
+
+// decodeMessage returns the message encoded by encodeMessage. At most one
+// byte beyond MaxMessageLen is ever decompressed.
+func decodeMessage(encoded []byte) ([]byte, error) {
+	if len(encoded) == 0 {
+		return nil, errUnknownEncoding
+	}
+	switch encoded[0] {
+	case encodingStored:
+		return encoded[1:], nil
+	case encodingDeflate:
+	default:
+		return nil, errUnknownEncoding
+	}
+	r := flate.NewReader(bytes.NewReader(encoded[1:]))
+	message, err := io.ReadAll(io.LimitReader(r, MaxMessageLen+1))
+	if err != nil {
+		return nil, errCorruptCompression
+	}
+	if len(message) > MaxMessageLen {
+		return nil, errDecompressedTooLarge
+	}
+	return message, nil
+}
+
+// fitsCompressed returns whether message is short enough to be sent once
+// compressed, if compression is offered.
+func (c *config) fitsCompressed(message []byte) bool {
+	return c.compression && len(message) <= MaxMessageLen && len(encodeMessage(message)) <= c.maxMessageLen()+1
+}
+
+// sentMessage returns our message as it is sent.
+func (ex *Exchange) sentMessage() []byte {
+	if ex.compressed {
+		return ex.encoded
+	}
+	return ex.message
+}
+
+// peerMessageFrom returns the peer's message given the payload that carried
+// it, which is decoded if compression is in use.
+func (ex *Exchange) peerMessageFrom(payload []byte) ([]byte, error) {
+	if !ex.compressed || ex.peerKeyOnly {
+		return payload, nil
+	}
+	return decodeMessage(payload)
+}
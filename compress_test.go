@@ -0,0 +1,147 @@
+package panda
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+// jsonMessage returns a compressible message of about n bytes.
+func jsonMessage(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"contact %d","verified":true},`, i, i)
+	}
+	return buf.Bytes()
+}
+
+func deflated(flag byte, message []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(flag)
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(message)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCompression(t *testing.T) {
+	opts := []Option{WithCompression(), WithProtocolVersion(ProtocolVersion4), WithBodySize(BodySize4K)}
+	limit, err := MaxMessageLenFor(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, limit)
+	rand.Read(random)
+	for _, message := range [][]byte{jsonMessage(5 * limit), random, nil, {}} {
+		a, err := New(rand.Reader, []byte("foo"), message, append(opts, fastKDF)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), append(opts, fastKDF)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aResult, bResult := runExchange(t, marshalUnmarshal(a), b)
+		if string(aResult) != "b" || !bytes.Equal(bResult, message) {
+			t.Errorf("%d byte message wasn't exchanged intact", len(message))
+		}
+		if !b.compressed {
+			t.Errorf("%d byte message: compression wasn't agreed", len(message))
+		}
+	}
+
+	if _, err := New(rand.Reader, []byte("foo"), append(random, 0), append(opts, fastKDF)...); err == nil {
+		t.Errorf("incompressible message over the limit was accepted")
+	}
+	if _, err := New(rand.Reader, []byte("foo"), jsonMessage(MaxMessageLen+1), append(opts, fastKDF)...); err == nil {
+		t.Errorf("message over MaxMessageLen was accepted")
+	}
+	if _, err := MaxMessageLenFor(WithCompression()); err == nil {
+		t.Errorf("compression was accepted with protocol version 1")
+	}
+}
+
+func TestCompressionUnsupported(t *testing.T) {
+	opts := []Option{WithProtocolVersion(ProtocolVersion4), WithBodySize(BodySize4K), fastKDF}
+	for _, n := range []int{100, 5 * BodySize4K} {
+		message := jsonMessage(n)
+		a, err := New(rand.Reader, []byte("foo"), message, append(opts, WithCompression())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		_, err = a.Process(bBody)
+		if n > BodySize4K {
+			if err != ErrCompressionUnsupported {
+				t.Errorf("got %v for an oversized message, want ErrCompressionUnsupported", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+		if a.compressed || b.compressed {
+			t.Errorf("compression was used without both parties offering it")
+		}
+		_, aBody = a.NextRequest()
+		if result, err := b.Process(aBody); err != nil || !bytes.Equal(result, message) {
+			t.Errorf("got %d bytes, %v", len(result), err)
+		}
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	atLimit := make([]byte, MaxMessageLen)
+	if message, err := decodeMessage(deflated(encodingDeflate, atLimit)); err != nil || len(message) != MaxMessageLen {
+		t.Errorf("message of MaxMessageLen gave %d bytes, %v", len(message), err)
+	}
+	// A few hundred bytes that expand to far more than MaxMessageLen.
+	bomb := deflated(encodingDeflate, make([]byte, 64*MaxMessageLen))
+	if len(bomb) > 100000 {
+		t.Fatalf("bomb is %d bytes", len(bomb))
+	}
+	if _, err := decodeMessage(bomb); err != errDecompressedTooLarge {
+		t.Errorf("got %v for a bomb, want errDecompressedTooLarge", err)
+	}
+	if _, err := decodeMessage(deflated(encodingDeflate, make([]byte, MaxMessageLen+1))); err != errDecompressedTooLarge {
+		t.Errorf("got %v for one byte over the limit, want errDecompressedTooLarge", err)
+	}
+
+	valid := deflated(encodingDeflate, jsonMessage(1000))
+	for _, test := range []struct {
+		name    string
+		encoded []byte
+		err     error
+	}{
+		{"empty", nil, errUnknownEncoding},
+		{"unknown flag", deflated(2, []byte("a")), errUnknownEncoding},
+		{"truncated", valid[:len(valid)/2], errCorruptCompression},
+		{"garbage", []byte{encodingDeflate, 0xff, 0xff, 0xff}, errCorruptCompression},
+	} {
+		if _, err := decodeMessage(test.encoded); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	random := make([]byte, 1000)
+	rand.Read(random)
+	if encoded := encodeMessage(random); encoded[0] != encodingStored || len(encoded) != len(random)+1 {
+		t.Errorf("incompressible message was encoded with flag %d in %d bytes", encoded[0], len(encoded))
+	}
+	for _, message := range [][]byte{random, jsonMessage(1000), {}} {
+		if decoded, err := decodeMessage(encodeMessage(message)); err != nil || !bytes.Equal(decoded, message) {
+			t.Errorf("%d byte message didn't survive encoding: %v", len(message), err)
+		}
+	}
+}
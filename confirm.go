@@ -0,0 +1,143 @@
+package panda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// ErrKeyConfirmationFailed is returned by Process when the peer's second
+// round body carries a key confirmation value that doesn't match, which means
+// that the two parties didn't agree on the same shared key.
+var ErrKeyConfirmationFailed = errors.New("panda: key confirmation failed")
+
+// keyConfirmationMarker follows the public value in the first round bodies of
+// exchanges that offer key confirmation.
+const keyConfirmationMarker = "\x00PANDA key confirmation"
+
+// confirmationLen is the length of a key confirmation value.
+const confirmationLen = sha256.Size
+
+// WithKeyConfirmation offers explicit key confirmation to the peer. If the
+// peer offers it too, each second round body carries a MAC, under a key
+// derived from the shared key, that the receiver checks before opening it,
+// and Process returns ErrKeyConfirmationFailed if it doesn't match. Otherwise
+// the exchange proceeds as usual. Bodies stay the same size, but the largest
+// message is smaller by the size of the MAC. Versions of this package that
+// predate the option can't complete exchanges with one that uses it.
+func WithKeyConfirmation() Option {
+	return func(c *config) {
+		c.keyConfirmation = true
+	}
+}
+
+// confirmation returns the key confirmation value sent by the party whose
+// public value is given.
+func (ex *Exchange) confirmation(public []byte) []byte {
+	var key []byte
+	if ex.version >= ProtocolVersion2 {
+		key = ex.scheduleKey(&ex.sharedKey, labelConfirmation, 32)
+	} else {
+		key = deriveKey(&ex.sharedKey, ex.context("key confirmation"))
+	}
+	defer wipe(key)
+	h := hmac.New(sha256.New, key)
+	h.Write(lengthPrefix(public))
+	return h.Sum(nil)
+}
+
+// roundTwoSendKey returns the key that seals our second round body, which,
+// in hybrid exchanges, depends on the secret that we encapsulated.
+func (ex *Exchange) roundTwoSendKey() *[32]byte {
+	key := ex.roundTwoKey()
+	if len(ex.kemCiphertext) > 0 {
+		key = ex.hybridKey(key, ex.kemSecret[:])
+	}
+	return key
+}
+
+// roundTwoBody returns our second round body. With key confirmation, our
+// confirmation value is inserted after the nonce, followed, in hybrid
+// exchanges, by our ML-KEM ciphertext. If we are key-only, the box is
+// empty.
+func (ex *Exchange) roundTwoBody() ([]byte, error) {
+	key := ex.roundTwoSendKey()
+	var inserted []byte
+	if ex.insertsConfirmation() {
+		inserted = ex.confirmation(ex.public)
+	}
+	inserted = append(inserted, ex.kemCiphertext...)
+	var payload []byte
+	if !ex.keyOnly {
+		payload = ex.roundTwoPayload()
+	}
+	if len(inserted) == 0 {
+		return ex.box(2, key, payload)
+	}
+	size := ex.bodySizeFor(len(payload) + len(inserted))
+	box, err := padAndBoxTo(ex.suite, ex.version, key, 2, payload, size-len(inserted))
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, 0, size)
+	body = append(body, box[:24]...)
+	body = append(body, inserted...)
+	return append(body, box[24:]...), nil
+}
+
+// openRoundTwo checks the peer's confirmation value, if expected, and opens
+// its second round body, using the secret that it encapsulated to us in
+// hybrid exchanges.
+func (ex *Exchange) openRoundTwo(reply []byte) ([]byte, error) {
+	body, _, err := ex.openRoundTwoKey(reply)
+	return body, err
+}
+
+// openRoundTwoKey is like openRoundTwo but also returns the key that opened
+// the body. If the peer is key-only, the body must be empty and nil is
+// returned in its place.
+func (ex *Exchange) openRoundTwoKey(reply []byte) ([]byte, *[32]byte, error) {
+	body, key, err := ex.openRoundTwoBox(reply)
+	if err != nil || !ex.peerKeyOnly {
+		return body, key, err
+	}
+	if len(body) != 0 {
+		return nil, nil, errors.New("panda: key-only peer sent a message")
+	}
+	return nil, key, nil
+}
+
+// openRoundTwoBox opens the peer's second round body as described by
+// openRoundTwoKey, without regard to whether the peer is key-only.
+func (ex *Exchange) openRoundTwoBox(reply []byte) ([]byte, *[32]byte, error) {
+	key := ex.roundTwoKey()
+	n := len(ex.peerConfirmation) + len(ex.kemCiphertext)
+	if n == 0 {
+		body, err := unbox(ex.suite, ex.version, key, reply)
+		return body, key, err
+	}
+	if len(reply) < 24+n {
+		return nil, nil, errors.New("panda: reply from server is too short to be valid")
+	}
+	inserted := reply[24 : 24+n]
+	if len(ex.peerConfirmation) > 0 {
+		if !hmac.Equal(inserted[:confirmationLen], ex.peerConfirmation) {
+			return nil, nil, ErrKeyConfirmationFailed
+		}
+		inserted = inserted[confirmationLen:]
+	}
+	if len(ex.kemCiphertext) > 0 {
+		// The peer's ciphertext is the same length as ours.
+		secret, err := ex.decapsulate(inserted)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = ex.hybridKey(key, secret)
+		wipe(secret)
+	}
+	box := make([]byte, 0, len(reply)-n)
+	box = append(box, reply[:24]...)
+	box = append(box, reply[24+n:]...)
+	body, err := unbox(ex.suite, ex.version, key, box)
+	return body, key, err
+}
@@ -0,0 +1,111 @@
+package panda
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestKeyConfirmation(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteP256} {
+		opts := []Option{WithKeyConfirmation(), WithSuite(suite), fastKDF}
+		a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+		a, b = marshalUnmarshal(a), marshalUnmarshal(b)
+		if len(a.peerConfirmation) != confirmationLen || len(b.peerConfirmation) != confirmationLen {
+			t.Fatalf("suite %d: key confirmation wasn't negotiated", suite)
+		}
+		_, aBody = a.NextRequest()
+		_, bBody = b.NextRequest()
+		if len(aBody) != bodySize {
+			t.Errorf("suite %d: body is %d bytes, want %d", suite, len(aBody), bodySize)
+		}
+		if result, err := a.Process(bBody); err != nil || string(result) != "b" {
+			t.Errorf("suite %d: got %q, %v", suite, result, err)
+		}
+		if result, err := b.Process(aBody); err != nil || string(result) != "a" {
+			t.Errorf("suite %d: got %q, %v", suite, result, err)
+		}
+	}
+
+	if n, err := MaxMessageLenFor(WithKeyConfirmation(), WithProtocolVersion(ProtocolVersion4)); err != nil || n != MaxMessageLen-confirmationLen {
+		t.Errorf("MaxMessageLenFor gave %d, %v", n, err)
+	}
+	if _, err := New(rand.Reader, []byte("foo"), make([]byte, MaxMessageLen), WithKeyConfirmation(), WithProtocolVersion(ProtocolVersion4), fastKDF); err == nil {
+		t.Errorf("New accepted a message with no room for confirmation")
+	}
+}
+
+func TestKeyConfirmationFailure(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithKeyConfirmation(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithKeyConfirmation(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate b arriving at a different shared key.
+	b.sharedKey[0] ^= 1
+	_, bBody = b.NextRequest()
+	if _, err := a.Process(bBody); err != ErrKeyConfirmationFailed {
+		t.Errorf("got %v, want ErrKeyConfirmationFailed", err)
+	}
+	b.sharedKey[0] ^= 1
+	_, bBody = b.NextRequest()
+	bBody[24] ^= 1
+	if _, err := a.Process(bBody); err != ErrKeyConfirmationFailed {
+		t.Errorf("got %v for a corrupt confirmation, want ErrKeyConfirmationFailed", err)
+	}
+	if a.complete {
+		t.Errorf("exchange completed despite failed confirmation")
+	}
+}
+
+func TestKeyConfirmationNegotiation(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithKeyConfirmation(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+	if a.peerConfirmation != nil || b.peerConfirmation != nil {
+		t.Errorf("key confirmation was used without both parties offering it")
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
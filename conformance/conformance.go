@@ -0,0 +1,236 @@
+// Package conformance checks that an HTTP meeting place behaves as PANDA
+// clients expect.
+//
+// The protocol is a single endpoint: a client POSTs a body to
+// /exchange/<tag>, where tag is 32 bytes in hex. The first body posted to a
+// tag is stored and answered with 204. A second, different body is stored and
+// each of the two bodies is thereafter answered with the other. Re-posting
+// either body is idempotent and any third body is answered with 409 without
+// disturbing the stored pair. Bodies larger than BodySize are rejected with
+// 413.
+//
+// Garbage collection of old postings can't be observed in a reasonable time
+// and so isn't checked.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/agl/panda"
+)
+
+// BodySize is the size of the largest bodies posted by package panda. A
+// meeting place must accept bodies of this size.
+const BodySize = panda.BodySize128K
+
+// A Result is the outcome of a single check.
+type Result struct {
+	Name   string
+	Passed bool
+	// Detail explains a failure.
+	Detail string
+}
+
+// A Report lists the outcome of every check, in the order that they ran.
+type Report struct {
+	Results []Result
+}
+
+// Passed returns true if every check passed.
+func (r *Report) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) String() string {
+	var out string
+	for _, result := range r.Results {
+		if result.Passed {
+			out += "PASS " + result.Name + "\n"
+		} else {
+			out += "FAIL " + result.Name + ": " + result.Detail + "\n"
+		}
+	}
+	return out
+}
+
+type checker struct {
+	ctx     context.Context
+	baseURL string
+	client  *http.Client
+}
+
+// A checkFunc performs one check. It returns an empty string if the check
+// passed, or else a description of the failure. The error is only for
+// failures to talk to the server at all.
+type checkFunc func(c *checker) (string, error)
+
+var checks = []struct {
+	name string
+	f    checkFunc
+}{
+	{"first body is recorded", checkFirstBody},
+	{"re-posting is idempotent", checkIdempotent},
+	{"two bodies are exchanged", checkExchange},
+	{"third body conflicts", checkThirdBody},
+	{"full-sized bodies are accepted", checkFullSize},
+	{"oversized bodies are rejected", checkOversized},
+	{"empty bodies are rejected", checkEmpty},
+	{"malformed tags are rejected", checkMalformedTag},
+}
+
+// RunConformance runs every check against the meeting place at baseURL. An
+// error is returned only if the server couldn't be reached; failed checks are
+// recorded in the Report.
+func RunConformance(ctx context.Context, baseURL string) (*Report, error) {
+	c := &checker{
+		ctx:     ctx,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  http.DefaultClient,
+	}
+	report := new(Report)
+	for _, check := range checks {
+		detail, err := check.f(c)
+		if err != nil {
+			return nil, err
+		}
+		report.Results = append(report.Results, Result{
+			Name:   check.name,
+			Passed: len(detail) == 0,
+			Detail: detail,
+		})
+	}
+	return report, nil
+}
+
+// post sends body to the given tag, which is used as-is in the URL, and
+// returns the status and reply.
+func (c *checker) post(tag string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequest("POST", c.baseURL+"/exchange/"+tag, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := c.client.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 2 * BodySize})
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, reply, nil
+}
+
+// expect posts body to tag and checks that the server replies with the given
+// status and, for 200, with the given reply.
+func (c *checker) expect(what, tag string, body []byte, status int, reply []byte) (string, error) {
+	gotStatus, gotReply, err := c.post(tag, body)
+	if err != nil {
+		return "", err
+	}
+	if gotStatus != status {
+		return what + ": got status " + strconv.Itoa(gotStatus) + ", want " + strconv.Itoa(status), nil
+	}
+	if status == 200 && !bytes.Equal(gotReply, reply) {
+		return what + ": reply was not the other body", nil
+	}
+	return "", nil
+}
+
+// sequence runs a number of expectations, stopping at the first failure.
+func sequence(steps ...func() (string, error)) (string, error) {
+	for _, step := range steps {
+		if detail, err := step(); err != nil || len(detail) > 0 {
+			return detail, err
+		}
+	}
+	return "", nil
+}
+
+func randomTag() string {
+	var tag [32]byte
+	if _, err := io.ReadFull(rand.Reader, tag[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(tag[:])
+}
+
+func randomBody(size int) []byte {
+	body := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, body); err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func checkFirstBody(c *checker) (string, error) {
+	return c.expect("first post", randomTag(), randomBody(1024), 204, nil)
+}
+
+func checkIdempotent(c *checker) (string, error) {
+	tag, a, b := randomTag(), randomBody(1024), randomBody(1024)
+	return sequence(
+		func() (string, error) { return c.expect("first post", tag, a, 204, nil) },
+		func() (string, error) { return c.expect("re-post before peer", tag, a, 204, nil) },
+		func() (string, error) { return c.expect("peer post", tag, b, 200, a) },
+		func() (string, error) { return c.expect("peer re-post", tag, b, 200, a) },
+		func() (string, error) { return c.expect("re-post after peer", tag, a, 200, b) },
+		func() (string, error) { return c.expect("second re-post after peer", tag, a, 200, b) },
+	)
+}
+
+func checkExchange(c *checker) (string, error) {
+	tag, a, b := randomTag(), randomBody(1024), randomBody(2048)
+	return sequence(
+		func() (string, error) { return c.expect("first post", tag, a, 204, nil) },
+		func() (string, error) { return c.expect("peer post", tag, b, 200, a) },
+		func() (string, error) { return c.expect("poll by first poster", tag, a, 200, b) },
+	)
+}
+
+func checkThirdBody(c *checker) (string, error) {
+	tag, a, b, third := randomTag(), randomBody(1024), randomBody(1024), randomBody(1024)
+	return sequence(
+		func() (string, error) { return c.expect("first post", tag, a, 204, nil) },
+		func() (string, error) { return c.expect("peer post", tag, b, 200, a) },
+		func() (string, error) { return c.expect("third post", tag, third, 409, nil) },
+		func() (string, error) { return c.expect("poll after third post", tag, a, 200, b) },
+		func() (string, error) { return c.expect("peer poll after third post", tag, b, 200, a) },
+	)
+}
+
+func checkFullSize(c *checker) (string, error) {
+	tag, a, b := randomTag(), randomBody(BodySize), randomBody(BodySize)
+	return sequence(
+		func() (string, error) { return c.expect("first post", tag, a, 204, nil) },
+		func() (string, error) { return c.expect("peer post", tag, b, 200, a) },
+	)
+}
+
+func checkOversized(c *checker) (string, error) {
+	return c.expect("oversized post", randomTag(), randomBody(BodySize+1), 413, nil)
+}
+
+func checkEmpty(c *checker) (string, error) {
+	return c.expect("empty post", randomTag(), nil, 400, nil)
+}
+
+func checkMalformedTag(c *checker) (string, error) {
+	return sequence(
+		func() (string, error) { return c.expect("non-hex tag", "zz", randomBody(1024), 400, nil) },
+		func() (string, error) { return c.expect("short tag", randomTag()[:32], randomBody(1024), 400, nil) },
+	)
+}
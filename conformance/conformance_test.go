@@ -0,0 +1,107 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/agl/panda/rendezvous"
+)
+
+// memoryServer is an in-memory meeting place. If evictOnThird is set it
+// makes a common mistake and replaces the second body when a third arrives.
+type memoryServer struct {
+	sync.Mutex
+	postings     map[string][2][]byte
+	evictOnThird bool
+}
+
+func (s *memoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tag, err := hex.DecodeString(strings.TrimPrefix(r.URL.Path, "/exchange/"))
+	if err != nil || len(tag) != 32 {
+		http.Error(w, "Malformed tag", 400)
+		return
+	}
+	body, _ := ioutil.ReadAll(&io.LimitedReader{R: r.Body, N: BodySize + 1})
+	if len(body) == 0 {
+		http.Error(w, "Empty body", 400)
+		return
+	}
+	if len(body) > BodySize {
+		http.Error(w, "Body too large", 413)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	p, ok := s.postings[string(tag)]
+	switch {
+	case !ok:
+		s.postings[string(tag)] = [2][]byte{body}
+	case bytes.Equal(p[0], body):
+		if p[1] != nil {
+			w.Write(p[1])
+			return
+		}
+	case p[1] == nil || bytes.Equal(p[1], body) || s.evictOnThird:
+		p[1] = body
+		s.postings[string(tag)] = p
+		w.Write(p[0])
+		return
+	default:
+		http.Error(w, "Tag collision", 409)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func TestConformance(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		handler http.Handler
+	}{
+		{"meeting place", rendezvous.NewHandler(rendezvous.NewMemoryStorage())},
+		{"memory server", &memoryServer{postings: make(map[string][2][]byte)}},
+	} {
+		server := httptest.NewServer(test.handler)
+		report, err := RunConformance(context.Background(), server.URL)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Passed() {
+			t.Errorf("%s failed:\n%s", test.name, report)
+		}
+	}
+}
+
+func TestConformanceDetectsEviction(t *testing.T) {
+	server := httptest.NewServer(&memoryServer{postings: make(map[string][2][]byte), evictOnThird: true})
+	defer server.Close()
+
+	report, err := RunConformance(context.Background(), server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range report.Results {
+		if shouldPass := result.Name != "third body conflicts"; result.Passed != shouldPass {
+			t.Errorf("%s: got passed=%t\n%s", result.Name, result.Passed, report)
+		}
+	}
+}
+
+func TestConformanceUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	if _, err := RunConformance(context.Background(), server.URL); err == nil {
+		t.Errorf("no error for an unreachable server")
+	}
+}
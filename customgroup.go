@@ -0,0 +1,199 @@
+package panda
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+
+	"github.com/agl/panda/groups"
+	"github.com/agl/panda/stateproto"
+)
+
+// MinCustomGroupBits is the smallest prime accepted by WithMODPGroup.
+const MinCustomGroupBits = 2048
+
+// WithMODPGroup replaces the group of a MODP suite with one supplied by the
+// caller, for deployments that mandate their own vetted parameters. p must be
+// a safe prime of between MinCustomGroupBits and 4096 bits, g must generate
+// the subgroup of order (p-1)/2 and n, the element that masks SPAKE2 values,
+// must be an element of the group other than ±1. It should be derived
+// verifiably, for example with groups.DeriveN, so that no one knows its
+// discrete logarithm. New returns an error describing any parameter that
+// fails these checks, which take about a second the first time that a group
+// is used in a process. The few most recently used groups are cached, so the
+// checks are repeated only for a group that has since been evicted.
+//
+// Both parties must use the same parameters. A hash of them is part of the
+// context of every derived value, so an exchange in a custom group never
+// matches one in a standard group.
+//
+// Unmarshal, UnmarshalKey and PeekStateInfo reject states in a custom group
+// unless New has used the group in this process or it has been passed to
+// AllowMODPGroup, so that a state from elsewhere can't make the process
+// check arbitrary groups.
+func WithMODPGroup(p, g, n *big.Int) Option {
+	return func(c *config) {
+		c.customGroup = &groups.Group{P: p, G: g, N: n}
+	}
+}
+
+// ErrCustomGroupNotAllowed is returned by Unmarshal, UnmarshalKey and
+// PeekStateInfo for a state in a custom group that neither New has used nor
+// AllowMODPGroup has allowed.
+var ErrCustomGroupNotAllowed = errors.New("panda: serialized state uses a custom group that hasn't been allowed")
+
+// maxCustomGroups is the number of checked custom groups that are cached.
+var maxCustomGroups = 8
+
+// customGroups caches the custom groups that have been checked, by the hash
+// of their parameters, evicting the least recently used beyond
+// maxCustomGroups. allowed holds the hashes of the groups that states may be
+// restored in.
+var customGroups struct {
+	sync.Mutex
+	m       map[[32]byte]*list.Element
+	lru     list.List
+	allowed map[[32]byte]bool
+}
+
+// AllowMODPGroup allows Unmarshal, UnmarshalKey and PeekStateInfo to restore
+// states in the custom group with the given parameters, as passed to
+// WithMODPGroup. It is only needed in processes that restore such states
+// without having created an exchange in the group with New.
+func AllowMODPGroup(p, g, n *big.Int) {
+	allowCustomGroup(customGroupHash(p, g, n))
+}
+
+func allowCustomGroup(hash [32]byte) {
+	customGroups.Lock()
+	defer customGroups.Unlock()
+	if customGroups.allowed == nil {
+		customGroups.allowed = make(map[[32]byte]bool)
+	}
+	customGroups.allowed[hash] = true
+}
+
+// checkCustomGroupAllowed returns ErrCustomGroupNotAllowed if params, the
+// parameters of a custom group read from a state, are not nil and states in
+// the group may not be restored.
+func checkCustomGroupAllowed(params *groups.Group) error {
+	if params == nil {
+		return nil
+	}
+	hash := customGroupHash(params.P, params.G, params.N)
+	customGroups.Lock()
+	defer customGroups.Unlock()
+	if !customGroups.allowed[hash] {
+		return ErrCustomGroupNotAllowed
+	}
+	return nil
+}
+
+// useCustomGroup records that New has used group: its fixed-base tables may
+// be built and states in it may be restored.
+func useCustomGroup(group *modpGroup) {
+	if group.tables.Load() {
+		return
+	}
+	allowCustomGroup(group.hash)
+	group.withTables()
+}
+
+// customGroupHash returns the hash of the parameters of a custom group.
+func customGroupHash(p, g, n *big.Int) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("PANDA custom group\x00"))
+	for _, x := range []*big.Int{p, g, n} {
+		h.Write(lengthPrefix(x.Bytes()))
+	}
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// lookupCustomGroup checks the parameters of a custom group and returns the
+// group.
+func lookupCustomGroup(p, g, n *big.Int) (*modpGroup, error) {
+	hash := customGroupHash(p, g, n)
+	if group := cachedCustomGroup(hash); group != nil {
+		return group, nil
+	}
+
+	if bits := p.BitLen(); bits < MinCustomGroupBits || bits > 8*xLen {
+		return nil, errors.New("panda: custom group has " + strconv.Itoa(bits) + "-bit p, want between " + strconv.Itoa(MinCustomGroupBits) + " and " + strconv.Itoa(8*xLen))
+	}
+	checked, err := groups.New("custom", p, g, n)
+	if err != nil {
+		return nil, err
+	}
+	group := newMODPGroup(checked)
+	group.hash = hash
+	group.label = "group " + hex.EncodeToString(hash[:]) + " "
+
+	customGroups.Lock()
+	defer customGroups.Unlock()
+	if customGroups.m == nil {
+		customGroups.m = make(map[[32]byte]*list.Element)
+	}
+	if e, ok := customGroups.m[hash]; ok {
+		customGroups.lru.MoveToFront(e)
+		return e.Value.(*modpGroup), nil
+	}
+	customGroups.m[hash] = customGroups.lru.PushFront(group)
+	for customGroups.lru.Len() > maxCustomGroups {
+		oldest := customGroups.lru.Back()
+		customGroups.lru.Remove(oldest)
+		delete(customGroups.m, oldest.Value.(*modpGroup).hash)
+	}
+	return group, nil
+}
+
+// cachedCustomGroup returns the checked custom group with the given hash, or
+// nil if it isn't cached.
+func cachedCustomGroup(hash [32]byte) *modpGroup {
+	customGroups.Lock()
+	defer customGroups.Unlock()
+	e, ok := customGroups.m[hash]
+	if !ok {
+		return nil
+	}
+	customGroups.lru.MoveToFront(e)
+	return e.Value.(*modpGroup)
+}
+
+// modpGroup returns the custom group of c, or nil if it has none. It returns
+// an error if the parameters fail the checks described at WithMODPGroup.
+func (c *config) modpGroup() (*modpGroup, error) {
+	if c.customGroup == nil {
+		return nil, nil
+	}
+	if !c.suite.isMODP() {
+		return nil, errors.New("panda: custom groups require a MODP suite")
+	}
+	return lookupCustomGroup(c.customGroup.P, c.customGroup.G, c.customGroup.N)
+}
+
+// marshalCustomGroup records the parameters of a custom group, if not nil, in
+// s.
+func marshalCustomGroup(p, g, n *big.Int, s *stateproto.State) {
+	if p != nil {
+		s.GroupP, s.GroupG, s.GroupN = p.Bytes(), g.Bytes(), n.Bytes()
+	}
+}
+
+// unmarshalCustomGroup returns the parameters of the custom group recorded in
+// s, or nil if there is none.
+func unmarshalCustomGroup(s *stateproto.State) *groups.Group {
+	if len(s.GroupP) == 0 && len(s.GroupG) == 0 && len(s.GroupN) == 0 {
+		return nil
+	}
+	return &groups.Group{
+		P: new(big.Int).SetBytes(s.GroupP),
+		G: new(big.Int).SetBytes(s.GroupG),
+		N: new(big.Int).SetBytes(s.GroupN),
+	}
+}
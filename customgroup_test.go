@@ -0,0 +1,185 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/groups"
+	"github.com/agl/panda/stateproto"
+)
+
+func testGroupOption() Option {
+	std := groups.MODP2048()
+	return WithMODPGroup(std.P, std.G, groups.DeriveN("PANDA custom group test", 2048))
+}
+
+func TestCustomGroup(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), testGroupOption(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), testGroupOption(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.modp().size != 256 {
+		t.Errorf("custom group wasn't used")
+	}
+	b = marshalUnmarshal(b)
+	if b.group != a.group {
+		t.Errorf("custom group was lost in serialization")
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	key, err := PrecomputeKey([]byte("foo"), testGroupOption(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = UnmarshalKey(key.Marshal()); err != nil || key.config.customGroup == nil {
+		t.Fatalf("custom group was lost from a Key: %v", err)
+	}
+	ex, err := NewFromKey(rand.Reader, key, []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.group != a.group {
+		t.Errorf("exchange from a Key doesn't use its custom group")
+	}
+}
+
+func TestCustomGroupTags(t *testing.T) {
+	std := groups.MODP2048()
+	for _, opt := range []Option{testGroupOption(), WithMODPGroup(std.P, std.G, std.N)} {
+		custom, err := New(rand.Reader, []byte("foo"), nil, opt, WithSuite(SuiteMODP2048), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		standard, err := New(rand.Reader, []byte("foo"), nil, WithSuite(SuiteMODP2048), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		customTag, _ := custom.NextRequest()
+		standardTag, _ := standard.NextRequest()
+		if bytes.Equal(customTag, standardTag) {
+			t.Errorf("custom group shares tags with the standard group")
+		}
+	}
+}
+
+func TestBadCustomGroup(t *testing.T) {
+	std := groups.MODP2048()
+	one := big.NewInt(1)
+	pMinusOne := new(big.Int).Sub(std.P, one)
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"small p", []Option{WithMODPGroup(big.NewInt(23), big.NewInt(4), big.NewInt(5))}},
+		{"composite p", []Option{WithMODPGroup(new(big.Int).Add(std.P, big.NewInt(2)), std.G, std.N)}},
+		{"g of one", []Option{WithMODPGroup(std.P, one, std.N)}},
+		{"g of order two", []Option{WithMODPGroup(std.P, pMinusOne, std.N)}},
+		{"n of one", []Option{WithMODPGroup(std.P, std.G, one)}},
+		{"n of minus one", []Option{WithMODPGroup(std.P, std.G, pMinusOne)}},
+		{"n of p", []Option{WithMODPGroup(std.P, std.G, std.P)}},
+		{"elliptic-curve suite", []Option{WithMODPGroup(std.P, std.G, std.N), WithSuite(SuiteP256)}},
+	} {
+		opts := append(test.opts, fastKDF)
+		if _, err := New(rand.Reader, []byte("foo"), nil, opts...); err == nil {
+			t.Errorf("%s: New succeeded", test.name)
+		}
+	}
+}
+
+// withGroupN returns data, a serialized state in a custom group, moved to the
+// group with a different n.
+func withGroupN(t *testing.T, data []byte, n *big.Int) []byte {
+	s := new(stateproto.State)
+	if err := proto.Unmarshal(data, s); err != nil {
+		t.Fatal(err)
+	}
+	s.GroupN = n.Bytes()
+	data, err := proto.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCustomGroupRestore(t *testing.T) {
+	std := groups.MODP2048()
+	n := groups.DeriveN("PANDA custom group restore test", 2048)
+	ex, err := New(rand.Reader, []byte("foo"), []byte("a"), testGroupOption(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := PrecomputeKey([]byte("foo"), testGroupOption(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := withGroupN(t, ex.Marshal(), n)
+	keyState := withGroupN(t, key.Marshal(), n)
+
+	if _, err := Unmarshal(state); err != ErrCustomGroupNotAllowed {
+		t.Errorf("Unmarshal gave %v for a group that wasn't allowed", err)
+	}
+	if _, err := PeekStateInfo(state); err != ErrCustomGroupNotAllowed {
+		t.Errorf("PeekStateInfo gave %v for a group that wasn't allowed", err)
+	}
+	if _, err := UnmarshalKey(keyState); err != ErrCustomGroupNotAllowed {
+		t.Errorf("UnmarshalKey gave %v for a group that wasn't allowed", err)
+	}
+
+	AllowMODPGroup(std.P, std.G, n)
+	restored, err := Unmarshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PeekStateInfo(state); err != nil {
+		t.Error(err)
+	}
+	if _, err := UnmarshalKey(keyState); err != nil {
+		t.Error(err)
+	}
+	if restored.group.tables.Load() {
+		t.Errorf("tables enabled for a group only used by Unmarshal")
+	}
+	if _, err := New(rand.Reader, []byte("foo"), []byte("a"), WithMODPGroup(std.P, std.G, n), fastKDF); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.group.tables.Load() {
+		t.Errorf("tables not enabled for a group used by New")
+	}
+}
+
+func TestCustomGroupCache(t *testing.T) {
+	defer func(max int) { maxCustomGroups = max }(maxCustomGroups)
+	maxCustomGroups = 1
+
+	std := groups.MODP2048()
+	n := groups.DeriveN("PANDA custom group cache test", 2048)
+	first, err := lookupCustomGroup(std.P, std.G, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := lookupCustomGroup(std.P, std.G, n); again != first {
+		t.Errorf("cached group wasn't reused")
+	}
+	if _, err := lookupCustomGroup(std.P, std.G, groups.DeriveN("PANDA custom group test", 2048)); err != nil {
+		t.Fatal(err)
+	}
+	customGroups.Lock()
+	cached := len(customGroups.m)
+	customGroups.Unlock()
+	if cached != 1 {
+		t.Errorf("%d groups cached, want 1", cached)
+	}
+	if again, _ := lookupCustomGroup(std.P, std.G, n); again == first {
+		t.Errorf("least recently used group wasn't evicted")
+	}
+}
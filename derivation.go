@@ -0,0 +1,270 @@
+package panda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"code.google.com/p/go.crypto/pbkdf2"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// A Derivation performs the key derivation of New in steps so that it can be
+// interleaved with other work and, for the scrypt KDFs, saved and resumed by
+// a later process if this one is killed. Once Step reports that it's done,
+// Key returns the same Key that PrecomputeKey would, for use with NewFromKey.
+//
+// scrypt's work is divided into lanes, p of them with the parameters of
+// WithScryptCost. A checkpoint records only completed lanes, because the
+// state of a lane in progress is as large as scrypt's memory cost, so up to
+// one lane of work is lost on resumption. The lanes of KDFScryptParallel are
+// run one after another. Other KDFs, and any KeyDeriver, run in a single
+// Step and aren't checkpointed.
+type Derivation struct {
+	config config
+	// input is the input to the KDF. It's nil once the derivation is done.
+	input []byte
+	// blocks holds scrypt's blocks, one lane after another, of which the
+	// first lanesDone have been mixed.
+	blocks    []byte
+	lanesDone int
+	// mixer, if not nil, holds the state of the lane in progress if mixing
+	// is true.
+	mixer  *romixer
+	mixing bool
+	done   bool
+	key    [32]byte
+	err    error
+}
+
+// derivationChunk is the number of iterations of scrypt's ROMix that Step
+// performs between checks of the time.
+const derivationChunk = 64
+
+// StartDerivation checks the secret and options as New does and returns a
+// Derivation of the key that New would derive from them. It does little of
+// the work itself.
+func StartDerivation(secret []byte, opts ...Option) (*Derivation, error) {
+	config := newConfig(opts)
+	if config.wipeSecret {
+		defer wipe(secret)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	input, err := config.kdfInput(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Derivation{config: *config, input: input}
+	if d.checkpointed() {
+		p := &d.config.kdf
+		laneSize := 128 * p.scryptR
+		if p.kdf == KDFScryptParallel {
+			for i := 0; i < p.scryptP; i++ {
+				salt := []byte(parallelScryptSalt + strconv.Itoa(i))
+				d.blocks = append(d.blocks, pbkdf2.Key(d.input, salt, 1, laneSize, sha256.New)...)
+			}
+		} else {
+			d.blocks = pbkdf2.Key(d.input, nil, 1, p.scryptP*laneSize, sha256.New)
+		}
+	}
+	return d, nil
+}
+
+// checkpointed returns true if d's progress is divided into lanes that can be
+// recorded by Marshal.
+func (d *Derivation) checkpointed() bool {
+	kdf := d.config.kdf.kdf
+	return d.config.deriver == nil && (kdf == KDFScrypt || kdf == KDFScryptParallel)
+}
+
+// lane returns the blocks of lane i.
+func (d *Derivation) lane(i int) []byte {
+	laneSize := 128 * d.config.kdf.scryptR
+	return d.blocks[i*laneSize : (i+1)*laneSize]
+}
+
+// Step works on the derivation for about budget and returns true once it's
+// done, successfully or not. Each call makes some progress, however small the
+// budget, but if the KDF isn't scrypt then the first call does all the work.
+func (d *Derivation) Step(budget time.Duration) (done bool) {
+	if d.done || d.err != nil {
+		return true
+	}
+	if !d.checkpointed() {
+		key, err := deriveKeyWith(d.config.deriver, &d.config.kdf, d.input, nil)
+		if err != nil {
+			d.err = err
+			return true
+		}
+		d.finish(key)
+		return true
+	}
+
+	deadline := time.Now().Add(budget)
+	p := &d.config.kdf
+	if d.mixer == nil {
+		d.mixer = newROMixer(p.scryptR, p.scryptN)
+	}
+	var iterations int64
+	for d.lanesDone < p.scryptP {
+		lane := d.lane(d.lanesDone)
+		if !d.mixing {
+			d.mixer.load(lane)
+			d.mixing = true
+		}
+		for !d.mixer.run(derivationChunk, &iterations) {
+			if !time.Now().Before(deadline) {
+				return false
+			}
+		}
+		d.mixer.store(lane)
+		d.mixing = false
+		d.lanesDone++
+		if d.lanesDone < p.scryptP && !time.Now().Before(deadline) {
+			return false
+		}
+	}
+
+	var key []byte
+	if p.kdf == KDFScryptParallel {
+		mac := hmac.New(sha256.New, []byte(parallelScryptSalt))
+		for i := 0; i < p.scryptP; i++ {
+			laneKey := pbkdf2.Key(d.input, d.lane(i), 1, 32, sha256.New)
+			mac.Write(laneKey)
+			wipe(laneKey)
+		}
+		key = mac.Sum(nil)
+	} else {
+		key = pbkdf2.Key(d.input, d.blocks, 1, 32, sha256.New)
+	}
+	d.finish(key)
+	return true
+}
+
+// finish completes the derivation given the output of the KDF, which it
+// wipes, and wipes the intermediate state.
+func (d *Derivation) finish(kdfOut []byte) {
+	kdfOut = applyPepper(kdfOut, d.config.pepper)
+	copy(d.key[:], kdfOut)
+	wipe(kdfOut)
+	d.wipeState()
+	d.done = true
+}
+
+// wipeState zeros and releases everything but the key.
+func (d *Derivation) wipeState() {
+	wipe(d.input)
+	wipe(d.blocks)
+	if d.mixer != nil {
+		d.mixer.wipe()
+	}
+	d.input, d.blocks, d.mixer, d.mixing = nil, nil, nil, false
+}
+
+// Key returns the derived key once Step has returned true, or the error that
+// stopped the derivation.
+func (d *Derivation) Key() (*Key, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if !d.done {
+		return nil, errors.New("panda: derivation is not complete")
+	}
+	return &Key{key: d.key, config: d.config}, nil
+}
+
+// Wipe zeros the secret material held by d: the input to the KDF, the
+// intermediate state and the key. The Derivation must not be used
+// afterwards. Checkpoints from Marshal are as sensitive as the secret itself
+// and must be deleted separately.
+func (d *Derivation) Wipe() {
+	d.wipeState()
+	d.key = [32]byte{}
+}
+
+// Marshal serializes d, including the progress of completed lanes. As with
+// Exchange.Marshal, the result is not encrypted, and it contains the secret
+// itself until the derivation is done. See MarshalSealed.
+func (d *Derivation) Marshal() []byte {
+	options := &Key{key: d.key, config: d.config}
+	state := &stateproto.Derivation{Options: options.Marshal()}
+	if d.done {
+		state.Done = proto.Bool(true)
+	} else {
+		state.Input = d.input
+		if d.checkpointed() {
+			state.Blocks = d.blocks
+			state.LanesDone = proto.Uint32(uint32(d.lanesDone))
+		}
+	}
+	s, err := proto.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ResumeDerivation creates a Derivation from the result of calling Marshal.
+func ResumeDerivation(data []byte) (*Derivation, error) {
+	s := new(stateproto.Derivation)
+	if err := proto.Unmarshal(data, s); err != nil {
+		return nil, errors.New("panda: derivation state is corrupt: " + err.Error())
+	}
+	key, err := UnmarshalKey(s.Options)
+	if err != nil {
+		return nil, err
+	}
+	d := &Derivation{config: key.config, done: s.GetDone()}
+	if d.done {
+		d.key = key.key
+		return d, nil
+	}
+
+	d.input = append([]byte(nil), s.Input...)
+	if d.checkpointed() {
+		p := &d.config.kdf
+		d.blocks = append([]byte(nil), s.Blocks...)
+		d.lanesDone = int(s.GetLanesDone())
+		if len(d.blocks) != p.scryptP*128*p.scryptR || d.lanesDone > p.scryptP {
+			return nil, errors.New("panda: derivation state is corrupt: bad scrypt state")
+		}
+	}
+	return d, nil
+}
+
+// MarshalSealed is like Marshal but encrypts and authenticates the result
+// with sealKey, using r for a nonce.
+func (d *Derivation) MarshalSealed(r io.Reader, sealKey *[32]byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(r, nonce[:]); err != nil {
+		return nil, err
+	}
+	plaintext := d.Marshal()
+	sealed := secretbox.Seal(nonce[:], plaintext, &nonce, sealKey)
+	wipe(plaintext)
+	return sealed, nil
+}
+
+// ResumeSealedDerivation creates a Derivation from the result of calling
+// MarshalSealed with the same sealKey.
+func ResumeSealedDerivation(data []byte, sealKey *[32]byte) (*Derivation, error) {
+	var nonce [24]byte
+	if len(data) < len(nonce)+secretbox.Overhead {
+		return nil, errors.New("panda: sealed derivation state is too short")
+	}
+	copy(nonce[:], data)
+	plaintext, ok := secretbox.Open(nil, data[len(nonce):], &nonce, sealKey)
+	if !ok {
+		return nil, errors.New("panda: sealed derivation state failed to authenticate")
+	}
+	defer wipe(plaintext)
+	return ResumeDerivation(plaintext)
+}
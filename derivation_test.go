@@ -0,0 +1,130 @@
+package panda
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestDerivation(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithScryptCost(1<<10, 8, 3)},
+		{WithKDF(KDFScryptParallel), WithScryptCost(1<<10, 4, 2), WithValidityWindow("2014-W09")},
+		{WithScryptCost(1<<10, 8, 1), WithPepper([]byte("pepper")), WithSecretNormalization()},
+		{WithKDF(KDFBalloon), WithBalloonCost(64, 1)},
+		{fastKDF},
+	} {
+		want, err := PrecomputeKey([]byte("foo"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := StartDerivation([]byte("foo"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Key(); err == nil {
+			t.Errorf("Key succeeded before the derivation was done")
+		}
+		steps := 0
+		for {
+			// Checkpoint at every lane, as a process that is killed
+			// repeatedly would.
+			lanesDone := d.lanesDone
+			done := d.Step(0)
+			steps++
+			if done || d.lanesDone != lanesDone {
+				if d, err = ResumeDerivation(d.Marshal()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if done {
+				break
+			}
+		}
+		if d.checkpointed() && steps < 3 {
+			t.Errorf("%v: derivation finished in %d steps", want.config.kdf.label(), steps)
+		}
+
+		got, err := d.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.key != want.key {
+			t.Errorf("%v: Derivation gave a different key from PrecomputeKey", want.config.kdf.label())
+		}
+		a, err := NewFromKey(rand.Reader, got, []byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aResult, bResult := runExchange(t, a, b)
+		if string(aResult) != "b" || string(bResult) != "a" {
+			t.Errorf("got %q and %q", aResult, bResult)
+		}
+	}
+}
+
+func TestDerivationBudget(t *testing.T) {
+	d, err := StartDerivation([]byte("foo"), WithScryptCost(1<<14, 8, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Step(time.Millisecond) {
+		t.Fatalf("derivation finished in a millisecond")
+	}
+	if d.lanesDone != 0 || d.mixer.i == 0 {
+		t.Errorf("Step made no progress within the lane")
+	}
+	if !d.Step(time.Minute) {
+		t.Errorf("derivation didn't finish in a minute")
+	}
+}
+
+func TestDerivationSealed(t *testing.T) {
+	d, err := StartDerivation([]byte("foo"), WithScryptCost(1<<10, 8, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for d.lanesDone == 0 {
+		d.Step(0)
+	}
+
+	var sealKey, otherKey [32]byte
+	sealKey[0], otherKey[0] = 1, 2
+	sealed, err := d.MarshalSealed(rand.Reader, &sealKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResumeSealedDerivation(sealed, &otherKey); err == nil {
+		t.Errorf("sealed state opened with the wrong key")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := ResumeSealedDerivation(sealed, &sealKey); err == nil {
+		t.Errorf("corrupt sealed state was accepted")
+	}
+	sealed[len(sealed)-1] ^= 1
+	resumed, err := ResumeSealedDerivation(sealed, &sealKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.lanesDone != 1 {
+		t.Errorf("resumed with %d lanes done, want 1", resumed.lanesDone)
+	}
+
+	marshaled := d.Marshal()
+	marshaled = marshaled[:len(marshaled)-1]
+	if _, err := ResumeDerivation(marshaled); err == nil {
+		t.Errorf("truncated state was accepted")
+	}
+
+	for !resumed.Step(time.Second) {
+	}
+	resumed.Wipe()
+	if resumed.key != [32]byte{} || resumed.input != nil || resumed.blocks != nil {
+		t.Errorf("Wipe left secret material")
+	}
+}
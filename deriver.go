@@ -0,0 +1,90 @@
+package panda
+
+import (
+	"errors"
+	"sync"
+)
+
+// A KeyDeriver replaces the package's KDF with another function from the
+// shared secret to the exchange key. It allows tests to avoid the cost of
+// the KDF and platforms to run it elsewhere, such as in hardware. Both
+// parties must derive the same key from the same secret.
+type KeyDeriver interface {
+	// Name identifies the deriver in serialized state. See
+	// RegisterKeyDeriver.
+	Name() string
+	DeriveKey(secret []byte) ([32]byte, error)
+}
+
+// WithKeyDeriver derives the exchange key with d rather than the KDF selected
+// by WithKDF, whose parameters are then unused. An exchange records the name
+// of its deriver so that, once restored by Unmarshal, it continues to use the
+// registered deriver of that name rather than reverting to the KDF.
+func WithKeyDeriver(d KeyDeriver) Option {
+	return func(c *config) {
+		c.deriver = d
+	}
+}
+
+var (
+	keyDeriversLock sync.Mutex
+	keyDerivers     = make(map[string]KeyDeriver)
+)
+
+// RegisterKeyDeriver makes d available, by name, to exchanges restored by
+// Unmarshal. A restored exchange whose deriver isn't registered fails to
+// derive keys, for example in RederiveSecret. RegisterKeyDeriver panics if
+// the name is empty or already registered.
+func RegisterKeyDeriver(d KeyDeriver) {
+	keyDeriversLock.Lock()
+	defer keyDeriversLock.Unlock()
+
+	name := d.Name()
+	if len(name) == 0 {
+		panic("panda: KeyDeriver has an empty name")
+	}
+	if _, ok := keyDerivers[name]; ok {
+		panic("panda: KeyDeriver " + name + " registered twice")
+	}
+	keyDerivers[name] = d
+}
+
+// unregisteredDeriver stands in for a deriver named in serialized state that
+// hasn't been registered.
+type unregisteredDeriver string
+
+func (d unregisteredDeriver) Name() string {
+	return string(d)
+}
+
+func (d unregisteredDeriver) DeriveKey(secret []byte) ([32]byte, error) {
+	return [32]byte{}, errors.New("panda: KeyDeriver " + string(d) + " is not registered")
+}
+
+// lookupKeyDeriver returns the registered deriver with the given name, or nil
+// if name is empty.
+func lookupKeyDeriver(name string) KeyDeriver {
+	if len(name) == 0 {
+		return nil
+	}
+	keyDeriversLock.Lock()
+	defer keyDeriversLock.Unlock()
+	if d, ok := keyDerivers[name]; ok {
+		return d
+	}
+	return unregisteredDeriver(name)
+}
+
+// deriveKeyWith computes the exchange key from the secret using d, if not
+// nil, or else the KDF described by p. done, if not nil, counts the KDF's
+// progress as for kdfParams.deriveCounting.
+func deriveKeyWith(d KeyDeriver, p *kdfParams, secret []byte, done *int64) ([]byte, error) {
+	if d == nil {
+		return p.deriveCounting(secret, done)
+	}
+	key, err := d.DeriveKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return key[:], nil
+}
@@ -0,0 +1,93 @@
+package panda
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+// unregisteredTestDeriver is never registered, as if the state were restored
+// by a program that lacks it.
+type unregisteredTestDeriver struct{}
+
+func (unregisteredTestDeriver) Name() string {
+	return "unregistered"
+}
+
+func (unregisteredTestDeriver) DeriveKey(secret []byte) ([32]byte, error) {
+	return sha256.Sum256(append([]byte("unregistered"), secret...)), nil
+}
+
+func TestKeyDeriver(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := PeekStateInfo(a.Marshal()); info.KeyDeriver != "test SHA-256" {
+		t.Errorf("PeekStateInfo reported deriver %q", info.KeyDeriver)
+	}
+	a = marshalUnmarshal(a)
+	if _, ok := a.deriver.(testDeriver); !ok {
+		t.Fatalf("restored exchange has deriver %#v", a.deriver)
+	}
+	// RederiveSecret must use the restored deriver, and so quickly match
+	// a new exchange.
+	if err := a.RederiveSecret(rand.Reader, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("bar"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	c, err := New(rand.Reader, []byte("foo"), []byte("c"), WithKeyDeriver(unregisteredTestDeriver{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = marshalUnmarshal(c)
+	if c.deriver == nil || c.deriver.Name() != "unregistered" {
+		t.Fatalf("restored exchange has deriver %#v", c.deriver)
+	}
+	err = c.RederiveSecret(rand.Reader, []byte("bar"))
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Errorf("RederiveSecret with an unregistered deriver returned %v", err)
+	}
+	// The name survives another round trip.
+	if c = marshalUnmarshal(c); c.deriver.Name() != "unregistered" {
+		t.Errorf("deriver name lost after restoring without registration")
+	}
+
+	key, err := PrecomputeKey([]byte("foo"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = UnmarshalKey(key.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.config.deriver.(testDeriver); !ok {
+		t.Errorf("restored Key has deriver %#v", key.config.deriver)
+	}
+}
+
+func TestRegisterKeyDeriverTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a deriver twice didn't panic")
+		}
+	}()
+	RegisterKeyDeriver(testDeriver{})
+}
+
+// BenchmarkNew measures the cost of New apart from the KDF.
+func BenchmarkNew(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := New(rand.Reader, []byte("foo"), []byte("message"), fastKDF); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package panda
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// ErrSuspectEntropy is returned by New and Exchange.RederiveSecret when the
+// supplied random source produces output that is clearly not random.
+var ErrSuspectEntropy = errors.New("panda: random source failed sanity checks")
+
+// entropyProbeLen is the number of bytes read from a random source in order to
+// check it.
+const entropyProbeLen = 64
+
+// minDistinctProbeBytes is the minimum number of distinct values in a probe.
+// A good source will have around 56 and the chance of it producing fewer than
+// this is negligible.
+const minDistinctProbeBytes = 16
+
+// checkEntropy reads a probe from r and rejects sources that are obviously
+// broken, such as those that return constant or counting bytes. It is not a
+// statistical test of randomness. crypto/rand is trusted without a probe.
+//
+// The probe consumes the first entropyProbeLen bytes of r, which are then
+// discarded, so the values that the caller draws from r afterwards are not
+// the first that it produces.
+func checkEntropy(r io.Reader) error {
+	if r == rand.Reader {
+		return nil
+	}
+
+	var probe [entropyProbeLen]byte
+	if _, err := io.ReadFull(r, probe[:]); err != nil {
+		return err
+	}
+
+	var seen [256]bool
+	distinct := 0
+	for _, b := range probe {
+		if !seen[b] {
+			seen[b] = true
+			distinct++
+		}
+	}
+	if distinct < minDistinctProbeBytes {
+		return ErrSuspectEntropy
+	}
+
+	// Reject counters, with any stride.
+	stride := probe[1] - probe[0]
+	for i := 2; i < len(probe); i++ {
+		if probe[i]-probe[i-1] != stride {
+			return nil
+		}
+	}
+	return ErrSuspectEntropy
+}
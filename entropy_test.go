@@ -0,0 +1,120 @@
+package panda
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+type counterReader struct {
+	next byte
+}
+
+func (c *counterReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = c.next
+		c.next += 3
+	}
+	return len(b), nil
+}
+
+// wrappedReader hides the identity of the reader that it wraps so that it
+// isn't exempted from checks.
+type wrappedReader struct {
+	io.Reader
+}
+
+func TestEntropyCheck(t *testing.T) {
+	if _, err := New(zeroReader{}, []byte("foo"), nil, fastKDF); err != ErrSuspectEntropy {
+		t.Errorf("zero reader: got %v", err)
+	}
+	if _, err := New(&counterReader{}, []byte("foo"), nil, fastKDF); err != ErrSuspectEntropy {
+		t.Errorf("counter reader: got %v", err)
+	}
+	if _, err := New(wrappedReader{rand.Reader}, []byte("foo"), nil, fastKDF); err != nil {
+		t.Errorf("good reader: got %v", err)
+	}
+	if _, err := New(&counterReader{}, []byte("foo"), nil, InsecureSkipEntropyCheck(), fastKDF); err != nil {
+		t.Errorf("counter reader with check disabled: got %v", err)
+	}
+}
+
+func TestEntropyProbeConsumed(t *testing.T) {
+	r := newReplayReader(t)
+	if err := checkEntropy(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.pos != entropyProbeLen {
+		t.Errorf("probe consumed %d bytes, want %d", r.pos, entropyProbeLen)
+	}
+}
+
+// replayReader returns the same bytes each time that it's rewound.
+type replayReader struct {
+	data []byte
+	pos  int
+}
+
+func newReplayReader(t *testing.T) *replayReader {
+	data := make([]byte, 4096)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+	return &replayReader{data: data}
+}
+
+func (r *replayReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.pos:])
+	r.pos += n
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func TestRederiveEntropyCheck(t *testing.T) {
+	for _, newSecret := range []string{"foo", "bar"} {
+		r := newReplayReader(t)
+		ex, err := New(r, []byte("foo"), []byte("a"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex = marshalUnmarshal(ex)
+		r.pos = 0
+		if err := ex.RederiveSecret(r, []byte(newSecret)); err != ErrSuspectEntropy {
+			t.Errorf("secret %q: got %v from a replayed draw, want ErrSuspectEntropy", newSecret, err)
+		}
+		if err := ex.RederiveSecret(r, []byte(newSecret)); err != nil {
+			t.Errorf("secret %q: got %v from a fresh draw", newSecret, err)
+		}
+	}
+
+	ex, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.RederiveSecret(&counterReader{}, []byte("bar")); err != ErrSuspectEntropy {
+		t.Errorf("counter reader: got %v, want ErrSuspectEntropy", err)
+	}
+}
+
+func TestRederiveSkipEntropyCheck(t *testing.T) {
+	ex, err := New(&counterReader{}, []byte("foo"), []byte("a"), InsecureSkipEntropyCheck(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The option survives serialization.
+	ex = marshalUnmarshal(ex)
+	if err := ex.RederiveSecret(&counterReader{}, []byte("bar")); err != nil {
+		t.Errorf("counter reader with check disabled: got %v", err)
+	}
+}
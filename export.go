@@ -0,0 +1,45 @@
+package panda
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/hkdf"
+)
+
+// exportPrefix begins the context of every key derived by DeriveKey, after
+// the context prefix of the exchange, so that no label can give one of the
+// keys that the protocol itself uses.
+const exportPrefix = "export "
+
+// Complete returns true once the exchange is complete, that is once Process
+// has returned the peer's message, or confirmed the key if the peer is
+// key-only, and so DeriveKey may be called.
+func (ex *Exchange) Complete() bool {
+	return ex.complete
+}
+
+// DeriveKey derives n bytes from the shared key of a completed exchange, for
+// keying whatever the parties do next, such as a session. Both parties get
+// the same output for the same label and different labels give independent
+// output. At most 8160 bytes can be derived for each label.
+func (ex *Exchange) DeriveKey(label string, n int) ([]byte, error) {
+	if !ex.complete {
+		return nil, errors.New("panda: keying material is only available once the exchange is complete")
+	}
+	if n < 0 || n > 255*sha256.Size {
+		return nil, errors.New("panda: invalid length of keying material")
+	}
+	out := make([]byte, n)
+	r := hkdf.New(sha256.New, ex.sharedKey[:], nil, []byte(ex.context(exportPrefix+label)))
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExportKeyingMaterial is the same as DeriveKey.
+func (ex *Exchange) ExportKeyingMaterial(label string, length int) ([]byte, error) {
+	return ex.DeriveKey(label, length)
+}
@@ -0,0 +1,87 @@
+package panda
+
+import (
+	"math/big"
+	"math/bits"
+	"sync"
+
+	"filippo.io/bigmod"
+)
+
+// fixedBaseWindow is the number of exponent bits consumed by each
+// multiplication in a fixedBase exponentiation.
+const fixedBaseWindow = 4
+
+// A fixedBase exponentiates a fixed base, g or N, faster than modpGroup.exp
+// by precomputing, for every window of the exponent, the base raised to each
+// value that the window can take. The table is built on first use and costs
+// 2^fixedBaseWindow elements per window: 8MiB for g in the 4096-bit group.
+// Entries are selected in constant time, so exp, like modpGroup.exp, takes
+// time that depends only on the length of the exponent.
+type fixedBase struct {
+	group *modpGroup
+	base  *big.Int
+	// bits is the length of the longest exponent that the table covers.
+	bits int
+
+	once sync.Once
+	// table[i][j] holds the limbs of base^(j·2^(fixedBaseWindow·i)).
+	table [][1 << fixedBaseWindow][]uint
+}
+
+func newFixedBase(group *modpGroup, base *big.Int, bits int) *fixedBase {
+	return &fixedBase{group: group, base: base, bits: bits}
+}
+
+func (f *fixedBase) init() {
+	m := f.group
+	windows := (f.bits + fixedBaseWindow - 1) / fixedBaseWindow
+	f.table = make([][1 << fixedBaseWindow][]uint, windows)
+	b := m.toNat(f.base)
+	for i := range f.table {
+		row := &f.table[i]
+		acc := m.toNat(big.NewInt(1))
+		for j := range row {
+			row[j] = append([]uint(nil), acc.Bits()...)
+			acc.Mul(b, m.modulus)
+		}
+		// acc is now b^(2^fixedBaseWindow), the base of the next row.
+		b = acc
+	}
+}
+
+// exp returns base^exp mod p. Exponents longer than the table are handled by
+// modpGroup.exp.
+func (f *fixedBase) exp(exp []byte) *big.Int {
+	if len(exp)*8 > f.bits {
+		return f.group.exp(f.base, exp)
+	}
+	f.once.Do(f.init)
+	m := f.group
+	acc := m.toNat(big.NewInt(1))
+	entry := bigmod.NewNat().ExpandFor(m.modulus)
+	defer m.fromNat(entry)
+	for i := 0; i < 8*len(exp)/fixedBaseWindow; i++ {
+		b := exp[len(exp)-1-i*fixedBaseWindow/8]
+		window := uint(b>>(uint(i*fixedBaseWindow)%8)) & (1<<fixedBaseWindow - 1)
+		selectLimbs(entry.Bits(), f.table[i][:], window)
+		acc.Mul(entry, m.modulus)
+	}
+	return m.fromNat(acc)
+}
+
+// selectLimbs sets out to table[index], reading every entry so that the
+// memory access pattern doesn't depend on index.
+func selectLimbs(out []uint, table [][]uint, index uint) {
+	for i := range out {
+		out[i] = 0
+	}
+	for j, entry := range table {
+		d := uint(j) ^ index
+		// mask is all ones if d is zero and zero otherwise.
+		mask := ((d | -d) >> (bits.UintSize - 1)) - 1
+		for i, limb := range entry {
+			out[i] |= limb & mask
+		}
+	}
+}
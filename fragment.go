@@ -0,0 +1,304 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// MaxFragments is the largest number of fragments that a message may be split
+// into. See WithFragmentation.
+const MaxFragments = 64
+
+// ErrFragmentationUnsupported is returned by Process when our message is too
+// large for a single body and the peer didn't offer fragmentation.
+var ErrFragmentationUnsupported = errors.New("panda: message needs fragmentation, which the peer didn't offer")
+
+var errFragmentHash = errors.New("panda: reassembled message doesn't match its hash")
+
+// fragmentHeaderLen is the length of the header of the first fragment: the
+// length of the whole message, in four bytes, big-endian, and its SHA-256
+// hash.
+const fragmentHeaderLen = 4 + sha256.Size
+
+// The labels of the tags and keys of fragments after the first. Each is
+// followed by a space and the index of the fragment.
+const (
+	labelFragmentTag = "fragment tag"
+	labelFragmentKey = "fragment key"
+)
+
+// WithFragmentation offers to fragment messages that are too large for a
+// single body, so that New accepts messages of up to MaxFragments bodies.
+// If the peer offers it too, the second round body becomes the first
+// fragment, which carries the length and hash of the whole message, and the
+// rest are exchanged under tags of their own, given by Fragments once the
+// peer's first fragment has been processed. Process returns the message
+// once every fragment has arrived and the message matches its hash. If the
+// peer doesn't offer it, the exchange proceeds as usual, unless our message
+// needs more than one body, in which case Process returns
+// ErrFragmentationUnsupported once the peer's first round body arrives. It
+// requires protocol version 2 or later, since the offer is carried in the
+// first round header.
+func WithFragmentation() Option {
+	return func(c *config) {
+		c.fragmentation = true
+	}
+}
+
+// A Fragment is a tag and body to be exchanged with the meeting place, like
+// those returned by NextRequest. Index is its position in the message.
+type Fragment struct {
+	Index     int
+	Tag, Body []byte
+}
+
+// maxFragmentedLen returns the largest message that can be fragmented, given
+// single, the largest message that fits in a second round body.
+func maxFragmentedLen(single, version, size int) int {
+	return single - fragmentHeaderLen + (MaxFragments-1)*maxMessageLenWith(version, size, false, false)
+}
+
+// fragmentLens returns the amount of a message carried by the first fragment
+// and by each of the rest. The first has less room if key confirmation or
+// hybrid protection is in use, which both parties know once the first round
+// is over.
+func (ex *Exchange) fragmentLens() (first, rest int) {
+	first = maxMessageLenWith(ex.version, ex.bodySize, ex.insertsConfirmation(), len(ex.kemCiphertext) > 0) - fragmentHeaderLen
+	return first, maxMessageLenWith(ex.version, ex.bodySize, false, false)
+}
+
+// fragmentCount returns the number of fragments in a message of n bytes.
+func (ex *Exchange) fragmentCount(n int) int {
+	first, rest := ex.fragmentLens()
+	if n <= first {
+		return 1
+	}
+	return 1 + (n-first+rest-1)/rest
+}
+
+// fragment returns the part of our message carried by the fragment with the
+// given index, which is empty beyond the end of the message.
+func (ex *Exchange) fragment(i int) []byte {
+	first, rest := ex.fragmentLens()
+	start, end := 0, first
+	if i > 0 {
+		start = first + (i-1)*rest
+		end = start + rest
+	}
+	message := ex.sentMessage()
+	start, end = min(start, len(message)), min(end, len(message))
+	return message[start:end]
+}
+
+// roundTwoPayload returns the plaintext of our second round body, which, if
+// fragmented, is our first fragment.
+func (ex *Exchange) roundTwoPayload() []byte {
+	if !ex.fragmented {
+		return ex.sentMessage()
+	}
+	message := ex.sentMessage()
+	hash := sha256.Sum256(message)
+	payload := binary.BigEndian.AppendUint32(nil, uint32(len(message)))
+	payload = append(payload, hash[:]...)
+	return append(payload, ex.fragment(0)...)
+}
+
+// splitFragmentHeader separates the header of the peer's first fragment from
+// the part of the message that it carries.
+func splitFragmentHeader(payload []byte) (header, data []byte, err error) {
+	if len(payload) < fragmentHeaderLen {
+		return nil, nil, errors.New("panda: first fragment is too short")
+	}
+	return payload[:fragmentHeaderLen], payload[fragmentHeaderLen:], nil
+}
+
+// peerFragmentCount returns the number of fragments in the peer's message,
+// or zero if its first fragment hasn't arrived.
+func (ex *Exchange) peerFragmentCount() int {
+	if ex.peerFragmentHeader == nil {
+		return 0
+	}
+	return ex.fragmentCount(int(binary.BigEndian.Uint32(ex.peerFragmentHeader)))
+}
+
+// fragmentTag returns the tag of the fragments with the given index, which
+// both parties use.
+func (ex *Exchange) fragmentTag(i int) []byte {
+	return ex.scheduleKey(&ex.sharedKey, labelFragmentTag+" "+strconv.Itoa(i), 32)
+}
+
+// fragmentKey returns the key that seals the fragment with the given index,
+// derived from the key that sealed the first fragment in the same direction.
+func (ex *Exchange) fragmentKey(roundTwoKey *[32]byte, i int) *[32]byte {
+	var key [32]byte
+	keySlice := ex.scheduleKey(roundTwoKey, labelFragmentKey+" "+strconv.Itoa(i), 32)
+	copy(key[:], keySlice)
+	wipe(keySlice)
+	return &key
+}
+
+// fragmentBody returns our fragment with the given index. Beyond the end of
+// our message it is empty, so that we can collect the rest of a longer
+// message from the peer.
+func (ex *Exchange) fragmentBody(i int) ([]byte, error) {
+	return ex.box(2, ex.fragmentKey(ex.roundTwoSendKey(), i), ex.fragment(i))
+}
+
+// Fragments returns the tags and bodies of the fragments after the first,
+// which is the second round body. It returns nil unless both parties offered
+// fragmentation and the peer's first fragment has been processed, since only
+// then is the length of the peer's message known, unless the peer is
+// key-only. Each must be posted, in any
+// order, and the peer's replies passed to Process, which ignores fragments
+// that it has already received. There are as many as the longer of the two
+// messages needs, so some bodies may carry nothing.
+func (ex *Exchange) Fragments() ([]Fragment, error) {
+	if !ex.fragmented || ex.peerFragmentHeader == nil && !ex.peerKeyOnly {
+		return nil, nil
+	}
+	n := max(ex.fragmentCount(len(ex.sentMessage())), ex.peerFragmentCount())
+	var fragments []Fragment
+	for i := 1; i < n; i++ {
+		body, err := ex.fragmentBody(i)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, Fragment{Index: i, Tag: ex.fragmentTag(i), Body: body})
+	}
+	return fragments, nil
+}
+
+// processFragment processes a second round reply, other than our own body, in
+// a fragmented exchange. Fragments may arrive in any order and duplicates are
+// ignored. Until the last has arrived the result carries no message.
+func (ex *Exchange) processFragment(reply []byte) (Result, error) {
+	if ex.complete {
+		return Result{}, ErrComplete
+	}
+	if ex.peerFragmentHeader == nil {
+		payload, key, err := ex.openRoundTwoKey(reply)
+		if err != nil {
+			return Result{}, err
+		}
+		header, data, err := splitFragmentHeader(payload)
+		if err != nil {
+			return Result{}, err
+		}
+		if binary.BigEndian.Uint32(header) > uint32(ex.maxPeerMessageLen()) {
+			return Result{}, errors.New("panda: peer's message is too long")
+		}
+		ex.peerFragmentHeader = header
+		ex.peerRoundTwoKey = *key
+		ex.fragments = map[int][]byte{0: data}
+		return ex.reassemble()
+	}
+
+	if _, _, err := ex.openRoundTwoKey(reply); err == nil {
+		// The peer's first fragment, again.
+		return Result{RoundConsumed: 2}, nil
+	}
+	n := max(ex.fragmentCount(len(ex.sentMessage())), ex.peerFragmentCount())
+	var lastErr error
+	for i := 1; i < n; i++ {
+		ours, err := ex.fragmentBody(i)
+		if err != nil {
+			return Result{}, err
+		}
+		if bytes.Equal(reply, ours) {
+			return Result{}, ErrOwnMessage
+		}
+		data, err := unbox(ex.suite, ex.version, ex.fragmentKey(&ex.peerRoundTwoKey, i), reply)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if i < ex.peerFragmentCount() {
+			ex.fragments[i] = data
+		}
+		return ex.reassemble()
+	}
+	if lastErr == nil {
+		lastErr = errors.New("panda: failed to authenticate reply from server")
+	}
+	return Result{}, lastErr
+}
+
+// maxPeerMessageLen returns the longest message that the peer could send in
+// MaxFragments fragments.
+func (ex *Exchange) maxPeerMessageLen() int {
+	first, rest := ex.fragmentLens()
+	return first + (MaxFragments-1)*rest
+}
+
+// reassemble completes the exchange if every fragment of the peer's message
+// has arrived.
+func (ex *Exchange) reassemble() (Result, error) {
+	n := ex.peerFragmentCount()
+	if len(ex.fragments) < n {
+		return Result{RoundConsumed: 2}, nil
+	}
+	message := make([]byte, 0, binary.BigEndian.Uint32(ex.peerFragmentHeader))
+	for i := 0; i < n; i++ {
+		message = append(message, ex.fragments[i]...)
+	}
+	hash := sha256.Sum256(message)
+	if len(message) != int(binary.BigEndian.Uint32(ex.peerFragmentHeader)) || subtle.ConstantTimeCompare(hash[:], ex.peerFragmentHeader[4:]) != 1 {
+		return Result{}, errFragmentHash
+	}
+	message, err := ex.peerMessageFrom(message)
+	if err != nil {
+		return Result{}, err
+	}
+	ex.complete = true
+	ex.peerMessageHash = hash
+	ex.fragments = nil
+	return Result{RoundConsumed: 2, Completed: true, Message: message}, nil
+}
+
+// marshalFragments returns the fragments in index order so that the
+// serialized state is deterministic.
+func marshalFragments(fragments map[int][]byte) []*stateproto.State_Fragment {
+	var indexes []int
+	for i := range fragments {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var entries []*stateproto.State_Fragment
+	for _, i := range indexes {
+		entries = append(entries, &stateproto.State_Fragment{
+			Index: proto.Uint32(uint32(i)),
+			Data:  fragments[i],
+		})
+	}
+	return entries
+}
+
+// unmarshalFragments returns the fragments recorded in s.
+func unmarshalFragments(s *stateproto.State) (map[int][]byte, error) {
+	if s.PeerFragmentHeader == nil {
+		if len(s.Fragments) > 0 {
+			return nil, errors.New("panda: serialized state is corrupt: fragments without a header")
+		}
+		return nil, nil
+	}
+	if len(s.PeerFragmentHeader) != fragmentHeaderLen || len(s.PeerRoundTwoKey) != 32 {
+		return nil, errors.New("panda: serialized state is corrupt: bad fragment header")
+	}
+	fragments := make(map[int][]byte)
+	for _, entry := range s.Fragments {
+		i := int(entry.GetIndex())
+		if _, ok := fragments[i]; ok || i >= MaxFragments {
+			return nil, errors.New("panda: serialized state is corrupt: bad fragment")
+		}
+		fragments[i] = entry.GetData()
+	}
+	return fragments, nil
+}
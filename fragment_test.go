@@ -0,0 +1,204 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	mathrand "math/rand"
+	"testing"
+)
+
+// fragmentedPair returns two exchanges, with fragmentation and small bodies,
+// that have completed the first round and sent the given messages.
+func fragmentedPair(t *testing.T, aMessage, bMessage []byte, opts ...Option) (a, b *Exchange) {
+	opts = append(opts, WithFragmentation(), WithProtocolVersion(ProtocolVersion4), WithBodySize(BodySize4K), fastKDF)
+	a, err := New(rand.Reader, []byte("foo"), aMessage, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = New(rand.Reader, []byte("foo"), bMessage, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestFragmentation(t *testing.T) {
+	first := maxMessageLenWith(ProtocolVersion4, BodySize4K, false, false) - fragmentHeaderLen
+	for _, lens := range [][2]int{{0, 10}, {first, first + 1}, {5 * first, 100}, {10 * first, 3 * first}} {
+		aMessage, bMessage := make([]byte, lens[0]), make([]byte, lens[1])
+		rand.Read(aMessage)
+		rand.Read(bMessage)
+		a, b := fragmentedPair(t, aMessage, bMessage)
+
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		aResult, err := a.ProcessDetailed(bBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bResult, err := b.ProcessDetailed(aBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aFragments, err := a.Fragments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bFragments, err := b.Fragments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(aFragments) != len(bFragments) {
+			t.Fatalf("%v: parties have %d and %d fragments", lens, len(aFragments), len(bFragments))
+		}
+		for i := range aFragments {
+			if !bytes.Equal(aFragments[i].Tag, bFragments[i].Tag) || len(aFragments[i].Body) != BodySize4K {
+				t.Fatalf("%v: fragment %d doesn't match", lens, i)
+			}
+		}
+
+		// Fragments are delivered in a random order, some twice, and the
+		// state is saved and restored as they arrive.
+		order := mathrand.Perm(len(aFragments))
+		if len(order) > 0 {
+			order = append(order, order[0])
+		}
+		for _, i := range order {
+			if !aResult.complete() {
+				if _, err := a.Process(aFragments[i].Body); err != ErrOwnMessage {
+					t.Errorf("%v: got %v for our own fragment, want ErrOwnMessage", lens, err)
+				}
+				if aResult, err = a.ProcessDetailed(bFragments[i].Body); err != nil {
+					t.Fatalf("%v: fragment %d: %s", lens, i, err)
+				}
+			}
+			if !bResult.complete() {
+				if bResult, err = b.ProcessDetailed(aFragments[i].Body); err != nil {
+					t.Fatalf("%v: fragment %d: %s", lens, i, err)
+				}
+			}
+			a, b = marshalUnmarshal(a), marshalUnmarshal(b)
+		}
+		if !bytes.Equal(aResult.Message, bMessage) || !bytes.Equal(bResult.Message, aMessage) {
+			t.Errorf("%v: messages weren't reassembled", lens)
+		}
+		if !a.complete || !b.complete {
+			t.Errorf("%v: exchanges didn't complete", lens)
+		}
+	}
+}
+
+func (r Result) complete() bool {
+	return r.Message != nil
+}
+
+func TestFragmentationMissing(t *testing.T) {
+	message := make([]byte, 3*BodySize4K)
+	a, b := fragmentedPair(t, message, []byte("b"))
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := b.ProcessDetailed(aBody); err != nil || result.RoundConsumed != 2 || result.Message != nil {
+		t.Fatalf("first fragment gave %+v, %v", result, err)
+	}
+	fragments, err := a.Fragments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) < 2 {
+		t.Fatalf("got %d fragments", len(fragments))
+	}
+	for _, fragment := range fragments[:len(fragments)-1] {
+		for i := 0; i < 2; i++ {
+			if result, err := b.ProcessDetailed(fragment.Body); err != nil || result.Message != nil {
+				t.Fatalf("fragment %d gave %+v, %v", fragment.Index, result, err)
+			}
+		}
+	}
+	if b.complete {
+		t.Fatal("exchange completed without its last fragment")
+	}
+	b = marshalUnmarshal(b)
+	if result, err := b.ProcessDetailed(fragments[len(fragments)-1].Body); err != nil || !bytes.Equal(result.Message, message) {
+		t.Errorf("last fragment gave %v", err)
+	}
+	if _, err := b.Process(fragments[0].Body); err != ErrComplete {
+		t.Errorf("got %v for a fragment after completion, want ErrComplete", err)
+	}
+}
+
+func TestFragmentationFallback(t *testing.T) {
+	opts := []Option{WithProtocolVersion(ProtocolVersion4), WithBodySize(BodySize4K), fastKDF}
+	single, err := MaxMessageLenFor(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{single, single + 1} {
+		a, err := New(rand.Reader, []byte("foo"), make([]byte, n), append(opts, WithFragmentation())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		_, err = a.Process(bBody)
+		if n > single {
+			if err != ErrFragmentationUnsupported {
+				t.Errorf("got %v for an oversized message, want ErrFragmentationUnsupported", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+		if a.fragmented || b.fragmented {
+			t.Errorf("fragmentation was used without both parties offering it")
+		}
+		_, aBody = a.NextRequest()
+		_, bBody = b.NextRequest()
+		if result, err := a.Process(bBody); err != nil || string(result) != "b" {
+			t.Errorf("got %q, %v", result, err)
+		}
+		if result, err := b.Process(aBody); err != nil || len(result) != n {
+			t.Errorf("got %d bytes, %v", len(result), err)
+		}
+	}
+}
+
+func TestFragmentationLimits(t *testing.T) {
+	if _, err := MaxMessageLenFor(WithFragmentation()); err == nil {
+		t.Errorf("fragmentation was accepted with protocol version 1")
+	}
+	opts := []Option{WithFragmentation(), WithProtocolVersion(ProtocolVersion4), WithBodySize(BodySize4K)}
+	limit, err := MaxMessageLenFor(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := New(rand.Reader, []byte("foo"), make([]byte, limit), append(opts, fastKDF)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ex.fragmentCount(limit); n != MaxFragments {
+		t.Errorf("largest message has %d fragments, want %d", n, MaxFragments)
+	}
+	if _, err := New(rand.Reader, []byte("foo"), make([]byte, limit+1), append(opts, fastKDF)...); err == nil {
+		t.Errorf("message over the limit was accepted")
+	}
+}
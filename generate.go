@@ -0,0 +1,77 @@
+package panda
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// wordlist holds the words that GenerateSecret chooses from.
+var wordlist = strings.Fields(wordlistWords)
+
+// MinSecretWords is the number of words that GenerateSecret should be asked
+// for at least. Six words give 66 bits, above DefaultMinSecretBits, which is
+// enough to outlast an unsalted brute-force search for the few days that an
+// exchange is pending, given the cost of the KDF.
+const MinSecretWords = 6
+
+// uniformIndex returns a uniformly distributed number in [0, n), for n no
+// greater than 1<<16, using rejection sampling to avoid modulo bias.
+func uniformIndex(r io.Reader, n int) (int, error) {
+	limit := 1 << 16
+	limit -= limit % n
+	var buf [2]byte
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		if v := int(buf[0])<<8 | int(buf[1]); v < limit {
+			return v % n, nil
+		}
+	}
+}
+
+// GenerateSecret returns a phrase of the given number of words, chosen
+// uniformly from an embedded list of 2048 and separated by hyphens, along
+// with its entropy in bits. A source other than crypto/rand is first checked
+// for obvious defects, as in New, which consumes its first 64 bytes, and any
+// error reading from it is returned; there is no fallback to another source.
+func GenerateSecret(r io.Reader, words int) (string, float64, error) {
+	if words < 1 {
+		return "", 0, errors.New("panda: secret must have at least one word")
+	}
+	if err := checkEntropy(r); err != nil {
+		return "", 0, err
+	}
+	chosen := make([]string, words)
+	for i := range chosen {
+		j, err := uniformIndex(r, len(wordlist))
+		if err != nil {
+			return "", 0, err
+		}
+		chosen[i] = wordlist[j]
+	}
+	return strings.Join(chosen, "-"), float64(words) * math.Log2(float64(len(wordlist))), nil
+}
+
+// GenerateSecretWithGroup is like GenerateSecret but appends a random
+// two-digit group, such as "-07", that helps users to tell apart several
+// pending exchanges. The group is part of the secret and counts towards its
+// entropy.
+func GenerateSecretWithGroup(r io.Reader, words int) (string, float64, error) {
+	secret, bits, err := GenerateSecret(r, words)
+	if err != nil {
+		return "", 0, err
+	}
+	group, err := uniformIndex(r, 100)
+	if err != nil {
+		return "", 0, err
+	}
+	digits := strconv.Itoa(group)
+	if group < 10 {
+		digits = "0" + digits
+	}
+	return secret + "-" + digits, bits + math.Log2(100), nil
+}
@@ -0,0 +1,83 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWordlist(t *testing.T) {
+	if len(wordlist) != 2048 {
+		t.Fatalf("wordlist has %d words", len(wordlist))
+	}
+	prefixes := make(map[string]bool)
+	for _, w := range wordlist {
+		p := w
+		if len(p) > 4 {
+			p = p[:4]
+		}
+		if prefixes[p] {
+			t.Errorf("prefix %q repeated", p)
+		}
+		prefixes[p] = true
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		secret, bits, err := GenerateSecret(rand.Reader, MinSecretWords)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if words := strings.Split(secret, "-"); len(words) != MinSecretWords {
+			t.Errorf("%q has %d words", secret, len(words))
+		}
+		if bits != 66 {
+			t.Errorf("got %f bits", bits)
+		}
+		if _, ok, reason := IsAcceptableSecret([]byte(secret)); !ok {
+			t.Errorf("%q isn't acceptable: %s", secret, reason)
+		}
+	}
+
+	secret, bits, err := GenerateSecretWithGroup(rand.Reader, MinSecretWords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^([a-z]+-){6}[0-9]{2}$`).MatchString(secret) {
+		t.Errorf("%q doesn't end in a two-digit group", secret)
+	}
+	if want := 66 + math.Log2(100); bits != want {
+		t.Errorf("got %f bits, want %f", bits, want)
+	}
+
+	if _, _, err := GenerateSecret(rand.Reader, 0); err == nil {
+		t.Errorf("zero words accepted")
+	}
+	if _, _, err := GenerateSecret(zeroReader{}, MinSecretWords); err != ErrSuspectEntropy {
+		t.Errorf("broken source: got %v", err)
+	}
+	// Enough for the entropy check and two words.
+	short := io.LimitReader(rand.Reader, entropyProbeLen+4)
+	if _, _, err := GenerateSecret(short, MinSecretWords); err == nil {
+		t.Errorf("exhausted source didn't cause an error")
+	}
+}
+
+func TestUniformIndex(t *testing.T) {
+	// 0xfff0 is rejected when choosing from 100, since 65536 isn't a
+	// multiple of 100, and the next value is used.
+	r := bytes.NewReader([]byte{0xff, 0xf0, 0x01, 0x00})
+	if i, err := uniformIndex(r, 100); err != nil || i != 256%100 {
+		t.Errorf("got %d, %v", i, err)
+	}
+	// Every value is accepted for a power of two.
+	r = bytes.NewReader([]byte{0xff, 0xff})
+	if i, err := uniformIndex(r, 2048); err != nil || i != 2047 {
+		t.Errorf("got %d, %v", i, err)
+	}
+}
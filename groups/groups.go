@@ -0,0 +1,131 @@
+// Package groups contains the parameters of the groups in which PANDA performs
+// SPAKE2, so that they can be inspected and checked independently of the
+// protocol implementation.
+package groups
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"code.google.com/p/go.crypto/salsa20"
+)
+
+// Group describes the subgroup of prime order Q in the multiplicative group
+// modulo the safe prime P.
+type Group struct {
+	// Name identifies the group.
+	Name string
+	// Bits is the length of P in bits.
+	Bits int
+	// P is a safe prime, i.e. (P-1)/2 is also prime.
+	P *big.Int
+	// G generates the subgroup of order Q.
+	G *big.Int
+	// Q is the order of the subgroup, (P-1)/2.
+	Q *big.Int
+	// N is the verifiably random element used to blind SPAKE2 values. It
+	// is derived from NSeed by DeriveN.
+	N *big.Int
+	// NSeed is the seed from which N was derived.
+	NSeed string
+}
+
+const (
+	modp4096P = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF"
+	modp4096N = "a4fc1dc7a9a7fb350cbe7ca8301e69be1b0a7d904214218dcb055aa5a43f5d5eafed84f570fb13532075ada5aa2aa3cd52b84f3dcadcccc99f22cbcf8666eb768bbe7adda90709d73011d8474d6e4d458a5e0c9f61bce08b76f86707702787814b122b6f51352dfd69a5da48def271f814b09116e200b01e5acfc66f666f8268447eb0ec2aac64a97093f09908653f93c5723d38e404f0f01b46799b5ef398dd4bd9e4301d704dd22d2bc4de8fed055be9992b147ac686364d80dcd5153ea6e9fdb85a65d78fc70ce816f2fc964d270affe1cb5267fad6bd17ad1994de8854f6c68d1347db7c65250196fddbf0ebbea9e2c4ab2f82bc4784f3d36881bab1b5b05ebf1a758d24a7db1f2030607349bc0e961e82e1ca9301bd3fa1ce32364a1febf5bc9915aa364bf1c1ac62e066022cb9828fb39becf77dcb3d0b1db35ecfdf7cf91c381b355b74175b5fb2918008ad775132fb3886333449dfc55bb65417c2a0c45559370f66d0e955d1c28e46f7274639b039736546c502470513a1e36a793f888ce880b3fe00e83018049749fc4870cefbbb9a9a6e10f90a78cd0de85360f7b0d7abaab43d99d539b48afb56e36c8538c03faf43320324c76741d8c7ea419dea6de120bdbb93402284436645cc4b4d4190ee0313dc2302b31cb4eb55cb4c4d779b56ca9b91423a43b50868c5211caf9491f36b77abb0e29f98639ef6592e77"
+	modp2048P = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+	modp2048N = "592be3041dfe71018331713ba4263484e949342401aaee44c41e873fec761396f603946944d9ef2dbe7a73de8df016bd26bea06946f57669ba6a4dd55372971d09530bdcb4fb729098ec6c3f6655a6c5f6308644d5f56ff022a416bae4b52015413daa2f4500eea82d7eb487777fafe15f6ef033bc01e00396ee9bc138b239aca1b7f17099c38cb5a8935e7d911fb101c0503b1a3a39ccdefa45da871ed2e9d08bbd04693ae01ded3f1cc3eb30608ff959752ad538dc24b74ff1b7eac83911399135e99d5cfe3e9fa79073547c29289964d1f7758049706c081713b5344e99e1e193ffaa9ac21e3fe6aa5c2a8aefa0129d2e4e6d6f7759107301810198d36ed4"
+)
+
+// MODP4096 returns the 4096-bit group from
+// https://tools.ietf.org/html/rfc3526#section-5. This is the group used by
+// PANDA. Each call returns a fresh copy that the caller may modify.
+func MODP4096() *Group {
+	return newGroup("MODP4096", 4096, modp4096P, 2, "PANDA key exchange, seed for N", modp4096N)
+}
+
+// MODP2048 returns the 2048-bit group from
+// https://tools.ietf.org/html/rfc3526#section-3, which PANDA offers for
+// devices on which MODP4096 is too slow.
+func MODP2048() *Group {
+	return newGroup("MODP2048", 2048, modp2048P, 2, "PANDA key exchange, seed for N, MODP2048", modp2048N)
+}
+
+// All returns every group known to this package.
+func All() []*Group {
+	return []*Group{MODP4096(), MODP2048()}
+}
+
+func newGroup(name string, bits int, p string, g int64, nSeed, n string) *Group {
+	group := &Group{
+		Name:  name,
+		Bits:  bits,
+		G:     big.NewInt(g),
+		NSeed: nSeed,
+	}
+	group.P, _ = new(big.Int).SetString(p, 16)
+	group.N, _ = new(big.Int).SetString(n, 16)
+	group.Q = new(big.Int).Rsh(group.P, 1)
+	return group
+}
+
+// DeriveN returns the element derived from seed for a group of the given size:
+// the first bits bits of Salsa20 output, interpreted as a big-endian number,
+// where the nonce is zero and the key is SHA-256(seed).
+func DeriveN(seed string, bits int) *big.Int {
+	key := sha256.Sum256([]byte(seed))
+	var nonce [8]byte
+	out := make([]byte, bits/8)
+	salsa20.XORKeyStream(out, out, nonce[:], &key)
+	return new(big.Int).SetBytes(out)
+}
+
+// VerifyN checks that N was correctly derived from NSeed and is an element of
+// the group.
+func (g *Group) VerifyN() error {
+	if DeriveN(g.NSeed, g.Bits).Cmp(g.N) != 0 {
+		return errors.New("groups: N does not match its seed in " + g.Name)
+	}
+	if g.N.Sign() <= 0 || g.N.Cmp(g.P) >= 0 {
+		return errors.New("groups: N is out of range in " + g.Name)
+	}
+	return nil
+}
+
+// New returns a group with caller-supplied parameters, after checking that p
+// is a safe prime, that g generates the subgroup of order (p-1)/2 and that n
+// is an element of the group other than ±1. The group's NSeed is empty, since
+// n wasn't necessarily derived from a seed. The primality tests take time
+// that grows quickly with the size of p.
+func New(name string, p, g, n *big.Int) (*Group, error) {
+	one := big.NewInt(1)
+	pMinusOne := new(big.Int).Sub(p, one)
+	if p.Sign() <= 0 || p.Bit(0) == 0 {
+		return nil, errors.New("groups: p is not an odd prime in " + name)
+	}
+	if g.Cmp(one) <= 0 || g.Cmp(pMinusOne) >= 0 {
+		return nil, errors.New("groups: g is out of range in " + name)
+	}
+	if n.Cmp(one) <= 0 || n.Cmp(pMinusOne) >= 0 {
+		return nil, errors.New("groups: n is out of range in " + name)
+	}
+	q := new(big.Int).Rsh(p, 1)
+	if new(big.Int).Exp(g, q, p).Cmp(one) != 0 {
+		return nil, errors.New("groups: g doesn't generate the subgroup of order (p-1)/2 in " + name)
+	}
+	if !p.ProbablyPrime(32) {
+		return nil, errors.New("groups: p is not prime in " + name)
+	}
+	if !q.ProbablyPrime(32) {
+		return nil, errors.New("groups: p is not a safe prime in " + name)
+	}
+	return &Group{
+		Name: name,
+		Bits: p.BitLen(),
+		P:    new(big.Int).Set(p),
+		G:    new(big.Int).Set(g),
+		Q:    q,
+		N:    new(big.Int).Set(n),
+	}, nil
+}
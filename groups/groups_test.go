@@ -0,0 +1,76 @@
+package groups
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	one := big.NewInt(1)
+
+	for _, g := range All() {
+		if n := g.P.BitLen(); n != g.Bits {
+			t.Errorf("%s: P has %d bits, want %d", g.Name, n, g.Bits)
+		}
+		if !g.P.ProbablyPrime(10) {
+			t.Errorf("%s: P is not prime", g.Name)
+		}
+		if !g.Q.ProbablyPrime(10) {
+			t.Errorf("%s: Q is not prime", g.Name)
+		}
+		if q := new(big.Int).Lsh(g.Q, 1); q.Add(q, one).Cmp(g.P) != 0 {
+			t.Errorf("%s: P is not 2Q+1", g.Name)
+		}
+		if new(big.Int).Exp(g.G, g.Q, g.P).Cmp(one) != 0 {
+			t.Errorf("%s: G does not have order Q", g.Name)
+		}
+		if err := g.VerifyN(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCopies(t *testing.T) {
+	g := MODP4096()
+	g.P.SetInt64(7)
+	if MODP4096().P.Cmp(g.P) == 0 {
+		t.Errorf("modifying a returned group changed later copies")
+	}
+}
+
+func TestMODP2048N(t *testing.T) {
+	g := MODP2048()
+	if DeriveN(g.NSeed, 2048).Cmp(g.N) != 0 {
+		t.Errorf("N doesn't match its seed")
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		p, g, n int64
+		ok      bool
+	}{
+		{23, 4, 5, true},
+		{23, 22, 5, false}, // g has order two.
+		{23, 5, 5, false},  // g generates the whole group.
+		{23, 4, 1, false},
+		{23, 4, 22, false},
+		{23, 4, 23, false},
+		{25, 7, 2, false}, // p isn't prime.
+		{29, 4, 2, false}, // p isn't a safe prime.
+		{24, 5, 7, false},
+	} {
+		g, err := New("test", big.NewInt(test.p), big.NewInt(test.g), big.NewInt(test.n))
+		if (err == nil) != test.ok {
+			t.Errorf("p=%d g=%d n=%d: got error %v", test.p, test.g, test.n, err)
+		}
+		if err == nil && (g.Q.Int64() != (test.p-1)/2 || g.Bits != 5) {
+			t.Errorf("p=%d: got Q=%s and %d bits", test.p, g.Q, g.Bits)
+		}
+	}
+
+	std := MODP2048()
+	if _, err := New("MODP2048", std.P, std.G, std.N); err != nil {
+		t.Errorf("standard group was rejected: %s", err)
+	}
+}
@@ -0,0 +1,43 @@
+package panda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// MinHighEntropySecretLen is the shortest secret accepted by
+// WithHighEntropySecret.
+const MinHighEntropySecretLen = 32
+
+// highEntropySalt keys the extraction of the exchange key from a
+// high-entropy secret.
+const highEntropySalt = "PANDA high-entropy secret v1"
+
+// WithHighEntropySecret is for secrets that are already uniformly random, such
+// as 32 bytes from a CSPRNG delivered in a QR code, for which the expensive
+// KDF adds nothing. The key is derived with a single HKDF-Extract instead,
+// and secrets shorter than MinHighEntropySecretLen are rejected. It selects
+// KDFHighEntropy, so, like any KDF, it's recorded in serialized state and
+// separates the exchange's tags from an exchange with another KDF over the
+// same secret. Both parties must use it for the exchange to complete. Never
+// use it with a secret that a person chose.
+func WithHighEntropySecret() Option {
+	return WithKDF(KDFHighEntropy)
+}
+
+// highEntropyKey is HKDF-Extract of the secret, with highEntropySalt as the
+// salt.
+func highEntropyKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(highEntropySalt))
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// checkSecret returns an error if secret is unsuitable for the KDF.
+func (p *kdfParams) checkSecret(secret []byte) error {
+	if p.kdf == KDFHighEntropy && len(secret) < MinHighEntropySecretLen {
+		return errors.New("panda: a high-entropy secret must be at least 32 bytes")
+	}
+	return nil
+}
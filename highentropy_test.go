@@ -0,0 +1,57 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestHighEntropySecret(t *testing.T) {
+	secret := make([]byte, MinHighEntropySecretLen)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(rand.Reader, secret, []byte("a"), WithHighEntropySecret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, secret, []byte("b"), WithHighEntropySecret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.kdf.kdf != KDFHighEntropy {
+		t.Errorf("KDF was lost in serialization")
+	}
+	aTag, aBody := a.NextRequest()
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	// A peer that didn't opt in must not match, even over the same bytes.
+	other, err := New(rand.Reader, secret, []byte("c"), WithScryptCost(1<<10, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTag, _ := other.NextRequest()
+	if bytes.Equal(aTag, otherTag) {
+		t.Errorf("high-entropy and scrypt exchanges share a tag")
+	}
+	if _, err := other.Process(aBody); err == nil {
+		t.Errorf("scrypt exchange accepted a high-entropy body")
+	}
+
+	if _, err := New(rand.Reader, secret[:MinHighEntropySecretLen-1], nil, WithHighEntropySecret()); err == nil {
+		t.Errorf("short secret was accepted")
+	}
+	c, err := New(rand.Reader, secret, []byte("c"), WithHighEntropySecret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RederiveSecret(rand.Reader, []byte("foo")); err == nil {
+		t.Errorf("RederiveSecret accepted a short secret")
+	}
+}
@@ -0,0 +1,114 @@
+package panda
+
+import (
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"errors"
+
+	"github.com/agl/panda/stateproto"
+)
+
+// labelHybridRoundTwo names the second round box key of hybrid exchanges.
+const labelHybridRoundTwo = "hybrid box key round2"
+
+// labelHybridEncapsulation names the randomness from which we encapsulate a
+// secret to the peer.
+const labelHybridEncapsulation = "hybrid encapsulation"
+
+var errInvalidKEMKey = errors.New("panda: invalid ML-KEM key from peer")
+
+// WithHybridKEM offers hybrid post-quantum protection of the second round to
+// the peer. Our first round body carries an ML-KEM-768 encapsulation key and,
+// if the peer's carries one too, each party encapsulates a secret to the
+// other's key and sends the ciphertext in its second round body, which is
+// sealed under a key derived from both the SPAKE2 shared key and that secret.
+// Someone who records the exchange and later breaks the SPAKE2 group, for
+// example with a quantum computer, then also has to break ML-KEM to read the
+// messages. If the peer doesn't offer it, the exchange proceeds as usual; the
+// offer is bound into the shared key by the body hash, so it can't be
+// stripped without the secret. Bodies stay the same size, but the largest
+// message is smaller by the size of the ciphertext. It requires protocol
+// version 2 or later, since the key is carried in the first round header.
+func WithHybridKEM() Option {
+	return func(c *config) {
+		c.hybridKEM = true
+	}
+}
+
+// kemKey returns our ML-KEM decapsulation key.
+func (ex *Exchange) kemKey() *mlkem.DecapsulationKey768 {
+	dk, err := mlkem.NewDecapsulationKey768(ex.kemSeed[:])
+	if err != nil {
+		panic(err)
+	}
+	return dk
+}
+
+// encapsulate encapsulates a new secret to peerKey, the peer's encapsulation
+// key, and records it and its ciphertext for our second round body.
+//
+// The encapsulation is derandomized so that, like the rest of the second
+// round body, it is the same each time that the first round reply is
+// processed: a state restored from before Process would otherwise post a
+// different body, which the meeting place rejects as a conflict. The
+// randomness is derived from our ML-KEM seed, which never leaves this party,
+// rather than from the SPAKE2 key, so that breaking the group doesn't reveal
+// it, and is bound to the first round bodies and the peer's key.
+func (ex *Exchange) encapsulate(peerKey []byte) error {
+	ek, err := mlkem.NewEncapsulationKey768(peerKey)
+	if err != nil {
+		return errInvalidKEMKey
+	}
+	salt := append(append([]byte{}, ex.bodyHash[:]...), peerKey...)
+	random := hkdfKey(salt, ex.kemSeed[:], ex.context(labelHybridEncapsulation), 32)
+	defer wipe(random)
+	// Encapsulate768 is documented as being for known-answer tests, but it
+	// is the only way to encapsulate with randomness of our choosing.
+	secret, ciphertext, err := mlkemtest.Encapsulate768(ek, random)
+	if err != nil {
+		return err
+	}
+	copy(ex.kemSecret[:], secret)
+	wipe(secret)
+	ex.kemCiphertext = ciphertext
+	return nil
+}
+
+// decapsulate returns the secret that the peer encapsulated to our key in
+// ciphertext.
+func (ex *Exchange) decapsulate(ciphertext []byte) ([]byte, error) {
+	return ex.kemKey().Decapsulate(ciphertext)
+}
+
+// hybridKey returns the box key for a second round body that carries an
+// encapsulated secret: the SPAKE2 box key, key, is the HKDF salt and the
+// secret its input. Since each party encapsulates to the other, each
+// direction has its own key, and both can send their second round bodies
+// without waiting for the other's.
+func (ex *Exchange) hybridKey(key *[32]byte, secret []byte) *[32]byte {
+	var hybrid [32]byte
+	keySlice := hkdfKey(key[:], secret, ex.context(labelHybridRoundTwo), 32)
+	copy(hybrid[:], keySlice)
+	wipe(keySlice)
+	return &hybrid
+}
+
+// checkKEMState checks the ML-KEM values in a serialized state.
+func checkKEMState(s *stateproto.State) error {
+	if !s.GetHybridKem() {
+		if len(s.KemSeed) != 0 || len(s.KemCiphertext) != 0 || len(s.KemSecret) != 0 {
+			return errors.New("panda: serialized state is corrupt: ML-KEM values without hybrid exchange")
+		}
+		return nil
+	}
+	if len(s.KemSeed) != mlkem.SeedSize {
+		return errors.New("panda: serialized state is corrupt: bad ML-KEM seed")
+	}
+	if len(s.KemCiphertext) == 0 && len(s.KemSecret) == 0 {
+		return nil
+	}
+	if len(s.KemCiphertext) != mlkem.CiphertextSize768 || len(s.KemSecret) != mlkem.SharedKeySize {
+		return errors.New("panda: serialized state is corrupt: bad ML-KEM ciphertext")
+	}
+	return nil
+}
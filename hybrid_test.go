@@ -0,0 +1,155 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+func TestHybridKEM(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255, SuiteP256} {
+		for _, confirm := range []bool{false, true} {
+			opts := []Option{WithHybridKEM(), WithProtocolVersion(ProtocolVersion2), WithSuite(suite)}
+			if confirm {
+				opts = append(opts, WithKeyConfirmation())
+			}
+			a, b := newPair(t, opts...)
+			_, aBody := a.NextRequest()
+			_, bBody := b.NextRequest()
+			if _, err := a.Process(bBody); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Process(aBody); err != nil {
+				t.Fatal(err)
+			}
+			a, b = marshalUnmarshal(a), marshalUnmarshal(b)
+			if len(a.kemCiphertext) != mlkem.CiphertextSize768 || len(b.kemCiphertext) != mlkem.CiphertextSize768 {
+				t.Fatalf("suite %d: hybrid protection wasn't negotiated", suite)
+			}
+			_, aBody = a.NextRequest()
+			_, bBody = b.NextRequest()
+			if len(aBody) != bodySize {
+				t.Errorf("suite %d: body is %d bytes, want %d", suite, len(aBody), bodySize)
+			}
+			if _, err := unbox(suite, a.version, a.roundTwoKey(), aBody); err == nil {
+				t.Errorf("suite %d: body opened without the encapsulated secret", suite)
+			}
+			corrupt := append([]byte(nil), bBody...)
+			corrupt[24+len(b.peerConfirmation)] ^= 1
+			if _, err := a.Process(corrupt); err == nil {
+				t.Errorf("suite %d: body with a corrupt ciphertext was accepted", suite)
+			}
+			if result, err := a.Process(bBody); err != nil || string(result) != "b" {
+				t.Errorf("suite %d: got %q, %v", suite, result, err)
+			}
+			if result, err := b.Process(aBody); err != nil || string(result) != "a" {
+				t.Errorf("suite %d: got %q, %v", suite, result, err)
+			}
+		}
+	}
+}
+
+func TestHybridKEMFallback(t *testing.T) {
+	for _, version := range []int{ProtocolVersion2, ProtocolVersion3} {
+		hybrid, err := New(rand.Reader, []byte("foo"), []byte("a"), WithHybridKEM(), WithProtocolVersion(version), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pure, err := New(rand.Reader, []byte("foo"), []byte("b"), WithProtocolVersion(version), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, pair := range [][2]*Exchange{{hybrid, pure}, {pure, hybrid}} {
+			a, b := marshalUnmarshal(pair[0]), marshalUnmarshal(pair[1])
+			aResult, bResult := runExchange(t, a, b)
+			if a.kemCiphertext != nil || b.kemCiphertext != nil {
+				t.Errorf("version %d, order %d: hybrid protection was used without both parties offering it", version, i)
+			}
+			if string(aResult) != string(b.message) || string(bResult) != string(a.message) {
+				t.Errorf("version %d, order %d: got %q and %q", version, i, aResult, bResult)
+			}
+		}
+	}
+}
+
+func TestHybridKEMRoundOne(t *testing.T) {
+	a, b := newPair(t, WithHybridKEM(), WithProtocolVersion(ProtocolVersion2))
+	peer, err := a.splitRoundOne(b.roundOnePayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(peer.public, b.public) || !bytes.Equal(peer.kemKey, b.kemKey().EncapsulationKey().Bytes()) {
+		t.Errorf("encapsulation key didn't round trip")
+	}
+
+	// Peers that don't know the extensions skip over the key.
+	pure, _ := newPair(t, WithProtocolVersion(ProtocolVersion2))
+	if peer, err := pure.splitRoundOne(b.roundOnePayload()); err != nil || !bytes.Equal(peer.public, b.public) {
+		t.Errorf("hybrid payload wasn't understood by a pure exchange: %v", err)
+	}
+
+	truncated := append(header(ProtocolVersion2, SuiteMODP4096, extHybridKEM, 3, 1, 2, 3), b.public...)
+	if _, err := a.splitRoundOne(truncated); err != errMalformedHeader {
+		t.Errorf("got %v for a truncated key, want errMalformedHeader", err)
+	}
+}
+
+func TestHybridKEMOptions(t *testing.T) {
+	if _, err := MaxMessageLenFor(WithHybridKEM()); err == nil {
+		t.Errorf("hybrid exchange was accepted with protocol version 1")
+	}
+	n, err := MaxMessageLenFor(WithHybridKEM(), WithKeyConfirmation(), WithProtocolVersion(ProtocolVersion4))
+	if want := MaxMessageLen - confirmationLen - mlkem.CiphertextSize768; err != nil || n != want {
+		t.Errorf("MaxMessageLenFor gave %d, %v, want %d", n, err, want)
+	}
+	if _, err := New(rand.Reader, []byte("foo"), make([]byte, n+1), WithHybridKEM(), WithKeyConfirmation(), WithProtocolVersion(ProtocolVersion4), fastKDF); err == nil {
+		t.Errorf("New accepted a message with no room for the ciphertext")
+	}
+}
+
+func TestHybridKEMCorruptState(t *testing.T) {
+	a, _ := newPair(t, WithHybridKEM(), WithProtocolVersion(ProtocolVersion2))
+	s := new(stateproto.State)
+	if err := proto.Unmarshal(a.Marshal(), s); err != nil {
+		t.Fatal(err)
+	}
+	s.KemSeed = s.KemSeed[1:]
+	data, err := proto.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(data); err == nil {
+		t.Errorf("state with a short ML-KEM seed was accepted")
+	}
+}
+
+// TestHybridKEMRestore checks that a hybrid party restored from a state saved
+// before or after processing the first round reply posts the same second
+// round body, as the meeting place requires of re-posts.
+func TestHybridKEMRestore(t *testing.T) {
+	a, b := newPair(t, WithHybridKEM(), WithProtocolVersion(ProtocolVersion2))
+	_, bBody := b.NextRequest()
+	saved := a.Marshal()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	_, want := a.NextRequest()
+
+	if _, got := marshalUnmarshal(a).NextRequest(); !bytes.Equal(got, want) {
+		t.Errorf("second round body changed after restoring the processed state")
+	}
+	restored, err := Unmarshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := restored.NextRequest(); !bytes.Equal(got, want) {
+		t.Errorf("second round body changed after processing the reply again")
+	}
+}
@@ -0,0 +1,97 @@
+// Package invite implements single-use invite codes for PANDA meeting places.
+//
+// An operator mints codes with a private key and hands them out. A client
+// presents a code with its posts and the meeting place, which knows only the
+// public key, charges each tag that the client stores a body under against
+// the code's budget. A code carries a random identifier, an expiry time and
+// the number of tags it may be spent on, so it says nothing about the
+// exchanges that it pays for.
+package invite
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned for codes that cannot be decoded.
+	ErrMalformed = errors.New("invite: malformed code")
+	// ErrBadSignature is returned for codes not signed by the expected key.
+	ErrBadSignature = errors.New("invite: bad signature")
+	// ErrExpired is returned for codes whose expiry time has passed.
+	ErrExpired = errors.New("invite: code expired")
+	// ErrInviteExhausted is returned when a code has been spent on as many
+	// tags as it allows.
+	ErrInviteExhausted = errors.New("invite: code exhausted")
+)
+
+// TagsPerExchange is the number of tags that one exchange posts to.
+const TagsPerExchange = 2
+
+const (
+	codeVersion = 1
+	// payloadLen is the length of the signed part of a code: the version,
+	// the ID, the expiry time in Unix seconds and the tag budget.
+	payloadLen = 1 + 16 + 8 + 4
+)
+
+// A Code is the decoded contents of an invite code.
+type Code struct {
+	// ID is a random identifier for the code.
+	ID [16]byte
+	// Expiry is the time after which the code may not be used.
+	Expiry time.Time
+	// Tags is the number of tags that the code may be spent on.
+	Tags uint32
+}
+
+// Mint creates a code allowing the given number of tags until expiry, signed
+// by key. The ID is read from rand.
+func Mint(rand io.Reader, key ed25519.PrivateKey, expiry time.Time, tags uint32) (string, error) {
+	payload := make([]byte, payloadLen, payloadLen+ed25519.SignatureSize)
+	payload[0] = codeVersion
+	if _, err := io.ReadFull(rand, payload[1:17]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(payload[17:25], uint64(expiry.Unix()))
+	binary.BigEndian.PutUint32(payload[25:29], tags)
+
+	signed := append(payload, ed25519.Sign(key, payload)...)
+	return base64.RawURLEncoding.EncodeToString(signed), nil
+}
+
+// Verify decodes code and checks that it was signed by key and hasn't
+// expired at time now.
+func Verify(key ed25519.PublicKey, code string, now time.Time) (*Code, error) {
+	signed, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil || len(signed) != payloadLen+ed25519.SignatureSize || signed[0] != codeVersion {
+		return nil, ErrMalformed
+	}
+	payload := signed[:payloadLen]
+	if !ed25519.Verify(key, payload, signed[payloadLen:]) {
+		return nil, ErrBadSignature
+	}
+
+	c := &Code{
+		Expiry: time.Unix(int64(binary.BigEndian.Uint64(payload[17:25])), 0),
+		Tags:   binary.BigEndian.Uint32(payload[25:29]),
+	}
+	copy(c.ID[:], payload[1:17])
+	if now.After(c.Expiry) {
+		return nil, ErrExpired
+	}
+	return c, nil
+}
+
+// Spend charges one tag against c, given the number of tags that it has
+// already been spent on, and returns the new count.
+func (c *Code) Spend(used int64) (int64, error) {
+	if used >= int64(c.Tags) {
+		return used, ErrInviteExhausted
+	}
+	return used + 1, nil
+}
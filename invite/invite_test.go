@@ -0,0 +1,68 @@
+package invite
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestMintAndSpend(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000000, 0)
+
+	code, err := Mint(rand.Reader, priv, now.Add(time.Hour), TagsPerExchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Verify(pub, code, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Tags != TagsPerExchange || !c.Expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("got %+v", c)
+	}
+
+	var used int64
+	for i := 0; i < TagsPerExchange; i++ {
+		if used, err = c.Spend(used); err != nil {
+			t.Fatalf("spend %d: %s", i, err)
+		}
+	}
+	if _, err := c.Spend(used); err != ErrInviteExhausted {
+		t.Errorf("double spend: got %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Unix(1000000, 0)
+
+	code, err := Mint(rand.Reader, priv, now, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(pub, code, now.Add(time.Second)); err != ErrExpired {
+		t.Errorf("expired code: got %v", err)
+	}
+	if _, err := Verify(otherPub, code, now); err != ErrBadSignature {
+		t.Errorf("wrong key: got %v", err)
+	}
+
+	tampered := []byte(code)
+	if tampered[5] == 'A' {
+		tampered[5] = 'B'
+	} else {
+		tampered[5] = 'A'
+	}
+	if _, err := Verify(pub, string(tampered), now); err != ErrBadSignature {
+		t.Errorf("tampered code: got %v", err)
+	}
+	if _, err := Verify(pub, "not a code", now); err != ErrMalformed {
+		t.Errorf("malformed code: got %v", err)
+	}
+}
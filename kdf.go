@@ -0,0 +1,379 @@
+package panda
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"code.google.com/p/go.crypto/argon2"
+	"code.google.com/p/go.crypto/scrypt"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// A KDF identifies the function used to derive an exchange's key from the
+// shared secret. Both parties must use the same KDF, with the same parameters,
+// for an exchange to complete.
+type KDF int32
+
+const (
+	// KDFScrypt is scrypt, by default with N=2^16, r=16 and p=4. See
+	// WithScryptCost. It is the default.
+	KDFScrypt KDF = 0
+	// KDFBalloon is Balloon hashing with SHA-256, in a variant that
+	// doesn't interoperate with other implementations. See WithBalloonCost.
+	KDFBalloon KDF = 1
+	// KDFArgon2id is Argon2id. See WithArgon2Cost.
+	KDFArgon2id KDF = 2
+	// KDFScryptParallel splits the scrypt work into p independent lanes,
+	// each scrypt with parallelism one, that run concurrently and are
+	// combined with HMAC-SHA256. The total work matches KDFScrypt with the
+	// same parameters but, on a device with p cores, takes about 1/p of the
+	// time. It derives a different key from KDFScrypt, so both parties must
+	// select it.
+	KDFScryptParallel KDF = 3
+	// KDFHighEntropy skips the expensive KDF, for secrets that are already
+	// uniformly random. See WithHighEntropySecret.
+	KDFHighEntropy KDF = 4
+)
+
+const (
+	// DefaultScryptN, DefaultScryptR and DefaultScryptP are the default
+	// parameters of KDFScrypt.
+	DefaultScryptN = 1 << 16
+	DefaultScryptR = 16
+	DefaultScryptP = 4
+)
+
+const (
+	// DefaultBalloonSpaceCost is the default number of 32-byte blocks (32MiB)
+	// used by KDFBalloon.
+	DefaultBalloonSpaceCost = 1 << 20
+	// DefaultBalloonTimeCost is the default number of rounds used by
+	// KDFBalloon.
+	DefaultBalloonTimeCost = 1
+)
+
+const (
+	// DefaultArgon2Time, DefaultArgon2Memory and DefaultArgon2Threads are
+	// the default number of passes, memory in KiB (64MiB) and parallelism
+	// used by KDFArgon2id.
+	DefaultArgon2Time    = 1
+	DefaultArgon2Memory  = 64 * 1024
+	DefaultArgon2Threads = 4
+)
+
+// parallelScryptSalt prefixes the salt of each lane of KDFScryptParallel.
+const parallelScryptSalt = "PANDA parallel scrypt "
+
+// argon2Salt is used in place of a salt, which the shared secret can't have,
+// to separate PANDA's use of Argon2id from any other.
+const argon2Salt = "PANDA Argon2id"
+
+// WithKDF selects the function used to derive the exchange's key from the
+// secret.
+func WithKDF(kdf KDF) Option {
+	return func(c *config) {
+		c.kdf.kdf = kdf
+	}
+}
+
+// WithScryptCost sets the parameters used by KDFScrypt and KDFScryptParallel.
+// N must be a power of two between 2^10 and 2^22, r between 1 and 32 and p
+// between 1 and 16. The parameters change the derived key, so both parties
+// must agree on them out of band or the exchange will fail as if the secrets
+// differed.
+func WithScryptCost(N, r, p int) Option {
+	return func(c *config) {
+		c.kdf.scryptN = N
+		c.kdf.scryptR = r
+		c.kdf.scryptP = p
+	}
+}
+
+// WithBalloonCost sets the memory, in 32-byte blocks, and number of rounds
+// used by KDFBalloon.
+func WithBalloonCost(spaceCost, timeCost uint32) Option {
+	return func(c *config) {
+		c.kdf.balloonSpaceCost = spaceCost
+		c.kdf.balloonTimeCost = timeCost
+	}
+}
+
+// A KDFParamError is returned when a KDF parameter is out of range.
+type KDFParamError struct {
+	// Param names the parameter, for example "scrypt N".
+	Param string
+	Value int64
+}
+
+func (e *KDFParamError) Error() string {
+	return "panda: " + e.Param + " of " + strconv.FormatInt(e.Value, 10) + " is out of range"
+}
+
+// WithArgon2Cost sets the number of passes, memory in KiB and parallelism used
+// by KDFArgon2id. Memory must be at least 8KiB per thread and no more than
+// 4GiB. As with the other KDFs, both parties must use the same parameters.
+func WithArgon2Cost(time, memory uint32, threads uint8) Option {
+	return func(c *config) {
+		c.kdf.argon2Time = time
+		c.kdf.argon2Memory = memory
+		c.kdf.argon2Threads = threads
+	}
+}
+
+// kdfParams records the KDF used by an exchange and its parameters.
+type kdfParams struct {
+	kdf                               KDF
+	scryptN, scryptR, scryptP         int
+	balloonSpaceCost, balloonTimeCost uint32
+	argon2Time, argon2Memory          uint32
+	argon2Threads                     uint8
+}
+
+func defaultKDFParams() kdfParams {
+	return kdfParams{
+		kdf:              KDFScrypt,
+		scryptN:          DefaultScryptN,
+		scryptR:          DefaultScryptR,
+		scryptP:          DefaultScryptP,
+		balloonSpaceCost: DefaultBalloonSpaceCost,
+		balloonTimeCost:  DefaultBalloonTimeCost,
+		argon2Time:       DefaultArgon2Time,
+		argon2Memory:     DefaultArgon2Memory,
+		argon2Threads:    DefaultArgon2Threads,
+	}
+}
+
+// defaultScrypt returns true if p uses scrypt with the default parameters.
+func (p *kdfParams) defaultScrypt() bool {
+	return p.kdf == KDFScrypt && p.scryptN == DefaultScryptN && p.scryptR == DefaultScryptR && p.scryptP == DefaultScryptP
+}
+
+func (p *kdfParams) validate() error {
+	switch p.kdf {
+	case KDFScrypt, KDFScryptParallel:
+		switch {
+		case p.scryptN < 1<<10 || p.scryptN > 1<<22 || p.scryptN&(p.scryptN-1) != 0:
+			return &KDFParamError{"scrypt N", int64(p.scryptN)}
+		case p.scryptR < 1 || p.scryptR > 32:
+			return &KDFParamError{"scrypt r", int64(p.scryptR)}
+		case p.scryptP < 1 || p.scryptP > 16:
+			return &KDFParamError{"scrypt p", int64(p.scryptP)}
+		}
+	case KDFBalloon:
+		if p.balloonSpaceCost < 2 {
+			return &KDFParamError{"Balloon space cost", int64(p.balloonSpaceCost)}
+		}
+		if p.balloonTimeCost < 1 {
+			return &KDFParamError{"Balloon time cost", int64(p.balloonTimeCost)}
+		}
+	case KDFArgon2id:
+		switch {
+		case p.argon2Time < 1:
+			return &KDFParamError{"Argon2 time", int64(p.argon2Time)}
+		case p.argon2Threads < 1:
+			return &KDFParamError{"Argon2 threads", int64(p.argon2Threads)}
+		case p.argon2Memory < 8*uint32(p.argon2Threads) || p.argon2Memory > 4<<20:
+			return &KDFParamError{"Argon2 memory", int64(p.argon2Memory)}
+		}
+	case KDFHighEntropy:
+	default:
+		return errors.New("panda: unknown KDF")
+	}
+	return nil
+}
+
+// derive computes the exchange key from the secret.
+func (p *kdfParams) derive(secret []byte) ([]byte, error) {
+	return p.deriveCounting(secret, nil)
+}
+
+// deriveCounting is like derive but, for the scrypt KDFs and if done is not
+// nil, adds to *done as the work progresses, up to p.work() in total.
+func (p *kdfParams) deriveCounting(secret []byte, done *int64) ([]byte, error) {
+	switch p.kdf {
+	case KDFBalloon:
+		return balloon(secret, nil, uint64(p.balloonSpaceCost), uint64(p.balloonTimeCost)), nil
+	case KDFArgon2id:
+		return argon2.IDKey(secret, []byte(argon2Salt), p.argon2Time, p.argon2Memory, p.argon2Threads, 32), nil
+	case KDFScryptParallel:
+		return parallelScrypt(secret, p.scryptN, p.scryptR, p.scryptP, done)
+	case KDFHighEntropy:
+		return highEntropyKey(secret), nil
+	}
+
+	if done != nil {
+		return scryptCounting(secret, nil, p.scryptN, p.scryptR, p.scryptP, done), nil
+	}
+	return scrypt.Key(secret, nil, p.scryptN, p.scryptR, p.scryptP, 32)
+}
+
+// work returns the amount of work that deriveCounting counts, or zero if it
+// doesn't count any.
+func (p *kdfParams) work() int64 {
+	switch p.kdf {
+	case KDFScrypt, KDFScryptParallel:
+		return 2 * int64(p.scryptN) * int64(p.scryptP)
+	}
+	return 0
+}
+
+// parallelScrypt runs lanes instances of scrypt concurrently, each with a
+// salt naming its lane, and combines their outputs with HMAC-SHA256. If done
+// is not nil, the lanes count their progress in it.
+func parallelScrypt(secret []byte, N, r, lanes int, done *int64) ([]byte, error) {
+	keys := make([][]byte, lanes)
+	errs := make([]error, lanes)
+	var wg sync.WaitGroup
+	for i := 0; i < lanes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			salt := []byte(parallelScryptSalt + strconv.Itoa(i))
+			if done != nil {
+				keys[i] = scryptCounting(secret, salt, N, r, 1, done)
+				return
+			}
+			keys[i], errs[i] = scrypt.Key(secret, salt, N, r, 1, 32)
+		}(i)
+	}
+	wg.Wait()
+
+	mac := hmac.New(sha256.New, []byte(parallelScryptSalt))
+	for i, key := range keys {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		mac.Write(key)
+		wipe(key)
+	}
+	return mac.Sum(nil), nil
+}
+
+// deriveContext is like deriveKeyWith but returns early if ctx is done. In
+// that case the derivation is left to finish in another goroutine, which
+// wipes the key. deriveContext takes ownership of secret and wipes it once
+// the derivation has finished. If progress is not nil, it's called as the
+// derivation proceeds, but never after deriveContext returns.
+func deriveContext(ctx context.Context, d KeyDeriver, p kdfParams, secret []byte, progress ProgressFunc) (key []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		wipe(secret)
+		return nil, err
+	}
+	var done *int64
+	if progress != nil {
+		var work int64
+		if d == nil {
+			work = p.work()
+		}
+		done = new(int64)
+		stop := reportProgress(progress, done, work)
+		defer func() {
+			stop(err == nil)
+		}()
+	}
+	if ctx.Done() == nil {
+		defer wipe(secret)
+		return deriveKeyWith(d, &p, secret, done)
+	}
+
+	type result struct {
+		key []byte
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		key, err := deriveKeyWith(d, &p, secret, done)
+		wipe(secret)
+		results <- result{key, err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.key, res.err
+	case <-ctx.Done():
+		go func() {
+			wipe((<-results).key)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// wipe zeros b. Keeping b alive until the zeros are written stops the
+// compiler from discarding them as stores to a dead buffer.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// label returns a prefix for the contexts used to derive values from the
+// exchange key so that exchanges with different KDFs never share tags. It is
+// empty for the default so that such exchanges are unchanged.
+func (p *kdfParams) label() string {
+	switch p.kdf {
+	case KDFBalloon:
+		return "balloon "
+	case KDFArgon2id:
+		return "argon2id "
+	case KDFScryptParallel:
+		return "parallel scrypt "
+	case KDFHighEntropy:
+		return "high entropy "
+	}
+	return ""
+}
+
+func (p *kdfParams) marshal(s *stateproto.State) {
+	if p.defaultScrypt() {
+		return
+	}
+	if p.kdf == KDFScrypt {
+		s.ScryptN = proto.Uint32(uint32(p.scryptN))
+		s.ScryptR = proto.Uint32(uint32(p.scryptR))
+		s.ScryptP = proto.Uint32(uint32(p.scryptP))
+		return
+	}
+	kdf := int32(p.kdf)
+	s.Kdf = &kdf
+	switch p.kdf {
+	case KDFScryptParallel:
+		s.ScryptN = proto.Uint32(uint32(p.scryptN))
+		s.ScryptR = proto.Uint32(uint32(p.scryptR))
+		s.ScryptP = proto.Uint32(uint32(p.scryptP))
+	case KDFBalloon:
+		s.BalloonSpaceCost = &p.balloonSpaceCost
+		s.BalloonTimeCost = &p.balloonTimeCost
+	case KDFArgon2id:
+		s.Argon2Time = &p.argon2Time
+		s.Argon2Memory = &p.argon2Memory
+		s.Argon2Threads = proto.Uint32(uint32(p.argon2Threads))
+	}
+}
+
+func (p *kdfParams) unmarshal(s *stateproto.State) {
+	*p = defaultKDFParams()
+	p.kdf = KDF(s.GetKdf())
+	if s.ScryptN != nil {
+		p.scryptN = int(*s.ScryptN)
+		p.scryptR = int(s.GetScryptR())
+		p.scryptP = int(s.GetScryptP())
+	}
+	if s.BalloonSpaceCost != nil {
+		p.balloonSpaceCost = *s.BalloonSpaceCost
+	}
+	if s.BalloonTimeCost != nil {
+		p.balloonTimeCost = *s.BalloonTimeCost
+	}
+	if s.Argon2Time != nil {
+		p.argon2Time = *s.Argon2Time
+		p.argon2Memory = s.GetArgon2Memory()
+		p.argon2Threads = uint8(s.GetArgon2Threads())
+	}
+}
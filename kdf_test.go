@@ -0,0 +1,294 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"code.google.com/p/go.crypto/scrypt"
+)
+
+// balloonVectors were generated by this implementation, not taken from the
+// reference implementation, which computes a different function. See balloon
+// for exactly which construction they pin.
+var balloonVectors = []struct {
+	passwd, salt        string
+	spaceCost, timeCost uint64
+	out                 string
+}{
+	{"hunter42", "examplesalt", 1024, 3, "6263f0f25391832c651377d1f42318860c9a54bd9348d561834704b937bae97b"},
+	{"", "salt", 3, 3, "661cc727fe3a0b39d14e6bb0d34a1d4f08684868d50fb2183cb51afb5be412ef"},
+	{"password", "", 16, 1, "d8ec3095e7fc37aaa1a00612db98a17ca33f6dfe268cca6d0e112495b049b585"},
+}
+
+func TestBalloonVectors(t *testing.T) {
+	for i, v := range balloonVectors {
+		out := hex.EncodeToString(balloon([]byte(v.passwd), []byte(v.salt), v.spaceCost, v.timeCost))
+		if out != v.out {
+			t.Errorf("#%d: got %s, want %s", i, out, v.out)
+		}
+	}
+}
+
+// TestBalloonConstruction spells out the smallest case, two blocks and one
+// round, step by step as documented at balloon.
+func TestBalloonConstruction(t *testing.T) {
+	passwd, salt := []byte("passwd"), []byte("salt")
+	var counter uint64
+	hash := func(inputs ...[]byte) []byte {
+		h := sha256.New()
+		binary.Write(h, binary.LittleEndian, counter)
+		counter++
+		for _, in := range inputs {
+			h.Write(in)
+		}
+		return h.Sum(nil)
+	}
+
+	buf := make([][]byte, 2)
+	buf[0] = hash(passwd, salt)
+	buf[1] = hash(buf[0])
+	for m := uint64(0); m < 2; m++ {
+		buf[m] = hash(buf[(m+1)%2], buf[m])
+		for i := uint64(0); i < balloonDelta; i++ {
+			idxBlock := make([]byte, 24)
+			binary.LittleEndian.PutUint64(idxBlock[8:], m)
+			binary.LittleEndian.PutUint64(idxBlock[16:], i)
+			other := binary.LittleEndian.Uint64(hash(salt, idxBlock)) % 2
+			buf[m] = hash(buf[m], buf[other])
+		}
+	}
+
+	if got := balloon(passwd, salt, 2, 1); !bytes.Equal(got, buf[1]) {
+		t.Errorf("got %x, want %x", got, buf[1])
+	}
+}
+
+func TestBalloonExchange(t *testing.T) {
+	opts := []Option{WithKDF(KDFBalloon), WithBalloonCost(64, 1)}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.kdf != b.kdf {
+		t.Errorf("KDF parameters changed after round trip: got %+v, want %+v", a.kdf, b.kdf)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	if _, err := New(rand.Reader, []byte("foo"), nil, WithKDF(KDFBalloon), WithBalloonCost(0, 1)); err == nil {
+		t.Errorf("zero space cost was accepted")
+	}
+	if _, err := New(rand.Reader, []byte("foo"), nil, WithKDF(KDF(99))); err == nil {
+		t.Errorf("unknown KDF was accepted")
+	}
+}
+
+func TestArgon2Exchange(t *testing.T) {
+	opts := []Option{WithKDF(KDFArgon2id), WithArgon2Cost(2, 256, 2)}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.kdf != b.kdf {
+		t.Errorf("KDF parameters changed after round trip: got %+v, want %+v", a.kdf, b.kdf)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	// Parties that disagree about the cost simply fail to authenticate
+	// each other.
+	c, err := New(rand.Reader, []byte("foo"), []byte("c"), WithKDF(KDFArgon2id), WithArgon2Cost(1, 256, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bBody := b.NextRequest()
+	if _, err := c.Process(bBody); err == nil {
+		t.Errorf("exchanges with different Argon2id costs agreed")
+	}
+
+	for _, cost := range [][3]uint32{{0, 256, 1}, {1, 7, 1}, {1, 15, 2}, {1, 256, 0}, {1, 5 << 20, 1}} {
+		_, err := New(rand.Reader, []byte("foo"), nil, WithKDF(KDFArgon2id), WithArgon2Cost(cost[0], cost[1], uint8(cost[2])))
+		var paramErr *KDFParamError
+		if !errors.As(err, &paramErr) {
+			t.Errorf("%v: got %v, want a KDFParamError", cost, err)
+		}
+	}
+}
+
+func TestScryptCost(t *testing.T) {
+	opts := []Option{WithScryptCost(1<<10, 8, 1)}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.kdf != b.kdf {
+		t.Errorf("KDF parameters changed after round trip: got %+v, want %+v", a.kdf, b.kdf)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	defaultEx, err := New(rand.Reader, []byte("foo"), []byte("b"), WithScryptCost(DefaultScryptN, DefaultScryptR, DefaultScryptP), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := parseState(defaultEx.Marshal(), "default"); s.ScryptN != nil || s.Kdf != nil {
+		t.Errorf("default parameters were recorded in the state")
+	}
+	otherEx, err := New(rand.Reader, []byte("foo"), []byte("b"), WithScryptCost(1<<11, 8, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTag, _ := otherEx.NextRequest()
+	customTag, _ := b.NextRequest()
+	if string(otherTag) == string(customTag) {
+		t.Errorf("different scrypt costs produced the same tag")
+	}
+
+	for _, cost := range [][3]int{{1000, 8, 1}, {1 << 9, 8, 1}, {1 << 23, 8, 1}, {1 << 10, 0, 1}, {1 << 10, 8, 17}} {
+		_, err := New(rand.Reader, []byte("foo"), nil, WithScryptCost(cost[0], cost[1], cost[2]))
+		var paramErr *KDFParamError
+		if !errors.As(err, &paramErr) {
+			t.Errorf("%v: got %v, want a KDFParamError", cost, err)
+		}
+	}
+}
+
+func TestParallelScrypt(t *testing.T) {
+	opts := []Option{WithKDF(KDFScryptParallel), WithScryptCost(1<<10, 8, 4)}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.kdf != b.kdf {
+		t.Errorf("KDF parameters changed after round trip: got %+v, want %+v", a.kdf, b.kdf)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	// The lanes must be combined in order, so the key is the same however
+	// the goroutines are scheduled.
+	p := b.kdf
+	key1, err := p.derive([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, _ := p.derive([]byte("foo"))
+	if string(key1) != string(key2) {
+		t.Errorf("parallel scrypt isn't deterministic")
+	}
+	p.kdf = KDFScrypt
+	if serial, _ := p.derive([]byte("foo")); string(serial) == string(key1) {
+		t.Errorf("parallel and serial scrypt derived the same key")
+	}
+
+	serial, err := New(rand.Reader, []byte("foo"), []byte("c"), WithScryptCost(1<<10, 8, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial = marshalUnmarshal(serial)
+	if serial.kdf.kdf != KDFScrypt {
+		t.Errorf("serial exchange restored with KDF %d", serial.kdf.kdf)
+	}
+	serialTag, serialBody := serial.NextRequest()
+	if bTag, _ := b.NextRequest(); string(serialTag) == string(bTag) {
+		t.Errorf("parallel and serial exchanges share a tag")
+	}
+	if _, err := b.Process(serialBody); err == nil {
+		t.Errorf("parallel exchange accepted a serial exchange's body")
+	}
+}
+
+func TestCrossKDF(t *testing.T) {
+	scryptEx, err := New(rand.Reader, []byte("foo"), nil, WithScryptCost(1<<10, 8, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balloonEx, err := New(rand.Reader, []byte("foo"), nil, WithKDF(KDFBalloon), WithBalloonCost(64, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon2Ex, err := New(rand.Reader, []byte("foo"), nil, WithKDF(KDFArgon2id), WithArgon2Cost(1, 64, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scryptTag, _ := scryptEx.NextRequest()
+	balloonTag, balloonBody := balloonEx.NextRequest()
+	argon2Tag, argon2Body := argon2Ex.NextRequest()
+	if string(scryptTag) == string(balloonTag) {
+		t.Errorf("scrypt and Balloon exchanges share a tag")
+	}
+	if string(scryptTag) == string(argon2Tag) || string(balloonTag) == string(argon2Tag) {
+		t.Errorf("Argon2id exchange shares a tag with another KDF")
+	}
+	if _, err := scryptEx.Process(balloonBody); err == nil {
+		t.Errorf("scrypt exchange accepted a Balloon exchange's body")
+	}
+	if _, err := scryptEx.Process(argon2Body); err == nil {
+		t.Errorf("scrypt exchange accepted an Argon2id exchange's body")
+	}
+}
+
+// The benchmarks below compare the default costs of the KDFs.
+
+func BenchmarkScryptDefault(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		scrypt.Key([]byte("secret"), nil, 1<<16, 16, 4, 32)
+	}
+}
+
+func BenchmarkBalloonDefault(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		balloon([]byte("secret"), nil, DefaultBalloonSpaceCost, DefaultBalloonTimeCost)
+	}
+}
+
+func BenchmarkScryptParallelDefault(b *testing.B) {
+	p := defaultKDFParams()
+	p.kdf = KDFScryptParallel
+	for i := 0; i < b.N; i++ {
+		p.derive([]byte("secret"))
+	}
+}
+
+func BenchmarkArgon2Default(b *testing.B) {
+	p := defaultKDFParams()
+	p.kdf = KDFArgon2id
+	for i := 0; i < b.N; i++ {
+		p.derive([]byte("secret"))
+	}
+}
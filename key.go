@@ -0,0 +1,251 @@
+package panda
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// A Key is the result of the expensive derivation that New performs on the
+// shared secret, along with the options that were used. It allows several
+// exchanges to be created from the same secret at the cost of one
+// derivation. A Key is as sensitive as the secret itself.
+type Key struct {
+	key    [32]byte
+	config config
+}
+
+// PrecomputeKey derives a Key from the secret with the given options. It
+// takes as long as New.
+func PrecomputeKey(secret []byte, opts ...Option) (*Key, error) {
+	config := newConfig(opts)
+	if config.wipeSecret {
+		defer wipe(secret)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return precomputeKey(context.Background(), secret, config)
+}
+
+// kdfInput checks the secret against the policies in c and returns the input
+// to the KDF in a new buffer, which the caller should wipe.
+func (c *config) kdfInput(secret []byte) ([]byte, error) {
+	secret, err := prepareSecret(secret, c.normalizeSecret)
+	if err != nil {
+		return nil, err
+	}
+	if c.normalizeSecret {
+		defer wipe(secret)
+	}
+	if len(c.checksum) > 0 && SecretChecksumDigits(secret, len(c.checksum)) != c.checksum {
+		return nil, ErrSecretChecksum
+	}
+	if err := c.kdf.checkSecret(secret); err != nil {
+		return nil, err
+	}
+	if c.minSecretBits > 0 {
+		if bits, reason := EstimateSecretEntropy(secret); bits < c.minSecretBits {
+			if len(reason) == 0 {
+				reason = "too short"
+			}
+			return nil, &WeakSecretError{bits, reason}
+		}
+	}
+	return scopeSecret(secret, c.appLabel, c.window), nil
+}
+
+func precomputeKey(ctx context.Context, secret []byte, config *config) (*Key, error) {
+	input, err := config.kdfInput(secret)
+	if err != nil {
+		return nil, err
+	}
+	keySlice, err := deriveContext(ctx, config.deriver, config.kdf, input, config.progress)
+	if err != nil {
+		return nil, err
+	}
+	keySlice = applyPepper(keySlice, config.pepper)
+	key := &Key{config: *config}
+	copy(key.key[:], keySlice)
+	wipe(keySlice)
+	return key, nil
+}
+
+// NewFromKey is like New but starts from a Key and so is cheap. The resulting
+// Exchange is indistinguishable from one created by New with the same secret
+// and options.
+func NewFromKey(r io.Reader, key *Key, message []byte) (*Exchange, error) {
+	if err := key.config.checkNew(r, message); err != nil {
+		return nil, err
+	}
+	return key.newExchange(r, message)
+}
+
+// exchange returns an Exchange with this configuration and no key material.
+func (c *config) exchange(message []byte) *Exchange {
+	ex := &Exchange{
+		message:         message,
+		kdf:             c.kdf,
+		suite:           c.suite,
+		serverID:        c.serverID,
+		normalizeSecret: c.normalizeSecret,
+		window:          c.window,
+		appLabel:        c.appLabel,
+		deriver:         c.deriver,
+		pepper:          c.pepper,
+		adHash:          c.adHash,
+	}
+	if c.augmented {
+		ex.role = roleProver
+	}
+	ex.keyConfirmation = c.keyConfirmation
+	ex.hybridKEM = c.hybridKEM
+	ex.fragmentation = c.fragmentation
+	ex.compression = c.compression
+	ex.version = c.version
+	ex.bodySize = c.bodySize
+	ex.peerBodySizes = c.peerBodySizes
+	ex.keyOnly = message == nil && c.version >= ProtocolVersion2
+	ex.skipEntropyCheck = c.skipEntropyCheck
+	// The group was checked by validate, so this is a lookup in the cache.
+	ex.group, _ = c.modpGroup()
+	if ex.group != nil {
+		useCustomGroup(ex.group)
+	}
+	return ex
+}
+
+func (key *Key) newExchange(r io.Reader, message []byte) (*Exchange, error) {
+	ex := key.config.exchange(message)
+	if err := ex.allocKeyMaterial(key.config.lockedMemory); err != nil {
+		return nil, err
+	}
+	ex.key = key.key
+	ex.augmentKey()
+	if err := ex.generateX(r); err != nil {
+		ex.Destroy()
+		return nil, err
+	}
+	return ex, nil
+}
+
+// Wipe zeros the key. The Key must not be used afterwards.
+func (key *Key) Wipe() {
+	key.key = [32]byte{}
+}
+
+// Marshal serializes key. As with Exchange.Marshal, the result is not
+// encrypted. The entropy check setting is not included.
+func (key *Key) Marshal() []byte {
+	// A Key is serialized as a State for an exchange that has no
+	// progress, so that the KDF parameters are recorded in the same way.
+	state := &stateproto.State{
+		Key:         key.key[:],
+		Message:     []byte{},
+		XBytes:      []byte{},
+		PublicBytes: []byte{},
+	}
+	key.config.marshal(state)
+	s, err := proto.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// marshal records the options of c that affect the exchange key in state.
+func (c *config) marshal(state *stateproto.State) {
+	c.kdf.marshal(state)
+	marshalSuite(c.suite, state)
+	if c.customGroup != nil {
+		marshalCustomGroup(c.customGroup.P, c.customGroup.G, c.customGroup.N, state)
+	}
+	marshalVersion(c.version, state)
+	marshalBodySize(c.bodySize, state)
+	marshalPeerBodySizes(c.peerBodySizes, state)
+	if len(c.serverID) > 0 {
+		state.ServerId = proto.String(c.serverID)
+	}
+	if c.normalizeSecret {
+		state.NormalizeSecret = proto.Bool(true)
+	}
+	if len(c.window) > 0 {
+		state.ValidityWindow = proto.String(c.window)
+	}
+	if len(c.appLabel) > 0 {
+		state.AppLabel = proto.String(c.appLabel)
+	}
+	if c.deriver != nil {
+		state.KeyDeriver = proto.String(c.deriver.Name())
+	}
+	if c.pepper != nil {
+		state.PepperHash = c.pepper[:]
+	}
+	if c.adHash != nil {
+		state.AssociatedDataHash = c.adHash[:]
+	}
+	if c.augmented {
+		state.AugmentedRole = proto.Int32(int32(roleProver))
+	}
+	if c.keyConfirmation {
+		state.KeyConfirmation = proto.Bool(true)
+	}
+	if c.hybridKEM {
+		state.HybridKem = proto.Bool(true)
+	}
+	if c.fragmentation {
+		state.Fragmentation = proto.Bool(true)
+	}
+	if c.compression {
+		state.Compression = proto.Bool(true)
+	}
+}
+
+// unmarshal sets the options recorded by marshal and validates them.
+func (c *config) unmarshal(s *stateproto.State) error {
+	c.kdf.unmarshal(s)
+	c.suite = unmarshalSuite(s)
+	c.customGroup = unmarshalCustomGroup(s)
+	c.version = unmarshalVersion(s)
+	c.bodySize = unmarshalBodySize(s)
+	c.peerBodySizes = unmarshalPeerBodySizes(s)
+	c.serverID = s.GetServerId()
+	c.normalizeSecret = s.GetNormalizeSecret()
+	c.window = s.GetValidityWindow()
+	c.appLabel = s.GetAppLabel()
+	c.deriver = lookupKeyDeriver(s.GetKeyDeriver())
+	c.pepper = unmarshalPepper(s)
+	c.adHash = unmarshalAssociatedData(s)
+	c.augmented = s.AugmentedRole != nil
+	c.keyConfirmation = s.GetKeyConfirmation()
+	c.hybridKEM = s.GetHybridKem()
+	c.fragmentation = s.GetFragmentation()
+	c.compression = s.GetCompression()
+	if err := checkCustomGroupAllowed(c.customGroup); err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+// UnmarshalKey creates a Key from the result of calling Marshal.
+func UnmarshalKey(data []byte) (*Key, error) {
+	s, err := parseState(data, "key")
+	if err != nil {
+		return nil, err
+	}
+	if len(s.PublicBytes) > 0 {
+		return nil, errors.New("panda: serialized state is an exchange, not a key")
+	}
+	if augmentedRole(s.GetAugmentedRole()) == roleVerifier {
+		return nil, errors.New("panda: serialized state is a verifier, not a key")
+	}
+	key := new(Key)
+	copy(key.key[:], s.Key)
+	if err := key.config.unmarshal(s); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,58 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestPrecomputeKey(t *testing.T) {
+	opts := []Option{WithKDF(KDFBalloon), WithBalloonCost(64, 1), WithServerBinding("https://example.com")}
+	key, err := PrecomputeKey([]byte("foo"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = UnmarshalKey(key.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := NewFromKey(rand.Reader, key, []byte("first attempt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFromKey(rand.Reader, key, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstTag, firstBody := first.NextRequest()
+	aTag, aBody := a.NextRequest()
+	bTag, _ := b.NextRequest()
+	if !bytes.Equal(aTag, bTag) || !bytes.Equal(firstTag, aTag) {
+		t.Errorf("exchanges from a Key don't match one from New")
+	}
+	if bytes.Equal(firstBody, aBody) {
+		t.Errorf("exchanges from the same Key share a body")
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	if _, err := Unmarshal(key.Marshal()); err == nil {
+		t.Errorf("Unmarshal accepted a Key")
+	}
+	if _, err := UnmarshalKey(a.Marshal()); err == nil {
+		t.Errorf("UnmarshalKey accepted an exchange")
+	}
+
+	key.Wipe()
+	if key.key != [32]byte{} {
+		t.Errorf("Wipe left the key intact")
+	}
+}
@@ -0,0 +1,53 @@
+package panda
+
+// PeerKeyOnly returns true if the peer created its exchange with a nil
+// message, and so is using the exchange only to agree a key, which is then
+// available from DeriveKey. It is known once the first round is over and
+// distinguishes such a peer from one that sent an empty message on purpose,
+// for which the message returned by Process is empty but not nil.
+//
+// A key-only party offers key confirmation and its second round body carries
+// its confirmation value and no message, so that the peer still learns that
+// the key was agreed. The body is padded and sealed like any other, so the
+// meeting place can't tell a key-only exchange from its length. Only protocol
+// version 2 and later
+// say whether a party is key-only, so with version 1 a nil message is sent as
+// an empty one and PeerKeyOnly always returns false. Versions of this package
+// that predate key-only exchanges can't complete them.
+func (ex *Exchange) PeerKeyOnly() bool {
+	return ex.peerKeyOnly
+}
+
+// offersConfirmation returns whether our first round body offers key
+// confirmation, which a key-only party always does.
+func (ex *Exchange) offersConfirmation() bool {
+	return ex.keyConfirmation || ex.keyOnly
+}
+
+// insertsConfirmation returns whether our second round body carries our
+// confirmation value, which it always does if we are key-only. A key-only
+// peer always offers key confirmation, so then it depends only on whether we
+// did.
+func (ex *Exchange) insertsConfirmation() bool {
+	if ex.keyOnly {
+		return true
+	}
+	if ex.peerKeyOnly {
+		return ex.offersConfirmation()
+	}
+	return len(ex.peerConfirmation) > 0
+}
+
+// validReplyLen returns whether n is the length of a reply that we could
+// accept now: a body, which includes tombstones.
+func (ex *Exchange) validReplyLen(n int) bool {
+	return ex.isBodySize(n)
+}
+
+// checkReplyLen returns a *ReplySizeError unless validReplyLen(n).
+func (ex *Exchange) checkReplyLen(n int) error {
+	if ex.validReplyLen(n) {
+		return nil
+	}
+	return &ReplySizeError{Got: n, Want: ex.bodySizesAccepted()}
+}
@@ -0,0 +1,105 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestKeyOnly(t *testing.T) {
+	for _, extra := range [][]Option{nil, {WithHybridKEM(), WithFragmentation()}} {
+		opts := append([]Option{WithProtocolVersion(ProtocolVersion4), fastKDF}, extra...)
+		a, err := New(rand.Reader, []byte("foo"), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+		a, b = marshalUnmarshal(a), marshalUnmarshal(b)
+		if !a.PeerKeyOnly() || !b.PeerKeyOnly() {
+			t.Fatal("parties didn't see that each other is key-only")
+		}
+
+		_, aBody = a.NextRequest()
+		_, bBody = b.NextRequest()
+		if len(aBody) != bodySize {
+			t.Errorf("second round body is %d bytes, want %d", len(aBody), bodySize)
+		}
+		if _, err := a.Process(aBody); err != ErrOwnMessage {
+			t.Errorf("got %v for our own body, want ErrOwnMessage", err)
+		}
+		corrupt := append([]byte(nil), bBody...)
+		corrupt[24] ^= 1
+		if _, err := a.Process(corrupt); err != ErrKeyConfirmationFailed {
+			t.Errorf("got %v for a bad confirmation, want ErrKeyConfirmationFailed", err)
+		}
+		aResult, err := a.ProcessDetailed(bBody)
+		if err != nil || !aResult.Completed || aResult.Message != nil {
+			t.Errorf("got %+v, %v", aResult, err)
+		}
+		if _, err := b.ProcessFrom(bytes.NewReader(aBody)); err != nil || !b.Complete() {
+			t.Errorf("ProcessFrom gave %v", err)
+		}
+		aKey, err := a.DeriveKey("session", 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bKey, err := marshalUnmarshal(b).DeriveKey("session", 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(aKey, bKey) {
+			t.Errorf("parties derived different keys")
+		}
+	}
+}
+
+func TestKeyOnlyWithMessage(t *testing.T) {
+	for _, extra := range [][]Option{nil, {WithKeyConfirmation()}, {WithHybridKEM(), WithKeyConfirmation()}} {
+		opts := append([]Option{WithProtocolVersion(ProtocolVersion2), fastKDF}, extra...)
+		a, err := New(rand.Reader, []byte("foo"), nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte{}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aResult, bResult := runExchange(t, a, b)
+		if aResult == nil || len(aResult) != 0 || a.PeerKeyOnly() {
+			t.Errorf("empty message wasn't received as one")
+		}
+		if bResult != nil || !b.PeerKeyOnly() {
+			t.Errorf("key-only peer wasn't reported as such")
+		}
+		// The meeting place mustn't be able to tell the key-only party
+		// from the length of its body.
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if len(aBody) != bodySize || len(bBody) != len(aBody) {
+			t.Errorf("second round bodies are %d bytes from the key-only party and %d from the other", len(aBody), len(bBody))
+		}
+	}
+
+	// Version 1 can't say that a party is key-only, so a nil message is
+	// sent as an empty one.
+	_, b := newPair(t)
+	a, err := New(rand.Reader, []byte("foo"), nil, fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || bResult == nil || len(bResult) != 0 || b.PeerKeyOnly() {
+		t.Errorf("version 1 exchange with a nil message gave %q and %q", aResult, bResult)
+	}
+}
@@ -0,0 +1,198 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/hkdf"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+const (
+	// ProtocolVersion1 is the original protocol, in which values are
+	// derived from the exchange key with HMAC-SHA256. It is the default.
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 derives every value with HKDF-SHA256, using the
+	// labels listed below, which is simpler to audit and to reimplement.
+	// It is incompatible with version 1 on the wire.
+	ProtocolVersion2 = 2
+	// ProtocolVersion3 is version 2 with the elements that mask SPAKE2
+	// values hashed to the group from the public context of each exchange,
+	// rather than fixed. See maskElementLabel.
+	ProtocolVersion3 = 3
+	// ProtocolVersion4 is version 3 with the length of the contents of each
+	// body recorded in three bytes rather than two, so that messages of up
+	// to MaxMessageLen can be sent. Earlier versions are limited to 65535
+	// bytes.
+	ProtocolVersion4 = 4
+	// ProtocolVersion5 is version 4 with each body padded to the smallest
+	// of the allowed body sizes, up to that given by WithBodySize, that
+	// fits its contents, rather than always to that size.
+	ProtocolVersion5 = 5
+	// ProtocolVersion6 is version 5 with the nonce of each body derived
+	// from labelNonce, the round and the hash of the body, rather than
+	// from the body itself in the context of the tag derivations. See
+	// bodyNonce.
+	ProtocolVersion6 = 6
+)
+
+// WithProtocolVersion selects the key schedule. Both parties must use the
+// same version.
+func WithProtocolVersion(version int) Option {
+	return func(c *config) {
+		c.version = version
+	}
+}
+
+// validateVersion returns an error if version is unknown.
+func validateVersion(version int) error {
+	if version < ProtocolVersion1 || version > ProtocolVersion6 {
+		return errors.New("panda: unknown protocol version")
+	}
+	return nil
+}
+
+// marshalVersion records version in s, unless it's the default.
+func marshalVersion(version int, s *stateproto.State) {
+	if version != ProtocolVersion1 {
+		s.ProtocolVersion = proto.Int32(int32(version))
+	}
+}
+
+// unmarshalVersion returns the version recorded in s.
+func unmarshalVersion(s *stateproto.State) int {
+	if s.ProtocolVersion == nil {
+		return ProtocolVersion1
+	}
+	return int(*s.ProtocolVersion)
+}
+
+// The labels of the values in the version 2 key schedule. The first four are
+// expanded from the exchange key, the rest from the shared key, except for
+// the shared key itself, which is extracted from the SPAKE2 transcript with
+// the exchange key as salt. Each label is preceded, in the HKDF info, by the
+// context prefix of the exchange, which includes the version and suite.
+const (
+	labelRoundOneTag  = "round one tag"
+	labelRoundTwoTag  = "round two tag"
+	labelSpakeMask    = "spake mask"
+	labelBoxRoundOne  = "box key round1"
+	labelSharedKey    = "shared key"
+	labelBoxRoundTwo  = "box key round2"
+	labelConfirmation = "confirmation"
+	labelSAS          = "short authentication string"
+)
+
+// scheduleSalt is the HKDF salt used to extract from the exchange key and the
+// shared key.
+const scheduleSalt = "PANDA key schedule v2"
+
+// hkdfKey returns n bytes of HKDF-SHA256 output.
+func hkdfKey(salt, secret []byte, info string, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// scheduleKey returns n bytes of the value named by label, expanded from
+// secret in the version 2 key schedule.
+func (ex *Exchange) scheduleKey(secret *[32]byte, label string, n int) []byte {
+	return hkdfKey([]byte(scheduleSalt), secret[:], ex.context(label), n)
+}
+
+// roundTag returns the tag for the given round.
+func (ex *Exchange) roundTag(round int) []byte {
+	if ex.version >= ProtocolVersion2 {
+		if round == 1 {
+			return ex.scheduleKey(&ex.key, labelRoundOneTag, 32)
+		}
+		return ex.scheduleKey(&ex.key, labelRoundTwoTag, 32)
+	}
+	if round == 1 {
+		return deriveKey(&ex.key, ex.context("round one tag"))
+	}
+	return deriveKey(&ex.key, ex.context("round two tag"))
+}
+
+// spakeSeed returns the value from which the password scalar or exponent is
+// derived: 32 bytes for the MODP groups or, if wide, 64 bytes to be reduced
+// modulo the order of an elliptic-curve group. The caller should wipe it.
+func (ex *Exchange) spakeSeed(wide bool) []byte {
+	n := 32
+	if wide {
+		n = 64
+	}
+	if ex.version >= ProtocolVersion2 {
+		return ex.scheduleKey(&ex.key, labelSpakeMask, n)
+	}
+	if !wide {
+		return deriveKey(&ex.key, ex.context("spake"))
+	}
+	h := hmac.New(sha512.New, ex.key[:])
+	h.Write([]byte(ex.context("spake")))
+	return h.Sum(nil)
+}
+
+// hashBodies sets bodyHash, in version 2 and later, from our first round
+// body and the peer's, so that the exact bodies exchanged, and not just the
+// SPAKE2 values in them, determine the shared key. The bodies are hashed in
+// sorted order so that both parties get the same result.
+func (ex *Exchange) hashBodies(peerBody []byte) error {
+	if ex.version < ProtocolVersion2 {
+		return nil
+	}
+	ours, err := ex.box(1, ex.roundOneKey(), ex.roundOnePayload())
+	if err != nil {
+		return err
+	}
+	a, b := ours, peerBody
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write(lengthPrefix32(a))
+	h.Write(lengthPrefix32(b))
+	h.Sum(ex.bodyHash[:0])
+	return nil
+}
+
+// lengthPrefix32 returns b preceded by its length as four big-endian bytes.
+func lengthPrefix32(b []byte) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	return append(l[:], b...)
+}
+
+// sharedKeyFrom derives the shared key from the length-prefixed SPAKE2
+// transcript and, in version 2 and later, bodyHash.
+func (ex *Exchange) sharedKeyFrom(transcript []byte) []byte {
+	if ex.version >= ProtocolVersion2 {
+		ikm := append(append([]byte(nil), transcript...), ex.bodyHash[:]...)
+		defer wipe(ikm)
+		return hkdfKey(ex.key[:], ikm, ex.context(labelSharedKey), 32)
+	}
+	h := hmac.New(sha256.New, ex.key[:])
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// roundTwoKey returns the key that seals second round bodies. From version 2,
+// bodyHash is its salt.
+func (ex *Exchange) roundTwoKey() *[32]byte {
+	if ex.version < ProtocolVersion2 {
+		return ex.bindAssociatedData(&ex.sharedKey)
+	}
+	var key [32]byte
+	keySlice := hkdfKey(ex.bodyHash[:], ex.sharedKey[:], ex.context(labelBoxRoundTwo), 32)
+	copy(key[:], keySlice)
+	wipe(keySlice)
+	return ex.bindAssociatedData(&key)
+}
@@ -0,0 +1,123 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestKeyScheduleVectors(t *testing.T) {
+	ex := &Exchange{keyMaterial: new(keyMaterial), suite: SuiteMODP4096, version: ProtocolVersion2, kdf: defaultKDFParams()}
+	for i := range ex.key {
+		ex.key[i] = byte(i)
+		ex.sharedKey[i] = byte(i + 32)
+		ex.bodyHash[i] = byte(i + 64)
+	}
+	for _, test := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{labelRoundOneTag, ex.roundTag(1), "de17f2505efb980fe4ad1889da93a6cf21448f3201f7e84b0cb2c975b942fe0f"},
+		{labelRoundTwoTag, ex.roundTag(2), "1f153d813ddfa7588689308691474cd2bc2df9595dea000c7970bb0a3d4d2518"},
+		{labelSpakeMask, ex.spakeSeed(false), "ac595383c23af8b87779dc528864deab9c78713d51f2f6395eea5f2fc6d41124"},
+		{labelSpakeMask + " (wide)", ex.spakeSeed(true), "ac595383c23af8b87779dc528864deab9c78713d51f2f6395eea5f2fc6d41124541849a26ca9e8d028522ae16b2318e3e2941c621be33c181c15cf73650c0669"},
+		{labelBoxRoundOne, ex.roundOneKey()[:], "e6b1f338b3dc5d7d55b392491dfb09d2eed25eb9ddc4003fc8d1e3f50021b45c"},
+		{labelSharedKey, ex.sharedKeyFrom([]byte("transcript")), "47cf66da915c9652df9b5afc5a75e5fd52433ba23ee9c33aa0adf0529d2462fb"},
+		{labelBoxRoundTwo, ex.roundTwoKey()[:], "8d07acf97a4acee86bfa9c741fb8d419d2e4e17be9171f60f211edad101b17c1"},
+		{labelConfirmation, ex.confirmation([]byte("public")), "165908f863eac75a73aa34ec02c3b9ce6859fb67e9c40a8ebbf1cc3611d6811f"},
+	} {
+		if got := hex.EncodeToString(test.got); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestProtocolVersion2(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255, SuiteP256, SuiteMODP2048} {
+		opts := []Option{WithProtocolVersion(ProtocolVersion2), WithSuite(suite), WithKeyConfirmation(), fastKDF}
+		a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a = marshalUnmarshal(a)
+		if a.version != ProtocolVersion2 {
+			t.Errorf("suite %d: version was lost in serialization", suite)
+		}
+
+		v1, err := New(rand.Reader, []byte("foo"), nil, WithSuite(suite), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aTag, aBody := a.NextRequest()
+		v1Tag, _ := v1.NextRequest()
+		if bytes.Equal(aTag, v1Tag) {
+			t.Errorf("suite %d: versions 1 and 2 share a tag", suite)
+		}
+		if _, err := v1.Process(aBody); err == nil {
+			t.Errorf("suite %d: version 1 exchange accepted a version 2 body", suite)
+		}
+
+		aResult, bResult := runExchange(t, a, b)
+		if string(aResult) != "b" || string(bResult) != "a" {
+			t.Errorf("suite %d: got %q and %q", suite, aResult, bResult)
+		}
+	}
+
+	key, err := PrecomputeKey([]byte("foo"), WithProtocolVersion(ProtocolVersion2), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = UnmarshalKey(key.Marshal()); err != nil || key.config.version != ProtocolVersion2 {
+		t.Errorf("version was lost from a Key: %v", err)
+	}
+	if _, err := New(rand.Reader, []byte("foo"), nil, WithProtocolVersion(7), fastKDF); err == nil {
+		t.Errorf("unknown protocol version was accepted")
+	}
+}
+
+// TestBodyHash checks that, in version 2, the first round bodies themselves
+// are bound into the keys. With AES-GCM, only the first 12 bytes of the
+// 24-byte nonce are used, so a body with a later nonce byte flipped opens to
+// the same public value.
+func TestBodyHash(t *testing.T) {
+	opts := []Option{WithProtocolVersion(ProtocolVersion2), WithSuite(SuiteP256), fastKDF}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	tampered := append([]byte(nil), aBody...)
+	tampered[20] ^= 1
+
+	if _, err := b.Process(tampered); err != nil {
+		t.Fatalf("tampered nonce was rejected in round one: %s", err)
+	}
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if a.bodyHash == b.bodyHash {
+		t.Errorf("altered body gave the same body hash")
+	}
+	b = marshalUnmarshal(b)
+
+	_, aBody = a.NextRequest()
+	_, bBody = b.NextRequest()
+	if _, err := b.Process(aBody); err == nil {
+		t.Errorf("b accepted round two after its round one body was altered")
+	}
+	if _, err := a.Process(bBody); err == nil {
+		t.Errorf("a accepted round two after its round one body was altered")
+	}
+}
@@ -0,0 +1,178 @@
+package panda
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"math/big"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// ErrLockedMemoryUnsupported is returned when locked memory is requested on a
+// platform that can't lock memory into RAM.
+var ErrLockedMemoryUnsupported = errors.New("panda: locked memory is not supported on this platform")
+
+// WithLockedMemory keeps the exchange's secrets, its key, secret exponent and
+// shared key, in memory that is locked into RAM, and so never swapped to
+// disk, and that the garbage collector never copies. The memory is held until
+// Destroy is called. Marshal still works, by copying the secrets out. If the
+// platform lacks mlock or VirtualLock, New fails with
+// ErrLockedMemoryUnsupported. Exchanges restored by Unmarshal can be moved
+// into locked memory with LockMemory.
+func WithLockedMemory() Option {
+	return func(c *config) {
+		c.lockedMemory = true
+	}
+}
+
+// xLen is the length of the secret exponent in the largest MODP group, which
+// is less than its p.
+const xLen = 512
+
+// keyMaterial holds the secrets of an Exchange. It contains no pointers so
+// that it can live outside the Go heap.
+type keyMaterial struct {
+	key       [32]byte
+	sharedKey [32]byte
+	// xBytes is the secret SPAKE2 exponent, big-endian, or for the
+	// elliptic-curve suites the encoded scalar in its first 32 bytes.
+	xBytes [xLen]byte
+	// w1 is the scalar that the party knowing the secret proves knowledge
+	// of in a SPAKE2+ exchange.
+	w1 [scalarLen]byte
+	// kemSeed is the seed of our ML-KEM decapsulation key and kemSecret
+	// the shared secret that we encapsulated to the peer, in hybrid
+	// exchanges. See WithHybridKEM.
+	kemSeed   [mlkem.SeedSize]byte
+	kemSecret [mlkem.SharedKeySize]byte
+	// peerRoundTwoKey is the key that sealed the peer's first fragment. See
+	// WithFragmentation.
+	peerRoundTwoKey [32]byte
+}
+
+// allocKeyMaterial gives ex zeroed key material, in locked memory if locked
+// is true.
+func (ex *Exchange) allocKeyMaterial(locked bool) error {
+	if !locked {
+		ex.keyMaterial = new(keyMaterial)
+		return nil
+	}
+	m, page, err := lockedSlots.alloc()
+	if err != nil {
+		return err
+	}
+	ex.keyMaterial, ex.lockedPage = m, page
+	return nil
+}
+
+// LockMemory moves the secrets of ex into locked memory, as if it had been
+// created with WithLockedMemory, and wipes the previous copy. It does nothing
+// if they're already locked.
+func (ex *Exchange) LockMemory() error {
+	if ex.lockedPage != nil {
+		return nil
+	}
+	m, page, err := lockedSlots.alloc()
+	if err != nil {
+		return err
+	}
+	*m = *ex.keyMaterial
+	*ex.keyMaterial = keyMaterial{}
+	ex.keyMaterial, ex.lockedPage = m, page
+	return nil
+}
+
+// Destroy wipes the secrets of ex and releases any locked memory that holds
+// them. The Exchange must not be used afterwards.
+func (ex *Exchange) Destroy() {
+	if ex.keyMaterial == nil {
+		return
+	}
+	if ex.lockedPage != nil {
+		lockedSlots.free(ex.keyMaterial, ex.lockedPage)
+	} else {
+		*ex.keyMaterial = keyMaterial{}
+	}
+	ex.keyMaterial, ex.lockedPage = nil, nil
+}
+
+// wipeInt zeros the memory that holds n.
+func wipeInt(n *big.Int) {
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
+
+// A lockedPage is a page of locked memory divided into slots for
+// keyMaterial.
+type lockedPage struct {
+	mem  []byte
+	used []bool
+	n    int
+}
+
+// lockedPool allocates keyMaterial from locked pages so that many exchanges
+// can share a page, since the amount of memory that a process may lock is
+// often small.
+type lockedPool struct {
+	sync.Mutex
+	pages []*lockedPage
+}
+
+var lockedSlots lockedPool
+
+const slotSize = int(unsafe.Sizeof(keyMaterial{}))
+
+func (p *lockedPool) alloc() (*keyMaterial, *lockedPage, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, page := range p.pages {
+		for i, used := range page.used {
+			if !used {
+				page.used[i] = true
+				page.n++
+				return (*keyMaterial)(unsafe.Pointer(&page.mem[i*slotSize])), page, nil
+			}
+		}
+	}
+
+	size := os.Getpagesize()
+	for size < slotSize {
+		size *= 2
+	}
+	mem, err := lockMemory(size)
+	if err != nil {
+		return nil, nil, err
+	}
+	page := &lockedPage{mem: mem, used: make([]bool, size/slotSize), n: 1}
+	page.used[0] = true
+	p.pages = append(p.pages, page)
+	return (*keyMaterial)(unsafe.Pointer(&page.mem[0])), page, nil
+}
+
+// free wipes m and returns it to its page, which is unlocked once it's
+// empty.
+func (p *lockedPool) free(m *keyMaterial, page *lockedPage) {
+	*m = keyMaterial{}
+
+	p.Lock()
+	defer p.Unlock()
+
+	i := int(uintptr(unsafe.Pointer(m))-uintptr(unsafe.Pointer(&page.mem[0]))) / slotSize
+	page.used[i] = false
+	page.n--
+	if page.n > 0 {
+		return
+	}
+	for j, other := range p.pages {
+		if other == page {
+			p.pages = append(p.pages[:j], p.pages[j+1:]...)
+			break
+		}
+	}
+	unlockMemory(page.mem)
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package panda
+
+// lockMemory fails because this platform can't lock memory.
+func lockMemory(size int) ([]byte, error) {
+	return nil, ErrLockedMemoryUnsupported
+}
+
+// unlockMemory is never called on this platform.
+func unlockMemory(mem []byte) {}
@@ -0,0 +1,84 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestLockedMemory(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF, WithLockedMemory())
+	if errors.Is(err, ErrLockedMemoryUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.lockedPage == nil {
+		t.Fatal("exchange isn't in locked memory")
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Unmarshal(a.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Destroy()
+	if err := restored.LockMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RederiveSecret(rand.Reader, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if restored.lockedPage == nil {
+		t.Errorf("RederiveSecret moved the exchange out of locked memory")
+	}
+	aResult, bResult := runExchange(t, restored, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+	unmarshaled := marshalUnmarshal(restored)
+	want := restored.Marshal()
+	restored.Destroy()
+	if err := unmarshaled.LockMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unmarshaled.Marshal(), want) {
+		t.Errorf("LockMemory changed the exchange")
+	}
+	unmarshaled.Destroy()
+	b.Destroy()
+
+	// Enough exchanges to fill several pages.
+	exchanges := make([]*Exchange, 3*slotsPerPage())
+	for i := range exchanges {
+		if exchanges[i], err = New(rand.Reader, []byte("foo"), nil, fastKDF, WithLockedMemory()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The other exchanges keep the first one's page mapped.
+	first := exchanges[0].keyMaterial
+	exchanges[0].Destroy()
+	if *first != (keyMaterial{}) {
+		t.Errorf("Destroy didn't wipe the key material")
+	}
+	for _, ex := range exchanges[1:] {
+		ex.Destroy()
+	}
+	if n := len(lockedSlots.pages); n != 0 {
+		t.Errorf("%d pages still locked after every exchange was destroyed", n)
+	}
+}
+
+func slotsPerPage() int {
+	ex, err := New(rand.Reader, []byte("foo"), nil, fastKDF, WithLockedMemory())
+	if err != nil {
+		return 1
+	}
+	defer ex.Destroy()
+	return len(ex.lockedPage.used)
+}
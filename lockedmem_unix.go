@@ -0,0 +1,30 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package panda
+
+import (
+	"errors"
+	"syscall"
+)
+
+// lockMemory returns size bytes of memory, outside the Go heap, that is
+// locked into RAM.
+func lockMemory(size int) ([]byte, error) {
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, errors.New("panda: failed to allocate locked memory: " + err.Error())
+	}
+	if err := syscall.Mlock(mem); err != nil {
+		syscall.Munmap(mem)
+		return nil, errors.New("panda: failed to lock memory: " + err.Error())
+	}
+	return mem, nil
+}
+
+// unlockMemory wipes and releases memory from lockMemory.
+func unlockMemory(mem []byte) {
+	wipe(mem)
+	syscall.Munlock(mem)
+	syscall.Munmap(mem)
+}
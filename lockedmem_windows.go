@@ -0,0 +1,24 @@
+package panda
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// lockMemory returns size bytes of memory that is locked into RAM. The Go
+// garbage collector doesn't move heap objects, so the memory can be
+// allocated normally as long as it's kept reachable until unlockMemory.
+func lockMemory(size int) ([]byte, error) {
+	mem := make([]byte, size)
+	if err := syscall.VirtualLock(uintptr(unsafe.Pointer(&mem[0])), uintptr(size)); err != nil {
+		return nil, errors.New("panda: failed to lock memory: " + err.Error())
+	}
+	return mem, nil
+}
+
+// unlockMemory wipes and releases memory from lockMemory.
+func unlockMemory(mem []byte) {
+	wipe(mem)
+	syscall.VirtualUnlock(uintptr(unsafe.Pointer(&mem[0])), uintptr(len(mem)))
+}
@@ -0,0 +1,98 @@
+package panda
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+	"strconv"
+
+	"github.com/gtank/ristretto255"
+)
+
+// maskElementLabel names, in version 3, the elements that mask SPAKE2 values.
+// Rather than being fixed, they are hashed to the group from the context of
+// the exchange, which holds only public values: the version, the suite and
+// the options that bind the exchange, such as WithContext. Both parties thus
+// compute the same elements without another round trip, and no single
+// element is shared by every user. The hash to the group is hashToGroup for
+// the MODP suites, ristretto255's FromUniformBytes for SuiteRistretto255 and
+// hashToP256 for SuiteP256, each given the output of HKDF-SHA256 with
+// hashToGroupSalt as salt and the context as input. The n given to
+// WithMODPGroup is unused.
+const maskElementLabel = "mask element"
+
+// hashToGroupSalt is the HKDF salt used to hash contexts to group elements.
+const hashToGroupSalt = "PANDA hash to group"
+
+// hashToGroupBytes returns n bytes hashed from label.
+func hashToGroupBytes(label, info string, n int) []byte {
+	return hkdfKey([]byte(hashToGroupSalt), []byte(label), info, n)
+}
+
+// hashToGroup returns the element of the subgroup of order q hashed from
+// label: the square, modulo p, of 128 bits more than the length of p of
+// HKDF output, read as a big-endian number. Since p is a safe prime, every
+// square other than zero and one has order q. It returns an error in the
+// unlikely event that the result is zero or one.
+func (m *modpGroup) hashToGroup(label string) (*big.Int, error) {
+	u := new(big.Int).SetBytes(hashToGroupBytes(label, "modp", m.size+16))
+	n := new(big.Int).Exp(u, big.NewInt(2), m.p)
+	if n.Cmp(big.NewInt(1)) <= 0 || new(big.Int).Exp(n, m.q, m.p).Cmp(big.NewInt(1)) != 0 {
+		return nil, errors.New("panda: mask element is degenerate")
+	}
+	return n, nil
+}
+
+// hashToRistretto returns the ristretto255 element hashed from label.
+func hashToRistretto(label string) *ristretto255.Element {
+	return ristretto255.NewElement().FromUniformBytes(hashToGroupBytes(label, "ristretto255", 64))
+}
+
+// hashToP256 returns the P-256 point hashed from label by try-and-increment:
+// for each counter value, from zero, 48 bytes of HKDF output, with the
+// counter in the info, are reduced modulo the field prime to give an x
+// coordinate. The first that is on the curve gives the point with the even y
+// coordinate. The time taken depends on label, which is public.
+func hashToP256(label string) ecPoint {
+	params := elliptic.P256().Params()
+	three := big.NewInt(3)
+	for counter := 0; ; counter++ {
+		x := new(big.Int).SetBytes(hashToGroupBytes(label, "p256 "+strconv.Itoa(counter), 48))
+		x.Mod(x, params.P)
+		// y² = x³ - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(three, x))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+		y := new(big.Int).ModSqrt(y2, params.P)
+		if y == nil || y.Sign() == 0 {
+			continue
+		}
+		if y.Bit(0) == 1 {
+			y.Sub(params.P, y)
+		}
+		return ecPoint{x, y}
+	}
+}
+
+// maskElement returns the element that masks values in a MODP group.
+func (ex *Exchange) maskElement() (*big.Int, error) {
+	return ex.modp().hashToGroup(ex.context(maskElementLabel))
+}
+
+// ristrettoMask returns the element that masks values in SuiteRistretto255.
+func (ex *Exchange) ristrettoMask() *ristretto255.Element {
+	if ex.version < ProtocolVersion3 {
+		return ristrettoN
+	}
+	return hashToRistretto(ex.context(maskElementLabel))
+}
+
+// p256MaskPoints returns the points M and N, used by SPAKE2+ provers and
+// verifiers respectively, and by both parties in the symmetric protocol.
+func (ex *Exchange) p256MaskPoints() (m, n ecPoint) {
+	if ex.version < ProtocolVersion3 {
+		return p256M, p256N
+	}
+	return hashToP256(ex.context(maskElementLabel + " M")), hashToP256(ex.context(maskElementLabel + " N"))
+}
@@ -0,0 +1,103 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/gtank/ristretto255"
+)
+
+func TestHashToGroupVectors(t *testing.T) {
+	for _, test := range []struct {
+		group *modpGroup
+		want  string
+	}{
+		{modp4096, "27720768df20d6f2e519e73c22054a67e75d66194ea957ab338fd5da6a53e37a"},
+		{modp2048, "43fbd4d9858c27be43144c48a305723bf3bae74382f9eb909b03324e315b0dbc"},
+	} {
+		n, err := test.group.hashToGroup("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Cmp(big.NewInt(1)) <= 0 || n.Cmp(test.group.p) >= 0 || new(big.Int).Exp(n, test.group.q, test.group.p).Cmp(big.NewInt(1)) != 0 {
+			t.Errorf("%d bits: element doesn't have order q", test.group.p.BitLen())
+		}
+		if h := sha256.Sum256(n.Bytes()); hex.EncodeToString(h[:]) != test.want {
+			t.Errorf("%d bits: got element with hash %x", test.group.p.BitLen(), h)
+		}
+	}
+
+	r := hashToRistretto("test")
+	if r.Equal(ristretto255.NewIdentityElement()) == 1 {
+		t.Errorf("ristretto255 element is the identity")
+	}
+	if got := hex.EncodeToString(r.Encode(nil)); got != "766218bb3f863cd0ab25fc5234a2abc11250952861fcf768f1cd42682af82763" {
+		t.Errorf("ristretto255: got %s", got)
+	}
+
+	p := hashToP256("test")
+	if !elliptic.P256().IsOnCurve(p.x, p.y) || p.y.Bit(0) != 0 {
+		t.Errorf("P-256 point isn't on the curve with even y")
+	}
+	if got := hex.EncodeToString(elliptic.MarshalCompressed(elliptic.P256(), p.x, p.y)); got != "023ae0def9745a0e2e2c2b32cc9d872552998286f184e177b428506eab8c40d4b8" {
+		t.Errorf("P-256: got %s", got)
+	}
+}
+
+func TestProtocolVersion3(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255, SuiteP256, SuiteMODP2048} {
+		a, b := newPair(t, WithProtocolVersion(ProtocolVersion3), WithSuite(suite), WithContext("app"))
+		a = marshalUnmarshal(a)
+		aResult, bResult := runExchange(t, a, b)
+		if string(aResult) != "b" || string(bResult) != "a" {
+			t.Errorf("suite %d: got %q and %q", suite, aResult, bResult)
+		}
+
+		v2, _ := newPair(t, WithProtocolVersion(ProtocolVersion2), WithSuite(suite), WithContext("app"))
+		other, _ := newPair(t, WithProtocolVersion(ProtocolVersion3), WithSuite(suite), WithContext("other app"))
+		switch {
+		case suite.isMODP():
+			n, _ := a.maskElement()
+			otherN, _ := other.maskElement()
+			if n.Cmp(a.modp().n) == 0 || n.Cmp(otherN) == 0 {
+				t.Errorf("suite %d: mask element isn't specific to the exchange", suite)
+			}
+		case suite == SuiteRistretto255:
+			if a.ristrettoMask().Equal(v2.ristrettoMask()) == 1 || a.ristrettoMask().Equal(other.ristrettoMask()) == 1 {
+				t.Errorf("suite %d: mask element isn't specific to the exchange", suite)
+			}
+		case suite == SuiteP256:
+			m, n := a.p256MaskPoints()
+			v2M, v2N := v2.p256MaskPoints()
+			_, otherN := other.p256MaskPoints()
+			if m.x.Cmp(n.x) == 0 || n.x.Cmp(v2N.x) == 0 || m.x.Cmp(v2M.x) == 0 || n.x.Cmp(otherN.x) == 0 {
+				t.Errorf("suite %d: mask elements aren't specific to the exchange", suite)
+			}
+		}
+	}
+}
+
+func TestProtocolVersion3Augmented(t *testing.T) {
+	opts := []Option{WithProtocolVersion(ProtocolVersion3), WithSuite(SuiteP256), WithAugmentedPeer(), fastKDF}
+	verifier, err := NewVerifier([]byte("foo"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewFromVerifier(rand.Reader, verifier, []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if !bytes.Equal(aResult, []byte("b")) || !bytes.Equal(bResult, []byte("a")) {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
@@ -0,0 +1,147 @@
+package panda
+
+import (
+	"math/big"
+	"sync/atomic"
+
+	"filippo.io/bigmod"
+	"github.com/agl/panda/groups"
+)
+
+// A modpGroup is a MODP group in which SPAKE2 is performed: p and g define
+// the multiplicative group, q is the order of the subgroup generated by g and
+// n is a verifiably random member of the group. See the groups package.
+// Wherever a value or exponent is secret, arithmetic uses the constant-time
+// bigmod package, since math/big takes time that depends on the values
+// involved.
+type modpGroup struct {
+	p, g, q, n *big.Int
+	// size is the length of p in bytes.
+	size    int
+	modulus *bigmod.Modulus
+	// pMinusTwo is the exponent that inverts elements of the group.
+	pMinusTwo []byte
+	// gBase and nBase exponentiate g, by exponents of the length of p, and
+	// n, by the 32-byte password exponents from spakeSeed.
+	gBase, nBase *fixedBase
+	// tables is set once gBase and nBase may build their tables, which
+	// for a custom group is once New has used it. Until then expG and expN
+	// exponentiate without them.
+	tables atomic.Bool
+	// hash identifies a custom group and label is included in the context
+	// of exchanges in it. See WithMODPGroup.
+	hash  [32]byte
+	label string
+}
+
+var (
+	modp4096 = newMODPGroup(groups.MODP4096()).withTables()
+	modp2048 = newMODPGroup(groups.MODP2048()).withTables()
+)
+
+// withTables allows the fixed-base tables of m to be built and returns m.
+func (m *modpGroup) withTables() *modpGroup {
+	m.tables.Store(true)
+	return m
+}
+
+// expG returns g^exp mod p.
+func (m *modpGroup) expG(exp []byte) *big.Int {
+	if m.tables.Load() {
+		return m.gBase.exp(exp)
+	}
+	return m.exp(m.g, exp)
+}
+
+// expN returns n^exp mod p.
+func (m *modpGroup) expN(exp []byte) *big.Int {
+	if m.tables.Load() {
+		return m.nBase.exp(exp)
+	}
+	return m.exp(m.n, exp)
+}
+
+func newMODPGroup(group *groups.Group) *modpGroup {
+	m := &modpGroup{
+		p:    group.P,
+		g:    group.G,
+		q:    group.Q,
+		n:    group.N,
+		size: (group.P.BitLen() + 7) / 8,
+	}
+	if m.size > xLen {
+		panic("panda: xLen is too small for " + group.Name)
+	}
+	var err error
+	if m.modulus, err = bigmod.NewModulus(group.P.Bytes()); err != nil {
+		panic(err)
+	}
+	m.pMinusTwo = new(big.Int).Sub(group.P, big.NewInt(2)).Bytes()
+	m.gBase = newFixedBase(m, m.g, 8*m.size)
+	m.nBase = newFixedBase(m, m.n, 8*32)
+	return m
+}
+
+// modpFor returns the group of a MODP suite.
+func modpFor(suite Suite) *modpGroup {
+	if suite == SuiteMODP2048 {
+		return modp2048
+	}
+	return modp4096
+}
+
+func (ex *Exchange) modp() *modpGroup {
+	if ex.group != nil {
+		return ex.group
+	}
+	return modpFor(ex.suite)
+}
+
+// secretX returns the secret exponent of a MODP exchange, which is stored
+// right-aligned in xBytes at the length of p.
+func (ex *Exchange) secretX() []byte {
+	return ex.xBytes[xLen-ex.modp().size:]
+}
+
+// toNat converts x, which must be no longer than p, to a bigmod.Nat reduced
+// modulo p.
+func (m *modpGroup) toNat(x *big.Int) *bigmod.Nat {
+	b := make([]byte, m.size)
+	defer wipe(b)
+	n, err := bigmod.NewNat().SetOverflowingBytes(x.FillBytes(b), m.modulus)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// fromNat converts n, and wipes it.
+func (m *modpGroup) fromNat(n *bigmod.Nat) *big.Int {
+	b := n.Bytes(m.modulus)
+	defer wipe(b)
+	limbs := n.Bits()
+	for i := range limbs {
+		limbs[i] = 0
+	}
+	return new(big.Int).SetBytes(b)
+}
+
+// exp returns base^exp mod p in time that depends only on the length of exp.
+func (m *modpGroup) exp(base *big.Int, exp []byte) *big.Int {
+	b := m.toNat(base)
+	defer m.fromNat(b)
+	return m.fromNat(bigmod.NewNat().Exp(b, exp, m.modulus))
+}
+
+// mul returns a·b mod p in constant time.
+func (m *modpGroup) mul(a, b *big.Int) *big.Int {
+	bNat := m.toNat(b)
+	defer m.fromNat(bNat)
+	return m.fromNat(m.toNat(a).Mul(bNat, m.modulus))
+}
+
+// inv returns the inverse of a modulo p in constant time, or zero if a is
+// zero.
+func (m *modpGroup) inv(a *big.Int) *big.Int {
+	return m.exp(a, m.pMinusTwo)
+}
@@ -0,0 +1,159 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExpMod(t *testing.T) {
+	for _, group := range []*modpGroup{modp4096, modp2048} {
+		for i := 0; i < 4; i++ {
+			a, err := rand.Int(rand.Reader, group.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := rand.Int(rand.Reader, group.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp := make([]byte, group.size)
+			rand.Read(exp)
+
+			want := new(big.Int).Exp(a, new(big.Int).SetBytes(exp), group.p)
+			if got := group.exp(a, exp); got.Cmp(want) != 0 {
+				t.Errorf("%d bits: exp differs from big.Int.Exp", group.p.BitLen())
+			}
+			want.Mul(a, b)
+			want.Mod(want, group.p)
+			if got := group.mul(a, b); got.Cmp(want) != 0 {
+				t.Errorf("%d bits: mul differs from big.Int.Mul", group.p.BitLen())
+			}
+			if got := group.mul(a, group.inv(a)); got.Cmp(big.NewInt(1)) != 0 {
+				t.Errorf("%d bits: inv didn't invert", group.p.BitLen())
+			}
+		}
+		if group.inv(new(big.Int)).Sign() != 0 {
+			t.Errorf("%d bits: inv of zero isn't zero", group.p.BitLen())
+		}
+	}
+}
+
+var timingTests = flag.Bool("timing", false, "run tests that measure timing, which are unreliable on loaded machines")
+
+// TestExpModTiming checks that exponents that math/big would handle at very
+// different speeds, one with a single bit set and one with every bit set,
+// take about the same time. Being sensitive to load, it only runs with
+// -timing.
+func TestExpModTiming(t *testing.T) {
+	if !*timingTests {
+		t.Skip("skipping timing test without -timing")
+	}
+	base, err := rand.Int(rand.Reader, modp4096.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	low := make([]byte, xLen)
+	low[xLen-1] = 1
+	high := bytes.Repeat([]byte{0xff}, xLen)
+
+	const runs = 15
+	var lowTimes, highTimes []time.Duration
+	for i := 0; i < runs; i++ {
+		for _, exp := range [][]byte{low, high} {
+			start := time.Now()
+			modp4096.exp(base, exp)
+			d := time.Since(start)
+			if exp[0] == 0 {
+				lowTimes = append(lowTimes, d)
+			} else {
+				highTimes = append(highTimes, d)
+			}
+		}
+	}
+	lowMedian, highMedian := median(lowTimes), median(highTimes)
+	if ratio := float64(highMedian) / float64(lowMedian); ratio < 0.8 || ratio > 1.25 {
+		t.Errorf("exponents are distinguishable: median times %v and %v", lowMedian, highMedian)
+	}
+}
+
+func median(times []time.Duration) time.Duration {
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+func BenchmarkExpMod(b *testing.B) {
+	exp := make([]byte, xLen)
+	rand.Read(exp)
+	for i := 0; i < b.N; i++ {
+		modp4096.exp(modp4096.g, exp)
+	}
+}
+
+func BenchmarkExpBig(b *testing.B) {
+	exp := make([]byte, xLen)
+	rand.Read(exp)
+	e := new(big.Int).SetBytes(exp)
+	for i := 0; i < b.N; i++ {
+		new(big.Int).Exp(modp4096.g, e, modp4096.p)
+	}
+}
+
+func TestFixedBase(t *testing.T) {
+	for _, group := range []*modpGroup{modp4096, modp2048} {
+		for _, f := range []*fixedBase{group.gBase, group.nBase} {
+			for _, n := range []int{f.bits / 8, 1, f.bits/8 + 1} {
+				exp := make([]byte, n)
+				rand.Read(exp)
+				want := new(big.Int).Exp(f.base, new(big.Int).SetBytes(exp), group.p)
+				if got := f.exp(exp); got.Cmp(want) != 0 {
+					t.Errorf("%d bits: %d-byte exponent differs from big.Int.Exp", group.p.BitLen(), n)
+				}
+			}
+			zero := make([]byte, f.bits/8)
+			if got := f.exp(zero); got.Cmp(big.NewInt(1)) != 0 {
+				t.Errorf("%d bits: zero exponent gave %s", group.p.BitLen(), got)
+			}
+		}
+	}
+}
+
+func BenchmarkFixedBaseG(b *testing.B) {
+	exp := make([]byte, modp4096.size)
+	rand.Read(exp)
+	modp4096.gBase.exp(exp)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		modp4096.gBase.exp(exp)
+	}
+}
+
+func BenchmarkExpModG(b *testing.B) {
+	exp := make([]byte, modp4096.size)
+	rand.Read(exp)
+	for i := 0; i < b.N; i++ {
+		modp4096.exp(modp4096.g, exp)
+	}
+}
+
+func BenchmarkFixedBaseN(b *testing.B) {
+	exp := make([]byte, 32)
+	rand.Read(exp)
+	modp4096.nBase.exp(exp)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		modp4096.nBase.exp(exp)
+	}
+}
+
+func BenchmarkExpModN(b *testing.B) {
+	exp := make([]byte, 32)
+	rand.Read(exp)
+	for i := 0; i < b.N; i++ {
+		modp4096.exp(modp4096.n, exp)
+	}
+}
@@ -0,0 +1,362 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+)
+
+// MaxMessages is the largest number of messages that can be passed to
+// NewMulti.
+const MaxMessages = 16
+
+// MaxMessageID is the largest ID of a message passed to NewMulti.
+const MaxMessageID = 255
+
+// ErrMultipleMessagesUnsupported is returned by Process when one party was
+// created by NewMulti and the other wasn't.
+var ErrMultipleMessagesUnsupported = errors.New("panda: only one party sends multiple messages")
+
+// senderMarkerLen is the length of the marker that begins each message body
+// in exchanges of several messages: a prefix of the hash of the sender's
+// public value. Both directions use the same key for each ID, so the marker
+// is what tells a party's own body from the peer's, even if their messages
+// are the same.
+const senderMarkerLen = 16
+
+// labelMessageKey names the key that seals the body of each message. It is
+// followed by a space and the ID of the message and expanded from the second
+// round box key.
+const labelMessageKey = "message key"
+
+// A MessageRequest is a tag and body to be exchanged with the meeting place,
+// like those returned by NextRequest, for the message with the given ID.
+type MessageRequest struct {
+	ID        int
+	Tag, Body []byte
+}
+
+// NewMulti is like New but sends several messages, each with an ID between
+// zero and MaxMessageID, which must be one of the peer's IDs or known to it
+// from the application. Each is delivered in the second round under a tag of
+// its own. The peer must be created by NewMulti too, and the IDs of each
+// party's messages are sent to the other in the first round. In the second
+// round NextRequest returns the body for the lowest ID, of either party,
+// that hasn't been received yet, and MessageRequests returns them all, to
+// be posted at once. The messages may be received in any order and Process
+// returns each as it arrives, with its ID in the Result. The exchange is
+// complete once a body has been received for every ID of either party,
+// which, as in the single-message exchange, means that the peer will be
+// able to complete too. PeerMessages returns the messages received so far.
+//
+// Each message is limited to 16 bytes less than MaxMessageLenFor. It
+// requires protocol version 2 or later and can't be combined with key
+// confirmation, hybrid protection, fragmentation or compression, which all
+// change the second round body that it replaces.
+func NewMulti(r io.Reader, secret []byte, messages map[int][]byte, opts ...Option) (*Exchange, error) {
+	c := newConfig(opts)
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.checkMulti(messages); err != nil {
+		return nil, err
+	}
+	ex, err := New(r, secret, []byte{}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ex.messages = make(map[int][]byte, len(messages))
+	for id, message := range messages {
+		ex.messages[id] = message
+	}
+	return ex, nil
+}
+
+// checkMulti checks messages, which are to be passed to NewMulti, against
+// the configuration.
+func (c *config) checkMulti(messages map[int][]byte) error {
+	if c.version < ProtocolVersion2 {
+		return errors.New("panda: multiple messages require protocol version 2 or later")
+	}
+	if c.keyConfirmation || c.hybridKEM || c.fragmentation || c.compression {
+		return errors.New("panda: multiple messages can't be combined with key confirmation, hybrid protection, fragmentation or compression")
+	}
+	if len(messages) == 0 || len(messages) > MaxMessages {
+		return errors.New("panda: invalid number of messages")
+	}
+	limit := maxMessageLenWith(c.version, c.bodySize, false, false) - senderMarkerLen
+	for id, message := range messages {
+		if id < 0 || id > MaxMessageID {
+			return errors.New("panda: invalid message ID")
+		}
+		if len(message) > limit {
+			return errors.New("panda: message too large")
+		}
+	}
+	return nil
+}
+
+// multi returns whether both parties sent multiple messages, which is known
+// once the first round is over.
+func (ex *Exchange) multi() bool {
+	return len(ex.peerMessageIDs) > 0
+}
+
+// checkPeerMessageIDs returns an error unless both parties, or neither, send
+// multiple messages.
+func (ex *Exchange) checkPeerMessageIDs(peerIDs []int) error {
+	if (len(ex.messages) > 0) != (len(peerIDs) > 0) {
+		return ErrMultipleMessagesUnsupported
+	}
+	return nil
+}
+
+// messageIDs returns the IDs of our messages in increasing order.
+func (ex *Exchange) messageIDs() []int {
+	ids := make([]int, 0, len(ex.messages))
+	for id := range ex.messages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// allMessageIDs returns the IDs of the messages of both parties in
+// increasing order.
+func (ex *Exchange) allMessageIDs() []int {
+	ids := ex.messageIDs()
+	for _, id := range ex.peerMessageIDs {
+		if _, ok := ex.messages[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// peerSends returns whether the peer declared a message with the given ID.
+func (ex *Exchange) peerSends(id int) bool {
+	for _, peerID := range ex.peerMessageIDs {
+		if peerID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// senderMarker returns the marker that begins our message bodies.
+func (ex *Exchange) senderMarker() []byte {
+	h := sha256.Sum256(ex.public)
+	return h[:senderMarkerLen]
+}
+
+// messageTag returns the tag of the message with the given ID.
+func (ex *Exchange) messageTag(id int) []byte {
+	return ex.scheduleKey(&ex.key, labelRoundTwoTag+" "+strconv.Itoa(id), 32)
+}
+
+// messageKey returns the key that seals the message with the given ID in
+// either direction.
+func (ex *Exchange) messageKey(id int) *[32]byte {
+	var key [32]byte
+	keySlice := ex.scheduleKey(ex.roundTwoKey(), labelMessageKey+" "+strconv.Itoa(id), 32)
+	copy(key[:], keySlice)
+	wipe(keySlice)
+	return &key
+}
+
+// messageBody returns our body for the message with the given ID, which is
+// empty if we have no message with that ID.
+func (ex *Exchange) messageBody(id int) ([]byte, error) {
+	payload := append(ex.senderMarker(), ex.messages[id]...)
+	return ex.box(2, ex.messageKey(id), payload)
+}
+
+// MessageRequests returns the tags and bodies of the messages of an exchange
+// created by NewMulti, including empty bodies for the IDs of the peer's
+// messages, so that the meeting place returns them. It returns nil until the
+// first round is over.
+func (ex *Exchange) MessageRequests() ([]MessageRequest, error) {
+	if !ex.multi() {
+		return nil, nil
+	}
+	var requests []MessageRequest
+	for _, id := range ex.allMessageIDs() {
+		body, err := ex.messageBody(id)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, MessageRequest{ID: id, Tag: ex.messageTag(id), Body: body})
+	}
+	return requests, nil
+}
+
+// nextMessageRequest returns the second round request of an exchange of
+// several messages: that for the lowest ID whose body hasn't been received,
+// or, once all have, the highest.
+func (ex *Exchange) nextMessageRequest() (tag, body []byte, err error) {
+	ids := ex.allMessageIDs()
+	id := ids[len(ids)-1]
+	for _, candidate := range ids {
+		if _, ok := ex.receivedMessages[candidate]; !ok {
+			id = candidate
+			break
+		}
+	}
+	if body, err = ex.messageBody(id); err != nil {
+		return nil, nil, err
+	}
+	return ex.messageTag(id), body, nil
+}
+
+// processMessage processes a second round reply in an exchange of several
+// messages. Bodies may arrive in any order and duplicates are ignored.
+func (ex *Exchange) processMessage(reply []byte) (Result, error) {
+	if ex.complete {
+		return Result{}, ErrComplete
+	}
+	var lastErr error
+	for _, id := range ex.allMessageIDs() {
+		payload, err := unbox(ex.suite, ex.version, ex.messageKey(id), reply)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(payload) < senderMarkerLen {
+			return Result{}, errors.New("panda: corrupt but authentic message found")
+		}
+		if bytes.Equal(payload[:senderMarkerLen], ex.senderMarker()) {
+			return Result{}, ErrOwnMessage
+		}
+		result := Result{RoundConsumed: 2, MessageID: id}
+		if _, ok := ex.receivedMessages[id]; ok {
+			return result, nil
+		}
+		message := payload[senderMarkerLen:]
+		if ex.receivedMessages == nil {
+			ex.receivedMessages = make(map[int][]byte)
+		}
+		ex.receivedMessages[id] = message
+		if ex.peerSends(id) {
+			result.Message = message
+		}
+		if len(ex.receivedMessages) == len(ex.allMessageIDs()) {
+			ex.complete = true
+			ex.peerMessageHash = hashMessages(ex.PeerMessages())
+			result.Completed = true
+		}
+		return result, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("panda: failed to authenticate reply from server")
+	}
+	return Result{}, lastErr
+}
+
+// PeerMessages returns the peer's messages, by ID, received so far in an
+// exchange created by NewMulti.
+func (ex *Exchange) PeerMessages() map[int][]byte {
+	messages := make(map[int][]byte)
+	for id, message := range ex.receivedMessages {
+		if ex.peerSends(id) {
+			messages[id] = message
+		}
+	}
+	return messages
+}
+
+// OutstandingMessageIDs returns, in increasing order, the IDs of either
+// party's messages whose bodies haven't yet been received from the peer in
+// an exchange created by NewMulti. It returns nil until the first round is
+// over.
+func (ex *Exchange) OutstandingMessageIDs() []int {
+	var ids []int
+	for _, id := range ex.allMessageIDs() {
+		if _, ok := ex.receivedMessages[id]; !ok && ex.multi() {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// hashMessages returns the hash of a set of messages, which takes the place
+// of the hash of the message in exchanges of several messages.
+func hashMessages(messages map[int][]byte) [32]byte {
+	ids := make([]int, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte{byte(id)})
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(messages[id]))))
+		h.Write(messages[id])
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// marshalItems returns messages in ID order so that the serialized state is
+// deterministic.
+func marshalItems(messages map[int][]byte) []*stateproto.State_Item {
+	ids := make([]int, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var items []*stateproto.State_Item
+	for _, id := range ids {
+		// Data is required, so a nil message is recorded as empty.
+		items = append(items, &stateproto.State_Item{
+			Id:   proto.Uint32(uint32(id)),
+			Data: append([]byte{}, messages[id]...),
+		})
+	}
+	return items
+}
+
+// unmarshalItems returns the messages recorded by marshalItems.
+func unmarshalItems(items []*stateproto.State_Item) (map[int][]byte, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	messages := make(map[int][]byte)
+	for _, item := range items {
+		id := int(item.GetId())
+		if _, ok := messages[id]; ok || id > MaxMessageID {
+			return nil, errors.New("panda: serialized state is corrupt: bad message")
+		}
+		messages[id] = item.GetData()
+	}
+	return messages, nil
+}
+
+// unmarshalMulti returns our messages, the IDs of the peer's and those
+// received so far, recorded in s.
+func unmarshalMulti(s *stateproto.State) (messages map[int][]byte, peerIDs []int, received map[int][]byte, err error) {
+	if messages, err = unmarshalItems(s.Messages); err != nil {
+		return nil, nil, nil, err
+	}
+	if received, err = unmarshalItems(s.ReceivedMessages); err != nil {
+		return nil, nil, nil, err
+	}
+	for i, id := range s.PeerMessageIds {
+		if id > MaxMessageID || i > 0 && id <= s.PeerMessageIds[i-1] {
+			return nil, nil, nil, errors.New("panda: serialized state is corrupt: bad message ID")
+		}
+		peerIDs = append(peerIDs, int(id))
+	}
+	if len(peerIDs) > 0 && len(messages) == 0 || len(received) > 0 && len(peerIDs) == 0 {
+		return nil, nil, nil, errors.New("panda: serialized state is corrupt: bad messages")
+	}
+	return messages, peerIDs, received, nil
+}
@@ -0,0 +1,199 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+)
+
+func newMultiPair(t *testing.T, aMessages, bMessages map[int][]byte, opts ...Option) (a, b *Exchange) {
+	opts = append([]Option{WithProtocolVersion(ProtocolVersion2), fastKDF}, opts...)
+	a, err := NewMulti(rand.Reader, []byte("foo"), aMessages, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = NewMulti(rand.Reader, []byte("foo"), bMessages, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// runMultiExchange runs a and b to completion via a test server, one
+// NextRequest at a time, marshaling them after every step.
+func runMultiExchange(t *testing.T, a, b *Exchange) (*Exchange, *Exchange) {
+	server := &Server{make(map[string]*pair)}
+	parties := []*Exchange{a, b}
+	for i := 0; !parties[0].Complete() || !parties[1].Complete(); i++ {
+		if i > 40 {
+			t.Fatal("exchange did not complete")
+		}
+		for j, ex := range parties {
+			if ex.Complete() {
+				continue
+			}
+			tag, body := ex.NextRequest()
+			if reply := server.Transact(tag, body); len(reply) > 0 {
+				if _, err := ex.ProcessDetailed(reply); err != nil {
+					t.Fatalf("error from party %d: %s", j, err)
+				}
+			}
+			parties[j] = marshalUnmarshal(ex)
+		}
+	}
+	return parties[0], parties[1]
+}
+
+func TestMulti(t *testing.T) {
+	aMessages := map[int][]byte{1: []byte("a1"), 3: []byte("same"), 7: {}}
+	bMessages := map[int][]byte{2: []byte("b2"), 3: []byte("same")}
+	for _, opts := range [][]Option{nil, {WithProtocolVersion(ProtocolVersion5)}, {WithAssociatedData([]byte("ad"))}} {
+		a, b := newMultiPair(t, aMessages, bMessages, opts...)
+		a, b = runMultiExchange(t, a, b)
+		if got := a.PeerMessages(); !reflect.DeepEqual(got, bMessages) {
+			t.Errorf("a received %v, want %v", got, bMessages)
+		}
+		if got := b.PeerMessages(); !reflect.DeepEqual(got, aMessages) {
+			t.Errorf("b received %v, want %v", got, aMessages)
+		}
+		if ids := a.OutstandingMessageIDs(); len(ids) != 0 {
+			t.Errorf("a has outstanding IDs %v", ids)
+		}
+
+		_, aAck, err := a.Acknowledgment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, bAck, err := b.Acknowledgment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.ProcessAcknowledgment(bAck); err != nil {
+			t.Errorf("a rejected b's acknowledgment: %v", err)
+		}
+		if err := b.ProcessAcknowledgment(aAck); err != nil {
+			t.Errorf("b rejected a's acknowledgment: %v", err)
+		}
+	}
+}
+
+func TestMultiParallel(t *testing.T) {
+	a, b := newMultiPair(t, map[int][]byte{0: []byte("a0"), 5: []byte("a5")}, map[int][]byte{5: []byte("b5"), 9: []byte("b9")})
+	if requests, err := a.MessageRequests(); requests != nil || err != nil {
+		t.Error("MessageRequests returned requests in the first round")
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+	if ids := a.OutstandingMessageIDs(); !reflect.DeepEqual(ids, []int{0, 5, 9}) {
+		t.Errorf("a has outstanding IDs %v", ids)
+	}
+
+	aRequests, err := a.MessageRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bRequests, err := b.MessageRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aRequests) != 3 || len(bRequests) != 3 {
+		t.Fatalf("got %d and %d requests, want 3", len(aRequests), len(bRequests))
+	}
+	tags := make(map[string]bool)
+	for i, request := range aRequests {
+		if !bytes.Equal(request.Tag, bRequests[i].Tag) || request.ID != bRequests[i].ID {
+			t.Fatalf("request %d differs between the parties", i)
+		}
+		tags[string(request.Tag)] = true
+		if _, err := a.Process(request.Body); err != ErrOwnMessage {
+			t.Errorf("got %v for our own body, want ErrOwnMessage", err)
+		}
+	}
+	if len(tags) != 3 {
+		t.Error("messages share tags")
+	}
+
+	// Deliver b's bodies in reverse order.
+	for i := len(bRequests) - 1; i >= 0; i-- {
+		result, err := a.ProcessDetailed(bRequests[i].Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.MessageID != bRequests[i].ID || result.Completed != (i == 0) {
+			t.Errorf("got %+v for message %d", result, bRequests[i].ID)
+		}
+		if wantMessage := i > 0; (result.Message != nil) != wantMessage {
+			t.Errorf("message %d: got message %q", bRequests[i].ID, result.Message)
+		}
+		if i == 2 {
+			if result, err := a.ProcessDetailed(bRequests[i].Body); err != nil || result.Message != nil {
+				t.Errorf("duplicate gave %+v, %v", result, err)
+			}
+		}
+	}
+	if !a.Complete() {
+		t.Fatal("a didn't complete")
+	}
+	if _, err := a.Process(bRequests[0].Body); err != ErrComplete {
+		t.Errorf("got %v after completion, want ErrComplete", err)
+	}
+	if got := a.PeerMessages(); !bytes.Equal(got[5], []byte("b5")) || !bytes.Equal(got[9], []byte("b9")) || len(got) != 2 {
+		t.Errorf("a received %v", got)
+	}
+}
+
+func TestMultiMismatch(t *testing.T) {
+	opts := []Option{WithProtocolVersion(ProtocolVersion2), fastKDF}
+	a, err := NewMulti(rand.Reader, []byte("foo"), map[int][]byte{1: []byte("a")}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != ErrMultipleMessagesUnsupported {
+		t.Errorf("got %v from NewMulti party, want ErrMultipleMessagesUnsupported", err)
+	}
+	if _, err := b.Process(aBody); err != ErrMultipleMessagesUnsupported {
+		t.Errorf("got %v from New party, want ErrMultipleMessagesUnsupported", err)
+	}
+}
+
+func TestMultiLimits(t *testing.T) {
+	tooMany := make(map[int][]byte)
+	for i := 0; i <= MaxMessages; i++ {
+		tooMany[i] = nil
+	}
+	limit := maxMessageLenWith(ProtocolVersion2, bodySize, false, false) - senderMarkerLen
+	for i, test := range []struct {
+		messages map[int][]byte
+		opts     []Option
+	}{
+		{messages: nil},
+		{messages: tooMany},
+		{messages: map[int][]byte{-1: nil}},
+		{messages: map[int][]byte{MaxMessageID + 1: nil}},
+		{messages: map[int][]byte{0: make([]byte, limit+1)}},
+		{messages: map[int][]byte{0: nil}, opts: []Option{WithProtocolVersion(ProtocolVersion1)}},
+		{messages: map[int][]byte{0: nil}, opts: []Option{WithKeyConfirmation()}},
+		{messages: map[int][]byte{0: nil}, opts: []Option{WithCompression()}},
+	} {
+		opts := append([]Option{WithProtocolVersion(ProtocolVersion2), fastKDF}, test.opts...)
+		if _, err := NewMulti(rand.Reader, []byte("foo"), test.messages, opts...); err == nil {
+			t.Errorf("#%d: NewMulti succeeded", i)
+		}
+	}
+	if _, err := NewMulti(rand.Reader, []byte("foo"), map[int][]byte{MaxMessageID: make([]byte, limit)}, WithProtocolVersion(ProtocolVersion2), fastKDF); err != nil {
+		t.Errorf("NewMulti failed with the largest message: %v", err)
+	}
+}
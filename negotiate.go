@@ -0,0 +1,226 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"errors"
+)
+
+// ErrUnsupportedVersion is returned by Process when the header of the peer's
+// first round body names a protocol version that this package doesn't
+// implement.
+var ErrUnsupportedVersion = errors.New("panda: peer uses an unsupported protocol version")
+
+var (
+	errMalformedHeader = errors.New("panda: malformed header in first round body")
+	errHeaderMismatch  = errors.New("panda: peer's protocol version or suite differs from ours")
+)
+
+// roundOneMagic begins the header of first round bodies from version 2.
+// Earlier bodies hold a bare public value, which can't begin with it: MODP
+// values are minimal big-endian numbers, which never begin with zero, and
+// P-256 points begin with two or three. A ristretto255 value may begin with
+// zero, but it is always 32 bytes long, so a header is never looked for in
+// a payload of the length of a bare value. See hasRoundOneHeader.
+const roundOneMagic = "\x00PANDA/"
+
+// The types of extensions in the first round header.
+const (
+	// extKeyConfirmation, which is empty, offers key confirmation. It
+	// replaces keyConfirmationMarker.
+	extKeyConfirmation = 1
+	// extHybridKEM, and the extensions that follow it, up to
+	// extHybridKEM+kemKeyExts-1, hold our ML-KEM-768 encapsulation key, in
+	// parts of at most 255 bytes, and offer hybrid protection of the
+	// second round. See WithHybridKEM.
+	extHybridKEM = 2
+	// extFragmentation, which is empty, offers fragmentation. See
+	// WithFragmentation.
+	extFragmentation = extHybridKEM + kemKeyExts
+	// extKeyOnly, which is empty, says that we have no message to send.
+	// See Exchange.PeerKeyOnly.
+	extKeyOnly = extFragmentation + 1
+	// extCompression, which is empty, offers compression. See
+	// WithCompression.
+	extCompression = extKeyOnly + 1
+	// extMessageIDs holds the IDs of our messages, a byte each in
+	// increasing order. See NewMulti.
+	extMessageIDs = extCompression + 1
+)
+
+// kemKeyExts is the number of extensions that hold an encapsulation key.
+const kemKeyExts = (mlkem.EncapsulationKeySize768 + 254) / 255
+
+// roundOne is the content of the peer's first round body.
+type roundOne struct {
+	public []byte
+	// confirms is true if the peer offered key confirmation.
+	confirms bool
+	// kemKey is the peer's ML-KEM encapsulation key, if it offered hybrid
+	// protection.
+	kemKey []byte
+	// fragments is true if the peer offered fragmentation.
+	fragments bool
+	// keyOnly is true if the peer has no message to send.
+	keyOnly bool
+	// compresses is true if the peer offered compression.
+	compresses bool
+	// messageIDs are the IDs of the peer's messages, if it sends several.
+	messageIDs []int
+}
+
+// roundOneHeader returns the header of our first round body, which precedes
+// the public value: the magic, the protocol version and the suite, in a byte
+// each, and the length of the extensions, in two bytes, followed by the
+// extensions, each a type byte, a length byte and a value.
+func (ex *Exchange) roundOneHeader() []byte {
+	var exts []byte
+	if ex.offersConfirmation() {
+		exts = append(exts, extKeyConfirmation, 0)
+	}
+	if ex.hybridKEM {
+		kemKey := ex.kemKey().EncapsulationKey().Bytes()
+		for i := 0; i < kemKeyExts; i++ {
+			part := kemKey[i*255 : min((i+1)*255, len(kemKey))]
+			exts = append(exts, byte(extHybridKEM+i), byte(len(part)))
+			exts = append(exts, part...)
+		}
+	}
+	if ex.fragmentation {
+		exts = append(exts, extFragmentation, 0)
+	}
+	if ex.keyOnly {
+		exts = append(exts, extKeyOnly, 0)
+	}
+	if ex.compression {
+		exts = append(exts, extCompression, 0)
+	}
+	if len(ex.messages) > 0 {
+		exts = append(exts, extMessageIDs, byte(len(ex.messages)))
+		for _, id := range ex.messageIDs() {
+			exts = append(exts, byte(id))
+		}
+	}
+	header := append([]byte(roundOneMagic), byte(ex.version), byte(ex.suite), byte(len(exts)>>8), byte(len(exts)))
+	return append(header, exts...)
+}
+
+// roundOnePayload returns the plaintext of our first round body. From version
+// 2 it begins with a header, which the body hash binds into the shared key
+// along with the rest of the body. Version 1 bodies have no header, so that
+// they stay compatible with earlier versions of this package.
+func (ex *Exchange) roundOnePayload() []byte {
+	if ex.version >= ProtocolVersion2 {
+		return append(ex.roundOneHeader(), ex.public...)
+	}
+	if !ex.keyConfirmation {
+		return ex.public
+	}
+	return append(append([]byte(nil), ex.public...), keyConfirmationMarker...)
+}
+
+// hasRoundOneHeader returns whether payload, the plaintext of the peer's
+// first round body, begins with a header.
+func (ex *Exchange) hasRoundOneHeader(payload []byte) bool {
+	if !bytes.HasPrefix(payload, []byte(roundOneMagic)) {
+		return false
+	}
+	if ex.suite.isMODP() {
+		return true
+	}
+	// Public values in the other suites have a fixed length.
+	n := len(ex.public)
+	return len(payload) != n && len(payload) != n+len(keyConfirmationMarker)
+}
+
+// splitRoundOne separates the peer's public value from the plaintext of its
+// first round body and reports which options it offered. A header, if
+// present, must be well formed and name our version and suite. Unknown
+// extensions are ignored, so that later versions can add them.
+func (ex *Exchange) splitRoundOne(payload []byte) (peer roundOne, err error) {
+	if !ex.hasRoundOneHeader(payload) {
+		if bytes.HasSuffix(payload, []byte(keyConfirmationMarker)) {
+			return roundOne{public: payload[:len(payload)-len(keyConfirmationMarker)], confirms: true}, nil
+		}
+		return roundOne{public: payload}, nil
+	}
+
+	rest := payload[len(roundOneMagic):]
+	if len(rest) < 4 {
+		return roundOne{}, errMalformedHeader
+	}
+	version, suite, extsLen := int(rest[0]), Suite(rest[1]), int(rest[2])<<8|int(rest[3])
+	if validateVersion(version) != nil {
+		return roundOne{}, ErrUnsupportedVersion
+	}
+	if version != ex.version || suite != ex.suite {
+		return roundOne{}, errHeaderMismatch
+	}
+	rest = rest[4:]
+	if len(rest) < extsLen {
+		return roundOne{}, errMalformedHeader
+	}
+	exts, public := rest[:extsLen], rest[extsLen:]
+
+	var seen [256]bool
+	var kemKeyParts [kemKeyExts][]byte
+	for len(exts) > 0 {
+		if len(exts) < 2 || len(exts) < 2+int(exts[1]) {
+			return roundOne{}, errMalformedHeader
+		}
+		extType, value := exts[0], exts[2:2+int(exts[1])]
+		if seen[extType] {
+			return roundOne{}, errMalformedHeader
+		}
+		seen[extType] = true
+		switch {
+		case extType == extKeyConfirmation:
+			if len(value) != 0 {
+				return roundOne{}, errMalformedHeader
+			}
+			peer.confirms = true
+		case extType >= extHybridKEM && extType < extHybridKEM+kemKeyExts:
+			kemKeyParts[extType-extHybridKEM] = value
+		case extType == extFragmentation:
+			if len(value) != 0 {
+				return roundOne{}, errMalformedHeader
+			}
+			peer.fragments = true
+		case extType == extKeyOnly:
+			if len(value) != 0 {
+				return roundOne{}, errMalformedHeader
+			}
+			peer.keyOnly = true
+		case extType == extCompression:
+			if len(value) != 0 {
+				return roundOne{}, errMalformedHeader
+			}
+			peer.compresses = true
+		case extType == extMessageIDs:
+			if len(value) == 0 || len(value) > MaxMessages {
+				return roundOne{}, errMalformedHeader
+			}
+			for i, id := range value {
+				if i > 0 && id <= value[i-1] {
+					return roundOne{}, errMalformedHeader
+				}
+				peer.messageIDs = append(peer.messageIDs, int(id))
+			}
+		}
+		exts = exts[2+len(value):]
+	}
+	if len(public) == 0 {
+		return roundOne{}, errMalformedHeader
+	}
+	peer.public = public
+
+	if seen[extHybridKEM] {
+		for _, part := range kemKeyParts {
+			peer.kemKey = append(peer.kemKey, part...)
+		}
+		if len(peer.kemKey) != mlkem.EncapsulationKeySize768 {
+			return roundOne{}, errMalformedHeader
+		}
+	}
+	return peer, nil
+}
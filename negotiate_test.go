@@ -0,0 +1,108 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func newPair(t *testing.T, opts ...Option) (a, b *Exchange) {
+	opts = append(opts, fastKDF)
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func header(version int, suite Suite, exts ...byte) []byte {
+	h := append([]byte(roundOneMagic), byte(version), byte(suite), byte(len(exts)>>8), byte(len(exts)))
+	return append(h, exts...)
+}
+
+func TestRoundOneHeader(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255, SuiteP256, SuiteMODP2048} {
+		a, b := newPair(t, WithProtocolVersion(ProtocolVersion2), WithSuite(suite), WithKeyConfirmation())
+		payload := a.roundOnePayload()
+		want := append(header(ProtocolVersion2, suite, extKeyConfirmation, 0), a.public...)
+		if !bytes.Equal(payload, want) {
+			t.Errorf("suite %d: got payload %x", suite, payload)
+		}
+		peer, err := b.splitRoundOne(payload)
+		if err != nil || !bytes.Equal(peer.public, a.public) || !peer.confirms {
+			t.Errorf("suite %d: header didn't round trip: %v", suite, err)
+		}
+
+		v1, _ := newPair(t, WithSuite(suite))
+		if bytes.HasPrefix(v1.roundOnePayload(), []byte(roundOneMagic)) {
+			t.Errorf("suite %d: version 1 payload has a header", suite)
+		}
+	}
+}
+
+func TestLegacyRoundOne(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255, SuiteP256, SuiteMODP2048} {
+		for _, confirm := range []bool{false, true} {
+			a, b := newPair(t, WithProtocolVersion(ProtocolVersion2), WithSuite(suite))
+			payload := b.public
+			if confirm {
+				payload = append(append([]byte(nil), payload...), keyConfirmationMarker...)
+			}
+			peer, err := a.splitRoundOne(payload)
+			if err != nil || !bytes.Equal(peer.public, b.public) || peer.confirms != confirm {
+				t.Errorf("suite %d: bare value wasn't accepted: %v", suite, err)
+			}
+			if _, err := a.Process(mustPadAndBox(t, suite, a.version, a.roundOneKey(), 1, payload)); err != nil {
+				t.Errorf("suite %d: bare value wasn't accepted by Process: %s", suite, err)
+			}
+		}
+	}
+
+	// A ristretto255 value that happens to begin with the magic is still
+	// taken as a bare value.
+	a, _ := newPair(t, WithSuite(SuiteRistretto255))
+	for _, n := range []int{scalarLen, scalarLen + len(keyConfirmationMarker)} {
+		payload := make([]byte, n)
+		copy(payload, roundOneMagic)
+		if a.hasRoundOneHeader(payload) {
+			t.Errorf("%d-byte value beginning with the magic was taken as a header", n)
+		}
+	}
+}
+
+func TestBadRoundOneHeader(t *testing.T) {
+	a, b := newPair(t, WithProtocolVersion(ProtocolVersion2))
+	for _, test := range []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"unknown version", append(header(9, SuiteMODP4096), b.public...), ErrUnsupportedVersion},
+		{"downgraded version", append(header(ProtocolVersion1, SuiteMODP4096), b.public...), errHeaderMismatch},
+		{"other suite", append(header(ProtocolVersion2, SuiteMODP2048), b.public...), errHeaderMismatch},
+		{"truncated", []byte(roundOneMagic + "\x02\x01\x00"), errMalformedHeader},
+		{"overlong extensions", []byte(roundOneMagic + "\x02\x01\x00\xc8\x01\x00"), errMalformedHeader},
+		{"truncated extension", header(ProtocolVersion2, SuiteMODP4096, 200, 3, 1), errMalformedHeader},
+		{"repeated extension", append(header(ProtocolVersion2, SuiteMODP4096, extKeyConfirmation, 0, extKeyConfirmation, 0), b.public...), errMalformedHeader},
+		{"confirmation with a value", append(header(ProtocolVersion2, SuiteMODP4096, extKeyConfirmation, 1, 0), b.public...), errMalformedHeader},
+		{"no public value", header(ProtocolVersion2, SuiteMODP4096), errMalformedHeader},
+	} {
+		if _, err := a.splitRoundOne(test.payload); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if _, err := a.Process(mustPadAndBox(t, a.suite, a.version, a.roundOneKey(), 1, append(header(9, SuiteMODP4096), b.public...))); err != ErrUnsupportedVersion {
+		t.Errorf("Process returned %v for an unknown version", err)
+	}
+
+	// Unknown extensions are ignored.
+	payload := append(header(ProtocolVersion2, SuiteMODP4096, 200, 3, 1, 2, 3), b.public...)
+	if peer, err := a.splitRoundOne(payload); err != nil || !bytes.Equal(peer.public, b.public) {
+		t.Errorf("unknown extension wasn't ignored: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package panda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// labelNonce begins the input from which the nonce of each body is derived
+// from version 6. It is distinct from the contexts of every other derivation.
+const labelNonce = "PANDA v6 nonce\x00"
+
+// roundAck is the round passed to padAndBox for acknowledgments, which are
+// sent after the second round.
+const roundAck = 3
+
+// bodyNonce returns the nonce that seals body with key in the given round.
+// It is a function of its inputs so that sealing the same body twice, as
+// happens when NextRequest is called again after a restart, gives the same
+// result. From version 6 it is the HMAC, keyed with key, of labelNonce, the
+// round and the hash of body. Earlier versions use the HMAC of the body
+// itself followed by key, which shares its form with the context-based
+// derivations of version 1 and so is kept only for compatibility. Either
+// way the body is only ever written to the HMAC as bytes.
+func bodyNonce(version int, key *[32]byte, round int, body []byte) *[24]byte {
+	h := hmac.New(sha256.New, key[:])
+	if version >= ProtocolVersion6 {
+		bodyHash := sha256.Sum256(body)
+		h.Write([]byte(labelNonce))
+		h.Write([]byte{byte(round)})
+		h.Write(bodyHash[:])
+	} else {
+		h.Write(body)
+		h.Write(key[:])
+	}
+	sum := h.Sum(nil)
+	var nonce [24]byte
+	copy(nonce[:], sum)
+	wipe(sum)
+	return &nonce
+}
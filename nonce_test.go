@@ -0,0 +1,85 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestBodyNonce(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "nonce test key, 32 bytes long...")
+	body := []byte("body")
+
+	// Versions before 6 keep the original derivation, so that bodies
+	// sealed by exchanges restored from state don't change.
+	old := deriveKey(&key, string(body))
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion5} {
+		if nonce := bodyNonce(version, &key, 2, body); !bytes.Equal(nonce[:], old[:24]) {
+			t.Errorf("version %d nonce changed", version)
+		}
+	}
+
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion6} {
+		for _, suite := range []Suite{SuiteMODP4096, SuiteP256} {
+			a := mustPadAndBox(t, suite, version, &key, 1, body)
+			if b := mustPadAndBox(t, suite, version, &key, 1, body); !bytes.Equal(a, b) {
+				t.Errorf("version %d, suite %d: sealing is not deterministic", version, suite)
+			}
+			if opened, err := unbox(suite, version, &key, a); err != nil || !bytes.Equal(opened, body) {
+				t.Errorf("version %d, suite %d: box didn't open: %v", version, suite, err)
+			}
+		}
+	}
+
+	nonce := bodyNonce(ProtocolVersion6, &key, 1, body)
+	if bytes.Equal(nonce[:], old[:24]) {
+		t.Error("version 6 nonce uses the original derivation")
+	}
+	if other := bodyNonce(ProtocolVersion6, &key, 2, body); *other == *nonce {
+		t.Error("version 6 nonce doesn't depend on the round")
+	}
+	if other := bodyNonce(ProtocolVersion6, &key, 1, []byte("other")); *other == *nonce {
+		t.Error("version 6 nonce doesn't depend on the body")
+	}
+}
+
+func TestProtocolVersion6(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithKeyConfirmation()}, {WithFragmentation()}} {
+		a, b := newPair(t, append([]Option{WithProtocolVersion(ProtocolVersion6)}, opts...)...)
+		if aResult, bResult := runExchange(t, a, b); string(aResult) != "b" || string(bResult) != "a" {
+			t.Errorf("got %q and %q", aResult, bResult)
+		}
+	}
+
+	// Bodies are the same after a restart, in either version.
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion6} {
+		a, b := newPair(t, WithProtocolVersion(version))
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+		_, before := a.NextRequest()
+		if _, after := marshalUnmarshal(a).NextRequest(); !bytes.Equal(before, after) {
+			t.Errorf("version %d: second round body changed after a restart", version)
+		}
+	}
+
+	// A version 6 party refuses a version 5 peer.
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithProtocolVersion(ProtocolVersion6), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithProtocolVersion(ProtocolVersion5), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err == nil {
+		t.Error("version 6 party accepted a version 5 body")
+	}
+}
@@ -0,0 +1,56 @@
+package panda
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"code.google.com/p/go.text/cases"
+	"code.google.com/p/go.text/unicode/norm"
+)
+
+// quoteReplacer maps typographic quotes, which some keyboards substitute
+// automatically, to their ASCII equivalents.
+var quoteReplacer = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "‛", "'",
+	"“", "\"", "”", "\"", "„", "\"", "‟", "\"",
+)
+
+// NormalizeSecret returns the canonical form of a textual secret so that the
+// same phrase typed on different devices produces the same bytes. The secret
+// must be UTF-8. It is converted to NFKC, case-folded, and typographic quotes
+// are replaced with ASCII ones. Leading and trailing whitespace is removed
+// and internal runs of whitespace become a single space.
+func NormalizeSecret(secret []byte) ([]byte, error) {
+	if !utf8.Valid(secret) {
+		return nil, errors.New("panda: secret to be normalized isn't UTF-8")
+	}
+	s := norm.NFKC.String(string(secret))
+	// Case folding can produce denormalized text, so NFKC is applied
+	// again afterwards.
+	s = norm.NFKC.String(cases.Fold().String(s))
+	s = quoteReplacer.Replace(s)
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) == 0 {
+		return nil, errors.New("panda: secret is empty after normalization")
+	}
+	return []byte(s), nil
+}
+
+// WithSecretNormalization applies NormalizeSecret to the secret before it's
+// used. This changes the derived key, so both parties must select it or
+// neither. The setting is recorded in serialized state and applies to any
+// later call to RederiveSecret.
+func WithSecretNormalization() Option {
+	return func(c *config) {
+		c.normalizeSecret = true
+	}
+}
+
+// prepareSecret returns the secret that is passed to the KDF.
+func prepareSecret(secret []byte, normalize bool) ([]byte, error) {
+	if !normalize {
+		return secret, nil
+	}
+	return NormalizeSecret(secret)
+}
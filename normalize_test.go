@@ -0,0 +1,117 @@
+package panda
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+var normalizeTests = []struct {
+	in, out string
+}{
+	{"café 1234", "café 1234"},
+	// Combining acute accent (NFD) and precomposed é (NFC).
+	{"café 1234", "café 1234"},
+	{"  Café\t\n 1234  ", "café 1234"},
+	// Full-width letters, digits and ideographic space.
+	{"ＣＡＦÉ　１２３４", "café 1234"},
+	{"Straße", "strasse"},
+	{"it’s “here”", "it's \"here\""},
+	{"ΣΊΣΥΦΟΣ", "σίσυφοσ"},
+	{"Привет  МИР", "привет мир"},
+	{"日本語　の　秘密", "日本語 の 秘密"},
+	// Half-width katakana become full-width.
+	{"ｶﾀｶﾅ", "カタカナ"},
+	// Compatibility characters such as ligatures and superscripts.
+	{"ﬁle²", "file2"},
+	{"가", "가"},
+	{"가", "가"},
+}
+
+func TestNormalizeSecret(t *testing.T) {
+	for _, test := range normalizeTests {
+		out, err := NormalizeSecret([]byte(test.in))
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if string(out) != test.out {
+			t.Errorf("%q: got %q, want %q", test.in, out, test.out)
+		}
+		// Normalization must be idempotent.
+		if again, _ := NormalizeSecret(out); string(again) != string(out) {
+			t.Errorf("%q: normalizing again gave %q", out, again)
+		}
+	}
+
+	for _, in := range []string{"", " \t ", "\xff\xfe"} {
+		if _, err := NormalizeSecret([]byte(in)); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestSecretNormalizationExchange(t *testing.T) {
+	a, err := New(rand.Reader, []byte("Café  1234"), []byte("a"), WithSecretNormalization(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("café 1234 "), []byte("b"), WithSecretNormalization(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if !a.normalizeSecret {
+		t.Errorf("normalization setting lost in round trip")
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	// Without normalization the secrets differ.
+	c, err := New(rand.Reader, []byte("Café  1234"), nil, fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(rand.Reader, []byte("café 1234 "), nil, fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cTag, _ := c.NextRequest()
+	if dTag, _ := d.NextRequest(); string(cTag) == string(dTag) {
+		t.Errorf("unnormalized secrets produced the same tag")
+	}
+
+	// A restored exchange normalizes the secret passed to RederiveSecret.
+	if err := a.RederiveSecret(rand.Reader, []byte("NEW secret")); err == nil {
+		t.Errorf("completed exchange accepted a new secret")
+	}
+	e, err := New(rand.Reader, []byte("old"), []byte("e"), WithSecretNormalization(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = marshalUnmarshal(e)
+	if err := e.RederiveSecret(rand.Reader, []byte(" NEW   secret")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(rand.Reader, []byte("new secret"), nil, WithSecretNormalization(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eTag, _ := e.NextRequest()
+	if fTag, _ := f.NextRequest(); string(eTag) != string(fTag) {
+		t.Errorf("RederiveSecret didn't normalize the secret")
+	}
+
+	key, err := PrecomputeKey([]byte("ＫＥＹ"), WithSecretNormalization(), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = UnmarshalKey(key.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.config.normalizeSecret {
+		t.Errorf("normalization setting lost from Key in round trip")
+	}
+}
@@ -0,0 +1,255 @@
+package panda
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"github.com/agl/panda/groups"
+)
+
+// An Option configures an Exchange created by New.
+type Option func(*config)
+
+// config holds the settings that may be changed by Options.
+type config struct {
+	// skipEntropyCheck disables the sanity checks on the random source
+	// passed to New.
+	skipEntropyCheck bool
+	// kdf selects the function used to derive the exchange key.
+	kdf kdfParams
+	// serverID, if not empty, binds the exchange to a meeting place.
+	serverID string
+	// normalizeSecret is true if the secret is passed through
+	// NormalizeSecret.
+	normalizeSecret bool
+	// minSecretBits, if not zero, is the least estimated entropy accepted
+	// in a secret.
+	minSecretBits float64
+	// window, if not empty, is the validity window that the exchange is
+	// scoped to.
+	window string
+	// deriver, if not nil, replaces the KDF.
+	deriver KeyDeriver
+	// checksum, if not empty, is the expected SecretChecksumDigits of the
+	// secret.
+	checksum string
+	// pepper, if not nil, is the hash of a value mixed into the key after
+	// the KDF. emptyPepper is true if the pepper was empty.
+	pepper      *[32]byte
+	emptyPepper bool
+	// adHash, if not nil, is the hash of the associated data bound to the
+	// box keys. See WithAssociatedData.
+	adHash *[32]byte
+	// progress, if not nil, is called as the KDF runs.
+	progress ProgressFunc
+	// wipeSecret is true if the caller's secret is zeroed once the key is
+	// derived.
+	wipeSecret bool
+	// lockedMemory is true if exchanges keep their secrets in locked
+	// memory.
+	lockedMemory bool
+	// suite is the group used for SPAKE2.
+	suite Suite
+	// augmented is true if the peer holds only a verifier. See
+	// WithAugmentedPeer.
+	augmented bool
+	// keyConfirmation is true if explicit key confirmation is offered to
+	// the peer.
+	keyConfirmation bool
+	// hybridKEM is true if ML-KEM protection of the second round is
+	// offered to the peer.
+	hybridKEM bool
+	// fragmentation is true if fragmentation of large messages is
+	// offered to the peer.
+	fragmentation bool
+	// compression is true if compression of messages is offered to the
+	// peer.
+	compression bool
+	// version selects the key schedule.
+	version int
+	// bodySize is the size to which bodies are padded.
+	bodySize int
+	// peerBodySizes are the other sizes that the peer may pad its bodies
+	// to. See WithPeerBodySizes.
+	peerBodySizes []int
+	// appLabel, if not empty, is the application that the exchange is
+	// bound to.
+	appLabel string
+	// customGroup, if not nil, holds the parameters of the group that
+	// replaces that of a MODP suite. See WithMODPGroup.
+	customGroup *groups.Group
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		kdf:      defaultKDFParams(),
+		suite:    SuiteMODP4096,
+		version:  ProtocolVersion1,
+		bodySize: bodySize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// validate checks that the options are consistent and in range.
+func (c *config) validate() error {
+	if c.emptyPepper {
+		return errors.New("panda: pepper is empty")
+	}
+	if err := validateSuite(c.suite); err != nil {
+		return err
+	}
+	if err := validateVersion(c.version); err != nil {
+		return err
+	}
+	if err := validateBodySize(c.bodySize); err != nil {
+		return err
+	}
+	if err := validatePeerBodySizes(c.peerBodySizes, c.fragmentation); err != nil {
+		return err
+	}
+	if c.augmented && c.suite != SuiteP256 {
+		return errors.New("panda: augmented exchanges require SuiteP256")
+	}
+	if c.hybridKEM && c.version < ProtocolVersion2 {
+		return errors.New("panda: hybrid exchanges require protocol version 2 or later")
+	}
+	if c.fragmentation && c.version < ProtocolVersion2 {
+		return errors.New("panda: fragmentation requires protocol version 2 or later")
+	}
+	if c.compression && c.version < ProtocolVersion2 {
+		return errors.New("panda: compression requires protocol version 2 or later")
+	}
+	if _, err := c.modpGroup(); err != nil {
+		return err
+	}
+	return c.kdf.validate()
+}
+
+// checkNew performs the checks that precede creating an Exchange with this
+// configuration.
+func (c *config) checkNew(r io.Reader, message []byte) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if len(message) > c.maxMessageLen() && !c.fitsCompressed(message) {
+		return errors.New("panda: message too large")
+	}
+	if !c.skipEntropyCheck {
+		return checkEntropy(r)
+	}
+	return nil
+}
+
+// maxMessageLen returns the largest message that can be sent by an Exchange
+// with this configuration, however incompressible.
+func (c *config) maxMessageLen() int {
+	return maxMessageLenOffered(c.version, c.bodySize, c.keyConfirmation, c.hybridKEM, c.fragmentation, c.compression)
+}
+
+// maxMessageLenOffered returns the largest message that can be sent, however
+// incompressible, by an Exchange that offers the given options.
+func maxMessageLenOffered(version, size int, keyConfirmation, hybridKEM, fragmentation, compression bool) int {
+	n := maxMessageLenWith(version, size, keyConfirmation, hybridKEM)
+	if fragmentation {
+		n = maxFragmentedLen(n, version, size)
+	}
+	if compression {
+		// The flag byte.
+		n--
+	}
+	return n
+}
+
+// maxMessageLenWith returns the largest message that fits in a second round
+// body of the given version and size alongside the values inserted by key
+// confirmation and hybrid exchanges, if offered.
+func maxMessageLenWith(version, size int, keyConfirmation, hybridKEM bool) int {
+	n := size - 24 /* nonce */ - secretbox.Overhead - lengthFieldLen(version)
+	if keyConfirmation {
+		n -= confirmationLen
+	}
+	if hybridKEM {
+		n -= mlkem.CiphertextSize768
+	}
+	if version < ProtocolVersion4 {
+		return min(n, maxLegacyMessageLen)
+	}
+	return n
+}
+
+// MaxMessageLenFor returns the largest message that can be passed to New
+// along with the given options, which depends on the body size and protocol
+// version. MaxMessageLen is the value for the default body size with
+// ProtocolVersion4. With WithCompression, longer messages are accepted if
+// they compress to fit.
+func MaxMessageLenFor(opts ...Option) (int, error) {
+	c := newConfig(opts)
+	if err := c.validate(); err != nil {
+		return 0, err
+	}
+	return c.maxMessageLen(), nil
+}
+
+// InsecureSkipEntropyCheck disables the checks that New performs on random
+// sources other than crypto/rand, so that none of the source's output is
+// consumed by them. The setting is recorded in serialized state and applies
+// to RederiveSecret too. It's intended for tests that need deterministic
+// output and must never be used with a weak source in practice.
+func InsecureSkipEntropyCheck() Option {
+	return func(c *config) {
+		c.skipEntropyCheck = true
+	}
+}
+
+// WithSecretWiping zeros the caller's secret once New, NewContext,
+// PrecomputeKey, StartDerivation or WindowTags has finished with it, whether
+// or not they succeed. The package keeps no reference to the secret, so
+// without this option a caller can instead wipe it as soon as the call
+// returns. Neither helps with copies held elsewhere, such as in strings.
+func WithSecretWiping() Option {
+	return func(c *config) {
+		c.wipeSecret = true
+	}
+}
+
+// WithServerBinding binds the exchange to the meeting place identified by
+// serverID, which is mixed into the derivation of tags and keys. Bodies posted
+// by an exchange bound to one server are then meaningless on any other. Both
+// parties must use the same identifier, for example by using ServerIDFromURL
+// on an agreed URL.
+func WithServerBinding(serverID string) Option {
+	return func(c *config) {
+		c.serverID = serverID
+	}
+}
+
+// ServerIDFromURL returns a canonical server identifier, for use with
+// WithServerBinding, from the base URL of an HTTP meeting place. The scheme
+// and host are lower-cased, default ports and trailing slashes are removed,
+// and any query or fragment is rejected.
+func ServerIDFromURL(baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("panda: server URL must be http or https")
+	}
+	if len(u.Host) == 0 || u.User != nil || len(u.RawQuery) > 0 || len(u.Fragment) > 0 {
+		return "", errors.New("panda: server URL must contain only a host and path")
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if scheme == "http" && strings.HasSuffix(host, ":80") || scheme == "https" && strings.HasSuffix(host, ":443") {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	return scheme + "://" + host + strings.TrimRight(u.Path, "/"), nil
+}
@@ -0,0 +1,147 @@
+package panda
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"math/big"
+)
+
+// gcmNonceSize is the length of the AES-GCM nonce, which is taken from the
+// start of the 24-byte nonce that precedes each box.
+const gcmNonceSize = 12
+
+// newGCM returns AES-256-GCM keyed with key, which seals the bodies of
+// exchanges in SuiteP256.
+func newGCM(key *[32]byte) cipher.AEAD {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// p256M and p256N are the points of RFC 9382, section 6, for P-256. The
+// parties in PANDA have no roles, so both mask their public values with N,
+// as in the symmetric variant of SPAKE2. In SPAKE2+ exchanges the party that
+// knows the secret uses M instead.
+var p256M, p256N = p256Point("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f"),
+	p256Point("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+
+type ecPoint struct {
+	x, y *big.Int
+}
+
+func p256Point(h string) ecPoint {
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		panic(err)
+	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), b)
+	if x == nil {
+		panic("panda: invalid P-256 point")
+	}
+	return ecPoint{x, y}
+}
+
+// p256Scalar returns a scalar derived from the exchange key with the given
+// label. The caller should wipe it with wipeInt.
+func (ex *Exchange) p256Scalar(label string) *big.Int {
+	h := hmac.New(sha512.New, ex.key[:])
+	h.Write([]byte(ex.context(label)))
+	sum := h.Sum(nil)
+	return p256Reduce(sum)
+}
+
+// p256Reduce returns seed reduced modulo the order of the curve, and wipes
+// seed.
+func p256Reduce(seed []byte) *big.Int {
+	defer wipe(seed)
+	w := new(big.Int).SetBytes(seed)
+	return w.Mod(w, elliptic.P256().Params().N)
+}
+
+// p256Mask returns w·p, where w is the password scalar.
+func (ex *Exchange) p256Mask(p ecPoint) ecPoint {
+	w := p256Reduce(ex.spakeSeed(true))
+	defer wipeInt(w)
+	wBytes := make([]byte, scalarLen)
+	defer wipe(wBytes)
+	w.FillBytes(wBytes)
+	x, y := elliptic.P256().ScalarMult(p.x, p.y, wBytes)
+	return ecPoint{x, y}
+}
+
+// p256Masks returns the points that mask our public value and the peer's.
+func (ex *Exchange) p256Masks() (ours, theirs ecPoint) {
+	m, n := ex.p256MaskPoints()
+	switch ex.role {
+	case roleProver:
+		return m, n
+	case roleVerifier:
+		return n, m
+	}
+	return n, n
+}
+
+// generateP256 picks a new secret scalar and computes the corresponding
+// public SPAKE2 value.
+func (ex *Exchange) generateP256(r io.Reader) error {
+	curve := elliptic.P256()
+	nMinusOne := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	x, err := rand.Int(r, nMinusOne)
+	if err != nil {
+		return err
+	}
+	x.Add(x, big.NewInt(1))
+	x.FillBytes(ex.xBytes[:scalarLen])
+	wipeInt(x)
+
+	Xx, Xy := curve.ScalarBaseMult(ex.xBytes[:scalarLen])
+	ours, _ := ex.p256Masks()
+	mask := ex.p256Mask(ours)
+	Xx, Xy = curve.Add(Xx, Xy, mask.x, mask.y)
+	ex.public = elliptic.MarshalCompressed(curve, Xx, Xy)
+	return nil
+}
+
+// p256Shared returns the SPAKE2 shared value given the peer's public value.
+// For SPAKE2+ it's followed by the second value, V, which only a party that
+// knows w1 or holds the verifier can compute.
+func (ex *Exchange) p256Shared(peer []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	Yx, Yy := elliptic.UnmarshalCompressed(curve, peer)
+	if Yx == nil {
+		return nil, ErrInvalidPeerElement
+	}
+	_, theirs := ex.p256Masks()
+	mask := ex.p256Mask(theirs)
+	negY := new(big.Int).Sub(curve.Params().P, mask.y)
+	Yx, Yy = curve.Add(Yx, Yy, mask.x, negY)
+	Zx, Zy := curve.ScalarMult(Yx, Yy, ex.xBytes[:scalarLen])
+	if Zx.Sign() == 0 && Zy.Sign() == 0 {
+		return nil, ErrInvalidPeerElement
+	}
+	shared := elliptic.MarshalCompressed(curve, Zx, Zy)
+
+	var Vx, Vy *big.Int
+	switch ex.role {
+	case roleProver:
+		Vx, Vy = curve.ScalarMult(Yx, Yy, ex.w1[:])
+	case roleVerifier:
+		Lx, Ly := elliptic.UnmarshalCompressed(curve, ex.verifierL)
+		Vx, Vy = curve.ScalarMult(Lx, Ly, ex.xBytes[:scalarLen])
+	default:
+		return shared, nil
+	}
+	return append(shared, elliptic.MarshalCompressed(curve, Vx, Vy)...), nil
+}
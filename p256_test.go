@@ -0,0 +1,135 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestP256Points(t *testing.T) {
+	curve := elliptic.P256()
+	for _, p := range []ecPoint{p256M, p256N} {
+		if !curve.IsOnCurve(p.x, p.y) {
+			t.Errorf("RFC 9382 point is not on the curve")
+		}
+	}
+	if p256M.x.Cmp(p256N.x) == 0 {
+		t.Errorf("M and N are the same point")
+	}
+}
+
+func TestP256(t *testing.T) {
+	opts := []Option{WithSuite(SuiteP256), fastKDF}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.public) != 33 {
+		t.Errorf("public value is %d bytes, want 33", len(a.public))
+	}
+
+	a = marshalUnmarshal(a)
+	if a.suite != SuiteP256 {
+		t.Errorf("suite was lost in serialization")
+	}
+	if info, err := PeekStateInfo(a.Marshal()); err != nil || info.Suite != SuiteP256 {
+		t.Errorf("PeekStateInfo reported suite %d, %v", info.Suite, err)
+	}
+	aTag, aBody := a.NextRequest()
+
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255} {
+		other, err := New(rand.Reader, []byte("foo"), []byte("c"), WithSuite(suite), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherTag, otherBody := other.NextRequest()
+		if bytes.Equal(aTag, otherTag) {
+			t.Errorf("P-256 exchange shares a tag with suite %d", suite)
+		}
+		if _, err := other.Process(aBody); err == nil {
+			t.Errorf("suite %d exchange accepted a P-256 body", suite)
+		}
+		if _, err := b.Process(otherBody); err == nil {
+			t.Errorf("P-256 exchange accepted a body from suite %d", suite)
+		}
+	}
+
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+	if a.sharedKey != b.sharedKey {
+		t.Errorf("shared keys differ")
+	}
+
+	c, err := New(rand.Reader, []byte("bar"), []byte("c"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(rand.Reader, []byte("foo"), []byte("d"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cBody := c.NextRequest()
+	_, dBody := d.NextRequest()
+	if _, err := d.Process(cBody); err == nil {
+		t.Errorf("body from a different secret was accepted")
+	}
+	if _, err := c.Process(dBody); err == nil {
+		t.Errorf("body from a different secret was accepted")
+	}
+}
+
+func TestP256Key(t *testing.T) {
+	opts := []Option{WithSuite(SuiteP256), fastKDF}
+	key, err := PrecomputeKey([]byte("foo"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = UnmarshalKey(key.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFromKey(rand.Reader, key, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
+
+func TestProcessAnySuites(t *testing.T) {
+	for _, suite := range []Suite{SuiteRistretto255, SuiteP256} {
+		a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithSuite(suite), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithSuite(suite), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		result, err := a.ProcessAny([][]byte{aBody, bBody})
+		if err != nil {
+			t.Fatalf("suite %d: %s", suite, err)
+		}
+		if result.Index != 1 || !result.KeyAgreed {
+			t.Errorf("suite %d: got %+v", suite, result)
+		}
+	}
+}
+
+func BenchmarkProcessP256(b *testing.B) {
+	benchmarkProcess(b, WithSuite(SuiteP256))
+}
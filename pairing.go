@@ -0,0 +1,361 @@
+package panda
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// A PairingConfig holds everything that two parties must agree on to start an
+// exchange, except the secret. It can be conveyed as a pairing URI, for
+// example in a QR code.
+//
+// Version two pairing URIs have the following grammar, where each value is
+// query-escaped and each parameter may appear at most once:
+//
+//	pairing-uri = "panda:2?" param *("&" param)
+//	param       = "server=" URL            ; required, see ServerIDFromURL
+//	            / "suite=" suite
+//	            / "version=" 1*DIGIT       ; see WithProtocolVersion
+//	            / "body-size=" 1*DIGIT     ; see WithBodySize
+//	            / "context=" text          ; see WithContext
+//	            / "window=" text           ; see WithValidityWindow
+//	            / "kdf=" kdf               ; required
+//	            / "n=" 1*DIGIT / "r=" 1*DIGIT / "p=" 1*DIGIT
+//	                                       ; scrypt cost, all or none,
+//	                                       ; kdf=scrypt or scrypt-parallel only
+//	            / "space=" 1*DIGIT         ; Balloon space cost, kdf=balloon only
+//	            / "time=" 1*DIGIT          ; Balloon time cost or Argon2 passes,
+//	                                       ; kdf=balloon or argon2id only
+//	            / "memory=" 1*DIGIT        ; Argon2 memory in KiB,
+//	                                       ; kdf=argon2id only
+//	            / "threads=" 1*DIGIT       ; Argon2 threads, kdf=argon2id only
+//	            / "insecure-secret=" text
+//	suite       = "modp4096" / "ristretto255" / "p256" / "modp2048"
+//	kdf         = "scrypt" / "scrypt-parallel" / "balloon" / "argon2id"
+//	            / "high-entropy"
+//
+// Numbers are positive and omitted parameters take their defaults. Unknown
+// parameters are an error: additions require a new version. Version one URIs,
+// which have only the server, kdf=scrypt or kdf=balloon, the Balloon costs and
+// the secret, are still accepted.
+type PairingConfig struct {
+	// Server is the base URL of the meeting place.
+	Server string
+	// Suite, ProtocolVersion and BodySize, if not zero, are passed to
+	// WithSuite, WithProtocolVersion and WithBodySize.
+	Suite           Suite
+	ProtocolVersion int
+	BodySize        int
+	// AppLabel and Window, if not empty, are passed to WithContext and
+	// WithValidityWindow.
+	AppLabel, Window string
+	// KDF is the function used to derive the exchange key. If it is
+	// KDFBalloon then BalloonSpaceCost and BalloonTimeCost must be set, and
+	// if it is KDFArgon2id then so must Argon2Time, Argon2Memory and
+	// Argon2Threads.
+	KDF KDF
+	// ScryptN, ScryptR and ScryptP, if not zero, are the cost of
+	// KDFScrypt or KDFScryptParallel. See WithScryptCost.
+	ScryptN, ScryptR, ScryptP         int
+	BalloonSpaceCost, BalloonTimeCost uint32
+	Argon2Time, Argon2Memory          uint32
+	Argon2Threads                     uint8
+
+	// InsecureSecret is the shared secret. Anyone who sees a URI that
+	// carries it can complete the exchange in place of the intended peer, so
+	// FormatPairingURI refuses to include it unless AllowInsecureSecret is
+	// also set.
+	InsecureSecret      string
+	AllowInsecureSecret bool
+}
+
+const pairingURIVersion = "2"
+
+// pairingSuites and pairingKDFs name the suites and KDFs in pairing URIs.
+var (
+	pairingSuites = map[string]Suite{
+		"modp4096":     SuiteMODP4096,
+		"ristretto255": SuiteRistretto255,
+		"p256":         SuiteP256,
+		"modp2048":     SuiteMODP2048,
+	}
+	pairingKDFs = map[string]KDF{
+		"scrypt":          KDFScrypt,
+		"scrypt-parallel": KDFScryptParallel,
+		"balloon":         KDFBalloon,
+		"argon2id":        KDFArgon2id,
+		"high-entropy":    KDFHighEntropy,
+	}
+)
+
+// pairingV1Params lists the parameters of version one pairing URIs.
+var pairingV1Params = map[string]bool{
+	"server":          true,
+	"kdf":             true,
+	"space":           true,
+	"time":            true,
+	"insecure-secret": true,
+}
+
+// pairingCostParams returns the names of the parameters that carry the cost
+// of kdf and whether they are required. Optional costs are given all together
+// or not at all.
+func pairingCostParams(kdf KDF) (names []string, required bool) {
+	switch kdf {
+	case KDFScrypt, KDFScryptParallel:
+		return []string{"n", "r", "p"}, false
+	case KDFBalloon:
+		return []string{"space", "time"}, true
+	case KDFArgon2id:
+		return []string{"time", "memory", "threads"}, true
+	}
+	return nil, false
+}
+
+// ErrPairingURIVersion is returned by ParsePairingURI for a URI of a version
+// not understood by this package.
+var ErrPairingURIVersion = errors.New("panda: unsupported pairing URI version")
+
+// ErrSecretInURI is returned by FormatPairingURI when asked to include the
+// secret without AllowInsecureSecret.
+var ErrSecretInURI = errors.New("panda: refusing to put the secret in a pairing URI")
+
+// A MissingFieldError is returned by ParsePairingURI when a required
+// parameter is absent.
+type MissingFieldError struct {
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	return "panda: pairing URI is missing " + e.Field
+}
+
+// Options returns the Options that configure an exchange as described by c.
+func (c *PairingConfig) Options() ([]Option, error) {
+	serverID, err := ServerIDFromURL(c.Server)
+	if err != nil {
+		return nil, err
+	}
+	opts := []Option{WithServerBinding(serverID), WithKDF(c.KDF)}
+	if c.Suite != 0 {
+		opts = append(opts, WithSuite(c.Suite))
+	}
+	if c.ProtocolVersion != 0 {
+		opts = append(opts, WithProtocolVersion(c.ProtocolVersion))
+	}
+	if c.BodySize != 0 {
+		opts = append(opts, WithBodySize(c.BodySize))
+	}
+	if len(c.AppLabel) > 0 {
+		opts = append(opts, WithContext(c.AppLabel))
+	}
+	if len(c.Window) > 0 {
+		opts = append(opts, WithValidityWindow(c.Window))
+	}
+	switch c.KDF {
+	case KDFScrypt, KDFScryptParallel:
+		if c.ScryptN != 0 || c.ScryptR != 0 || c.ScryptP != 0 {
+			opts = append(opts, WithScryptCost(c.ScryptN, c.ScryptR, c.ScryptP))
+		}
+	case KDFBalloon:
+		opts = append(opts, WithBalloonCost(c.BalloonSpaceCost, c.BalloonTimeCost))
+	case KDFArgon2id:
+		opts = append(opts, WithArgon2Cost(c.Argon2Time, c.Argon2Memory, c.Argon2Threads))
+	}
+	if err := c.checkCosts(); err != nil {
+		return nil, err
+	}
+	if err := newConfig(opts).validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// checkCosts returns an error if c sets the cost of a KDF other than its own,
+// which a pairing URI can't carry.
+func (c *PairingConfig) checkCosts() error {
+	scrypt := c.ScryptN != 0 || c.ScryptR != 0 || c.ScryptP != 0
+	balloon := c.BalloonSpaceCost != 0 || c.BalloonTimeCost != 0
+	argon2 := c.Argon2Time != 0 || c.Argon2Memory != 0 || c.Argon2Threads != 0
+	if scrypt && c.KDF != KDFScrypt && c.KDF != KDFScryptParallel || balloon && c.KDF != KDFBalloon || argon2 && c.KDF != KDFArgon2id {
+		return errors.New("panda: pairing config has costs for another KDF")
+	}
+	return nil
+}
+
+// FormatPairingURI encodes c as a pairing URI.
+func FormatPairingURI(c *PairingConfig) (string, error) {
+	if len(c.InsecureSecret) > 0 && !c.AllowInsecureSecret {
+		return "", ErrSecretInURI
+	}
+	if len(c.Server) == 0 {
+		return "", &MissingFieldError{"server"}
+	}
+	if _, err := c.Options(); err != nil {
+		return "", err
+	}
+
+	// The parameters are written in a fixed order so that a given
+	// configuration always has the same URI.
+	uri := "panda:" + pairingURIVersion + "?server=" + url.QueryEscape(c.Server)
+	if c.Suite != 0 {
+		for name, suite := range pairingSuites {
+			if suite == c.Suite {
+				uri += "&suite=" + name
+			}
+		}
+	}
+	if c.ProtocolVersion != 0 {
+		uri += "&version=" + strconv.Itoa(c.ProtocolVersion)
+	}
+	if c.BodySize != 0 {
+		uri += "&body-size=" + strconv.Itoa(c.BodySize)
+	}
+	if len(c.AppLabel) > 0 {
+		uri += "&context=" + url.QueryEscape(c.AppLabel)
+	}
+	if len(c.Window) > 0 {
+		uri += "&window=" + url.QueryEscape(c.Window)
+	}
+	for name, kdf := range pairingKDFs {
+		if kdf == c.KDF {
+			uri += "&kdf=" + name
+		}
+	}
+	switch c.KDF {
+	case KDFScrypt, KDFScryptParallel:
+		if c.ScryptN != 0 {
+			uri += "&n=" + strconv.Itoa(c.ScryptN) + "&r=" + strconv.Itoa(c.ScryptR) + "&p=" + strconv.Itoa(c.ScryptP)
+		}
+	case KDFBalloon:
+		uri += "&space=" + strconv.FormatUint(uint64(c.BalloonSpaceCost), 10) + "&time=" + strconv.FormatUint(uint64(c.BalloonTimeCost), 10)
+	case KDFArgon2id:
+		uri += "&time=" + strconv.FormatUint(uint64(c.Argon2Time), 10) + "&memory=" + strconv.FormatUint(uint64(c.Argon2Memory), 10) + "&threads=" + strconv.FormatUint(uint64(c.Argon2Threads), 10)
+	}
+	if len(c.InsecureSecret) > 0 {
+		uri += "&insecure-secret=" + url.QueryEscape(c.InsecureSecret)
+	}
+	return uri, nil
+}
+
+// ParsePairingURI decodes a URI produced by FormatPairingURI. If the URI
+// carries the secret then AllowInsecureSecret is set in the result.
+func ParsePairingURI(uri string) (*PairingConfig, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.New("panda: malformed pairing URI: " + err.Error())
+	}
+	if u.Scheme != "panda" || len(u.Opaque) == 0 || len(u.Fragment) > 0 {
+		return nil, errors.New("panda: not a pairing URI")
+	}
+	if u.Opaque != pairingURIVersion && u.Opaque != "1" {
+		return nil, ErrPairingURIVersion
+	}
+	v1 := u.Opaque == "1"
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, errors.New("panda: malformed pairing URI: " + err.Error())
+	}
+
+	c := new(PairingConfig)
+	costs := make(map[string]uint64)
+	for name, values := range params {
+		if len(values) != 1 {
+			return nil, errors.New("panda: pairing URI repeats " + name)
+		}
+		value := values[0]
+		if v1 && !pairingV1Params[name] {
+			return nil, errors.New("panda: pairing URI has unknown parameter " + name)
+		}
+		switch name {
+		case "server":
+			c.Server = value
+		case "suite":
+			suite, ok := pairingSuites[value]
+			if !ok {
+				return nil, errors.New("panda: pairing URI has unknown suite " + value)
+			}
+			c.Suite = suite
+		case "version", "body-size":
+			n, err := parsePairingNumber(name, value, 31)
+			if err != nil {
+				return nil, err
+			}
+			if name == "version" {
+				c.ProtocolVersion = int(n)
+			} else {
+				c.BodySize = int(n)
+			}
+		case "context":
+			c.AppLabel = value
+		case "window":
+			c.Window = value
+		case "kdf":
+			kdf, ok := pairingKDFs[value]
+			if !ok || v1 && kdf != KDFScrypt && kdf != KDFBalloon {
+				return nil, errors.New("panda: pairing URI has unknown KDF " + value)
+			}
+			c.KDF = kdf
+		case "n", "r", "p", "space", "time", "memory", "threads":
+			bits := 32
+			if name == "threads" {
+				bits = 8
+			}
+			cost, err := parsePairingNumber(name, value, bits)
+			if err != nil {
+				return nil, err
+			}
+			costs[name] = cost
+		case "insecure-secret":
+			c.InsecureSecret = value
+			c.AllowInsecureSecret = true
+		default:
+			return nil, errors.New("panda: pairing URI has unknown parameter " + name)
+		}
+	}
+
+	if len(c.Server) == 0 {
+		return nil, &MissingFieldError{"server"}
+	}
+	if _, ok := params["kdf"]; !ok {
+		return nil, &MissingFieldError{"kdf"}
+	}
+	names, required := pairingCostParams(c.KDF)
+	for name := range costs {
+		known := false
+		for _, costName := range names {
+			known = known || name == costName
+		}
+		if !known {
+			return nil, errors.New("panda: pairing URI has costs for another KDF")
+		}
+	}
+	for _, name := range names {
+		if _, ok := costs[name]; !ok && (required || len(costs) > 0) {
+			return nil, &MissingFieldError{name}
+		}
+	}
+	switch c.KDF {
+	case KDFScrypt, KDFScryptParallel:
+		c.ScryptN, c.ScryptR, c.ScryptP = int(costs["n"]), int(costs["r"]), int(costs["p"])
+	case KDFBalloon:
+		c.BalloonSpaceCost, c.BalloonTimeCost = uint32(costs["space"]), uint32(costs["time"])
+	case KDFArgon2id:
+		c.Argon2Time, c.Argon2Memory, c.Argon2Threads = uint32(costs["time"]), uint32(costs["memory"]), uint8(costs["threads"])
+	}
+	if _, err := c.Options(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parsePairingNumber parses the value of the named parameter, which must be a
+// positive number of at most the given number of bits.
+func parsePairingNumber(name, value string, bits int) (uint64, error) {
+	n, err := strconv.ParseUint(value, 10, bits)
+	if err != nil || n == 0 {
+		return 0, errors.New("panda: pairing URI has invalid " + name)
+	}
+	return n, nil
+}
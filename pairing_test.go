@@ -0,0 +1,240 @@
+package panda
+
+import (
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func TestPairingURIRoundTrip(t *testing.T) {
+	configs := []*PairingConfig{
+		{Server: "https://panda.example.com/meet"},
+		{Server: "http://localhost:8080", KDF: KDFBalloon, BalloonSpaceCost: 1024, BalloonTimeCost: 2},
+		{Server: "https://example.com", InsecureSecret: "correct horse & battery", AllowInsecureSecret: true},
+		{Server: "https://example.com", Suite: SuiteRistretto255, ProtocolVersion: ProtocolVersion6, BodySize: BodySize16K},
+		{Server: "https://example.com", AppLabel: "chat & more", Window: "2014-W09"},
+		{Server: "https://example.com", KDF: KDFScrypt, ScryptN: 1 << 15, ScryptR: 8, ScryptP: 1},
+		{Server: "https://example.com", KDF: KDFScryptParallel, ScryptN: 1 << 16, ScryptR: 8, ScryptP: 4},
+		{Server: "https://example.com", KDF: KDFScryptParallel},
+		{Server: "https://example.com", KDF: KDFHighEntropy, Suite: SuiteP256},
+		{Server: "https://example.com", KDF: KDFArgon2id, Argon2Time: 3, Argon2Memory: 1 << 16, Argon2Threads: 4},
+		{Server: "https://example.com", KDF: KDFArgon2id, Argon2Time: 1, Argon2Memory: 4 << 20, Argon2Threads: 255},
+	}
+
+	for _, c := range configs {
+		uri, err := FormatPairingURI(c)
+		if err != nil {
+			t.Fatalf("%+v: %s", c, err)
+		}
+		parsed, err := ParsePairingURI(uri)
+		if err != nil {
+			t.Fatalf("%s: %s", uri, err)
+		}
+		if !reflect.DeepEqual(parsed, c) {
+			t.Errorf("%s parsed as %+v, want %+v", uri, parsed, c)
+		}
+	}
+}
+
+func TestPairingURISecret(t *testing.T) {
+	c := &PairingConfig{Server: "https://example.com", InsecureSecret: "foo"}
+	if _, err := FormatPairingURI(c); err != ErrSecretInURI {
+		t.Errorf("got %v when formatting a secret without permission", err)
+	}
+	parsed, err := ParsePairingURI("panda:2?server=https://example.com&kdf=scrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.InsecureSecret) > 0 || parsed.AllowInsecureSecret {
+		t.Errorf("secret reported for a URI without one: %+v", parsed)
+	}
+}
+
+func TestPairingURIRejects(t *testing.T) {
+	tests := []struct {
+		uri     string
+		missing string
+	}{
+		{"panda:2?kdf=scrypt", "server"},
+		{"panda:2?server=https://example.com", "kdf"},
+		{"panda:2?server=https://example.com&kdf=balloon&space=1024", "time"},
+		{"panda:2?server=https://example.com&kdf=scrypt&n=1024&r=8", "p"},
+		{"panda:2?server=https://example.com&kdf=scrypt&space=1024", ""},
+		{"panda:2?server=https://example.com&kdf=high-entropy&n=1024&r=8&p=1", ""},
+		{"panda:2?server=https://example.com&kdf=argon2", ""},
+		{"panda:2?server=https://example.com&kdf=argon2id&time=1&memory=65536", "threads"},
+		{"panda:2?server=https://example.com&kdf=argon2id&time=1&memory=65536&threads=256", ""},
+		{"panda:2?server=https://example.com&kdf=argon2id&time=1&memory=8&threads=4", ""},
+		{"panda:2?server=https://example.com&kdf=balloon&space=1024&time=1&memory=8", ""},
+		{"panda:1?server=https://example.com&kdf=argon2id&time=1&memory=65536&threads=4", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt&pins=abc", ""},
+		{"panda:2?server=https://example.com&server=https://example.org&kdf=scrypt", ""},
+		{"panda:2?server=ftp://example.com&kdf=scrypt", ""},
+		{"panda:2?server=https://example.com&kdf=balloon&space=1&time=1", ""},
+		{"panda:2?server=https://example.com&kdf=balloon&space=-1&time=1", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt&n=1000&r=8&p=1", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt&suite=ed25519", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt&version=0", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt&version=7", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt&body-size=1000", ""},
+		{"panda:2?server=https://example.com&kdf=scrypt#frag", ""},
+		{"panda:1?server=https://example.com&kdf=scrypt&suite=p256", ""},
+		{"panda:1?server=https://example.com&kdf=high-entropy", ""},
+		{"https://example.com", ""},
+		{"panda:", ""},
+	}
+
+	for _, test := range tests {
+		_, err := ParsePairingURI(test.uri)
+		if err == nil {
+			t.Errorf("%s: accepted", test.uri)
+			continue
+		}
+		var missing *MissingFieldError
+		if isMissing := errors.As(err, &missing); isMissing != (len(test.missing) > 0) || isMissing && missing.Field != test.missing {
+			t.Errorf("%s: got error %q, want missing %q", test.uri, err, test.missing)
+		}
+	}
+
+	if _, err := ParsePairingURI("panda:3?server=https://example.com&kdf=scrypt"); err != ErrPairingURIVersion {
+		t.Errorf("got %v for an unknown version", err)
+	}
+}
+
+func TestPairingURIQuick(t *testing.T) {
+	// Arbitrary input must never cause a panic and anything that parses must
+	// format back to a URI that parses identically.
+	check := func(s string) bool {
+		for _, uri := range []string{s, "panda:1?" + s, "panda:2?" + s} {
+			c, err := ParsePairingURI(uri)
+			if err != nil {
+				continue
+			}
+			formatted, err := FormatPairingURI(c)
+			if err != nil {
+				return false
+			}
+			reparsed, err := ParsePairingURI(formatted)
+			if err != nil || !reflect.DeepEqual(c, reparsed) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Any Argon2id cost that FormatPairingURI accepts must survive the
+	// round trip.
+	checkArgon2 := func(time, memory uint32, threads uint8) bool {
+		c := &PairingConfig{Server: "https://example.com", KDF: KDFArgon2id, Argon2Time: time, Argon2Memory: memory % (8 << 20), Argon2Threads: threads}
+		uri, err := FormatPairingURI(c)
+		if err != nil {
+			return true
+		}
+		parsed, err := ParsePairingURI(uri)
+		return err == nil && reflect.DeepEqual(parsed, c)
+	}
+	if err := quick.Check(checkArgon2, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPairingURIVersion1(t *testing.T) {
+	c, err := ParsePairingURI("panda:1?server=https://example.com&kdf=balloon&space=1024&time=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PairingConfig{Server: "https://example.com", KDF: KDFBalloon, BalloonSpaceCost: 1024, BalloonTimeCost: 2}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+}
+
+func TestPairingConfigOptions(t *testing.T) {
+	c := &PairingConfig{
+		Server:           "https://example.com",
+		Suite:            SuiteRistretto255,
+		ProtocolVersion:  ProtocolVersion6,
+		BodySize:         BodySize4K,
+		AppLabel:         "chat",
+		Window:           "2014-W09",
+		KDF:              KDFBalloon,
+		BalloonSpaceCost: 16,
+		BalloonTimeCost:  1,
+	}
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := New(rand.Reader, []byte("secret"), []byte("hello"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := PeekStateInfo(ex.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Suite != c.Suite || info.BodySize != c.BodySize || info.AppLabel != c.AppLabel || info.Window != c.Window || info.KDF != c.KDF {
+		t.Errorf("exchange doesn't match its pairing config: %+v", info)
+	}
+
+	for _, bad := range []*PairingConfig{
+		{Server: "https://example.com", KDF: KDFBalloon, BalloonSpaceCost: 16, BalloonTimeCost: 1, ScryptN: 1 << 14, ScryptR: 8, ScryptP: 1},
+		{Server: "https://example.com", KDF: KDFScrypt, BalloonSpaceCost: 16},
+		{Server: "https://example.com", KDF: KDFScrypt, ScryptN: 1 << 14},
+		{Server: "https://example.com", KDF: KDFArgon2id, Argon2Time: 1, Argon2Memory: 1 << 16},
+		{Server: "https://example.com", KDF: KDFScrypt, Argon2Threads: 1},
+		{Server: "https://example.com", Suite: 99},
+	} {
+		if _, err := FormatPairingURI(bad); err == nil {
+			t.Errorf("%+v was formatted", bad)
+		}
+	}
+}
+
+func TestPairingURIScryptCost(t *testing.T) {
+	cost := ScryptCost{N: MinScryptN, R: calibratedScryptR, P: 2}
+	uri, err := FormatPairingURI(&PairingConfig{Server: "https://example.com", ScryptN: cost.N, ScryptR: cost.R, ScryptP: cost.P})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ParsePairingURI(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := newConfig(opts).kdf, newConfig([]Option{cost.Option()}).kdf
+	if got != want {
+		t.Errorf("%s gives %+v, want %+v", uri, got, want)
+	}
+}
+
+func TestPairingURIExchange(t *testing.T) {
+	c, err := ParsePairingURI("panda:2?server=https%3A%2F%2FPanda.example.com%3A443%2F&kdf=scrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(rand.Reader, []byte("shared secret"), []byte("hello"), append(opts, fastKDF)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("shared secret"), []byte("world"), WithServerBinding("https://panda.example.com"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "world" || string(bResult) != "hello" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
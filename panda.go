@@ -24,91 +24,337 @@ during the course of an exchange.
 package panda
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"io"
+	"io/ioutil"
+	"math"
 	"math/big"
 	"strconv"
 
 	"code.google.com/p/go.crypto/nacl/secretbox"
-	"code.google.com/p/go.crypto/scrypt"
 	"code.google.com/p/goprotobuf/proto"
 	"github.com/agl/panda/stateproto"
 )
 
-// bodySize is the number of bytes that we'll pad every message to.
-const bodySize = 1<<17
-// MaxMessageLen is the maximum size of a message exchanged via PANDA.
-const MaxMessageLen = bodySize - 24 /* nonce */ - secretbox.Overhead - 2
+// bodySize is the number of bytes that we'll pad every message to, unless
+// changed by WithBodySize.
+const bodySize = BodySize128K
 
-// groupP and groupG define the multiplicative group in which we perform
-// SPAKE2. They are taken from
-// https://tools.ietf.org/html/rfc3526#section-5.
-var groupP, groupG *big.Int
+// MaxMessageLen is the maximum size of a message exchanged via PANDA with
+// the default body size and ProtocolVersion4 or later. Earlier versions
+// record the length of a message in two bytes and so are limited to
+// maxLegacyMessageLen, 65535 bytes. MaxMessageLenFor gives the limit for a
+// particular configuration.
+const MaxMessageLen = bodySize - 24 /* nonce */ - secretbox.Overhead - 3
 
-// groupN is a verifiably random member of the group, generated by taking 4096
-// bits of Salsa20 output with a zero nonce and where the key is
-// SHA-256("PANDA key exchange, seed for N").
-var groupN *big.Int
-
-func init() {
-	groupP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF", 16)
-	groupG = big.NewInt(2)
-	groupN, _ = new(big.Int).SetString("a4fc1dc7a9a7fb350cbe7ca8301e69be1b0a7d904214218dcb055aa5a43f5d5eafed84f570fb13532075ada5aa2aa3cd52b84f3dcadcccc99f22cbcf8666eb768bbe7adda90709d73011d8474d6e4d458a5e0c9f61bce08b76f86707702787814b122b6f51352dfd69a5da48def271f814b09116e200b01e5acfc66f666f8268447eb0ec2aac64a97093f09908653f93c5723d38e404f0f01b46799b5ef398dd4bd9e4301d704dd22d2bc4de8fed055be9992b147ac686364d80dcd5153ea6e9fdb85a65d78fc70ce816f2fc964d270affe1cb5267fad6bd17ad1994de8854f6c68d1347db7c65250196fddbf0ebbea9e2c4ab2f82bc4784f3d36881bab1b5b05ebf1a758d24a7db1f2030607349bc0e961e82e1ca9301bd3fa1ce32364a1febf5bc9915aa364bf1c1ac62e066022cb9828fb39becf77dcb3d0b1db35ecfdf7cf91c381b355b74175b5fb2918008ad775132fb3886333449dfc55bb65417c2a0c45559370f66d0e955d1c28e46f7274639b039736546c502470513a1e36a793f888ce880b3fe00e83018049749fc4870cefbbb9a9a6e10f90a78cd0de85360f7b0d7abaab43d99d539b48afb56e36c8538c03faf43320324c76741d8c7ea419dea6de120bdbb93402284436645cc4b4d4190ee0313dc2302b31cb4eb55cb4c4d779b56ca9b91423a43b50868c5211caf9491f36b77abb0e29f98639ef6592e77", 16)
-}
+// maxLegacyMessageLen is the maximum size of a message before version 4.
+const maxLegacyMessageLen = 1<<16 - 1
 
 // Exchange represents a key exchange in progress.
 type Exchange struct {
-	key [32]byte
-	x, X *big.Int
+	// keyMaterial holds the key, the secret exponent and the shared key.
+	// lockedPage, if not nil, is the locked memory that holds it. See
+	// WithLockedMemory.
+	*keyMaterial
+	lockedPage *lockedPage
+	// public is our SPAKE2 public value, encoded for the suite.
+	public        []byte
 	haveSharedKey bool
-	sharedKey [32]byte
-	message []byte
+	// complete is true once the peer's message has been received.
+	complete bool
+	// peerAcknowledged is true once the peer's acknowledgment has been
+	// processed. See Acknowledgment.
+	peerAcknowledged bool
+	// peerMessageHash is the SHA-256 hash of the peer's message as sent,
+	// once complete. It is zero for exchanges completed by older versions.
+	peerMessageHash [32]byte
+	message         []byte
+	// kdf records how key was derived from the secret.
+	kdf kdfParams
+	// suite is the group used for SPAKE2.
+	suite Suite
+	// group, if not nil, replaces the group of a MODP suite. See
+	// WithMODPGroup.
+	group *modpGroup
+	// role is this party's side of a SPAKE2+ exchange, or zero for the
+	// symmetric protocol. verifierL is the verifier's public point, for
+	// roleVerifier.
+	role      augmentedRole
+	verifierL []byte
+	// keyConfirmation is true if we offer key confirmation.
+	// peerConfirmation is the confirmation value expected from the peer,
+	// once both parties have agreed to use it or the peer has said that
+	// it is key-only.
+	keyConfirmation  bool
+	peerConfirmation []byte
+	// hybridKEM is true if we offer ML-KEM protection of the second round.
+	// kemCiphertext is the ciphertext that we encapsulated to the peer's
+	// key, once both parties have agreed to use it. See WithHybridKEM.
+	hybridKEM     bool
+	kemCiphertext []byte
+	// fragmentation is true if we offer fragmentation and fragmented is
+	// true once both parties have agreed to it. peerFragmentHeader is the
+	// header of the peer's first fragment, once received, and fragments
+	// holds the peer's fragments received so far. See WithFragmentation.
+	fragmentation      bool
+	fragmented         bool
+	peerFragmentHeader []byte
+	fragments          map[int][]byte
+	// compression is true if we offer compression and compressed is true
+	// once both parties have agreed to it, whereupon encoded is our
+	// message as sent. See WithCompression.
+	compression bool
+	compressed  bool
+	encoded     []byte
+	// keyOnly is true if we have no message to send, and peerKeyOnly is
+	// true once the peer has said the same. See PeerKeyOnly.
+	keyOnly     bool
+	peerKeyOnly bool
+	// messages holds our messages, by ID, if we send several.
+	// peerMessageIDs are the IDs of the peer's, once known, and
+	// receivedMessages holds the bodies received so far, by ID. See
+	// NewMulti.
+	messages         map[int][]byte
+	peerMessageIDs   []int
+	receivedMessages map[int][]byte
+	// version selects the key schedule. See WithProtocolVersion.
+	version int
+	// bodySize is the size of our bodies. See WithBodySize.
+	bodySize int
+	// peerBodySizes are the other sizes that the peer may pad its bodies
+	// to. See WithPeerBodySizes.
+	peerBodySizes []int
+	// bodyHash is the hash of both first round bodies, once the shared key
+	// is known, in version 2 and later. See hashBodies.
+	bodyHash [32]byte
+	// serverID is the meeting place that the exchange is bound to, if any.
+	serverID string
+	// normalizeSecret is true if secrets are passed through
+	// NormalizeSecret.
+	normalizeSecret bool
+	// window is the validity window that the exchange is scoped to, if
+	// any.
+	window string
+	// appLabel is the application that the exchange is bound to, if any.
+	// See WithContext.
+	appLabel string
+	// deriver, if not nil, replaces the KDF described by kdf.
+	deriver KeyDeriver
+	// pepper, if not nil, is the hash of a value mixed into key after the
+	// KDF. See WithPepper.
+	pepper *[32]byte
+	// adHash, if not nil, is the hash of the associated data bound to the
+	// box keys. See WithAssociatedData.
+	adHash *[32]byte
+	// failure is non-nil if the exchange has been abandoned.
+	failure *FailureError
+	// appData is the application's metadata. See SetAppData.
+	appData map[string]string
+	// skipEntropyCheck is true if the random sources passed to
+	// RederiveSecret aren't checked. See InsecureSkipEntropyCheck.
+	skipEntropyCheck bool
+}
+
+// FailureCode classifies the reason that an exchange was abandoned. The values
+// are recorded in serialized states and so will not change.
+type FailureCode int32
+
+const (
+	// FailureOther is used for reasons that fit no other code.
+	FailureOther FailureCode = 1
+	// FailureSecretMismatch means that the peers appear to have used
+	// different secrets.
+	FailureSecretMismatch FailureCode = 2
+	// FailureTooManyErrors means that too many attempts to complete the
+	// exchange failed.
+	FailureTooManyErrors FailureCode = 3
+	// FailureDeadline means that the exchange did not complete in time.
+	FailureDeadline FailureCode = 4
+	// FailureAborted means that the exchange was cancelled by either party.
+	FailureAborted FailureCode = 5
+)
+
+// ErrExchangeFailed is wrapped by the errors returned from an Exchange that
+// has been marked as failed.
+var ErrExchangeFailed = errors.New("panda: exchange failed")
+
+// FailureError describes why an exchange was abandoned.
+type FailureError struct {
+	Code    FailureCode
+	Message string
+}
+
+func (e *FailureError) Error() string {
+	return "panda: exchange failed: " + e.Message
 }
 
-var testingMode = false
+// Unwrap returns ErrExchangeFailed.
+func (e *FailureError) Unwrap() error {
+	return ErrExchangeFailed
+}
 
 // New creates a new Exchange that will send the given message to the other
-// holder of the shared secret. It performs a significant amount of computation
-// (many seconds).
-func New(r io.Reader, secret, message []byte) (*Exchange, error) {
-	if len(message) > MaxMessageLen {
-		return nil, errors.New("panda: message too large")
+// holder of the shared secret. A nil message, unlike an empty one, means
+// that the exchange is only used to agree a key: see PeerKeyOnly. It performs
+// a significant amount of computation (many seconds). Unless the
+// InsecureSkipEntropyCheck option is given, a random source other than
+// crypto/rand is checked for obvious defects first, which consumes and
+// discards the first 64 bytes that it produces.
+func New(r io.Reader, secret, message []byte, opts ...Option) (*Exchange, error) {
+	return NewContext(context.Background(), r, secret, message, opts...)
+}
+
+// NewContext is like New but gives up, returning ctx.Err(), as soon as ctx is
+// done. The key derivation itself can't be interrupted and continues in the
+// background until it finishes, whereupon its result is wiped.
+func NewContext(ctx context.Context, r io.Reader, secret, message []byte, opts ...Option) (*Exchange, error) {
+	config := newConfig(opts)
+	if config.wipeSecret {
+		defer wipe(secret)
+	}
+	if err := config.checkNew(r, message); err != nil {
+		return nil, err
 	}
 
-	var keySlice []byte
-	var err error
+	key, err := precomputeKey(ctx, secret, config)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Wipe()
+	return key.newExchange(r, message)
+}
 
-	if testingMode {
-		h := sha256.New()
-		h.Write(secret)
-		keySlice = h.Sum(nil)
-	} else {
-		if keySlice, err = scrypt.Key(secret, nil, 1<<16, 16, 4, 32); err != nil {
-			return nil, err
+// generateX picks a new secret exponent and computes the corresponding public
+// SPAKE2 value. In hybrid exchanges it also picks the seed of our ML-KEM key.
+func (ex *Exchange) generateX(r io.Reader) (err error) {
+	if ex.hybridKEM {
+		if _, err := io.ReadFull(r, ex.kemSeed[:]); err != nil {
+			return err
 		}
 	}
-
-	ex := &Exchange{
-		message: message,
+	switch ex.suite {
+	case SuiteRistretto255:
+		return ex.generateRistretto(r)
+	case SuiteP256:
+		return ex.generateP256(r)
 	}
-	copy(ex.key[:], keySlice)
 
+	group := ex.modp()
+	var x *big.Int
 	for {
-		if ex.x, err = rand.Int(r, groupP); err != nil {
-			return nil, err
+		if x, err = rand.Int(r, group.p); err != nil {
+			return err
 		}
-		if ex.x.Sign() > 0 {
+		if x.Sign() > 0 {
 			break
 		}
 	}
-	ex.X = new(big.Int).Exp(groupG, ex.x, groupP)
-	ex.X.Mul(ex.X, ex.nPW())
-	ex.X.Mod(ex.X, groupP)
+	defer wipeInt(x)
+	npw, err := ex.nPW()
+	if err != nil {
+		return err
+	}
+	x.FillBytes(ex.xBytes[:])
+	gx := group.expG(ex.secretX())
+	X := group.mul(gx, npw)
+	wipeInt(gx)
+	wipeInt(npw)
+	ex.public = X.Bytes()
+	return nil
+}
 
-	return ex, nil
+// RederiveSecret restarts ex using a different secret, for when the original
+// was entered incorrectly. It performs the same expensive key derivation as
+// New, with the same parameters, and discards any progress in the exchange,
+// which will use new tags. The message and other configuration are kept and
+// any failure recorded by Fail is cleared. It is an error to call
+// RederiveSecret on a completed exchange. As in New, a random source other
+// than crypto/rand is checked for obvious defects, consuming its first 64
+// bytes, and ErrSuspectEntropy is also returned if it repeats the draw that
+// it made for the exchange being replaced, unless the exchange was created
+// with InsecureSkipEntropyCheck.
+func (ex *Exchange) RederiveSecret(r io.Reader, newSecret []byte) error {
+	if ex.complete {
+		return errors.New("panda: cannot change the secret of a completed exchange")
+	}
+	if ex.role == roleVerifier {
+		return errors.New("panda: cannot change the secret of an exchange created from a verifier")
+	}
+	if !ex.skipEntropyCheck {
+		if err := checkEntropy(r); err != nil {
+			return err
+		}
+	}
+
+	newSecret, err := prepareSecret(newSecret, ex.normalizeSecret)
+	if err != nil {
+		return err
+	}
+	if ex.normalizeSecret {
+		defer wipe(newSecret)
+	}
+	if err := ex.kdf.checkSecret(newSecret); err != nil {
+		return err
+	}
+	input := scopeSecret(newSecret, ex.appLabel, ex.window)
+	keySlice, err := deriveKeyWith(ex.deriver, &ex.kdf, input, nil)
+	wipe(input)
+	if err != nil {
+		return err
+	}
+	keySlice = applyPepper(keySlice, ex.pepper)
+	defer wipe(keySlice)
+
+	restarted := &Exchange{
+		message:         ex.message,
+		kdf:             ex.kdf,
+		suite:           ex.suite,
+		group:           ex.group,
+		role:            ex.role,
+		keyConfirmation: ex.keyConfirmation,
+		hybridKEM:       ex.hybridKEM,
+		fragmentation:   ex.fragmentation,
+		compression:     ex.compression,
+		keyOnly:         ex.keyOnly,
+		messages:        ex.messages,
+		version:         ex.version,
+		bodySize:        ex.bodySize,
+		peerBodySizes:   ex.peerBodySizes,
+		serverID:        ex.serverID,
+		appData:         ex.appData,
+		normalizeSecret: ex.normalizeSecret,
+		window:          ex.window,
+		appLabel:        ex.appLabel,
+		deriver:         ex.deriver,
+		pepper:          ex.pepper,
+		adHash:          ex.adHash,
+	}
+	restarted.skipEntropyCheck = ex.skipEntropyCheck
+	if err := restarted.allocKeyMaterial(ex.lockedPage != nil); err != nil {
+		return err
+	}
+	copy(restarted.key[:], keySlice)
+	restarted.augmentKey()
+	if err := restarted.generateX(r); err != nil {
+		restarted.Destroy()
+		return err
+	}
+	// A source that replays its output gives the same exponent and, if the
+	// secret is unchanged, the same public value as before.
+	if !ex.skipEntropyCheck && (subtle.ConstantTimeCompare(restarted.xBytes[:], ex.xBytes[:]) == 1 || bytes.Equal(restarted.public, ex.public)) {
+		restarted.Destroy()
+		return ErrSuspectEntropy
+	}
+
+	ex.Destroy()
+	*ex = *restarted
+	return nil
 }
 
 // Unmarshal creates an Exchange from the result of calling Marshal.
@@ -117,39 +363,474 @@ func Unmarshal(data []byte) (*Exchange, error) {
 	if err := proto.Unmarshal(data, s); err != nil {
 		return nil, err
 	}
+	if len(s.PublicBytes) == 0 {
+		return nil, errors.New("panda: serialized state is a key, not an exchange")
+	}
+	suite := unmarshalSuite(s)
+	if err := validateSuite(suite); err != nil {
+		return nil, err
+	}
+	version := unmarshalVersion(s)
+	if err := validateVersion(version); err != nil {
+		return nil, err
+	}
+	size := unmarshalBodySize(s)
+	if err := validateBodySize(size); err != nil {
+		return nil, err
+	}
+	peerSizes := unmarshalPeerBodySizes(s)
+	if err := validatePeerBodySizes(peerSizes, s.GetFragmentation()); err != nil {
+		return nil, err
+	}
+	var group *modpGroup
+	if params := unmarshalCustomGroup(s); params != nil {
+		if !suite.isMODP() {
+			return nil, errors.New("panda: serialized state is corrupt: custom group with a non-MODP suite")
+		}
+		if err := checkCustomGroupAllowed(params); err != nil {
+			return nil, err
+		}
+		var err error
+		if group, err = lookupCustomGroup(params.P, params.G, params.N); err != nil {
+			return nil, err
+		}
+	}
+	modpSize := modpFor(suite).size
+	if group != nil {
+		modpSize = group.size
+	}
+	if suite.isMODP() && len(s.XBytes) > modpSize || !suite.isMODP() && len(s.XBytes) != scalarLen {
+		return nil, errors.New("panda: serialized state is corrupt: bad secret exponent")
+	}
+	role := augmentedRole(s.GetAugmentedRole())
+	if err := checkAugmentedState(s, role, suite); err != nil {
+		return nil, err
+	}
+	if n := len(s.PeerConfirmation); n != 0 && n != confirmationLen {
+		return nil, errors.New("panda: serialized state is corrupt: bad peer confirmation")
+	}
+	if n := len(s.BodyHash); n != 0 && n != len(Exchange{}.bodyHash) {
+		return nil, errors.New("panda: serialized state is corrupt: bad body hash")
+	}
+	if err := checkKEMState(s); err != nil {
+		return nil, err
+	}
+	fragments, err := unmarshalFragments(s)
+	if err != nil {
+		return nil, err
+	}
+	if s.GetCompressed() && len(s.EncodedMessage) == 0 {
+		return nil, errors.New("panda: serialized state is corrupt: compressed without an encoded message")
+	}
+	messages, peerMessageIDs, receivedMessages, err := unmarshalMulti(s)
+	if err != nil {
+		return nil, err
+	}
 	ex := &Exchange{
-		message: s.Message,
-		x: new(big.Int).SetBytes(s.XBytes),
-		X: new(big.Int).SetBytes(s.PublicBytes),
-		haveSharedKey: len(s.SharedKey) > 0,
+		keyMaterial:        new(keyMaterial),
+		message:            s.Message,
+		public:             s.PublicBytes,
+		suite:              suite,
+		group:              group,
+		role:               role,
+		verifierL:          s.VerifierL,
+		keyConfirmation:    s.GetKeyConfirmation(),
+		version:            version,
+		bodySize:           size,
+		peerBodySizes:      peerSizes,
+		peerConfirmation:   s.PeerConfirmation,
+		hybridKEM:          s.GetHybridKem(),
+		kemCiphertext:      s.KemCiphertext,
+		fragmentation:      s.GetFragmentation(),
+		fragmented:         s.GetFragmented(),
+		peerFragmentHeader: s.PeerFragmentHeader,
+		fragments:          fragments,
+		compression:        s.GetCompression(),
+		compressed:         s.GetCompressed(),
+		encoded:            s.EncodedMessage,
+		keyOnly:            s.GetKeyOnly(),
+		peerKeyOnly:        s.GetPeerKeyOnly(),
+		messages:           messages,
+		peerMessageIDs:     peerMessageIDs,
+		receivedMessages:   receivedMessages,
+		haveSharedKey:      len(s.SharedKey) > 0,
+		complete:           s.GetComplete(),
+		peerAcknowledged:   s.GetPeerAcknowledged(),
+		serverID:           s.GetServerId(),
+		normalizeSecret:    s.GetNormalizeSecret(),
+		skipEntropyCheck:   s.GetSkipEntropyCheck(),
+		window:             s.GetValidityWindow(),
+		appLabel:           s.GetAppLabel(),
+		deriver:            lookupKeyDeriver(s.GetKeyDeriver()),
+		pepper:             unmarshalPepper(s),
+		adHash:             unmarshalAssociatedData(s),
+	}
+	ex.kdf.unmarshal(s)
+	if ex.keyOnly {
+		ex.message = nil
 	}
 	copy(ex.key[:], s.Key)
+	if !suite.isMODP() {
+		copy(ex.xBytes[:], s.XBytes)
+	} else {
+		copy(ex.xBytes[xLen-len(s.XBytes):], s.XBytes)
+	}
+	copy(ex.w1[:], s.W1)
+	copy(ex.kemSeed[:], s.KemSeed)
+	copy(ex.kemSecret[:], s.KemSecret)
+	copy(ex.peerRoundTwoKey[:], s.PeerRoundTwoKey)
+	copy(ex.bodyHash[:], s.BodyHash)
+	copy(ex.peerMessageHash[:], s.PeerMessageHash)
 	if ex.haveSharedKey {
 		copy(ex.sharedKey[:], s.SharedKey)
 	}
-	
+	if s.FailureCode != nil {
+		ex.failure = &FailureError{
+			Code:    FailureCode(s.GetFailureCode()),
+			Message: s.GetFailureMessage(),
+		}
+	}
+	ex.appData = unmarshalAppData(s)
+
 	return ex, nil
 }
 
 // Marshal serializes the state of ex. The serialized data is not encrypted and
-// contains secrets.
+// contains secrets. It panics if the state can't be serialized, which
+// indicates a bug in this package; MarshalTo returns an error instead.
 func (ex *Exchange) Marshal() []byte {
+	s, err := ex.marshal()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// marshal serializes the state of ex.
+func (ex *Exchange) marshal() ([]byte, error) {
 	var sharedKey []byte
 	if ex.haveSharedKey {
 		sharedKey = ex.sharedKey[:]
 	}
 
-	s, err := proto.Marshal(&stateproto.State{
-		Key: ex.key[:],
-		Message: ex.message,
-		XBytes: ex.x.Bytes(),
-		PublicBytes: ex.X.Bytes(),
-		SharedKey: sharedKey,
-	})
+	message := ex.message
+	if message == nil {
+		// The field is required.
+		message = []byte{}
+	}
+	state := &stateproto.State{
+		Key:         ex.key[:],
+		Message:     message,
+		XBytes:      bytes.TrimLeft(ex.xBytes[:], "\x00"),
+		PublicBytes: ex.public,
+		SharedKey:   sharedKey,
+	}
+	if !ex.suite.isMODP() {
+		state.XBytes = ex.xBytes[:scalarLen]
+	}
+	ex.kdf.marshal(state)
+	marshalSuite(ex.suite, state)
+	if ex.group != nil {
+		marshalCustomGroup(ex.group.p, ex.group.g, ex.group.n, state)
+	}
+	marshalVersion(ex.version, state)
+	marshalBodySize(ex.bodySize, state)
+	marshalPeerBodySizes(ex.peerBodySizes, state)
+	if ex.version >= ProtocolVersion2 && ex.haveSharedKey {
+		state.BodyHash = ex.bodyHash[:]
+	}
+	if ex.role != 0 {
+		state.AugmentedRole = proto.Int32(int32(ex.role))
+		if ex.role == roleProver {
+			state.W1 = ex.w1[:]
+		} else {
+			state.VerifierL = ex.verifierL
+		}
+	}
+	if ex.keyConfirmation {
+		state.KeyConfirmation = proto.Bool(true)
+	}
+	state.PeerConfirmation = ex.peerConfirmation
+	if ex.hybridKEM {
+		state.HybridKem = proto.Bool(true)
+		state.KemSeed = ex.kemSeed[:]
+		if len(ex.kemCiphertext) > 0 {
+			state.KemCiphertext = ex.kemCiphertext
+			state.KemSecret = ex.kemSecret[:]
+		}
+	}
+	if ex.fragmentation {
+		state.Fragmentation = proto.Bool(true)
+	}
+	if ex.fragmented {
+		state.Fragmented = proto.Bool(true)
+	}
+	if ex.compression {
+		state.Compression = proto.Bool(true)
+	}
+	if ex.compressed {
+		state.Compressed = proto.Bool(true)
+		state.EncodedMessage = ex.encoded
+	}
+	if ex.keyOnly {
+		state.KeyOnly = proto.Bool(true)
+	}
+	if ex.peerKeyOnly {
+		state.PeerKeyOnly = proto.Bool(true)
+	}
+	state.Messages = marshalItems(ex.messages)
+	for _, id := range ex.peerMessageIDs {
+		state.PeerMessageIds = append(state.PeerMessageIds, uint32(id))
+	}
+	state.ReceivedMessages = marshalItems(ex.receivedMessages)
+	if ex.peerFragmentHeader != nil {
+		state.PeerFragmentHeader = ex.peerFragmentHeader
+		state.PeerRoundTwoKey = ex.peerRoundTwoKey[:]
+		state.Fragments = marshalFragments(ex.fragments)
+	}
+	if ex.complete {
+		state.Complete = proto.Bool(true)
+		state.PeerMessageHash = ex.peerMessageHash[:]
+	}
+	if ex.peerAcknowledged {
+		state.PeerAcknowledged = proto.Bool(true)
+	}
+	if len(ex.serverID) > 0 {
+		state.ServerId = proto.String(ex.serverID)
+	}
+	if ex.normalizeSecret {
+		state.NormalizeSecret = proto.Bool(true)
+	}
+	if ex.skipEntropyCheck {
+		state.SkipEntropyCheck = proto.Bool(true)
+	}
+	if len(ex.window) > 0 {
+		state.ValidityWindow = proto.String(ex.window)
+	}
+	if len(ex.appLabel) > 0 {
+		state.AppLabel = proto.String(ex.appLabel)
+	}
+	if ex.deriver != nil {
+		state.KeyDeriver = proto.String(ex.deriver.Name())
+	}
+	if ex.pepper != nil {
+		state.PepperHash = ex.pepper[:]
+	}
+	if ex.adHash != nil {
+		state.AssociatedDataHash = ex.adHash[:]
+	}
+	if ex.failure != nil {
+		state.FailureCode = proto.Int32(int32(ex.failure.Code))
+		state.FailureMessage = proto.String(ex.failure.Message)
+	}
+	state.AppData = marshalAppData(ex.appData)
+
+	return proto.Marshal(state)
+}
+
+// MaxMessageLen returns the largest message that an Exchange with the same
+// configuration as ex could send.
+func (ex *Exchange) MaxMessageLen() int {
+	return maxMessageLenOffered(ex.version, ex.bodySize, ex.keyConfirmation, ex.hybridKEM, ex.fragmentation, ex.compression)
+}
+
+// Fail marks ex as abandoned. The reason is recorded in the serialized state
+// and all further calls to Process will return it. If reason is a
+// *FailureError then its code is kept, otherwise FailureOther is used. A nil
+// reason is recorded as FailureOther with an empty message. Only the first
+// call to Fail has any effect.
+func (ex *Exchange) Fail(reason error) {
+	if ex.failure != nil {
+		return
+	}
+	failure, ok := reason.(*FailureError)
+	switch {
+	case ok && failure != nil:
+	case reason == nil || ok:
+		failure = &FailureError{Code: FailureOther}
+	default:
+		failure = &FailureError{Code: FailureOther, Message: reason.Error()}
+	}
+	ex.failure = failure
+}
+
+// Err returns the reason that ex was marked as failed, or nil if it hasn't
+// been.
+func (ex *Exchange) Err() error {
+	if ex.failure == nil {
+		return nil
+	}
+	return ex.failure
+}
+
+// MarshalTo writes the serialized state of ex, as returned by Marshal, to w.
+// As with Marshal, the output is not encrypted and contains secrets. Unlike
+// Marshal, it returns an error if the state can't be serialized.
+func (ex *Exchange) MarshalTo(w io.Writer) error {
+	s, err := ex.marshal()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return s
+	_, err = w.Write(s)
+	return err
+}
+
+// UnmarshalFrom creates an Exchange from a serialized state read from r. It
+// reads no more than limit bytes and returns an error if r has more data than
+// that, rather than buffering an unbounded stream. A negative limit is an
+// error.
+func UnmarshalFrom(r io.Reader, limit int64) (*Exchange, error) {
+	if limit < 0 {
+		return nil, errors.New("panda: negative limit for serialized state")
+	}
+	// One byte more than limit is read to detect a longer state, unless
+	// that would overflow, in which case no longer state can exist anyway.
+	n := limit
+	if n < math.MaxInt64 {
+		n++
+	}
+	data, err := ioutil.ReadAll(&io.LimitedReader{R: r, N: n})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errors.New("panda: serialized state exceeds limit")
+	}
+	return Unmarshal(data)
+}
+
+// parseState decodes a serialized state without constructing an Exchange.
+// The name of the argument is included in any error so that callers
+// comparing two states can tell which was corrupt.
+func parseState(data []byte, name string) (*stateproto.State, error) {
+	s := new(stateproto.State)
+	if err := proto.Unmarshal(data, s); err != nil {
+		return nil, errors.New("panda: " + name + " state is corrupt: " + err.Error())
+	}
+	if len(s.Key) != 32 {
+		return nil, errors.New("panda: " + name + " state is corrupt: bad key length")
+	}
+	return s, nil
+}
+
+// stateFingerprint identifies the exchange that s belongs to, independent of
+// its progress.
+func stateFingerprint(s *stateproto.State) []byte {
+	var key [32]byte
+	copy(key[:], s.Key)
+	fingerprintKey := deriveKey(&key, "fingerprint")
+	defer wipe(fingerprintKey)
+	h := hmac.New(sha256.New, fingerprintKey)
+	h.Write(s.PublicBytes)
+	return h.Sum(nil)
+}
+
+// stateStage returns the progress of the exchange in s as one of the Stage
+// constants, which increase as the exchange progresses.
+func stateStage(s *stateproto.State) int {
+	switch {
+	case s.GetComplete():
+		return StageComplete
+	case len(s.SharedKey) > 0:
+		return StageRoundTwo
+	}
+	return StageRoundOne
+}
+
+// SameExchange reports whether two serialized states belong to the same
+// exchange, possibly at different stages of progress.
+func SameExchange(a, b []byte) (bool, error) {
+	sa, err := parseState(a, "first")
+	if err != nil {
+		return false, err
+	}
+	sb, err := parseState(b, "second")
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(stateFingerprint(sa), stateFingerprint(sb)), nil
+}
+
+// MoreAdvanced compares the progress of two serialized states of the same
+// exchange. It returns a positive number if a is further along than b, a
+// negative number if b is further along and zero if they are at the same
+// stage. It is an error for the states to belong to different exchanges.
+func MoreAdvanced(a, b []byte) (int, error) {
+	sa, err := parseState(a, "first")
+	if err != nil {
+		return 0, err
+	}
+	sb, err := parseState(b, "second")
+	if err != nil {
+		return 0, err
+	}
+	if !hmac.Equal(stateFingerprint(sa), stateFingerprint(sb)) {
+		return 0, errors.New("panda: states belong to different exchanges")
+	}
+	return stateStage(sa) - stateStage(sb), nil
+}
+
+// These are the values of StateInfo.Stage.
+const (
+	// StageRoundOne is the stage of an exchange waiting on the first round.
+	StageRoundOne = 1
+	// StageRoundTwo is the stage of an exchange waiting on the second round.
+	StageRoundTwo = 2
+	// StageComplete is the stage of an exchange that has completed.
+	StageComplete = 3
+)
+
+// StateInfo summarizes a serialized state without any of its secrets.
+type StateInfo struct {
+	// Stage is StageRoundOne, StageRoundTwo or StageComplete.
+	Stage int
+	// Failed is true if the exchange was marked as failed with Fail.
+	Failed bool
+	KDF    KDF
+	Suite  Suite
+	// KeyDeriver is the name of the KeyDeriver that replaced the KDF, if
+	// any.
+	KeyDeriver string
+	// ServerID is the meeting place that the exchange is bound to, if any.
+	ServerID string
+	// Window is the validity window that the exchange is scoped to, if
+	// any.
+	Window string
+	// AppLabel is the application that the exchange is bound to, if any.
+	// See WithContext.
+	AppLabel string
+	// BodySize is the size to which bodies are padded. See WithBodySize.
+	BodySize int
+	// Acknowledged is true once the peer's acknowledgment has been
+	// processed. See Exchange.Acknowledgment.
+	Acknowledged bool
+	// AppData is the application's metadata. See SetAppData.
+	AppData map[string]string
+}
+
+// PeekStateInfo returns a summary of the serialized state in data, as
+// returned by Marshal, without constructing an Exchange.
+func PeekStateInfo(data []byte) (StateInfo, error) {
+	s, err := parseState(data, "serialized")
+	if err != nil {
+		return StateInfo{}, err
+	}
+	if err := checkCustomGroupAllowed(unmarshalCustomGroup(s)); err != nil {
+		return StateInfo{}, err
+	}
+	return StateInfo{
+		Stage:        stateStage(s),
+		Failed:       s.FailureCode != nil,
+		KDF:          KDF(s.GetKdf()),
+		Suite:        unmarshalSuite(s),
+		KeyDeriver:   s.GetKeyDeriver(),
+		ServerID:     s.GetServerId(),
+		Window:       s.GetValidityWindow(),
+		AppLabel:     s.GetAppLabel(),
+		BodySize:     unmarshalBodySize(s),
+		Acknowledged: s.GetPeerAcknowledged(),
+		AppData:      unmarshalAppData(s),
+	}, nil
 }
 
 func deriveKey(key *[32]byte, context string) []byte {
@@ -159,40 +840,142 @@ func deriveKey(key *[32]byte, context string) []byte {
 	return h.Sum(nil)
 }
 
-func (ex *Exchange) nPW() *big.Int {
-	return new(big.Int).Exp(groupN, new(big.Int).SetBytes(deriveKey(&ex.key, "spake")), groupP)
+// context returns the context used to derive the value named by label from
+// the exchange key.
+func (ex *Exchange) context(label string) string {
+	prefix := ex.suite.label() + ex.kdf.label()
+	if ex.group != nil {
+		prefix += ex.group.label
+	}
+	if ex.version >= ProtocolVersion2 {
+		prefix = "PANDA v" + strconv.Itoa(ex.version) + " " + prefix
+	}
+	if ex.role != 0 {
+		prefix += "spake2+ "
+	}
+	if len(ex.serverID) > 0 {
+		prefix += "server " + strconv.Itoa(len(ex.serverID)) + ":" + ex.serverID + " "
+	}
+	if len(ex.window) > 0 {
+		prefix += "window " + strconv.Itoa(len(ex.window)) + ":" + ex.window + " "
+	}
+	if len(ex.appLabel) > 0 {
+		prefix += "app " + strconv.Itoa(len(ex.appLabel)) + ":" + ex.appLabel + " "
+	}
+	return prefix + label
 }
 
-func padAndBox(key *[32]byte, body []byte) []byte {
-	nonceSlice := deriveKey(key, string(body))
-	var nonce [24]byte
-	copy(nonce[:], nonceSlice)
+// nPW returns the element that masks SPAKE2 public values in a MODP group.
+// It returns an error if the element is degenerate: zero, which has no
+// inverse, or one, which masks nothing.
+func (ex *Exchange) nPW() (*big.Int, error) {
+	exponent := ex.spakeSeed(false)
+	defer wipe(exponent)
+	group := ex.modp()
+	var npw *big.Int
+	if ex.version >= ProtocolVersion3 {
+		n, err := ex.maskElement()
+		if err != nil {
+			return nil, err
+		}
+		npw = group.exp(n, exponent)
+	} else {
+		npw = group.expN(exponent)
+	}
+	if npw.Cmp(big.NewInt(1)) <= 0 {
+		return nil, errors.New("panda: password element is degenerate")
+	}
+	return npw, nil
+}
 
-	padded := make([]byte, bodySize - len(nonce) - secretbox.Overhead)
-	padded[0] = byte(len(body))
-	padded[1] = byte(len(body) >> 8)
-	if n := copy(padded[2:], body); n < len(body) {
-		panic("argument to padAndBox too large: " + strconv.Itoa(len(body)))
+// lengthFieldLen returns the number of bytes, at the start of the padded
+// contents of a box, that record the length of the body: two, little-endian,
+// or three from version 4.
+func lengthFieldLen(version int) int {
+	if version >= ProtocolVersion4 {
+		return 3
 	}
+	return 2
+}
+
+// ErrBodyTooLarge is wrapped by the *RoundError returned when the contents of
+// a body don't fit in it. New rejects messages that could cause it, so it
+// indicates a bug in this package.
+var ErrBodyTooLarge = errors.New("panda: contents too large for body")
+
+// A RoundError is returned when a body can't be produced. Round is the
+// protocol round that the body was for, or 3 for acknowledgments.
+type RoundError struct {
+	Round int
+	Err   error
+}
+
+func (e *RoundError) Error() string {
+	return "panda: round " + strconv.Itoa(e.Round) + ": " + e.Err.Error()
+}
+
+func (e *RoundError) Unwrap() error {
+	return e.Err
+}
 
-	box := make([]byte, bodySize)
+// padAndBox pads body to a fixed size and seals it with key, using the AEAD
+// of the given suite and the length field and nonce derivation of the given
+// version. round is the protocol round that the body is sent in, or
+// roundAck for acknowledgments.
+func padAndBox(suite Suite, version int, key *[32]byte, round int, body []byte) ([]byte, error) {
+	return padAndBoxTo(suite, version, key, round, body, bodySize)
+}
+
+// padAndBoxTo is like padAndBox but produces a result of the given size.
+func padAndBoxTo(suite Suite, version int, key *[32]byte, round int, body []byte, size int) ([]byte, error) {
+	lengthLen := lengthFieldLen(version)
+	if len(body) >= 1<<(8*uint(lengthLen)) || len(body) > size-24-secretbox.Overhead-lengthLen {
+		return nil, &RoundError{round, ErrBodyTooLarge}
+	}
+	nonce := bodyNonce(version, key, round, body)
+
+	padded := make([]byte, size-len(nonce)-secretbox.Overhead)
+	for i := 0; i < lengthLen; i++ {
+		padded[i] = byte(len(body) >> (8 * uint(i)))
+	}
+	copy(padded[lengthLen:], body)
+
+	box := make([]byte, size)
 	copy(box, nonce[:])
-	secretbox.Seal(box[len(nonce):len(nonce)], padded, &nonce, key)
-	return box
+	if suite == SuiteP256 {
+		newGCM(key).Seal(box[len(nonce):len(nonce)], nonce[:gcmNonceSize], padded, nil)
+	} else {
+		secretbox.Seal(box[len(nonce):len(nonce)], padded, nonce, key)
+	}
+	return box, nil
 }
 
-func unbox(key *[32]byte, body []byte) ([]byte, error) {
+// unbox opens a body sealed by padAndBox and removes the padding. Callers
+// check that body is of an expected size first; see checkReplyLen.
+func unbox(suite Suite, version int, key *[32]byte, body []byte) ([]byte, error) {
 	var nonce [24]byte
-	if len(body) < len(nonce)+secretbox.Overhead+2 {
+	lengthLen := lengthFieldLen(version)
+	if len(body) < len(nonce)+secretbox.Overhead+lengthLen {
 		return nil, errors.New("panda: reply from server is too short to be valid")
 	}
 	copy(nonce[:], body)
-	unsealed, ok := secretbox.Open(nil, body[len(nonce):], &nonce, key)
+	var unsealed []byte
+	ok := false
+	if suite == SuiteP256 {
+		var err error
+		unsealed, err = newGCM(key).Open(nil, nonce[:gcmNonceSize], body[len(nonce):], nil)
+		ok = err == nil
+	} else {
+		unsealed, ok = secretbox.Open(nil, body[len(nonce):], &nonce, key)
+	}
 	if !ok {
 		return nil, errors.New("panda: failed to authenticate reply from server")
 	}
-	l := int(unsealed[0]) | int(unsealed[1]) << 8
-	unsealed = unsealed[2:]
+	l := 0
+	for i := 0; i < lengthLen; i++ {
+		l |= int(unsealed[i]) << (8 * uint(i))
+	}
+	unsealed = unsealed[lengthLen:]
 	if l > len(unsealed) {
 		return nil, errors.New("panda: corrupt but authentic message found")
 	}
@@ -200,63 +983,395 @@ func unbox(key *[32]byte, body []byte) ([]byte, error) {
 }
 
 // NextRequest returns a tag and message for transmission to the shared server.
-// NextRequest is idempotent.
+// NextRequest is idempotent. From ProtocolVersion5 the length of the body
+// depends on its contents, so transports that size uploads in advance should
+// use len(body). See WithBodySize.
+//
+// A failed exchange has nothing to post, so NextRequest returns nil for it.
+// Otherwise it panics if NextRequestErr would return an error, which New and
+// Unmarshal are meant to prevent. Long-running programs that hold many
+// exchanges should call NextRequestErr instead.
 func (ex *Exchange) NextRequest() (tag, body []byte) {
+	tag, body, err := ex.NextRequestErr()
+	if ex.failure != nil {
+		return nil, nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return tag, body
+}
+
+// NextRequestErr is like NextRequest but returns an error, rather than
+// panicking, if the body can't be produced, which is a *RoundError, or the
+// failure recorded by Fail if the exchange has failed.
+func (ex *Exchange) NextRequestErr() (tag, body []byte, err error) {
+	if ex.failure != nil {
+		return nil, nil, ex.failure
+	}
 	if !ex.haveSharedKey {
 		// First round: exchange SPAKE2 public values.
-		tag = deriveKey(&ex.key, "round one tag")
-		body = padAndBox(&ex.key, ex.X.Bytes())
+		tag = ex.roundTag(1)
+		body, err = ex.box(1, ex.roundOneKey(), ex.roundOnePayload())
 	} else {
 		// Second round: send encrypted message.
-		tag = deriveKey(&ex.key, "round two tag")
-		body = padAndBox(&ex.sharedKey, ex.message)
+		if ex.multi() {
+			return ex.nextMessageRequest()
+		}
+		tag = ex.roundTag(2)
+		body, err = ex.roundTwoBody()
+	}
+	if err != nil {
+		return nil, nil, err
 	}
-	return
+	return tag, body, nil
 }
 
-func lengthPrefix(n *big.Int) []byte {
-	b := n.Bytes()
+func lengthPrefix(b []byte) []byte {
 	return append([]byte{byte(len(b)), byte(len(b) >> 8)}, b...)
 }
 
+// Result describes the effect of a reply passed to ProcessDetailed.
+type Result struct {
+	// RoundConsumed is the protocol round, either one or two, that the
+	// reply was processed as.
+	RoundConsumed int
+	// KeyAgreed is true if the reply completed the first round and thus
+	// established the shared key.
+	KeyAgreed bool
+	// Completed is true if the reply completed the exchange.
+	Completed bool
+	// Message contains the peer's message if the reply completed the
+	// exchange, except from ProcessTo, which writes it elsewhere. It is
+	// nil if the peer is key-only. See PeerKeyOnly.
+	Message []byte
+	// Index is the position of the consumed reply in the slice passed to
+	// ProcessAny, or -1 if none was consumed.
+	Index int
+	// MessageID is the ID of the message that a second round reply carried
+	// in an exchange created by NewMulti. Message is set the first time
+	// that each of the peer's messages is received.
+	MessageID int
+	// BodySize is the size of the consumed reply, which may differ from
+	// that of our bodies. See WithPeerBodySizes.
+	BodySize int
+}
+
+// ErrTagConflict is returned by ProcessAny when more than one distinct,
+// authentic body from a peer is found under a tag.
+var ErrTagConflict = errors.New("panda: multiple authentic peer bodies found for tag")
+
+// ErrInvalidPeerElement is returned by Process when the peer's SPAKE2 value
+// isn't a valid element of the group, or is one, such as the identity, that
+// would leak information or make the shared key predictable.
+var ErrInvalidPeerElement = errors.New("panda: invalid SPAKE value from peer")
+
+// ErrOwnMessage is returned by Process when the reply is the body that we
+// posted, echoed back by the server. The exchange is unchanged and the
+// caller should keep waiting for the peer.
+var ErrOwnMessage = errors.New("panda: reply is our own body")
+
 // Process processes a message from a peer (presumably exchanged via a shared
 // server). It should always be called after the result of NextRequest has been
 // transmitted. If the exchange is complete, it returns the peer's message.
 // Once this occurs, no further actions are required for the peer to complete
 // the exchange.
 func (ex *Exchange) Process(reply []byte) ([]byte, error) {
+	result, err := ex.ProcessDetailed(reply)
+	if err != nil {
+		return nil, err
+	}
+	return result.Message, nil
+}
+
+// ProcessDetailed is like Process but reports which round the reply was
+// consumed by and what changed as a result, rather than leaving the caller
+// to infer that from whether a message was returned.
+//
+// If the reply is a tombstone from the peer's Abort, an *AbortError is
+// returned and ex is marked as failed with FailureAborted.
+func (ex *Exchange) ProcessDetailed(reply []byte) (Result, error) {
+	result, err := ex.processDetailed(reply)
+	if err == nil {
+		result.BodySize = len(reply)
+	}
+	return result, err
+}
+
+func (ex *Exchange) processDetailed(reply []byte) (Result, error) {
+	if ex.failure != nil {
+		return Result{}, ex.failure
+	}
+
+	if err := ex.checkReplyLen(len(reply)); err != nil {
+		return Result{}, err
+	}
+
+	if abort, ok := ex.openTombstone(reply); ok {
+		if ex.complete {
+			return Result{}, ErrComplete
+		}
+		ex.failure = &FailureError{Code: FailureAborted, Message: abort.Reason}
+		return Result{}, abort
+	}
+
 	if !ex.haveSharedKey {
 		// First round.
-		body, err := unbox(&ex.key, reply)
+		payload, err := unbox(ex.suite, ex.version, ex.roundOneKey(), reply)
+		if err != nil {
+			return Result{}, err
+		}
+		peer, err := ex.splitRoundOne(payload)
+		if err != nil {
+			return Result{}, err
+		}
+		if bytes.Equal(peer.public, ex.public) {
+			return Result{}, ErrOwnMessage
+		}
+		if err := ex.checkPeerMessageIDs(peer.messageIDs); err != nil {
+			return Result{}, err
+		}
+		compressed := ex.compression && peer.compresses
+		sent := ex.message
+		if compressed {
+			sent = encodeMessage(ex.message)
+		}
+		if len(sent) > maxMessageLenOffered(ex.version, ex.bodySize, ex.keyConfirmation && peer.confirms, ex.hybridKEM && peer.kemKey != nil, ex.fragmentation && peer.fragments, false) {
+			if ex.compression && !compressed {
+				return Result{}, ErrCompressionUnsupported
+			}
+			return Result{}, ErrFragmentationUnsupported
+		}
+		if err := ex.hashBodies(reply); err != nil {
+			return Result{}, err
+		}
+		sharedKey, err := ex.agree(peer.public)
+		if err != nil {
+			return Result{}, err
+		}
+		keyOnly := ex.keyOnly && peer.keyOnly
+		if ex.hybridKEM && peer.kemKey != nil && !keyOnly {
+			if err := ex.encapsulate(peer.kemKey); err != nil {
+				*sharedKey = [32]byte{}
+				return Result{}, err
+			}
+		}
+		ex.sharedKey = *sharedKey
+		*sharedKey = [32]byte{}
+		ex.haveSharedKey = true
+		if ex.offersConfirmation() && peer.confirms || peer.keyOnly {
+			ex.peerConfirmation = ex.confirmation(peer.public)
+		}
+		ex.peerKeyOnly = peer.keyOnly
+		ex.peerMessageIDs = peer.messageIDs
+		ex.fragmented = ex.fragmentation && peer.fragments && !keyOnly
+		if compressed {
+			ex.compressed, ex.encoded = true, sent
+		}
+		return Result{RoundConsumed: 1, KeyAgreed: true}, nil
+	}
+
+	if ex.multi() {
+		return ex.processMessage(reply)
+	}
+	ours, err := ex.roundTwoBody()
+	if err != nil {
+		return Result{}, err
+	}
+	if bytes.Equal(reply, ours) {
+		return Result{}, ErrOwnMessage
+	}
+	if ex.fragmented && !ex.peerKeyOnly {
+		return ex.processFragment(reply)
+	}
+	body, err := ex.openRoundTwo(reply)
+	if err != nil {
+		return Result{}, err
+	}
+	message, err := ex.peerMessageFrom(body)
+	if err != nil {
+		return Result{}, err
+	}
+	ex.complete = true
+	ex.peerMessageHash = sha256.Sum256(body)
+	return Result{RoundConsumed: 2, Completed: true, Message: message}, nil
+}
+
+// agree computes the shared key from the peer's first round body.
+func (ex *Exchange) agree(body []byte) (*[32]byte, error) {
+	var a, b, shared []byte
+	if !ex.suite.isMODP() {
+		var err error
+		if ex.suite == SuiteP256 {
+			shared, err = ex.p256Shared(body)
+		} else {
+			shared, err = ex.ristrettoShared(body)
+		}
 		if err != nil {
 			return nil, err
 		}
+		a, b = ex.public, body
+		if bytes.Compare(a, b) > 0 {
+			a, b = b, a
+		}
+	} else {
+		// Values out of range, and the elements of order one and two,
+		// are rejected before anything secret is used.
+		group := ex.modp()
 		Y := new(big.Int).SetBytes(body)
-		if Y.Sign() <= 0 || Y.Cmp(groupP) >= 0 {
-			return nil, errors.New("panda: invalid SPAKE value from peer")
+		one := big.NewInt(1)
+		pMinusOne := new(big.Int).Sub(group.p, one)
+		if Y.Cmp(one) <= 0 || Y.Cmp(pMinusOne) >= 0 {
+			return nil, ErrInvalidPeerElement
 		}
-		npwInv := new(big.Int).ModInverse(ex.nPW(), groupP)
-		unmaskedY := npwInv.Mul(Y, npwInv)
-		unmaskedY.Mod(unmaskedY, groupP)
-		shared := npwInv.Exp(unmaskedY, ex.x, groupP)
-
-		h := hmac.New(sha256.New, ex.key[:])
-		a, b := ex.X, Y
-		if a.Cmp(b) > 0 {
+		// N isn't in the subgroup of order q, so only the unmasked
+		// value can be checked.
+		npw, err := ex.nPW()
+		if err != nil {
+			return nil, err
+		}
+		npwInv := group.inv(npw)
+		wipeInt(npw)
+		if npwInv.Sign() == 0 {
+			return nil, errors.New("panda: password element is not invertible")
+		}
+		unmaskedY := group.mul(Y, npwInv)
+		wipeInt(npwInv)
+		defer wipeInt(unmaskedY)
+		if unmaskedY.Cmp(one) == 0 || group.exp(unmaskedY, group.q.Bytes()).Cmp(one) != 0 {
+			return nil, ErrInvalidPeerElement
+		}
+		sharedInt := group.exp(unmaskedY, ex.secretX())
+		shared = sharedInt.Bytes()
+		wipeInt(sharedInt)
+		a, b = ex.public, Y.Bytes()
+		if new(big.Int).SetBytes(a).Cmp(Y) > 0 {
 			a, b = b, a
 		}
-		h.Write(lengthPrefix(a))
-		h.Write(lengthPrefix(b))
-		h.Write(lengthPrefix(shared))
-		sharedKey := h.Sum(nil)
-		copy(ex.sharedKey[:], sharedKey)
-		ex.haveSharedKey = true
-		return nil, nil
 	}
+	defer wipe(shared)
 
-	body, err := unbox(&ex.sharedKey, reply)
-	if err != nil {
+	transcript := append(lengthPrefix(a), lengthPrefix(b)...)
+	sharedBytes := lengthPrefix(shared)
+	transcript = append(transcript, sharedBytes...)
+	wipe(sharedBytes)
+	defer wipe(transcript)
+	var sharedKey [32]byte
+	sum := ex.sharedKeyFrom(transcript)
+	copy(sharedKey[:], sum)
+	wipe(sum)
+	return &sharedKey, nil
+}
+
+// ErrBadReplySize is wrapped by the *ReplySizeError returned by Process,
+// ProcessFrom and ProcessAny when a reply is not of a size that our bodies
+// could be, as happens when the parties choose different sizes with
+// WithBodySize or a server truncates or concatenates bodies. The size is
+// checked before any attempt to open the reply.
+var ErrBadReplySize = errors.New("panda: reply from server has the wrong size")
+
+// A ReplySizeError gives the size of a rejected reply and the sizes that
+// were acceptable. Before ProtocolVersion5 that is the size given by
+// WithBodySize; from it, each of the allowed sizes up to that one. Either way
+// it includes those of any sizes given by WithPeerBodySizes. From
+// ProcessFrom, Got is one more than the largest acceptable size if the
+// reply was longer still.
+type ReplySizeError struct {
+	Got  int
+	Want []int
+}
+
+func (e *ReplySizeError) Error() string {
+	want := ""
+	for i, n := range e.Want {
+		if i > 0 {
+			want += " or "
+		}
+		want += strconv.Itoa(n)
+	}
+	return "panda: reply from server has the wrong size: got " + strconv.Itoa(e.Got) + " bytes, want " + want
+}
+
+func (e *ReplySizeError) Unwrap() error {
+	return ErrBadReplySize
+}
+
+// ProcessFrom is like Process but reads the reply from r. No more than one
+// byte beyond the size of a valid body is read, so an oversized reply is
+// rejected without being buffered.
+func (ex *Exchange) ProcessFrom(r io.Reader) ([]byte, error) {
+	accepted := ex.bodySizesAccepted()
+	reply := make([]byte, accepted[len(accepted)-1]+1)
+	n, err := io.ReadFull(r, reply)
+	switch err {
+	case nil:
+		return nil, ex.checkReplyLen(n)
+	case io.EOF, io.ErrUnexpectedEOF:
+		if err := ex.checkReplyLen(n); err != nil {
+			return nil, err
+		}
+	default:
 		return nil, err
 	}
-	return body, nil
+	return ex.Process(reply[:n])
+}
+
+// ProcessAny is like ProcessDetailed but takes every body stored under the
+// tag, for servers that return all of them rather than just the peer's.
+// Duplicates and copies of our own request are ignored and at most one of the
+// remaining bodies, the one that authenticates as a body or tombstone, is
+// consumed. If none remain, the Result has an Index of -1 and nothing is
+// changed.
+func (ex *Exchange) ProcessAny(replies [][]byte) (Result, error) {
+	if ex.failure != nil {
+		return Result{}, ex.failure
+	}
+
+	open := func(reply []byte) ([]byte, error) {
+		return unbox(ex.suite, ex.version, ex.roundOneKey(), reply)
+	}
+	if ex.haveSharedKey {
+		open = ex.openRoundTwo
+	}
+	_, ours, err := ex.NextRequestErr()
+	if err != nil {
+		return Result{}, err
+	}
+	oursHash := sha256.Sum256(ours)
+
+	seen := map[[sha256.Size]byte]bool{oursHash: true}
+	found := -1
+	var lastErr error
+	for i, reply := range replies {
+		h := sha256.Sum256(reply)
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if err := ex.checkReplyLen(len(reply)); err != nil {
+			lastErr = err
+			continue
+		}
+		if _, err := open(reply); err != nil {
+			if _, ok := ex.openTombstone(reply); !ok {
+				lastErr = err
+				continue
+			}
+		}
+		if found >= 0 {
+			return Result{}, ErrTagConflict
+		}
+		found = i
+	}
+
+	if found < 0 {
+		if lastErr != nil {
+			return Result{}, lastErr
+		}
+		return Result{Index: -1}, nil
+	}
+
+	result, err := ex.ProcessDetailed(replies[found])
+	result.Index = found
+	return result, err
 }
@@ -2,8 +2,17 @@ package panda
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type pair struct {
@@ -43,6 +52,32 @@ func (s *Server) Transact(tag, message []byte) []byte {
 	panic("collision")
 }
 
+// testDeriver is a cheap KeyDeriver so that tests don't wait for the KDF.
+type testDeriver struct{}
+
+func (testDeriver) Name() string {
+	return "test SHA-256"
+}
+
+func (testDeriver) DeriveKey(secret []byte) ([32]byte, error) {
+	return sha256.Sum256(secret), nil
+}
+
+var fastKDF = WithKeyDeriver(testDeriver{})
+
+func init() {
+	RegisterKeyDeriver(testDeriver{})
+}
+
+// mustPadAndBox is padAndBox for contents that are known to fit.
+func mustPadAndBox(t *testing.T, suite Suite, version int, key *[32]byte, round int, body []byte) []byte {
+	box, err := padAndBox(suite, version, key, round, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
+
 func marshalUnmarshal(ex *Exchange) *Exchange {
 	marshaled := ex.Marshal()
 	duplicate, err := Unmarshal(marshaled)
@@ -52,17 +87,49 @@ func marshalUnmarshal(ex *Exchange) *Exchange {
 	return duplicate
 }
 
-func TestPANDA(t *testing.T) {
-	testingMode = true
+// runExchange runs a and b to completion via a test server and returns the
+// message that each received.
+func runExchange(t *testing.T, a, b *Exchange) (aResult, bResult []byte) {
+	server := &Server{make(map[string]*pair)}
+	aDone, bDone := false, false
 
+	for i := 0; !aDone || !bDone; i++ {
+		if i > 10 {
+			t.Fatal("exchange did not complete")
+		}
+		if !aDone {
+			tag, msg := a.NextRequest()
+			if reply := server.Transact(tag, msg); len(reply) > 0 {
+				result, err := a.ProcessDetailed(reply)
+				if err != nil {
+					t.Fatalf("Error from a: %s", err)
+				}
+				aResult, aDone = result.Message, result.RoundConsumed == 2
+			}
+		}
+		if !bDone {
+			tag, msg := b.NextRequest()
+			if reply := server.Transact(tag, msg); len(reply) > 0 {
+				result, err := b.ProcessDetailed(reply)
+				if err != nil {
+					t.Fatalf("Error from b: %s", err)
+				}
+				bResult, bDone = result.Message, result.RoundConsumed == 2
+			}
+		}
+	}
+	return
+}
+
+func TestPANDA(t *testing.T) {
 	aMessage := []byte("0123456789")
 	bMessage := []byte("abcdefghij")
 	key := []byte("foo")
-	a, err := New(rand.Reader, key, aMessage)
+	a, err := New(rand.Reader, key, aMessage, fastKDF)
 	if err != nil {
 		t.Fatal(err)
 	}
-	b, err := New(rand.Reader, key, bMessage)
+	b, err := New(rand.Reader, key, bMessage, fastKDF)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,3 +171,1121 @@ func TestPANDA(t *testing.T) {
 		t.Errorf("got %x from a, expected %x", aResult, bMessage)
 	}
 }
+
+func TestProcessDetailed(t *testing.T) {
+	aMessage := []byte("0123456789")
+	bMessage := []byte("abcdefghij")
+	key := []byte("foo")
+	a, err := New(rand.Reader, key, aMessage, fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, key, bMessage, fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{make(map[string]*pair)}
+
+	for round := 1; round <= 2; round++ {
+		tag, msg := a.NextRequest()
+		if reply := server.Transact(tag, msg); reply != nil {
+			t.Fatalf("round %d: unexpected reply for first poster", round)
+		}
+		tag, msg = b.NextRequest()
+		reply := server.Transact(tag, msg)
+		result, err := b.ProcessDetailed(reply)
+		if err != nil {
+			t.Fatalf("round %d: error from b: %s", round, err)
+		}
+		if result.RoundConsumed != round {
+			t.Errorf("round %d: b consumed round %d", round, result.RoundConsumed)
+		}
+		if result.KeyAgreed != (round == 1) {
+			t.Errorf("round %d: b reported KeyAgreed = %t", round, result.KeyAgreed)
+		}
+
+		tag, msg = a.NextRequest()
+		reply = server.Transact(tag, msg)
+		aResult, err := a.ProcessDetailed(reply)
+		if err != nil {
+			t.Fatalf("round %d: error from a: %s", round, err)
+		}
+		if aResult.RoundConsumed != round || aResult.KeyAgreed != (round == 1) {
+			t.Errorf("round %d: unexpected result from a: %+v", round, aResult)
+		}
+
+		if round == 1 {
+			if result.Message != nil || aResult.Message != nil {
+				t.Errorf("message returned after first round")
+			}
+			continue
+		}
+		if !bytes.Equal(result.Message, aMessage) {
+			t.Errorf("got %x from b, expected %x", result.Message, aMessage)
+		}
+		if !bytes.Equal(aResult.Message, bMessage) {
+			t.Errorf("got %x from a, expected %x", aResult.Message, bMessage)
+		}
+	}
+}
+
+func TestMarshalToUnmarshalFrom(t *testing.T) {
+	ex, err := New(rand.Reader, []byte("foo"), []byte("message"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := ex.Marshal()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(ex.MarshalTo(w))
+	}()
+	duplicate, err := UnmarshalFrom(r, int64(len(serialized)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(duplicate.Marshal(), serialized) {
+		t.Errorf("state changed after round trip through a pipe")
+	}
+
+	if _, err := UnmarshalFrom(bytes.NewReader(serialized), int64(len(serialized)-1)); err == nil {
+		t.Errorf("oversized state was accepted")
+	}
+	if _, err := UnmarshalFrom(bytes.NewReader(serialized), -1); err == nil {
+		t.Errorf("negative limit was accepted")
+	}
+	duplicate, err = UnmarshalFrom(bytes.NewReader(serialized), math.MaxInt64)
+	if err != nil {
+		t.Fatalf("UnmarshalFrom failed with the largest limit: %s", err)
+	}
+	if !bytes.Equal(duplicate.Marshal(), serialized) {
+		t.Errorf("state changed after round trip with the largest limit")
+	}
+}
+
+func TestSameExchange(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(rand.Reader, []byte("bar"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := a.Marshal()
+	server := &Server{make(map[string]*pair)}
+	tag, msg := a.NextRequest()
+	server.Transact(tag, msg)
+	tag, msg = b.NextRequest()
+	server.Transact(tag, msg)
+	tag, msg = a.NextRequest()
+	if _, err := a.Process(server.Transact(tag, msg)); err != nil {
+		t.Fatal(err)
+	}
+	after := a.Marshal()
+
+	if same, err := SameExchange(before, after); err != nil || !same {
+		t.Errorf("SameExchange(before, after) = %t, %v", same, err)
+	}
+	if same, err := SameExchange(before, b.Marshal()); err != nil || same {
+		t.Errorf("SameExchange with the peer's state = %t, %v", same, err)
+	}
+	if same, err := SameExchange(before, other.Marshal()); err != nil || same {
+		t.Errorf("SameExchange with a different secret = %t, %v", same, err)
+	}
+
+	if n, err := MoreAdvanced(after, before); err != nil || n <= 0 {
+		t.Errorf("MoreAdvanced(after, before) = %d, %v", n, err)
+	}
+	if n, err := MoreAdvanced(before, after); err != nil || n >= 0 {
+		t.Errorf("MoreAdvanced(before, after) = %d, %v", n, err)
+	}
+	if n, err := MoreAdvanced(after, after); err != nil || n != 0 {
+		t.Errorf("MoreAdvanced(after, after) = %d, %v", n, err)
+	}
+	if _, err := MoreAdvanced(before, other.Marshal()); err == nil {
+		t.Errorf("MoreAdvanced accepted states from different exchanges")
+	}
+
+	corrupt := []byte{0xff, 0xff}
+	if _, err := SameExchange(corrupt, after); err == nil || !strings.Contains(err.Error(), "first") {
+		t.Errorf("corrupt first state gave error %v", err)
+	}
+	if _, err := MoreAdvanced(after, corrupt); err == nil || !strings.Contains(err.Error(), "second") {
+		t.Errorf("corrupt second state gave error %v", err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Err() != nil {
+		t.Fatalf("new exchange has error %s", a.Err())
+	}
+
+	a.Fail(&FailureError{Code: FailureDeadline, Message: "deadline passed"})
+	a.Fail(errors.New("ignored"))
+	a = marshalUnmarshal(a)
+
+	failure, ok := a.Err().(*FailureError)
+	if !ok {
+		t.Fatalf("Err returned %v after restore", a.Err())
+	}
+	if failure.Code != FailureDeadline || failure.Message != "deadline passed" {
+		t.Errorf("got failure %+v after restore", failure)
+	}
+
+	_, body := b.NextRequest()
+	if _, err := a.Process(body); !errors.Is(err, ErrExchangeFailed) {
+		t.Errorf("Process on failed exchange returned %v", err)
+	}
+	if tag, body, err := a.NextRequestErr(); tag != nil || body != nil || !errors.Is(err, ErrExchangeFailed) {
+		t.Errorf("NextRequestErr on failed exchange returned %v", err)
+	}
+	if tag, body := a.NextRequest(); tag != nil || body != nil {
+		t.Error("NextRequest on failed exchange returned a request")
+	}
+
+	b.Fail(errors.New("something else"))
+	if failure := b.Err().(*FailureError); failure.Code != FailureOther || failure.Message != "something else" {
+		t.Errorf("got failure %+v for plain error", failure)
+	}
+
+	for _, reason := range []error{nil, (*FailureError)(nil)} {
+		c, err := New(rand.Reader, []byte("foo"), []byte("c"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Fail(reason)
+		c = marshalUnmarshal(c)
+		if failure, ok := c.Err().(*FailureError); !ok || failure.Code != FailureOther || failure.Message != "" {
+			t.Errorf("got failure %v for %#v", c.Err(), reason)
+		}
+	}
+}
+
+func TestMaxMessageLen(t *testing.T) {
+	for _, test := range []struct {
+		version int
+		want    int
+	}{
+		{ProtocolVersion1, maxLegacyMessageLen},
+		{ProtocolVersion3, maxLegacyMessageLen},
+		{ProtocolVersion4, MaxMessageLen},
+	} {
+		limit, err := MaxMessageLenFor(WithProtocolVersion(test.version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit != test.want {
+			t.Errorf("version %d: MaxMessageLenFor() = %d, want %d", test.version, limit, test.want)
+		}
+
+		ex, err := New(rand.Reader, []byte("foo"), make([]byte, limit), WithProtocolVersion(test.version), fastKDF)
+		if err != nil {
+			t.Fatalf("version %d: message at the limit was rejected: %s", test.version, err)
+		}
+		if n := ex.MaxMessageLen(); n != limit {
+			t.Errorf("version %d: Exchange.MaxMessageLen() = %d, want %d", test.version, n, limit)
+		}
+		if _, err := New(rand.Reader, []byte("foo"), make([]byte, limit+1), WithProtocolVersion(test.version), fastKDF); err == nil {
+			t.Errorf("version %d: message one byte over the limit was accepted", test.version)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	// New rejects messages that wouldn't fit once the options offered
+	// have taken their share of the body.
+	for _, opts := range [][]Option{
+		{WithKeyConfirmation()},
+		{WithHybridKEM()},
+		{WithFragmentation()},
+		{WithCompression()},
+		{WithFragmentation(), WithCompression(), WithKeyConfirmation()},
+	} {
+		opts = append([]Option{WithProtocolVersion(ProtocolVersion4), fastKDF}, opts...)
+		limit, err := MaxMessageLenFor(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := make([]byte, limit+1)
+		rand.Read(message)
+		if _, err := New(rand.Reader, []byte("foo"), message, opts...); err == nil {
+			t.Errorf("%d-byte message was accepted with a limit of %d", len(message), limit)
+		}
+		if _, err := New(rand.Reader, []byte("foo"), message[:limit], opts...); err != nil {
+			t.Errorf("%d-byte message was rejected: %v", limit, err)
+		}
+	}
+
+	var key [32]byte
+	for _, test := range []struct {
+		version, n int
+	}{
+		{ProtocolVersion4, MaxMessageLen + 1},
+		{ProtocolVersion1, maxLegacyMessageLen + 1},
+	} {
+		_, err := padAndBox(SuiteMODP4096, test.version, &key, 2, make([]byte, test.n))
+		var roundErr *RoundError
+		if !errors.As(err, &roundErr) || roundErr.Round != 2 || !errors.Is(err, ErrBodyTooLarge) {
+			t.Errorf("version %d: padAndBox gave %v for %d bytes", test.version, err, test.n)
+		}
+	}
+
+	// Bodies that can't be produced are errors from NextRequestErr.
+	a, b := newPair(t, WithBodySize(BodySize4K))
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	if _, err := a.Process(bBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+	a.message = make([]byte, BodySize4K)
+	var roundErr *RoundError
+	if _, _, err := a.NextRequestErr(); !errors.As(err, &roundErr) || roundErr.Round != 2 {
+		t.Errorf("NextRequestErr gave %v for an oversized message", err)
+	}
+	if _, err := a.Process(aBody); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("Process gave %v for an oversized message", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("NextRequest didn't panic for an oversized message")
+		}
+	}()
+	a.NextRequest()
+}
+
+func TestLongMessages(t *testing.T) {
+	var key [32]byte
+	for _, n := range []int{maxLegacyMessageLen, maxLegacyMessageLen + 1, MaxMessageLen} {
+		message := make([]byte, n)
+		rand.Read(message)
+		for _, suite := range []Suite{SuiteMODP4096, SuiteP256} {
+			box := mustPadAndBox(t, suite, ProtocolVersion4, &key, 1, message)
+			if opened, err := unbox(suite, ProtocolVersion4, &key, box); err != nil || !bytes.Equal(opened, message) {
+				t.Errorf("suite %d: %d-byte message didn't round trip: %v", suite, n, err)
+			}
+		}
+
+		a, err := New(rand.Reader, []byte("foo"), message, WithProtocolVersion(ProtocolVersion4), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithProtocolVersion(ProtocolVersion4), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aResult, bResult := runExchange(t, a, b)
+		if string(aResult) != "b" || !bytes.Equal(bResult, message) {
+			t.Errorf("%d-byte message wasn't exchanged intact", n)
+		}
+	}
+
+	// Before version 4, messages that don't fit in the length field are
+	// rejected rather than truncated.
+	if _, err := New(rand.Reader, []byte("foo"), make([]byte, maxLegacyMessageLen+1), fastKDF); err == nil {
+		t.Errorf("version 1 exchange accepted a message too long for its length field")
+	}
+}
+
+func TestRederiveSecret(t *testing.T) {
+	opts := []Option{WithKDF(KDFBalloon), WithBalloonCost(64, 1)}
+	a, err := New(rand.Reader, []byte("fob"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{make(map[string]*pair)}
+	tag, msg := a.NextRequest()
+	server.Transact(tag, msg)
+	a.Fail(&FailureError{Code: FailureSecretMismatch, Message: "typo"})
+	kdf := a.kdf
+
+	if err := a.RederiveSecret(rand.Reader, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if a.Err() != nil {
+		t.Errorf("failure survived RederiveSecret: %s", a.Err())
+	}
+	if a.kdf != kdf {
+		t.Errorf("KDF parameters changed: got %+v, want %+v", a.kdf, kdf)
+	}
+	if newTag, _ := a.NextRequest(); bytes.Equal(newTag, tag) {
+		t.Errorf("tag did not change")
+	}
+
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	a = marshalUnmarshal(a)
+	if err := a.RederiveSecret(rand.Reader, []byte("bar")); err == nil {
+		t.Errorf("RederiveSecret succeeded on a completed exchange")
+	}
+}
+
+func TestProcessAny(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(rand.Reader, []byte("foo"), []byte("c"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, aBody := a.NextRequest()
+	_, bBody := b.NextRequest()
+	_, cBody := c.NextRequest()
+	garbage := make([]byte, len(aBody))
+
+	result, err := a.ProcessAny([][]byte{aBody, aBody})
+	if err != nil || result.Index != -1 || a.haveSharedKey {
+		t.Errorf("ours only: got %+v, %v", result, err)
+	}
+
+	if _, err := a.ProcessAny([][]byte{aBody, bBody, cBody}); err != ErrTagConflict {
+		t.Errorf("two foreign bodies: got %v", err)
+	}
+	if a.haveSharedKey {
+		t.Errorf("conflicting bodies were consumed")
+	}
+
+	if _, err := a.ProcessAny([][]byte{garbage}); err == nil {
+		t.Errorf("garbage only: no error")
+	}
+
+	result, err = a.ProcessAny([][]byte{garbage, aBody, bBody, bBody})
+	if err != nil {
+		t.Fatalf("garbage and theirs: %s", err)
+	}
+	if result.Index != 2 || result.RoundConsumed != 1 || !result.KeyAgreed {
+		t.Errorf("garbage and theirs: got %+v", result)
+	}
+
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+	_, aBody = a.NextRequest()
+	_, bBody = b.NextRequest()
+	result, err = a.ProcessAny([][]byte{aBody, bBody})
+	if err != nil {
+		t.Fatalf("ours and theirs: %s", err)
+	}
+	if result.Index != 1 || result.RoundConsumed != 2 || string(result.Message) != "b" {
+		t.Errorf("ours and theirs: got %+v", result)
+	}
+}
+
+func TestOwnMessage(t *testing.T) {
+	for _, suite := range []Suite{SuiteMODP4096, SuiteRistretto255, SuiteP256} {
+		a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithSuite(suite), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithSuite(suite), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, aBody := a.NextRequest()
+		if _, err := a.Process(aBody); err != ErrOwnMessage {
+			t.Errorf("suite %d, round one: got %v, want ErrOwnMessage", suite, err)
+		}
+		if a.haveSharedKey {
+			t.Errorf("suite %d: echo of round one changed the exchange", suite)
+		}
+		_, bBody := b.NextRequest()
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+
+		_, aBody = a.NextRequest()
+		if _, err := a.Process(aBody); err != ErrOwnMessage {
+			t.Errorf("suite %d, round two: got %v, want ErrOwnMessage", suite, err)
+		}
+		if a.complete {
+			t.Errorf("suite %d: echo of round two completed the exchange", suite)
+		}
+		_, bBody = b.NextRequest()
+		if result, err := a.Process(bBody); err != nil || string(result) != "b" {
+			t.Errorf("suite %d: got %q, %v", suite, result, err)
+		}
+	}
+}
+
+func TestInvalidPeerElement(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	npw, err := a.nPW()
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := big.NewInt(1)
+	pMinusOne := new(big.Int).Sub(modp4096.p, one)
+	// outside is a valid element once unmasked, but not in the subgroup.
+	outside := new(big.Int).Exp(modp4096.g, big.NewInt(5), modp4096.p)
+	outside.Sub(modp4096.p, outside)
+	outside.Mul(outside, npw)
+	outside.Mod(outside, modp4096.p)
+
+	for _, test := range []struct {
+		name string
+		Y    *big.Int
+	}{
+		{"zero", new(big.Int)},
+		{"one", one},
+		{"p-1", pMinusOne},
+		{"p", modp4096.p},
+		{"p+1", new(big.Int).Add(modp4096.p, one)},
+		{"mask", npw},
+		{"outside the subgroup", outside},
+	} {
+		body := mustPadAndBox(t, a.suite, a.version, a.roundOneKey(), 1, test.Y.Bytes())
+		if _, err := a.Process(body); err != ErrInvalidPeerElement {
+			t.Errorf("%s: got %v, want ErrInvalidPeerElement", test.name, err)
+		}
+		if a.haveSharedKey {
+			t.Fatalf("%s: value was accepted", test.name)
+		}
+	}
+
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
+
+func TestDegeneratePasswordElement(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bBody := b.NextRequest()
+
+	// No key can make the password element degenerate with the real
+	// group, so replace N instead.
+	defer func(n *fixedBase) { modp4096.nBase = n }(modp4096.nBase)
+	for _, test := range []struct {
+		name string
+		n    *big.Int
+	}{
+		{"p", modp4096.p},
+		{"one", big.NewInt(1)},
+	} {
+		modp4096.nBase = newFixedBase(modp4096, test.n, modp4096.nBase.bits)
+		if _, err := New(rand.Reader, []byte("foo"), nil, fastKDF); err == nil {
+			t.Errorf("N = %s: New succeeded", test.name)
+		}
+		if _, err := a.Process(bBody); err == nil {
+			t.Errorf("N = %s: Process succeeded", test.name)
+		}
+	}
+}
+
+func TestServerBinding(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithServerBinding("https://one.example"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithServerBinding("https://two.example"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound, err := New(rand.Reader, []byte("foo"), []byte("c"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aTag, aBody := a.NextRequest()
+	bTag, _ := b.NextRequest()
+	unboundTag, _ := unbound.NextRequest()
+	if bytes.Equal(aTag, bTag) || bytes.Equal(aTag, unboundTag) {
+		t.Errorf("tags are shared between servers")
+	}
+
+	// A body copied from one server to another is posted under a tag that
+	// the other peer never looks at.
+	server := &Server{make(map[string]*pair)}
+	server.Transact(aTag, aBody)
+	if reply := server.Transact(bTag, aBody); len(reply) > 0 {
+		t.Errorf("replayed body was found under a different server's tag")
+	}
+
+	b, err = New(rand.Reader, []byte("foo"), []byte("b"), WithServerBinding("https://one.example"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
+
+func TestServerIDFromURL(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"https://Example.COM/", "https://example.com"},
+		{"https://example.com:443/panda/", "https://example.com/panda"},
+		{"http://example.com:80", "http://example.com"},
+		{"http://example.com:8080/x", "http://example.com:8080/x"},
+		{"ftp://example.com", ""},
+		{"https://example.com/?q=1", ""},
+		{"https://user@example.com", ""},
+	}
+
+	for _, test := range tests {
+		out, err := ServerIDFromURL(test.in)
+		if len(test.out) == 0 {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", test.in, out)
+			}
+			continue
+		}
+		if err != nil || out != test.out {
+			t.Errorf("%s: got %q, %v, want %q", test.in, out, err, test.out)
+		}
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestProcessFrom(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body := b.NextRequest()
+
+	if _, err := a.ProcessFrom(bytes.NewReader(body[:len(body)-1])); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("short reply: got %v", err)
+	}
+	if _, err := a.ProcessFrom(io.MultiReader(bytes.NewReader(body), bytes.NewReader(body))); !errors.Is(err, ErrBadReplySize) {
+		t.Errorf("oversized reply: got %v", err)
+	}
+	streamErr := errors.New("connection reset")
+	if _, err := a.ProcessFrom(io.MultiReader(bytes.NewReader(body[:100]), errorReader{streamErr})); err != streamErr {
+		t.Errorf("failing reader: got %v", err)
+	}
+	if a.haveSharedKey {
+		t.Fatalf("bad replies were consumed")
+	}
+
+	if _, err := a.ProcessFrom(bytes.NewReader(body)); err != nil {
+		t.Errorf("exact-size reply: got %v", err)
+	}
+	if !a.haveSharedKey {
+		t.Errorf("exact-size reply was not consumed")
+	}
+}
+
+func TestAppData(t *testing.T) {
+	ex, err := New(rand.Reader, []byte("foo"), []byte("hello"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, body := ex.NextRequest()
+	stateBefore := ex.Marshal()
+
+	if err := ex.SetAppData("nickname", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.SetAppData("sent", "Tuesday"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ex.SetAppData("sent", ""); err != nil {
+		t.Fatal(err)
+	}
+	if newTag, newBody := ex.NextRequest(); !bytes.Equal(tag, newTag) || !bytes.Equal(body, newBody) {
+		t.Errorf("application data changed the request")
+	}
+	if bytes.Equal(stateBefore, ex.Marshal()) {
+		t.Errorf("application data was not serialized")
+	}
+
+	restored, err := Unmarshal(ex.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appData := restored.AppData(); len(appData) != 1 || appData["nickname"] != "Alice" {
+		t.Errorf("got %v after round trip", appData)
+	}
+	info, err := PeekStateInfo(ex.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AppData["nickname"] != "Alice" {
+		t.Errorf("got %v from PeekStateInfo", info.AppData)
+	}
+	if err := restored.RederiveSecret(rand.Reader, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if restored.AppData()["nickname"] != "Alice" {
+		t.Errorf("application data lost by RederiveSecret")
+	}
+
+	if err := ex.SetAppData("big", strings.Repeat("x", MaxAppDataLen)); err == nil {
+		t.Errorf("oversized application data was accepted")
+	}
+	if err := ex.SetAppData("nickname", strings.Repeat("x", MaxAppDataLen-len("nickname"))); err != nil {
+		t.Errorf("replacing a value was wrongly counted against the limit: %s", err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	abortTime := time.Unix(1400000000, 0)
+
+	newPair := func() (a, b *Exchange) {
+		a, err := New(rand.Reader, []byte("foo"), []byte("hello"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err = New(rand.Reader, []byte("foo"), []byte("world"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a, b
+	}
+	roundOne := func(a, b *Exchange) {
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkAborted := func(b *Exchange, tombstone []byte) {
+		_, err := b.Process(tombstone)
+		var abort *AbortError
+		if !errors.As(err, &abort) || !errors.Is(err, ErrAborted) {
+			t.Fatalf("got %v, want an abort", err)
+		}
+		if abort.Reason != "changed my mind" || !abort.Time.Equal(abortTime) {
+			t.Errorf("got %+v", abort)
+		}
+		restored, err := Unmarshal(b.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := restored.Process(tombstone); !errors.Is(err, ErrExchangeFailed) {
+			t.Errorf("restored exchange was not failed: %v", err)
+		} else if err.(*FailureError).Code != FailureAborted {
+			t.Errorf("got failure %v", err)
+		}
+	}
+
+	// Before key agreement.
+	a, b := newPair()
+	aTag, _ := a.NextRequest()
+	tag, tombstone, err := a.Abort("changed my mind", abortTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tag, aTag) {
+		t.Errorf("tombstone is not for the current tag")
+	}
+	if a.Err() == nil {
+		t.Errorf("aborting did not fail the exchange")
+	}
+	if result, err := b.ProcessAny([][]byte{tombstone}); err == nil || result.Index != 0 {
+		t.Errorf("ProcessAny did not consume the tombstone: %+v, %v", result, err)
+	}
+	a, b = newPair()
+	_, tombstone, _ = a.Abort("changed my mind", abortTime)
+	checkAborted(b, tombstone)
+
+	// After key agreement.
+	a, b = newPair()
+	roundOne(a, b)
+	_, tombstone, _ = a.Abort("changed my mind", abortTime)
+	checkAborted(b, tombstone)
+
+	// A tombstone replayed after the exchange completed is ignored.
+	a, b = newPair()
+	roundOne(a, b)
+	aCopy, err := Unmarshal(a.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tombstone, _ = aCopy.Abort("changed my mind", abortTime)
+	_, aBody := a.NextRequest()
+	if _, err := b.Process(aBody); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Process(tombstone); err != ErrComplete {
+		t.Errorf("got %v for a tombstone after completion", err)
+	}
+	if b.Err() != nil {
+		t.Errorf("late tombstone failed a completed exchange")
+	}
+	if _, _, err := b.Abort("too late", abortTime); err == nil {
+		t.Errorf("completed exchange was aborted")
+	}
+
+	// A tombstone from someone who doesn't know the secret is just garbage.
+	a, b = newPair()
+	other, err := New(rand.Reader, []byte("bar"), []byte("hello"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forged, _ := other.Abort("changed my mind", abortTime)
+	if _, err := b.Process(forged); err == nil || errors.Is(err, ErrAborted) || b.Err() != nil {
+		t.Errorf("got %v for a forged tombstone", err)
+	}
+	if _, _, err := a.Abort(strings.Repeat("x", MaxAbortReasonLen+1), abortTime); err == nil {
+		t.Errorf("overlong reason was accepted")
+	}
+}
+
+func TestVerifyTranscript(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("hello"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("world"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roundOne, roundTwo [][]byte
+	for _, round := range []*[][]byte{&roundOne, &roundTwo} {
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		*round = [][]byte{aBody, bBody}
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Garbage posted by a third party to the same tag.
+	roundOne = append(roundOne, make([]byte, bodySize))
+
+	report, err := VerifyTranscript(a.Marshal(), roundOne, roundTwo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || string(report.PeerMessage) != "world" {
+		t.Errorf("transcript not verified: %+v", report)
+	}
+	want := []Disposition{DispositionOurs, DispositionPeer, DispositionInvalid, DispositionOurs, DispositionPeer}
+	for i, body := range report.Bodies {
+		if body.Disposition != want[i] {
+			t.Errorf("%s, want %s", body, want[i])
+		}
+	}
+
+	tampered := append([]byte(nil), roundTwo[1]...)
+	tampered[len(tampered)-1] ^= 1
+	report, err = VerifyTranscript(a.Marshal(), roundOne, [][]byte{roundTwo[0], tampered})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Verified || report.PeerMessage != nil || report.Bodies[4].Disposition != DispositionInvalid {
+		t.Errorf("tampered transcript verified: %+v", report)
+	}
+
+	// B's body from the first round can't stand in for A's view of the
+	// second.
+	report, err = VerifyTranscript(a.Marshal(), roundOne, [][]byte{roundOne[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Verified {
+		t.Errorf("transcript without a second round verified")
+	}
+
+	incomplete, err := New(rand.Reader, []byte("foo"), []byte("hello"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyTranscript(incomplete.Marshal(), roundOne, roundTwo); err == nil {
+		t.Errorf("incomplete state was accepted")
+	}
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("hello"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ExportKeyingMaterial("label", 32); err == nil {
+		t.Errorf("keying material exported before completion")
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("world"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runExchange(t, a, b)
+
+	aKey, err := a.ExportKeyingMaterial("label", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bKey, err := b.ExportKeyingMaterial("label", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aKey, bKey) {
+		t.Errorf("parties exported different keying material")
+	}
+	otherKey, err := a.ExportKeyingMaterial("other label", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(aKey, otherKey) {
+		t.Errorf("different labels gave the same keying material")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion2} {
+		opts := []Option{WithProtocolVersion(version), WithKeyConfirmation(), fastKDF}
+		a, err := New(rand.Reader, []byte("foo"), []byte("hello"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("world"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Complete() {
+			t.Errorf("version %d: new exchange is complete", version)
+		}
+		if _, err := a.DeriveKey("session", 32); err == nil {
+			t.Errorf("version %d: key derived before completion", version)
+		}
+		runExchange(t, a, b)
+		if !a.Complete() || !b.Complete() {
+			t.Fatalf("version %d: exchange isn't complete", version)
+		}
+
+		aKey, err := a.DeriveKey("session", 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bKey, err := b.DeriveKey("session", 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(aKey, bKey) {
+			t.Errorf("version %d: parties derived different keys", version)
+		}
+		if otherKey, _ := a.DeriveKey("other", 32); bytes.Equal(aKey, otherKey) {
+			t.Errorf("version %d: different labels gave the same key", version)
+		}
+
+		protocolKeys := [][]byte{a.sharedKey[:], a.roundTwoKey()[:]}
+		for _, label := range []string{"", labelBoxRoundTwo, labelConfirmation, "key confirmation", a.context(labelBoxRoundTwo)} {
+			key, err := a.DeriveKey(label, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, protocolKey := range protocolKeys {
+				if bytes.Equal(key, protocolKey) {
+					t.Errorf("version %d: label %q gave a protocol key", version, label)
+				}
+			}
+		}
+	}
+}
+
+func TestNewContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewContext(cancelled, rand.Reader, []byte("foo"), []byte("hello"), fastKDF); err != context.Canceled {
+		t.Errorf("got %v from a cancelled context", err)
+	}
+
+	// The default Balloon cost takes well over a second, so the deadline
+	// expires during the derivation.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ex, err := NewContext(ctx, rand.Reader, []byte("foo"), []byte("hello"), WithKDF(KDFBalloon))
+	if err != context.DeadlineExceeded || ex != nil {
+		t.Errorf("got %v, %v after the deadline", ex, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s to notice the deadline", elapsed)
+	}
+
+	if _, err := NewContext(context.Background(), rand.Reader, []byte("foo"), []byte("hello"), fastKDF); err != nil {
+		t.Errorf("NewContext failed: %s", err)
+	}
+}
+
+// restoreCase configures an exchange for TestRestoredRequests.
+type restoreCase struct {
+	name     string
+	opts     []Option
+	messages [2][]byte
+	multi    bool
+}
+
+func (c restoreCase) newParty(t *testing.T, i int) *Exchange {
+	opts := append([]Option{fastKDF}, c.opts...)
+	var ex *Exchange
+	var err error
+	if c.multi {
+		ex, err = NewMulti(rand.Reader, []byte("foo"), map[int][]byte{i + 1: c.messages[i]}, opts...)
+	} else {
+		ex, err = New(rand.Reader, []byte("foo"), c.messages[i], opts...)
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", c.name, err)
+	}
+	return ex
+}
+
+// requests returns every tag and body that ex would post next.
+func requests(t *testing.T, ex *Exchange) [][]byte {
+	tag, body := ex.NextRequest()
+	all := [][]byte{tag, body}
+	fragments, err := ex.Fragments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fragments {
+		all = append(all, f.Tag, f.Body)
+	}
+	messages, err := ex.MessageRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		all = append(all, m.Tag, m.Body)
+	}
+	return all
+}
+
+func sameRequests(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestRestoredRequests checks that a state restored from a backup, and
+// given the same replies again, posts exactly what the original did, for
+// every option that changes the bodies. The meeting place would otherwise
+// see the second post as a conflict.
+func TestRestoredRequests(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 3*BodySize4K)
+	var cases []restoreCase
+	for version := ProtocolVersion1; version <= ProtocolVersion6; version++ {
+		for _, size := range bodySizes {
+			cases = append(cases, restoreCase{
+				name:     "version " + strconv.Itoa(version) + ", body size " + strconv.Itoa(size),
+				opts:     []Option{WithProtocolVersion(version), WithBodySize(size)},
+				messages: [2][]byte{[]byte("a"), []byte("b")},
+			})
+		}
+	}
+	// The options are tried over the quickest suite.
+	v6 := func(opts ...Option) []Option {
+		return append([]Option{WithProtocolVersion(ProtocolVersion6), WithSuite(SuiteRistretto255)}, opts...)
+	}
+	cases = append(cases,
+		restoreCase{name: "hybrid", opts: v6(WithHybridKEM()), messages: [2][]byte{[]byte("a"), []byte("b")}},
+		restoreCase{name: "fragmentation", opts: v6(WithFragmentation(), WithBodySize(BodySize4K)), messages: [2][]byte{large, []byte("b")}},
+		restoreCase{name: "compression", opts: v6(WithCompression(), WithBodySize(BodySize4K)), messages: [2][]byte{large, []byte("b")}},
+		restoreCase{name: "key confirmation", opts: v6(WithKeyConfirmation()), messages: [2][]byte{[]byte("a"), []byte("b")}},
+		restoreCase{name: "key only", opts: v6()},
+		restoreCase{name: "associated data", opts: v6(WithAssociatedData([]byte("ad"))), messages: [2][]byte{[]byte("a"), []byte("b")}},
+		restoreCase{name: "multi", opts: v6(), messages: [2][]byte{[]byte("a"), []byte("b")}, multi: true},
+	)
+
+	for _, c := range cases {
+		a, b := c.newParty(t, 0), c.newParty(t, 1)
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		_, bBody2 := b.NextRequest()
+
+		// Check the requests before and after each of the peer's bodies
+		// is processed.
+		for round, reply := range [][]byte{bBody, bBody2} {
+			saved := a.Marshal()
+			want := requests(t, a)
+			if got := requests(t, marshalUnmarshal(a)); !sameRequests(got, want) {
+				t.Errorf("%s: requests before round %d reply changed after restoring", c.name, round+1)
+			}
+			if _, err := a.Process(reply); err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+			want = requests(t, a)
+			if got := requests(t, marshalUnmarshal(a)); !sameRequests(got, want) {
+				t.Errorf("%s: requests after round %d reply changed after restoring", c.name, round+1)
+			}
+			restored, err := Unmarshal(saved)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := restored.Process(reply); err != nil {
+				t.Fatalf("%s: %s", c.name, err)
+			}
+			if got := requests(t, restored); !sameRequests(got, want) {
+				t.Errorf("%s: requests changed after processing the round %d reply again", c.name, round+1)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package panda
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/payloadproto"
+)
+
+// PayloadVersion is the version of payloadproto.Payload understood by this
+// package.
+const PayloadVersion = 1
+
+// publicKeyLengths maps each known key algorithm to the length of its
+// encoded public keys.
+var publicKeyLengths = map[payloadproto.PublicKey_Algorithm]int{
+	payloadproto.PublicKey_ED25519: 32,
+	payloadproto.PublicKey_X25519:  32,
+	payloadproto.PublicKey_P256:    65,
+}
+
+// NewWithPayload is like New but takes a structured payload as the message.
+// If the payload's version is unset, it is set to PayloadVersion.
+func NewWithPayload(r io.Reader, secret []byte, payload *payloadproto.Payload, opts ...Option) (*Exchange, error) {
+	if payload.Version == nil {
+		payload.Version = proto.Uint32(PayloadVersion)
+	}
+	if err := validatePayload(payload); err != nil {
+		return nil, err
+	}
+	message, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := MaxMessageLenFor(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > limit && !newConfig(opts).fitsCompressed(message) {
+		return nil, errors.New("panda: payload too large (" + strconv.Itoa(len(message)) + " bytes, maximum is " + strconv.Itoa(limit) + ")")
+	}
+	return New(r, secret, message, opts...)
+}
+
+// ParsePayload decodes and validates a message that was sent with
+// NewWithPayload. Fields unknown to this version of the package are retained
+// and will be included if the payload is serialized again.
+func ParsePayload(msg []byte) (*payloadproto.Payload, error) {
+	payload := new(payloadproto.Payload)
+	if err := proto.Unmarshal(msg, payload); err != nil {
+		return nil, errors.New("panda: malformed payload: " + err.Error())
+	}
+	if err := validatePayload(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func validatePayload(payload *payloadproto.Payload) error {
+	if v := payload.GetVersion(); v != PayloadVersion {
+		return errors.New("panda: unsupported payload version " + strconv.FormatUint(uint64(v), 10))
+	}
+	for i, key := range payload.PublicKeys {
+		if key.Algorithm == nil {
+			return errors.New("panda: public key " + strconv.Itoa(i) + " has no algorithm")
+		}
+		expected, ok := publicKeyLengths[*key.Algorithm]
+		if !ok {
+			return errors.New("panda: public key " + strconv.Itoa(i) + " has unknown algorithm " + key.Algorithm.String())
+		}
+		if len(key.Key) != expected {
+			return errors.New("panda: " + key.Algorithm.String() + " public key " + strconv.Itoa(i) + " is " + strconv.Itoa(len(key.Key)) + " bytes, expected " + strconv.Itoa(expected))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/payloadproto"
+)
+
+func goldenPayload() *payloadproto.Payload {
+	return &payloadproto.Payload{
+		Version: proto.Uint32(PayloadVersion),
+		PublicKeys: []*payloadproto.PublicKey{
+			{
+				Algorithm: payloadproto.PublicKey_ED25519.Enum(),
+				Key:       bytes.Repeat([]byte{0x11}, 32),
+			},
+		},
+		Endpoints:   []string{"https://example.com"},
+		DisplayName: proto.String("Alice"),
+		Extension:   []byte{0xff},
+	}
+}
+
+// goldenPayloadHex is the encoding of goldenPayload, fixed so that other
+// implementations can check their output against it.
+const goldenPayloadHex = "080112240801122011111111111111111111111111111111111111111111111111111111111111111a1368747470733a2f2f6578616d706c652e636f6d2205416c6963652a01ff"
+
+func TestPayloadGolden(t *testing.T) {
+	encoded, err := proto.Marshal(goldenPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(encoded); got != goldenPayloadHex {
+		t.Errorf("got encoding %s, want %s", got, goldenPayloadHex)
+	}
+
+	golden, _ := hex.DecodeString(goldenPayloadHex)
+	payload, err := ParsePayload(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.GetDisplayName() != "Alice" || len(payload.PublicKeys) != 1 {
+		t.Errorf("golden payload parsed incorrectly: %s", payload)
+	}
+}
+
+func TestPayloadUnknownFields(t *testing.T) {
+	golden, _ := hex.DecodeString(goldenPayloadHex)
+	// Field 15, varint 42, as might be written by a newer version.
+	withUnknown := append(golden, 0x78, 0x2a)
+
+	payload, err := ParsePayload(withUnknown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := proto.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, withUnknown) {
+		t.Errorf("unknown field was not preserved: got %x, want %x", encoded, withUnknown)
+	}
+}
+
+func TestPayloadValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*payloadproto.Payload)
+	}{
+		{"bad version", func(p *payloadproto.Payload) { p.Version = proto.Uint32(2) }},
+		{"unknown algorithm", func(p *payloadproto.Payload) { p.PublicKeys[0].Algorithm = payloadproto.PublicKey_Algorithm(99).Enum() }},
+		{"missing algorithm", func(p *payloadproto.Payload) { p.PublicKeys[0].Algorithm = nil }},
+		{"short ed25519 key", func(p *payloadproto.Payload) { p.PublicKeys[0].Key = p.PublicKeys[0].Key[:31] }},
+		{"long x25519 key", func(p *payloadproto.Payload) {
+			p.PublicKeys[0].Algorithm = payloadproto.PublicKey_X25519.Enum()
+			p.PublicKeys[0].Key = make([]byte, 33)
+		}},
+		{"compressed p256 key", func(p *payloadproto.Payload) {
+			p.PublicKeys[0].Algorithm = payloadproto.PublicKey_P256.Enum()
+			p.PublicKeys[0].Key = make([]byte, 33)
+		}},
+		{"oversized", func(p *payloadproto.Payload) { p.Extension = make([]byte, MaxMessageLen) }},
+	}
+
+	for _, test := range tests {
+		payload := goldenPayload()
+		test.modify(payload)
+		if _, err := NewWithPayload(rand.Reader, []byte("foo"), payload, fastKDF); err == nil {
+			t.Errorf("%s: NewWithPayload succeeded", test.name)
+		}
+		if encoded, err := proto.Marshal(payload); err == nil {
+			if _, err := ParsePayload(encoded); err == nil && test.name != "oversized" {
+				t.Errorf("%s: ParsePayload succeeded", test.name)
+			}
+		}
+	}
+
+	if _, err := ParsePayload([]byte{0xff}); err == nil {
+		t.Errorf("malformed payload was accepted")
+	}
+	if _, err := NewWithPayload(rand.Reader, []byte("foo"), goldenPayload(), fastKDF); err != nil {
+		t.Errorf("valid payload was rejected: %s", err)
+	}
+}
+
+func TestPayloadBodySizeLimit(t *testing.T) {
+	limit, err := MaxMessageLenFor(WithBodySize(BodySize4K))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := goldenPayload()
+	payload.Extension = make([]byte, limit)
+	_, err = NewWithPayload(rand.Reader, []byte("foo"), payload, fastKDF, WithBodySize(BodySize4K))
+	if err == nil || !strings.Contains(err.Error(), "maximum is "+strconv.Itoa(limit)) {
+		t.Errorf("got %v for a payload larger than a 4K body, want an error naming the limit", err)
+	}
+	if _, err := NewWithPayload(rand.Reader, []byte("foo"), payload, fastKDF); err != nil {
+		t.Errorf("payload within the default limit was rejected: %s", err)
+	}
+}
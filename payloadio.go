@@ -0,0 +1,65 @@
+package panda
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	errPayloadShort = errors.New("panda: payload is shorter than its declared size")
+	errPayloadLong  = errors.New("panda: payload is longer than its declared size")
+)
+
+// NewFromReader is like New but reads the message, of exactly size bytes,
+// from payload. The size is checked against the limit for the options before
+// anything is read, and it is an error for payload to hold fewer or more
+// bytes. The message is still kept whole by the Exchange, since it must be
+// re-sent until the peer has it and is recorded by Marshal, but the caller
+// needn't hold a copy of its own.
+func NewFromReader(r io.Reader, secret []byte, payload io.Reader, size int64, opts ...Option) (*Exchange, error) {
+	c := newConfig(opts)
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > int64(c.maxMessageLen()) {
+		return nil, errors.New("panda: message too large")
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(payload, message); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errPayloadShort
+		}
+		return nil, err
+	}
+	var extra [1]byte
+	switch _, err := io.ReadFull(payload, extra[:]); err {
+	case nil:
+		return nil, errPayloadLong
+	case io.EOF:
+	default:
+		return nil, err
+	}
+	return New(r, secret, message, opts...)
+}
+
+// ProcessTo is like ProcessDetailed but, rather than returning the peer's
+// message, writes it to w once the exchange completes. Nothing is written
+// unless the whole message has been authenticated, and the copy held by the
+// package is wiped once written. If w returns an error, the exchange is left
+// as it was before the call, so that the reply can be processed again.
+func (ex *Exchange) ProcessTo(reply []byte, w io.Writer) (Result, error) {
+	saved := *ex
+	result, err := ex.ProcessDetailed(reply)
+	if err != nil || !result.Completed {
+		return result, err
+	}
+	message := result.Message
+	result.Message = nil
+	defer wipe(message)
+	if _, err := w.Write(message); err != nil {
+		*ex = saved
+		return Result{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestNewFromReader(t *testing.T) {
+	message := make([]byte, 100000)
+	rand.Read(message)
+	opts := []Option{WithProtocolVersion(ProtocolVersion4), fastKDF}
+	a, err := NewFromReader(rand.Reader, []byte("foo"), bytes.NewReader(message), int64(len(message)), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || !bytes.Equal(bResult, message) {
+		t.Errorf("message read from a reader wasn't exchanged intact")
+	}
+
+	for _, test := range []struct {
+		name    string
+		payload io.Reader
+		size    int64
+		err     error
+	}{
+		{"short", bytes.NewReader(message[:10]), 11, errPayloadShort},
+		{"empty", bytes.NewReader(nil), 1, errPayloadShort},
+		{"long", bytes.NewReader(message[:10]), 9, errPayloadLong},
+	} {
+		if _, err := NewFromReader(rand.Reader, []byte("foo"), test.payload, test.size, opts...); err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+	if _, err := NewFromReader(rand.Reader, []byte("foo"), bytes.NewReader(nil), 0, opts...); err != nil {
+		t.Errorf("empty message was rejected: %s", err)
+	}
+	if _, err := NewFromReader(rand.Reader, []byte("foo"), bytes.NewReader(nil), MaxMessageLen+1, opts...); err == nil {
+		t.Errorf("oversized message was accepted")
+	}
+}
+
+func TestProcessTo(t *testing.T) {
+	a, b := newPair(t)
+	for round := 1; round <= 2; round++ {
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if round == 2 {
+			var out bytes.Buffer
+			corrupt := append([]byte(nil), bBody...)
+			corrupt[len(corrupt)-1] ^= 1
+			if _, err := a.ProcessTo(corrupt, &out); err == nil || out.Len() != 0 {
+				t.Errorf("corrupt body gave %v and wrote %d bytes", err, out.Len())
+			}
+
+			if _, err := a.ProcessTo(bBody, failingWriter{}); err == nil {
+				t.Errorf("writer error wasn't returned")
+			}
+			if a.complete {
+				t.Errorf("exchange completed despite the writer error")
+			}
+			result, err := a.ProcessTo(bBody, &out)
+			if err != nil || !result.Completed || result.Message != nil || out.String() != "b" {
+				t.Errorf("got %+v, %v and wrote %q", result, err, out.String())
+			}
+		} else if result, err := a.ProcessTo(bBody, failingWriter{}); err != nil || result.Completed {
+			t.Errorf("first round gave %+v, %v", result, err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Code generated by protoc-gen-go from "payload.proto"
+// DO NOT EDIT!
+
+package payloadproto
+
+import proto "code.google.com/p/goprotobuf/proto"
+import "encoding/json"
+import "math"
+
+// Reference proto, json, and math imports to suppress error if they are not otherwise used.
+var _ = proto.Marshal
+var _ = &json.SyntaxError{}
+var _ = math.Inf
+
+type PublicKey_Algorithm int32
+
+const (
+	PublicKey_ED25519 PublicKey_Algorithm = 1
+	PublicKey_X25519  PublicKey_Algorithm = 2
+	PublicKey_P256    PublicKey_Algorithm = 3
+)
+
+var PublicKey_Algorithm_name = map[int32]string{
+	1: "ED25519",
+	2: "X25519",
+	3: "P256",
+}
+var PublicKey_Algorithm_value = map[string]int32{
+	"ED25519": 1,
+	"X25519":  2,
+	"P256":    3,
+}
+
+func (x PublicKey_Algorithm) Enum() *PublicKey_Algorithm {
+	p := new(PublicKey_Algorithm)
+	*p = x
+	return p
+}
+func (x PublicKey_Algorithm) String() string {
+	return proto.EnumName(PublicKey_Algorithm_name, int32(x))
+}
+func (x PublicKey_Algorithm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+func (x *PublicKey_Algorithm) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(PublicKey_Algorithm_value, data, "PublicKey_Algorithm")
+	if err != nil {
+		return err
+	}
+	*x = PublicKey_Algorithm(value)
+	return nil
+}
+
+type Payload struct {
+	Version          *uint32      `protobuf:"varint,1,req,name=version" json:"version,omitempty"`
+	PublicKeys       []*PublicKey `protobuf:"bytes,2,rep,name=public_keys" json:"public_keys,omitempty"`
+	Endpoints        []string     `protobuf:"bytes,3,rep,name=endpoints" json:"endpoints,omitempty"`
+	DisplayName      *string      `protobuf:"bytes,4,opt,name=display_name" json:"display_name,omitempty"`
+	Extension        []byte       `protobuf:"bytes,5,opt,name=extension" json:"extension,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (this *Payload) Reset()         { *this = Payload{} }
+func (this *Payload) String() string { return proto.CompactTextString(this) }
+func (*Payload) ProtoMessage()       {}
+
+func (this *Payload) GetVersion() uint32 {
+	if this != nil && this.Version != nil {
+		return *this.Version
+	}
+	return 0
+}
+
+func (this *Payload) GetPublicKeys() []*PublicKey {
+	if this != nil {
+		return this.PublicKeys
+	}
+	return nil
+}
+
+func (this *Payload) GetEndpoints() []string {
+	if this != nil {
+		return this.Endpoints
+	}
+	return nil
+}
+
+func (this *Payload) GetDisplayName() string {
+	if this != nil && this.DisplayName != nil {
+		return *this.DisplayName
+	}
+	return ""
+}
+
+func (this *Payload) GetExtension() []byte {
+	if this != nil {
+		return this.Extension
+	}
+	return nil
+}
+
+type PublicKey struct {
+	Algorithm        *PublicKey_Algorithm `protobuf:"varint,1,req,name=algorithm,enum=payloadproto.PublicKey_Algorithm" json:"algorithm,omitempty"`
+	Key              []byte               `protobuf:"bytes,2,req,name=key" json:"key,omitempty"`
+	XXX_unrecognized []byte               `json:"-"`
+}
+
+func (this *PublicKey) Reset()         { *this = PublicKey{} }
+func (this *PublicKey) String() string { return proto.CompactTextString(this) }
+func (*PublicKey) ProtoMessage()       {}
+
+func (this *PublicKey) GetAlgorithm() PublicKey_Algorithm {
+	if this != nil && this.Algorithm != nil {
+		return *this.Algorithm
+	}
+	return PublicKey_ED25519
+}
+
+func (this *PublicKey) GetKey() []byte {
+	if this != nil {
+		return this.Key
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterEnum("payloadproto.PublicKey_Algorithm", PublicKey_Algorithm_name, PublicKey_Algorithm_value)
+}
@@ -0,0 +1,51 @@
+package panda
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/agl/panda/stateproto"
+)
+
+// WithPepper mixes a high-entropy value that both parties hold, such as the
+// contents of a file exchanged in person, into the exchange key after the
+// KDF. An attacker then can't brute-force the secret during the exchange
+// without the pepper too. Nothing changes on the wire: a party with a
+// different or missing pepper simply never finds the peer's posts. Only a
+// hash of the pepper is kept, including in serialized state, so that
+// RederiveSecret can use it again. The pepper must not be empty.
+func WithPepper(pepper []byte) Option {
+	h := sha256.New()
+	h.Write([]byte("PANDA pepper v1\x00"))
+	h.Write(pepper)
+	var pepperHash [32]byte
+	copy(pepperHash[:], h.Sum(nil))
+	empty := len(pepper) == 0
+
+	return func(c *config) {
+		c.pepper = &pepperHash
+		c.emptyPepper = empty
+	}
+}
+
+// applyPepper returns the exchange key given the output of the KDF and the
+// pepper's hash, which may be nil. It wipes kdfOut if it's replaced.
+func applyPepper(kdfOut []byte, pepperHash *[32]byte) []byte {
+	if pepperHash == nil {
+		return kdfOut
+	}
+	mac := hmac.New(sha256.New, kdfOut)
+	mac.Write(pepperHash[:])
+	wipe(kdfOut)
+	return mac.Sum(nil)
+}
+
+// unmarshalPepper returns the pepper hash recorded in s, if any.
+func unmarshalPepper(s *stateproto.State) *[32]byte {
+	if len(s.PepperHash) != 32 {
+		return nil
+	}
+	var pepperHash [32]byte
+	copy(pepperHash[:], s.PepperHash)
+	return &pepperHash
+}
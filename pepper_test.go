@@ -0,0 +1,88 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestPepper(t *testing.T) {
+	large := make([]byte, 4<<20)
+	if _, err := io.ReadFull(rand.Reader, large); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pepper := range [][]byte{[]byte("x"), large} {
+		a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithPepper(pepper), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Copy the pepper so that the option can't rely on the caller's
+		// buffer.
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithPepper(append([]byte(nil), pepper...)), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pepper) > 32 && bytes.Contains(a.Marshal(), pepper[:32]) {
+			t.Errorf("serialized state contains the pepper")
+		}
+		a = marshalUnmarshal(a)
+		aResult, bResult := runExchange(t, a, b)
+		if string(aResult) != "b" || string(bResult) != "a" {
+			t.Errorf("%d-byte pepper: got %q and %q", len(pepper), aResult, bResult)
+		}
+	}
+
+	if _, err := New(rand.Reader, []byte("foo"), nil, WithPepper(nil), fastKDF); err == nil {
+		t.Errorf("empty pepper was accepted")
+	}
+
+	peppered, err := New(rand.Reader, []byte("foo"), []byte("a"), WithPepper([]byte("pepper")), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peppered = marshalUnmarshal(peppered)
+	pepperedTag, pepperedBody := peppered.NextRequest()
+	for _, opts := range [][]Option{{fastKDF}, {WithPepper([]byte("pepped")), fastKDF}} {
+		other, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherTag, _ := other.NextRequest()
+		if bytes.Equal(otherTag, pepperedTag) {
+			t.Errorf("exchange with a missing or wrong pepper shares a tag")
+		}
+		if _, err := other.Process(pepperedBody); err == nil {
+			t.Errorf("exchange with a missing or wrong pepper accepted a body")
+		}
+	}
+
+	// RederiveSecret keeps the pepper after a restore.
+	if err := peppered.RederiveSecret(rand.Reader, []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := New(rand.Reader, []byte("bar"), []byte("b"), WithPepper([]byte("pepper")), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rederivedTag, _ := peppered.NextRequest()
+	if freshTag, _ := fresh.NextRequest(); !bytes.Equal(rederivedTag, freshTag) {
+		t.Errorf("RederiveSecret lost the pepper")
+	}
+
+	key, err := PrecomputeKey([]byte("bar"), WithPepper([]byte("pepper")), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = UnmarshalKey(key.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	fromKey, err := NewFromKey(rand.Reader, key, []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyTag, _ := fromKey.NextRequest(); !bytes.Equal(keyTag, rederivedTag) {
+		t.Errorf("Key lost the pepper")
+	}
+}
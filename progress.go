@@ -0,0 +1,69 @@
+package panda
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A ProgressFunc is told how far through a phase of the work New is. The
+// fraction runs from zero to one.
+type ProgressFunc func(phase string, fraction float64)
+
+// ProgressKDF is the phase reported while the KDF runs. It's the only phase at
+// present because everything else that New does is quick.
+const ProgressKDF = "kdf"
+
+// progressInterval is the time between reports of the KDF's progress.
+const progressInterval = 100 * time.Millisecond
+
+// WithProgress has New, and PrecomputeKey, call f as the KDF runs: once at the
+// start, several times a second while it works and, if it succeeds, with a
+// fraction of one at the end. Only the scrypt KDFs report the fractions in
+// between. f is called from another goroutine, one call at a time, and so
+// can't stall the KDF, but New waits for any call in progress to return and
+// f is never called after New has returned. The key is unaffected.
+func WithProgress(f ProgressFunc) Option {
+	return func(c *config) {
+		c.progress = f
+	}
+}
+
+// reportProgress calls f with the fraction of work done so far, as counted
+// in *done, until stop is called. If finished is true, f is called once more
+// with a fraction of one. stop returns once f will not be called again. If
+// work is zero, f is only called at the start and the end.
+func reportProgress(f ProgressFunc, done *int64, work int64) (stop func(finished bool)) {
+	quit := make(chan bool)
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+		f(ProgressKDF, 0)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case finished := <-quit:
+				if finished {
+					f(ProgressKDF, 1)
+				}
+				return
+			case <-ticker.C:
+				if work == 0 {
+					continue
+				}
+				fraction := float64(atomic.LoadInt64(done)) / float64(work)
+				if fraction > 1 {
+					fraction = 1
+				}
+				f(ProgressKDF, fraction)
+			}
+		}
+	}()
+
+	return func(finished bool) {
+		quit <- finished
+		<-exited
+	}
+}
@@ -0,0 +1,132 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/scrypt"
+)
+
+func TestScryptCounting(t *testing.T) {
+	for _, c := range []struct {
+		passwd, salt string
+		N, r, p      int
+	}{
+		{"", "", 16, 1, 1},
+		{"password", "NaCl", 1024, 8, 16},
+		{"foo", "", 1 << 10, 16, 4},
+		{"secret", "salt", 2, 3, 5},
+	} {
+		want, err := scrypt.Key([]byte(c.passwd), []byte(c.salt), c.N, c.r, c.p, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var done int64
+		got := scryptCounting([]byte(c.passwd), []byte(c.salt), c.N, c.r, c.p, &done)
+		if !bytes.Equal(got, want) {
+			t.Errorf("N=%d r=%d p=%d: got %x, want %x", c.N, c.r, c.p, got, want)
+		}
+		if work := 2 * int64(c.N) * int64(c.p); done != work {
+			t.Errorf("N=%d r=%d p=%d: counted %d, want %d", c.N, c.r, c.p, done, work)
+		}
+	}
+
+	for _, kdf := range []KDF{KDFScrypt, KDFScryptParallel} {
+		p := kdfParams{kdf: kdf, scryptN: 1 << 10, scryptR: 8, scryptP: 3}
+		want, _ := p.derive([]byte("foo"))
+		var done int64
+		got, _ := p.deriveCounting([]byte("foo"), &done)
+		if !bytes.Equal(got, want) {
+			t.Errorf("KDF %d: counting changed the key", kdf)
+		}
+		if done != p.work() {
+			t.Errorf("KDF %d: counted %d, want %d", kdf, done, p.work())
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var (
+		lock      sync.Mutex
+		fractions []float64
+		returned  int32
+		late      int32
+	)
+	progress := func(phase string, fraction float64) {
+		if atomic.LoadInt32(&returned) != 0 {
+			atomic.StoreInt32(&late, 1)
+		}
+		if phase != ProgressKDF {
+			t.Errorf("unexpected phase %q", phase)
+		}
+		lock.Lock()
+		fractions = append(fractions, fraction)
+		lock.Unlock()
+	}
+
+	start := time.Now()
+	ex, err := New(rand.Reader, []byte("foo"), []byte("a"), WithScryptCost(1<<14, 8, 4), WithProgress(progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&returned, 1)
+	elapsed := time.Since(start)
+
+	plain, err := New(rand.Reader, []byte("foo"), []byte("a"), WithScryptCost(1<<14, 8, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.key != plain.key {
+		t.Errorf("progress reporting changed the key")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(fractions) < 2 || fractions[0] != 0 || fractions[len(fractions)-1] != 1 {
+		t.Fatalf("got fractions %v, want 0 first and 1 last", fractions)
+	}
+	for i := 1; i < len(fractions); i++ {
+		if fractions[i] < fractions[i-1] {
+			t.Errorf("fractions went backwards: %v", fractions)
+			break
+		}
+	}
+	if elapsed > 3*progressInterval && len(fractions) < 3 {
+		t.Errorf("only %d calls in %s", len(fractions), elapsed)
+	}
+
+	time.Sleep(2 * progressInterval)
+	if atomic.LoadInt32(&late) != 0 {
+		t.Errorf("progress was reported after New returned")
+	}
+}
+
+func TestProgressDeriver(t *testing.T) {
+	var fractions []float64
+	progress := func(phase string, fraction float64) {
+		fractions = append(fractions, fraction)
+	}
+	if _, err := New(rand.Reader, []byte("foo"), nil, fastKDF, WithProgress(progress)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fractions) != 2 || fractions[0] != 0 || fractions[1] != 1 {
+		t.Errorf("got fractions %v, want [0 1]", fractions)
+	}
+}
+
+func BenchmarkScryptCounting(b *testing.B) {
+	var done int64
+	for i := 0; i < b.N; i++ {
+		scryptCounting([]byte("secret"), nil, 1<<16, 16, 1, &done)
+	}
+}
+
+func BenchmarkScryptKey(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		scrypt.Key([]byte("secret"), nil, 1<<16, 16, 1, 32)
+	}
+}
@@ -0,0 +1,105 @@
+package rendezvous
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnknownToken is returned by the Verifiers in this package for a
+	// token that they weren't given.
+	ErrUnknownToken = errors.New("rendezvous: unknown token")
+	// ErrTokenExpired is returned by a Verifier from ExpiringTokens for a
+	// token whose expiry has passed.
+	ErrTokenExpired = errors.New("rendezvous: token expired")
+)
+
+// A Verifier decides whether a client may use the meeting place. Tokens are
+// only used to authorize requests and never affect the exchange itself.
+type Verifier interface {
+	// Verify returns an error if token should not be accepted.
+	Verify(token string) error
+}
+
+// VerifierFunc adapts a function to the Verifier interface.
+type VerifierFunc func(token string) error
+
+func (f VerifierFunc) Verify(token string) error {
+	return f(token)
+}
+
+type staticTokens [][sha256.Size]byte
+
+// StaticTokens returns a Verifier that accepts any of the given tokens.
+func StaticTokens(tokens ...string) Verifier {
+	var s staticTokens
+	for _, token := range tokens {
+		s = append(s, sha256.Sum256([]byte(token)))
+	}
+	return s
+}
+
+// find returns the index of token in s, or -1. It takes the same time
+// wherever, and whether, the token is found.
+func (s staticTokens) find(token string) int {
+	h := sha256.Sum256([]byte(token))
+	found := -1
+	for i := range s {
+		match := subtle.ConstantTimeCompare(s[i][:], h[:])
+		found = subtle.ConstantTimeSelect(match, i, found)
+	}
+	return found
+}
+
+func (s staticTokens) Verify(token string) error {
+	if s.find(token) < 0 {
+		return ErrUnknownToken
+	}
+	return nil
+}
+
+type expiringTokens struct {
+	now     func() time.Time
+	tokens  staticTokens
+	expires []time.Time
+}
+
+// ExpiringTokens returns a Verifier that accepts each of the given tokens
+// until its expiry, according to now.
+func ExpiringTokens(now func() time.Time, tokens map[string]time.Time) Verifier {
+	e := &expiringTokens{now: now}
+	for token, expiry := range tokens {
+		e.tokens = append(e.tokens, sha256.Sum256([]byte(token)))
+		e.expires = append(e.expires, expiry)
+	}
+	return e
+}
+
+func (e *expiringTokens) Verify(token string) error {
+	i := e.tokens.find(token)
+	if i < 0 {
+		return ErrUnknownToken
+	}
+	if !e.now().Before(e.expires[i]) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// Authorized reports whether r carries a bearer token, in the Authorization
+// header, that is accepted by v. If v is nil, every request is authorized.
+func Authorized(v Verifier, r *http.Request) bool {
+	if v == nil {
+		return true
+	}
+	const scheme = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, scheme) {
+		return false
+	}
+	return v.Verify(auth[len(scheme):]) == nil
+}
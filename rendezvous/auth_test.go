@@ -0,0 +1,64 @@
+package rendezvous
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuthorized(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	clock := func() time.Time { return now }
+	expiring := ExpiringTokens(clock, map[string]time.Time{
+		"current": now.Add(time.Hour),
+		"expired": now,
+	})
+	rejectAll := VerifierFunc(func(string) error { return errors.New("no") })
+
+	tests := []struct {
+		name     string
+		verifier Verifier
+		header   string
+		want     bool
+	}{
+		{"unauthenticated, no token", nil, "", true},
+		{"unauthenticated, any token", nil, "Bearer whatever", true},
+		{"valid static token", StaticTokens("one", "two"), "Bearer two", true},
+		{"invalid static token", StaticTokens("one", "two"), "Bearer three", false},
+		{"missing token", StaticTokens("one"), "", false},
+		{"wrong scheme", StaticTokens("one"), "Basic one", false},
+		{"empty token", StaticTokens("one"), "Bearer ", false},
+		{"current token", expiring, "Bearer current", true},
+		{"expired token", expiring, "Bearer expired", false},
+		{"unknown expiring token", expiring, "Bearer other", false},
+		{"rejecting func", rejectAll, "Bearer one", false},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest("POST", "/exchange/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.header) > 0 {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := Authorized(test.verifier, r); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVerifierErrors(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	v := ExpiringTokens(func() time.Time { return now }, map[string]time.Time{"expired": now.Add(-time.Second)})
+	if err := v.Verify("expired"); err != ErrTokenExpired {
+		t.Errorf("got %v for an expired token, want ErrTokenExpired", err)
+	}
+	if err := v.Verify("other"); err != ErrUnknownToken {
+		t.Errorf("got %v for an unknown token, want ErrUnknownToken", err)
+	}
+	if err := StaticTokens("one").Verify("two"); err != ErrUnknownToken {
+		t.Errorf("got %v from StaticTokens, want ErrUnknownToken", err)
+	}
+}
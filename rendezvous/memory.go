@@ -0,0 +1,93 @@
+package rendezvous
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// MemoryStorage is a Storage that keeps postings in memory, for tests and for
+// meeting places that can lose their postings on restart. It is safe for
+// concurrent use.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	postings map[string]Posting
+	invites  map[[16]byte]int64
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		postings: make(map[string]Posting),
+		invites:  make(map[[16]byte]int64),
+	}
+}
+
+// memoryTx buffers the writes of a transaction until it commits.
+type memoryTx struct {
+	s        *MemoryStorage
+	postings map[string]Posting
+	invites  map[[16]byte]int64
+}
+
+func (tx *memoryTx) Posting(tag []byte) (*Posting, error) {
+	p, ok := tx.postings[string(tag)]
+	if !ok {
+		p, ok = tx.s.postings[string(tag)]
+	}
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (tx *memoryTx) PutPosting(tag []byte, p *Posting) error {
+	tx.postings[string(tag)] = *p
+	return nil
+}
+
+func (tx *memoryTx) InviteUsage(id [16]byte) (int64, error) {
+	if used, ok := tx.invites[id]; ok {
+		return used, nil
+	}
+	return tx.s.invites[id], nil
+}
+
+func (tx *memoryTx) PutInviteUsage(id [16]byte, used int64) error {
+	tx.invites[id] = used
+	return nil
+}
+
+func (s *MemoryStorage) RunInTransaction(r *http.Request, f func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memoryTx{s, make(map[string]Posting), make(map[[16]byte]int64)}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for tag, p := range tx.postings {
+		s.postings[tag] = p
+	}
+	for id, used := range tx.invites {
+		s.invites[id] = used
+	}
+	return nil
+}
+
+func (s *MemoryStorage) DeleteExpired(r *http.Request, expired func(p *Posting) bool) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tags []string
+	for tag, p := range s.postings {
+		if expired(&p) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	var deleted [][]byte
+	for _, tag := range tags {
+		delete(s.postings, tag)
+		deleted = append(deleted, []byte(tag))
+	}
+	return deleted, nil
+}
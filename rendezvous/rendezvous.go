@@ -0,0 +1,436 @@
+// Package rendezvous implements a PANDA meeting place as an http.Handler that
+// can be mounted in any mux. Postings are kept by a Storage, so the same
+// handler serves from the App Engine datastore, see package
+// appengine/meetingplace, or from memory, and builds without the App Engine
+// SDK.
+package rendezvous
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agl/panda"
+	"github.com/agl/panda/auditlog"
+	"github.com/agl/panda/invite"
+)
+
+const defaultBodyLimit = panda.BodySize128K
+const defaultLifetime = 5 * 24 * time.Hour
+
+// errPollOnly is returned from a transaction when a request that may only
+// poll would have stored a body.
+var errPollOnly = errors.New("rendezvous: request may only poll")
+
+// A Storage holds the postings of a meeting place. Each method is passed the
+// request being served so that, for example, an App Engine context can be
+// derived from it.
+type Storage interface {
+	// RunInTransaction calls f with a Tx. The reads and writes made by f
+	// take effect atomically, and the writes only if f returns nil. f may
+	// be called more than once if the transaction is retried.
+	RunInTransaction(r *http.Request, f func(tx Tx) error) error
+	// DeleteExpired removes postings for which expired returns true and
+	// returns their tags. To bound its work, it may leave some behind.
+	DeleteExpired(r *http.Request, expired func(p *Posting) bool) ([][]byte, error)
+}
+
+// A Tx reads and writes a Storage within a transaction.
+type Tx interface {
+	// Posting returns the posting stored under tag or, if there is none,
+	// nil.
+	Posting(tag []byte) (*Posting, error)
+	// PutPosting stores p under tag.
+	PutPosting(tag []byte, p *Posting) error
+	// InviteUsage returns the number of tags that the invite code with the
+	// given ID has been spent on, which is zero for a code not seen before.
+	InviteUsage(id [16]byte) (int64, error)
+	// PutInviteUsage records the number of tags that the invite code with
+	// the given ID has been spent on.
+	PutInviteUsage(id [16]byte, used int64) error
+}
+
+// An Option configures a handler created by NewHandler.
+type Option func(*handler)
+
+// WithPathPrefix causes the handler to serve its endpoints below prefix,
+// which should begin with a slash and not end with one.
+func WithPathPrefix(prefix string) Option {
+	return func(h *handler) {
+		h.prefix = prefix
+	}
+}
+
+// WithClock sets the function used to get the current time.
+func WithClock(now func() time.Time) Option {
+	return func(h *handler) {
+		h.now = now
+	}
+}
+
+// WithLogger sets the logger used for internal errors. By default they are
+// written to standard error.
+func WithLogger(logger *log.Logger) Option {
+	return func(h *handler) {
+		h.logger = logger
+	}
+}
+
+// WithBodyLimit sets the largest body, in bytes, that will be accepted.
+func WithBodyLimit(limit int) Option {
+	return func(h *handler) {
+		h.bodyLimit = limit
+	}
+}
+
+// WithLifetime sets how long a posting is kept before it may be garbage
+// collected.
+func WithLifetime(lifetime time.Duration) Option {
+	return func(h *handler) {
+		h.lifetime = lifetime
+	}
+}
+
+// WithVerifier requires that every request carry a bearer token, in the
+// Authorization header, that is accepted by v.
+func WithVerifier(v Verifier) Option {
+	return func(h *handler) {
+		h.verifier = v
+	}
+}
+
+// WithUnauthenticatedPolls allows requests without an accepted bearer token,
+// when WithVerifier is given, as long as they only poll: that is, re-post a
+// body already stored under the tag in order to collect the other. Requests
+// that would store a new body, or that conflict with a stored pair, still
+// need a token.
+func WithUnauthenticatedPolls() Option {
+	return func(h *handler) {
+		h.unauthenticatedPolls = true
+	}
+}
+
+// WithInviteKey requires that every request carry an invite code, in the
+// X-Panda-Invite header, minted by the private half of key. Each tag that a
+// request stores a body under is charged to the code.
+func WithInviteKey(key ed25519.PublicKey) Option {
+	return func(h *handler) {
+		h.inviteKey = key
+	}
+}
+
+// WithAuditLog records every operation in l. Client addresses are hashed
+// under clientKey, which should be at least 32 random bytes; see
+// auditlog.NewEvent for how to rotate it.
+func WithAuditLog(l *auditlog.Log, clientKey []byte) Option {
+	return func(h *handler) {
+		h.auditLog = l
+		h.auditClientKey = clientKey
+	}
+}
+
+type handler struct {
+	storage              Storage
+	prefix               string
+	now                  func() time.Time
+	logger               *log.Logger
+	bodyLimit            int
+	lifetime             time.Duration
+	verifier             Verifier
+	unauthenticatedPolls bool
+	inviteKey            ed25519.PublicKey
+	auditLog             *auditlog.Log
+	auditClientKey       []byte
+}
+
+// audit appends an event to the audit log, if one is configured.
+func (h *handler) audit(op string, tag, body []byte, client string) {
+	if h.auditLog == nil {
+		return
+	}
+	if err := h.auditLog.Append(auditlog.NewEvent(h.now(), op, tag, body, client, h.auditClientKey)); err != nil {
+		h.logger.Printf("Error writing audit log: %s", err)
+	}
+}
+
+// clientHost returns the address of the client of r without its port, which
+// changes from one connection to the next and so would give the same client a
+// different identity in the audit log for every request.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewHandler returns a handler that serves the meeting place endpoints,
+// keeping postings in storage. It performs no global registration.
+func NewHandler(storage Storage, opts ...Option) http.Handler {
+	h := &handler{
+		storage:   storage,
+		now:       time.Now,
+		logger:    log.New(os.Stderr, "", 0),
+		bodyLimit: defaultBodyLimit,
+		lifetime:  defaultLifetime,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(h.prefix+"/exchange/", h.exchange)
+	return mux
+}
+
+type Posting struct {
+	Time time.Time
+	A, B []byte
+	// AHash and BHash are the SHA-256 hashes of A and B. Postings stored
+	// before these were recorded lack them until fillHashes is called.
+	AHash, BHash []byte
+}
+
+// Expired returns true if p is older than lifetime at time now.
+func (p Posting) Expired(now time.Time, lifetime time.Duration) bool {
+	return p.Time.Add(lifetime).Before(now)
+}
+
+// fillHashes computes any missing body hashes and reports whether p was
+// changed.
+func (p *Posting) fillHashes() bool {
+	changed := false
+	if len(p.A) > 0 && len(p.AHash) == 0 {
+		p.AHash = hashBody(p.A)
+		changed = true
+	}
+	if len(p.B) > 0 && len(p.BHash) == 0 {
+		p.BHash = hashBody(p.B)
+		changed = true
+	}
+	return changed
+}
+
+func hashBody(body []byte) []byte {
+	h := sha256.Sum256(body)
+	return h[:]
+}
+
+// sameBody reports whether two body hashes are equal without leaking, via
+// timing, how long a common prefix they share.
+func sameBody(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+func (h *handler) exchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad method", 405)
+		return
+	}
+
+	// A request without a token may still be allowed to poll, which is
+	// only known once the stored posting has been read.
+	pollOnly := !Authorized(h.verifier, r)
+	if pollOnly && !h.unauthenticatedPolls {
+		unauthorized(w)
+		return
+	}
+
+	pathPrefix := h.prefix + "/exchange/"
+	if !strings.HasPrefix(r.URL.Path, pathPrefix) {
+		http.Error(w, "Bad URL path", 500)
+		return
+	}
+
+	tagHex := r.URL.Path[len(pathPrefix):]
+	tag, err := hex.DecodeString(tagHex)
+	if err != nil || len(tag) != 32 {
+		http.Error(w, "Malformed tag", 400)
+		return
+	}
+
+	input := &io.LimitedReader{R: r.Body, N: int64(h.bodyLimit) + 1}
+	body, err := ioutil.ReadAll(input)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Error reading body", 400)
+		return
+	}
+	if len(body) == 0 {
+		http.Error(w, "Empty body", 400)
+		return
+	}
+	if len(body) > h.bodyLimit {
+		http.Error(w, "Body too large", 413)
+		return
+	}
+
+	var code *invite.Code
+	if h.inviteKey != nil {
+		if code, err = invite.Verify(h.inviteKey, r.Header.Get("X-Panda-Invite"), h.now()); err != nil {
+			http.Error(w, "Invalid invite code", 403)
+			return
+		}
+	}
+
+	bodyHash := hashBody(body)
+
+	var other []byte
+	var contended bool
+	var created bool
+	var stored bool
+	err = h.storage.RunInTransaction(r, func(tx Tx) error {
+		other, contended, created, stored = nil, false, false, false
+		p, err := tx.Posting(tag)
+		if err != nil {
+			return err
+		}
+		if p == nil || p.Expired(h.now(), h.lifetime) {
+			if pollOnly {
+				return errPollOnly
+			}
+			// The posting is new or has expired.
+			p = &Posting{
+				Time:  h.now(),
+				A:     body,
+				AHash: bodyHash,
+			}
+			if err := spendInvite(tx, code); err != nil {
+				return err
+			}
+			created = true
+			stored = true
+			return tx.PutPosting(tag, p)
+		}
+		// Postings written before hashes were stored are upgraded the
+		// first time that they are seen.
+		dirty := p.fillHashes()
+		if len(p.B) > 0 {
+			if sameBody(p.AHash, bodyHash) {
+				other = p.B
+			} else if sameBody(p.BHash, bodyHash) {
+				other = p.A
+			} else if pollOnly {
+				return errPollOnly
+			} else {
+				contended = true
+			}
+		} else if !sameBody(p.AHash, bodyHash) {
+			if pollOnly {
+				return errPollOnly
+			}
+			if err := spendInvite(tx, code); err != nil {
+				return err
+			}
+			p.B = body
+			p.BHash = bodyHash
+			other = p.A
+			dirty = true
+			stored = true
+		}
+		if !dirty {
+			return nil
+		}
+		return tx.PutPosting(tag, p)
+	})
+
+	if err == errPollOnly {
+		unauthorized(w)
+		return
+	}
+	if err == invite.ErrInviteExhausted {
+		http.Error(w, "Invite code exhausted", 403)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("Error from transaction: %s", err)
+		http.Error(w, "Internal error", 500)
+		return
+	}
+
+	client := clientHost(r)
+	switch {
+	case contended:
+		h.audit(auditlog.OpConflict, tag, body, client)
+	case stored:
+		h.audit(auditlog.OpPost, tag, body, client)
+	default:
+		h.audit(auditlog.OpPoll, tag, body, client)
+	}
+
+	if created {
+		h.maybeGarbageCollect(r)
+	}
+
+	if contended {
+		http.Error(w, "Tag collision", 409)
+		return
+	}
+
+	if len(other) == 0 {
+		http.Error(w, "Request recorded", 204)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/binary")
+	w.Header().Set("Content-Length", strconv.Itoa(len(other)))
+	w.Write(other)
+}
+
+// unauthorized responds to a request without an accepted bearer token.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Unauthorized", 401)
+}
+
+// spendInvite charges one tag to code, if not nil. It must be called within
+// a transaction.
+func spendInvite(tx Tx, code *invite.Code) error {
+	if code == nil {
+		return nil
+	}
+	used, err := tx.InviteUsage(code.ID)
+	if err != nil {
+		return err
+	}
+	if used, err = code.Spend(used); err != nil {
+		return err
+	}
+	return tx.PutInviteUsage(code.ID, used)
+}
+
+func (h *handler) maybeGarbageCollect(r *http.Request) {
+	var randByte [1]byte
+	_, err := io.ReadFull(rand.Reader, randByte[:])
+	if err != nil {
+		h.logger.Printf("Error reading random byte: %s", err)
+		return
+	}
+
+	if randByte[0] >= 2 {
+		return
+	}
+
+	// Every one in 128 insertions we'll clean out expired postings.
+	tags, err := h.storage.DeleteExpired(r, func(p *Posting) bool {
+		return p.Expired(h.now(), h.lifetime)
+	})
+	if err != nil {
+		h.logger.Printf("Error deleting expired postings: %s", err)
+	}
+	for _, tag := range tags {
+		h.audit(auditlog.OpGC, tag, nil, "")
+	}
+}
@@ -0,0 +1,265 @@
+package rendezvous
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/panda"
+	"github.com/agl/panda/auditlog"
+	"github.com/agl/panda/invite"
+)
+
+var testTag = strings.Repeat("ab", 32)
+
+var testClientKey = bytes.Repeat([]byte{0x42}, 32)
+
+// post sends body to the exchange endpoint of h and returns the recorded
+// response.
+func post(h http.Handler, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	return postFrom(h, "192.0.2.1:1234", path, body, header)
+}
+
+// postFrom is like post but for a client at the given address.
+func postFrom(h http.Handler, remoteAddr, path string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHandlerExchange(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/panda/", NewHandler(NewMemoryStorage(), WithPathPrefix("/panda")))
+	mux.Handle("/", http.NotFoundHandler())
+	path := "/panda/exchange/" + testTag
+
+	if w := post(mux, path, []byte("a"), nil); w.Code != 204 {
+		t.Fatalf("first post: got %d", w.Code)
+	}
+	if w := post(mux, path, []byte("b"), nil); w.Code != 200 || w.Body.String() != "a" {
+		t.Fatalf("second post: got %d %q", w.Code, w.Body)
+	}
+	if w := post(mux, path, []byte("a"), nil); w.Code != 200 || w.Body.String() != "b" {
+		t.Fatalf("poll: got %d %q", w.Code, w.Body)
+	}
+	if w := post(mux, path, []byte("c"), nil); w.Code != 409 {
+		t.Fatalf("third post: got %d", w.Code)
+	}
+	if w := post(mux, "/exchange/"+testTag, []byte("a"), nil); w.Code != 404 {
+		t.Errorf("post outside the prefix: got %d", w.Code)
+	}
+}
+
+// TestHandlerFullExchange runs a PANDA exchange through the handler mounted
+// below a prefix in a mux, behind middleware that has nothing to do with it.
+func TestHandlerFullExchange(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/panda/", NewHandler(NewMemoryStorage(), WithPathPrefix("/panda")))
+	mux.Handle("/", http.NotFoundHandler())
+	requests := 0
+	middleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Served-By", "test")
+		mux.ServeHTTP(w, r)
+	})
+
+	opts := []panda.Option{panda.WithKDF(panda.KDFBalloon), panda.WithBalloonCost(16, 1)}
+	var parties [2]*panda.Exchange
+	for i, message := range []string{"from a", "from b"} {
+		ex, err := panda.New(rand.Reader, []byte("secret"), []byte(message), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parties[i] = ex
+	}
+
+	var received [2][]byte
+	for round := 0; received[0] == nil || received[1] == nil; round++ {
+		if round > 10 {
+			t.Fatal("exchange did not complete")
+		}
+		for i, ex := range parties {
+			if received[i] != nil {
+				continue
+			}
+			tag, body := ex.NextRequest()
+			w := post(middleware, "/panda/exchange/"+hex.EncodeToString(tag), body, nil)
+			if w.Header().Get("X-Served-By") != "test" {
+				t.Fatal("response bypassed the middleware")
+			}
+			switch w.Code {
+			case 204:
+				continue
+			case 200:
+			default:
+				t.Fatalf("party %d: got status %d", i, w.Code)
+			}
+			message, err := ex.Process(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("party %d: %s", i, err)
+			}
+			received[i] = message
+		}
+	}
+	if string(received[0]) != "from b" || string(received[1]) != "from a" {
+		t.Errorf("got messages %q and %q", received[0], received[1])
+	}
+	if requests == 0 {
+		t.Error("no requests passed through the middleware")
+	}
+}
+
+func TestHandlerExpiry(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	h := NewHandler(NewMemoryStorage(), WithClock(func() time.Time { return now }), WithLifetime(time.Hour))
+	path := "/exchange/" + testTag
+
+	post(h, path, []byte("a"), nil)
+	post(h, path, []byte("b"), nil)
+	now = now.Add(2 * time.Hour)
+	if w := post(h, path, []byte("c"), nil); w.Code != 204 {
+		t.Errorf("post to an expired tag: got %d", w.Code)
+	}
+}
+
+func TestHandlerAuthorization(t *testing.T) {
+	h := NewHandler(NewMemoryStorage(), WithVerifier(StaticTokens("secret")))
+	path := "/exchange/" + testTag
+
+	if w := post(h, path, []byte("a"), nil); w.Code != 401 || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("post without a token: got %d", w.Code)
+	}
+	if w := post(h, path, []byte("a"), http.Header{"Authorization": {"Bearer wrong"}}); w.Code != 401 {
+		t.Errorf("post with a bad token: got %d", w.Code)
+	}
+	if w := post(h, path, []byte("a"), http.Header{"Authorization": {"Bearer secret"}}); w.Code != 204 {
+		t.Errorf("post with a good token: got %d", w.Code)
+	}
+}
+
+func TestHandlerUnauthenticatedPolls(t *testing.T) {
+	token := http.Header{"Authorization": {"Bearer secret"}}
+	for _, allowPolls := range []bool{false, true} {
+		opts := []Option{WithVerifier(StaticTokens("secret"))}
+		if allowPolls {
+			opts = append(opts, WithUnauthenticatedPolls())
+		}
+		h := NewHandler(NewMemoryStorage(), opts...)
+		path := "/exchange/" + testTag
+
+		if w := post(h, path, []byte("a"), nil); w.Code != 401 {
+			t.Errorf("polls %v: first post without a token: got %d", allowPolls, w.Code)
+		}
+		if w := post(h, path, []byte("a"), token); w.Code != 204 {
+			t.Fatalf("polls %v: first post with a token: got %d", allowPolls, w.Code)
+		}
+		wantPoll := 401
+		if allowPolls {
+			wantPoll = 204
+		}
+		if w := post(h, path, []byte("a"), nil); w.Code != wantPoll {
+			t.Errorf("polls %v: poll without a token: got %d, want %d", allowPolls, w.Code, wantPoll)
+		}
+		if w := post(h, path, []byte("b"), nil); w.Code != 401 {
+			t.Errorf("polls %v: second body without a token: got %d", allowPolls, w.Code)
+		}
+		if w := post(h, path, []byte("b"), token); w.Code != 200 || w.Body.String() != "a" {
+			t.Fatalf("polls %v: second body with a token: got %d %q", allowPolls, w.Code, w.Body)
+		}
+		wantPoll = 401
+		if allowPolls {
+			wantPoll = 200
+		}
+		if w := post(h, path, []byte("a"), nil); w.Code != wantPoll {
+			t.Errorf("polls %v: collecting without a token: got %d, want %d", allowPolls, w.Code, wantPoll)
+		}
+		if w := post(h, path, []byte("c"), nil); w.Code != 401 {
+			t.Errorf("polls %v: conflicting body without a token: got %d", allowPolls, w.Code)
+		}
+	}
+}
+
+func TestHandlerInvites(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := invite.Mint(rand.Reader, priv, time.Now().Add(time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(NewMemoryStorage(), WithInviteKey(pub))
+	header := http.Header{"X-Panda-Invite": {code}}
+
+	if w := post(h, "/exchange/"+testTag, []byte("a"), nil); w.Code != 403 {
+		t.Errorf("post without an invite: got %d", w.Code)
+	}
+	if w := post(h, "/exchange/"+testTag, []byte("a"), header); w.Code != 204 {
+		t.Fatalf("first post: got %d", w.Code)
+	}
+	// Polling the same tag isn't charged.
+	if w := post(h, "/exchange/"+testTag, []byte("a"), header); w.Code != 204 {
+		t.Errorf("poll: got %d", w.Code)
+	}
+	if w := post(h, "/exchange/"+strings.Repeat("cd", 32), []byte("a"), header); w.Code != 403 {
+		t.Errorf("post beyond the invite's budget: got %d", w.Code)
+	}
+}
+
+func TestHandlerAudit(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Unix(1000000, 0)
+	h := NewHandler(NewMemoryStorage(), WithAuditLog(auditlog.New(&buf), testClientKey), WithClock(func() time.Time { return now }))
+	path := "/exchange/" + testTag
+
+	// The same client connects from a different port each time.
+	postFrom(h, "192.0.2.1:1000", path, []byte("a"), nil)
+	postFrom(h, "192.0.2.1:2000", path, []byte("a"), nil)
+	postFrom(h, "[2001:db8::1]:3000", path, []byte("b"), nil)
+	postFrom(h, "192.0.2.1:4000", path, []byte("c"), nil)
+
+	if _, err := auditlog.Verify(bytes.NewReader(buf.Bytes()), &auditlog.Head{}); err != nil {
+		t.Fatal(err)
+	}
+	var events []auditlog.Event
+	for scanner := bufio.NewScanner(&buf); scanner.Scan(); {
+		var record struct {
+			Event *auditlog.Event
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Event != nil {
+			events = append(events, *record.Event)
+		}
+	}
+
+	tag := bytes.Repeat([]byte{0xab}, 32)
+	want := []auditlog.Event{
+		auditlog.NewEvent(now, auditlog.OpPost, tag, []byte("a"), "192.0.2.1", testClientKey),
+		auditlog.NewEvent(now, auditlog.OpPoll, tag, []byte("a"), "192.0.2.1", testClientKey),
+		auditlog.NewEvent(now, auditlog.OpPost, tag, []byte("b"), "2001:db8::1", testClientKey),
+		auditlog.NewEvent(now, auditlog.OpConflict, tag, []byte("c"), "192.0.2.1", testClientKey),
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
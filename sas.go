@@ -0,0 +1,104 @@
+package panda
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+
+	"code.google.com/p/go.crypto/hkdf"
+)
+
+// ErrNoSharedKey is returned by SAS, SASWords and SASEmoji when the shared
+// key hasn't yet been established, which happens when the peer's first round
+// body is processed.
+var ErrNoSharedKey = errors.New("panda: shared key not yet established")
+
+// maxSASLen is the longest short authentication string, in digits, words or
+// emoji.
+const maxSASLen = 16
+
+// sasEmoji is the table that SASEmoji chooses from. The entries are easy to
+// tell apart and to name aloud, and its order is part of the protocol.
+var sasEmoji = []string{
+	"🐶", "🐱", "🦁", "🐎", "🦄", "🐷", "🐘", "🐰",
+	"🐼", "🐓", "🐧", "🐢", "🐟", "🐙", "🦋", "🌷",
+	"🌳", "🌵", "🍄", "🌏", "🌙", "☁", "🔥", "🍌",
+	"🍎", "🍓", "🌽", "🍕", "🎂", "❤", "😀", "🤖",
+	"🎩", "👓", "🔧", "🎅", "👍", "☂", "⌛", "⏰",
+	"🎁", "💡", "📕", "✏", "📎", "✂", "🔒", "🔑",
+	"🔨", "☎", "🏁", "🚂", "🚲", "✈", "🚀", "🏆",
+	"⚽", "🎸", "🎺", "🔔", "⚓", "🎧", "📁", "📌",
+}
+
+// SAS returns a short authentication string of n decimal digits, between one
+// and sixteen, derived from the shared key. Both parties get the same string
+// if, and only if, they agreed on the same key, so reading it to each other
+// over another channel, such as a phone call, confirms that no one
+// interfered with the exchange. It is available once the shared key is
+// established, otherwise ErrNoSharedKey is returned.
+func (ex *Exchange) SAS(n int) (string, error) {
+	indexes, err := ex.sasIndexes(n, 10)
+	if err != nil {
+		return "", err
+	}
+	digits := make([]byte, n)
+	for i, d := range indexes {
+		digits[i] = byte('0' + d)
+	}
+	return string(digits), nil
+}
+
+// SASWords is like SAS but returns n words, from the list that GenerateSecret
+// uses, separated by hyphens.
+func (ex *Exchange) SASWords(n int) (string, error) {
+	indexes, err := ex.sasIndexes(n, len(wordlist))
+	if err != nil {
+		return "", err
+	}
+	words := make([]string, n)
+	for i, j := range indexes {
+		words[i] = wordlist[j]
+	}
+	return strings.Join(words, "-"), nil
+}
+
+// SASEmoji is like SAS but returns n emoji, from a fixed table of 64,
+// separated by spaces.
+func (ex *Exchange) SASEmoji(n int) (string, error) {
+	indexes, err := ex.sasIndexes(n, len(sasEmoji))
+	if err != nil {
+		return "", err
+	}
+	emoji := make([]string, n)
+	for i, j := range indexes {
+		emoji[i] = sasEmoji[j]
+	}
+	return strings.Join(emoji, " "), nil
+}
+
+// sasIndexes returns n uniformly distributed numbers in [0, base), derived
+// from the shared key under a context of their own.
+func (ex *Exchange) sasIndexes(n, base int) ([]int, error) {
+	if !ex.haveSharedKey {
+		return nil, ErrNoSharedKey
+	}
+	if n < 1 || n > maxSASLen {
+		return nil, errors.New("panda: invalid length of short authentication string")
+	}
+	var r io.Reader
+	if ex.version >= ProtocolVersion2 {
+		r = hkdf.New(sha256.New, ex.sharedKey[:], []byte(scheduleSalt), []byte(ex.context(labelSAS)))
+	} else {
+		r = hkdf.New(sha256.New, ex.sharedKey[:], nil, []byte(ex.context("short authentication string")))
+	}
+	indexes := make([]int, n)
+	for i := range indexes {
+		j, err := uniformIndex(r, base)
+		if err != nil {
+			return nil, err
+		}
+		indexes[i] = j
+	}
+	return indexes, nil
+}
@@ -0,0 +1,93 @@
+package panda
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSAS(t *testing.T) {
+	for _, version := range []int{ProtocolVersion1, ProtocolVersion2} {
+		a, err := New(rand.Reader, []byte("foo"), []byte("hello"), WithProtocolVersion(version), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.SAS(6); err != ErrNoSharedKey {
+			t.Errorf("version %d: got %v before the shared key was established", version, err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("world"), WithProtocolVersion(version), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runExchange(t, a, b)
+		b = marshalUnmarshal(b)
+
+		for _, sas := range []func(*Exchange, int) (string, error){(*Exchange).SAS, (*Exchange).SASWords, (*Exchange).SASEmoji} {
+			aSAS, err := sas(a, maxSASLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bSAS, err := sas(b, maxSASLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if aSAS != bSAS {
+				t.Errorf("version %d: parties got %q and %q", version, aSAS, bSAS)
+			}
+			if _, err := sas(a, 0); err == nil {
+				t.Errorf("version %d: empty string was allowed", version)
+			}
+			if _, err := sas(a, maxSASLen+1); err == nil {
+				t.Errorf("version %d: overlong string was allowed", version)
+			}
+		}
+
+		digits, _ := a.SAS(8)
+		if len(digits) != 8 || strings.Trim(digits, "0123456789") != "" {
+			t.Errorf("version %d: bad digits %q", version, digits)
+		}
+		if words, _ := a.SASWords(4); len(strings.Split(words, "-")) != 4 {
+			t.Errorf("version %d: bad words %q", version, words)
+		}
+		if emoji, _ := a.SASEmoji(5); len(strings.Fields(emoji)) != 5 {
+			t.Errorf("version %d: bad emoji %q", version, emoji)
+		}
+	}
+}
+
+func TestSASDiffers(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		a, err := New(rand.Reader, []byte("foo"), []byte("a"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runExchange(t, a, b)
+		sas, err := a.SAS(maxSASLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[sas] {
+			t.Errorf("exchanges repeated the string %q", sas)
+		}
+		seen[sas] = true
+	}
+}
+
+func TestSASEmojiTable(t *testing.T) {
+	if len(sasEmoji) != 64 {
+		t.Fatalf("emoji table has %d entries", len(sasEmoji))
+	}
+	seen := make(map[string]bool)
+	for _, e := range sasEmoji {
+		if utf8.RuneCountInString(e) != 1 || seen[e] {
+			t.Errorf("bad or repeated entry %q", e)
+		}
+		seen[e] = true
+	}
+}
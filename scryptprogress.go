@@ -0,0 +1,163 @@
+package panda
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"sync/atomic"
+
+	"code.google.com/p/go.crypto/pbkdf2"
+)
+
+// scryptCounting computes scrypt exactly as scrypt.Key does, with keyLen 32,
+// but adds one to *done for every block mix so that its progress can be
+// observed. There are 2*N*p in total. The parameters must already have been
+// validated.
+func scryptCounting(password, salt []byte, N, r, p int, done *int64) []byte {
+	m := newROMixer(r, N)
+	b := pbkdf2.Key(password, salt, 1, p*128*r, sha256.New)
+	for i := 0; i < p; i++ {
+		m.load(b[i*128*r:])
+		m.run(2*N, done)
+		m.store(b[i*128*r:])
+	}
+	key := pbkdf2.Key(password, b, 1, 32, sha256.New)
+	wipe(b)
+	return key
+}
+
+// salsa208 applies the Salsa20/8 core to b in place.
+func salsa208(b *[16]uint32) {
+	x0, x1, x2, x3, x4, x5, x6, x7 := b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7]
+	x8, x9, x10, x11, x12, x13, x14, x15 := b[8], b[9], b[10], b[11], b[12], b[13], b[14], b[15]
+	for i := 0; i < 8; i += 2 {
+		x4 ^= bits.RotateLeft32(x0+x12, 7)
+		x8 ^= bits.RotateLeft32(x4+x0, 9)
+		x12 ^= bits.RotateLeft32(x8+x4, 13)
+		x0 ^= bits.RotateLeft32(x12+x8, 18)
+		x9 ^= bits.RotateLeft32(x5+x1, 7)
+		x13 ^= bits.RotateLeft32(x9+x5, 9)
+		x1 ^= bits.RotateLeft32(x13+x9, 13)
+		x5 ^= bits.RotateLeft32(x1+x13, 18)
+		x14 ^= bits.RotateLeft32(x10+x6, 7)
+		x2 ^= bits.RotateLeft32(x14+x10, 9)
+		x6 ^= bits.RotateLeft32(x2+x14, 13)
+		x10 ^= bits.RotateLeft32(x6+x2, 18)
+		x3 ^= bits.RotateLeft32(x15+x11, 7)
+		x7 ^= bits.RotateLeft32(x3+x15, 9)
+		x11 ^= bits.RotateLeft32(x7+x3, 13)
+		x15 ^= bits.RotateLeft32(x11+x7, 18)
+
+		x1 ^= bits.RotateLeft32(x0+x3, 7)
+		x2 ^= bits.RotateLeft32(x1+x0, 9)
+		x3 ^= bits.RotateLeft32(x2+x1, 13)
+		x0 ^= bits.RotateLeft32(x3+x2, 18)
+		x6 ^= bits.RotateLeft32(x5+x4, 7)
+		x7 ^= bits.RotateLeft32(x6+x5, 9)
+		x4 ^= bits.RotateLeft32(x7+x6, 13)
+		x5 ^= bits.RotateLeft32(x4+x7, 18)
+		x11 ^= bits.RotateLeft32(x10+x9, 7)
+		x8 ^= bits.RotateLeft32(x11+x10, 9)
+		x9 ^= bits.RotateLeft32(x8+x11, 13)
+		x10 ^= bits.RotateLeft32(x9+x8, 18)
+		x12 ^= bits.RotateLeft32(x15+x14, 7)
+		x13 ^= bits.RotateLeft32(x12+x15, 9)
+		x14 ^= bits.RotateLeft32(x13+x12, 13)
+		x15 ^= bits.RotateLeft32(x14+x13, 18)
+	}
+	b[0] += x0
+	b[1] += x1
+	b[2] += x2
+	b[3] += x3
+	b[4] += x4
+	b[5] += x5
+	b[6] += x6
+	b[7] += x7
+	b[8] += x8
+	b[9] += x9
+	b[10] += x10
+	b[11] += x11
+	b[12] += x12
+	b[13] += x13
+	b[14] += x14
+	b[15] += x15
+}
+
+// blockMix is scrypt's BlockMix with Salsa20/8, from in to out, each of
+// 32*r words.
+func blockMix(tmp *[16]uint32, in, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for j := range tmp {
+			tmp[j] ^= in[i*16+j]
+		}
+		salsa208(tmp)
+		// Even blocks go to the first half of the output and odd ones
+		// to the second.
+		copy(out[(i/2+(i%2)*r)*16:], tmp[:])
+	}
+}
+
+// A romixer computes scrypt's ROMix on one block in steps.
+type romixer struct {
+	r, N int
+	v    []uint32
+	x, y []uint32
+	// i counts the iterations done, of 2*N.
+	i   int
+	tmp [16]uint32
+}
+
+// newROMixer returns a romixer for blocks of 128*r bytes.
+func newROMixer(r, N int) *romixer {
+	xy := make([]uint32, 64*r)
+	return &romixer{r: r, N: N, v: make([]uint32, 32*N*r), x: xy[:32*r], y: xy[32*r:]}
+}
+
+// load starts ROMix on the 128*r bytes at the start of b.
+func (m *romixer) load(b []byte) {
+	for i := range m.x {
+		m.x[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	m.i = 0
+}
+
+// run performs up to n iterations, adding one to *done for each, and returns
+// true once ROMix is complete.
+func (m *romixer) run(n int, done *int64) bool {
+	R := 32 * m.r
+	x, y := m.x, m.y
+	for ; n > 0 && m.i < m.N; n, m.i = n-1, m.i+1 {
+		copy(m.v[m.i*R:], x)
+		blockMix(&m.tmp, x, y, m.r)
+		x, y = y, x
+		atomic.AddInt64(done, 1)
+	}
+	for ; n > 0 && m.i < 2*m.N; n, m.i = n-1, m.i+1 {
+		j := int(uint64(x[R-16])|uint64(x[R-15])<<32) & (m.N - 1)
+		for k, w := range m.v[j*R : (j+1)*R] {
+			x[k] ^= w
+		}
+		blockMix(&m.tmp, x, y, m.r)
+		x, y = y, x
+		atomic.AddInt64(done, 1)
+	}
+	m.x, m.y = x, y
+	return m.i == 2*m.N
+}
+
+// store writes the result of ROMix to the start of b.
+func (m *romixer) store(b []byte) {
+	for i, w := range m.x {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+}
+
+// wipe zeros the romixer's state.
+func (m *romixer) wipe() {
+	for _, s := range [][]uint32{m.v, m.x, m.y, m.tmp[:]} {
+		for i := range s {
+			s[i] = 0
+		}
+	}
+}
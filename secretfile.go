@@ -0,0 +1,53 @@
+package panda
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MinSecretFileSize is the smallest file accepted by SecretFromFile.
+const MinSecretFileSize = 4096
+
+// ErrLowEntropySource is returned by SecretFromFile when the file is too small
+// to be a plausible secret.
+var ErrLowEntropySource = errors.New("panda: file too small to be used as a secret")
+
+// secretFileContext separates secrets derived from files from any other use
+// of SHA-256.
+const secretFileContext = "PANDA secret from file v1\x00"
+
+// SecretFromFile returns a secret, for passing to New, derived from the
+// contents of a file that both parties hold, such as a photo. The file is
+// hashed exactly as read: both copies must be byte-for-byte identical, so a
+// photo that has been resized, recompressed or had its metadata changed by
+// either party won't work. The contents must be at least MinSecretFileSize
+// bytes long.
+//
+// A file is only as secret as its distribution: one that has been posted
+// online, or sent over a channel that an attacker can see, is no secret at
+// all.
+func SecretFromFile(r io.Reader) ([]byte, error) {
+	return SecretFromFileAndPassphrase(r, nil)
+}
+
+// SecretFromFileAndPassphrase is like SecretFromFile but also mixes in a
+// passphrase, which both parties must also know.
+func SecretFromFileAndPassphrase(r io.Reader, passphrase []byte) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte(secretFileContext))
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(passphrase)))
+	h.Write(length[:])
+	h.Write(passphrase)
+
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if n < MinSecretFileSize {
+		return nil, ErrLowEntropySource
+	}
+	return h.Sum(nil), nil
+}
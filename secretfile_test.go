@@ -0,0 +1,56 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSecretFromFile(t *testing.T) {
+	photo := make([]byte, 3*MinSecretFileSize)
+	rand.Read(photo)
+	changed := append([]byte(nil), photo...)
+	changed[len(changed)/2] ^= 1
+
+	tagFor := func(file, passphrase []byte) []byte {
+		secret, err := SecretFromFileAndPassphrase(bytes.NewReader(file), passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := New(rand.Reader, secret, []byte("hello"), fastKDF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, _ := ex.NextRequest()
+		return tag
+	}
+
+	if !bytes.Equal(tagFor(photo, nil), tagFor(append([]byte(nil), photo...), nil)) {
+		t.Errorf("identical files produced different tags")
+	}
+	if bytes.Equal(tagFor(photo, nil), tagFor(changed, nil)) {
+		t.Errorf("a one byte difference produced the same tag")
+	}
+	if bytes.Equal(tagFor(photo, nil), tagFor(photo, []byte("passphrase"))) {
+		t.Errorf("the passphrase was not mixed in")
+	}
+
+	withoutPassphrase, err := SecretFromFile(bytes.NewReader(photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withEmptyPassphrase, err := SecretFromFileAndPassphrase(bytes.NewReader(photo), []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(withoutPassphrase, withEmptyPassphrase) {
+		t.Errorf("SecretFromFile differs from using an empty passphrase")
+	}
+
+	if _, err := SecretFromFile(bytes.NewReader(photo[:MinSecretFileSize-1])); err != ErrLowEntropySource {
+		t.Errorf("got %v for a small file", err)
+	}
+	if _, err := SecretFromFile(bytes.NewReader(photo[:MinSecretFileSize])); err != nil {
+		t.Errorf("minimum size file was rejected: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+package panda
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultMinSecretBits is the estimated entropy that IsAcceptableSecret
+// requires. It is high for a password because the secret can't be salted: a
+// single dictionary of derived tags serves an attacker against every exchange
+// that uses the same KDF parameters.
+const DefaultMinSecretBits = 56
+
+// ErrWeakSecret is wrapped by the *WeakSecretError returned when a secret
+// fails the policy set by WithMinSecretBits.
+var ErrWeakSecret = errors.New("panda: secret is too weak")
+
+// A WeakSecretError gives the estimated entropy of a rejected secret and the
+// main reason that it's weak.
+type WeakSecretError struct {
+	Bits   float64
+	Reason string
+}
+
+func (e *WeakSecretError) Error() string {
+	return "panda: secret is too weak (about " + strconv.Itoa(int(e.Bits)) + " bits): " + e.Reason
+}
+
+func (e *WeakSecretError) Unwrap() error {
+	return ErrWeakSecret
+}
+
+// WithMinSecretBits makes New reject secrets that EstimateSecretEntropy rates
+// below minBits with a *WeakSecretError. DefaultMinSecretBits is a reasonable
+// value. The check happens before the KDF, so it costs nothing to fail.
+func WithMinSecretBits(minBits float64) Option {
+	return func(c *config) {
+		c.minSecretBits = minBits
+	}
+}
+
+// IsAcceptableSecret estimates the entropy of secret and reports whether it
+// reaches DefaultMinSecretBits. If it doesn't, reason is a short explanation
+// suitable for showing to the user. Use EstimateSecretEntropy to apply a
+// different threshold.
+func IsAcceptableSecret(secret []byte) (bits float64, ok bool, reason string) {
+	bits, reason = EstimateSecretEntropy(secret)
+	if bits >= DefaultMinSecretBits {
+		return bits, true, ""
+	}
+	if len(reason) == 0 {
+		reason = "too short"
+	}
+	return bits, false, reason
+}
+
+// EstimateSecretEntropy returns a rough, conservative estimate of the entropy
+// of a secret chosen by a person. Each character is credited according to the
+// classes of character used in the whole secret, except that characters
+// continuing a repetition, sequence or keyboard walk earn only a bit, and
+// common passwords earn almost nothing. reason names the most significant
+// weakness found, if any. The estimate is meant to catch obviously bad
+// secrets, not to certify good ones: a quotation or song lyric will score
+// well but is easily guessed.
+func EstimateSecretEntropy(secret []byte) (bits float64, reason string) {
+	if !utf8.Valid(secret) {
+		// Binary secrets are credited at face value.
+		return 8 * float64(len(secret)), ""
+	}
+	s := string(secret)
+	lower := strings.ToLower(s)
+	if rank, ok := commonPasswordRank(lower); ok {
+		return math.Log2(float64(rank + 2)), "a common password"
+	}
+
+	runes := []rune(s)
+	perRune := math.Log2(float64(characterPool(runes)))
+	patterned := 0
+	for i := 1; i < len(runes); i++ {
+		if continuesPattern(unicode.ToLower(runes[i-1]), unicode.ToLower(runes[i])) {
+			bits++
+			patterned++
+		} else {
+			bits += perRune
+		}
+	}
+	if len(runes) > 0 {
+		bits += perRune
+	}
+
+	if unit := repeatedUnit(lower); unit > 0 {
+		unitBits, _ := EstimateSecretEntropy([]byte(lower[:unit]))
+		return unitBits + math.Log2(float64(len(lower)/unit)), "repeats itself"
+	}
+	if patterned*2 >= len(runes) && len(runes) > 1 {
+		reason = "made of repeated characters, sequences or keyboard patterns"
+	}
+	return bits, reason
+}
+
+// characterPool returns the number of characters that an attacker would try
+// at each position, given the classes of character present.
+func characterPool(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			pool += class.size
+		}
+	}
+	if pool < 2 {
+		pool = 2
+	}
+	return pool
+}
+
+// keyboardRows are the rows of a QWERTY keyboard, used to detect walks
+// along them.
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+// continuesPattern returns true if b follows a as part of a repetition, an
+// alphabetic or numeric sequence, or a walk along a keyboard row.
+func continuesPattern(a, b rune) bool {
+	if a == b || a+1 == b || a == b+1 {
+		return true
+	}
+	for _, row := range keyboardRows {
+		i, j := strings.IndexRune(row, a), strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatedUnit returns the length of the shortest string that s is two or
+// more copies of, or zero if there is none.
+func repeatedUnit(s string) int {
+	for unit := 1; unit <= len(s)/2; unit++ {
+		if len(s)%unit == 0 && strings.Repeat(s[:unit], len(s)/unit) == s {
+			return unit
+		}
+	}
+	return 0
+}
+
+// commonPasswordRank returns the position of s in commonPasswords, also
+// allowing for a few digits or a symbol added at the end.
+func commonPasswordRank(s string) (int, bool) {
+	trimmed := strings.TrimRightFunc(s, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+	for i, p := range commonPasswords {
+		if s == p || (len(s)-len(trimmed) <= 4 && trimmed == p) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// commonPasswords are some of the most frequently used passwords, most
+// common first.
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345",
+	"1234", "111111", "1234567", "dragon", "123123", "baseball", "abc123",
+	"football", "monkey", "letmein", "shadow", "master", "696969",
+	"mustang", "666666", "qwertyuiop", "123321", "1234567890", "michael",
+	"superman", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm",
+	"asdfgh", "hunter", "buster", "soccer", "harley", "batman", "andrew",
+	"tigger", "sunshine", "iloveyou", "2000", "charlie", "robert",
+	"thomas", "hockey", "ranger", "daniel", "starwars",
+	"112233", "george", "computer", "michelle", "jessica", "pepper",
+	"1111", "zxcvbn", "555555", "11111111", "131313", "freedom", "777777",
+	"pass", "maggie", "159753", "aaaaaa", "ginger", "princess", "joshua",
+	"cheese", "amanda", "summer", "love", "ashley", "nicole", "chelsea",
+	"biteme", "matthew", "access", "yankees", "987654321", "dallas",
+	"austin", "thunder", "taylor", "matrix", "hunter2", "welcome",
+	"passw0rd", "p@ssw0rd", "secret", "admin", "changeme", "letmein1",
+	"correcthorsebatterystaple", "correct horse battery staple",
+}
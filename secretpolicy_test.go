@@ -0,0 +1,62 @@
+package panda
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// secretCorpus records the expected estimates, to the nearest bit, of some
+// good and bad secrets so that changes to the estimator are deliberate.
+var secretCorpus = []struct {
+	secret string
+	bits   float64
+	ok     bool
+	reason string
+}{
+	{"hunter2", 5, false, "a common password"},
+	{"HUNTER2", 5, false, "a common password"},
+	{"Password!", 2, false, "a common password"},
+	{"qwertyuiop", 5, false, "a common password"},
+	{"aaaaaaaaaaaa", 8, false, "repeats itself"},
+	{"abcabcabcabc", 9, false, "repeats itself"},
+	{"abcdefghijkl", 16, false, "made of repeated characters, sequences or keyboard patterns"},
+	{"asdfghjkl;", 15, false, "made of repeated characters, sequences or keyboard patterns"},
+	{"short", 20, false, "too short"},
+	{"8 chars!", 44, false, "too short"},
+	{"Tr0ub4dor&3xyz!Q", 88, true, ""},
+	{"ぱんだのひみつをまもる", 73, true, ""},
+	{"correct staple horse battery orange", 172, true, ""},
+	{"7 purple elephants dance on Tuesday", 208, true, ""},
+	{"\xff\x00\x01\x02\x03\x04\x05\x06\x07\x08", 80, true, ""},
+}
+
+func TestIsAcceptableSecret(t *testing.T) {
+	for _, test := range secretCorpus {
+		bits, ok, reason := IsAcceptableSecret([]byte(test.secret))
+		if bits < test.bits-0.5 || bits >= test.bits+0.5 || ok != test.ok || reason != test.reason {
+			t.Errorf("%q: got %.1f bits, %t, %q; want %.0f bits, %t, %q", test.secret, bits, ok, reason, test.bits, test.ok, test.reason)
+		}
+	}
+}
+
+func TestMinSecretBits(t *testing.T) {
+	_, err := New(rand.Reader, []byte("hunter2"), nil, WithMinSecretBits(DefaultMinSecretBits), fastKDF)
+	var weakErr *WeakSecretError
+	if !errors.As(err, &weakErr) || !errors.Is(err, ErrWeakSecret) {
+		t.Fatalf("got %v, want a WeakSecretError", err)
+	}
+	if weakErr.Reason != "a common password" {
+		t.Errorf("got reason %q", weakErr.Reason)
+	}
+	if _, err := PrecomputeKey([]byte("short"), WithMinSecretBits(DefaultMinSecretBits), fastKDF); !errors.Is(err, ErrWeakSecret) {
+		t.Errorf("PrecomputeKey: got %v, want ErrWeakSecret", err)
+	}
+
+	if _, err := New(rand.Reader, []byte("short"), nil, WithMinSecretBits(16), fastKDF); err != nil {
+		t.Errorf("secret above a lower threshold was rejected: %v", err)
+	}
+	if _, err := New(rand.Reader, []byte("hunter2"), nil, fastKDF); err != nil {
+		t.Errorf("weak secret rejected without a policy: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package panda
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"go/format"
+	"os"
+	"sort"
+	"testing"
+)
+
+var generateSelfTest = flag.Bool("generate-selftest", false, "rewrite selftest_vectors.go")
+
+// TestGenerateSelfTestVectors writes the known answers for RunSelfTest to
+// selftest_vectors.go when run with -generate-selftest.
+func TestGenerateSelfTestVectors(t *testing.T) {
+	if !*generateSelfTest {
+		t.Skip("run with -generate-selftest to rewrite the vectors")
+	}
+	vectors := make(map[string]string)
+	if err := runSelfTest(func(stage string, got []byte) error {
+		vectors[stage] = hex.EncodeToString(got)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stages := make([]string, 0, len(vectors))
+	for stage := range vectors {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by TestGenerateSelfTestVectors with -generate-selftest. DO NOT EDIT.\n\npackage panda\n\n")
+	buf.WriteString("// selfTestVectors holds the known answers for RunSelfTest, by stage.\nvar selfTestVectors = map[string]string{\n")
+	for _, stage := range stages {
+		buf.WriteString("\t" + `"` + stage + `": "` + vectors[stage] + "\",\n")
+	}
+	buf.WriteString("}\n")
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("selftest_vectors.go", src, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	if err := RunSelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfTestFailure(t *testing.T) {
+	defer func(want string) { selfTestVectors[stageSharedKey] = want }(selfTestVectors[stageSharedKey])
+	selfTestVectors[stageSharedKey] = "00"
+	err := RunSelfTest()
+	if e, ok := err.(*SelfTestError); !ok || e.Stage != stageSharedKey {
+		t.Errorf("got %v, want a failure in %s", err, stageSharedKey)
+	}
+}
@@ -0,0 +1,152 @@
+package panda
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Suit is the suit of a playing card.
+type Suit uint8
+
+// The four suits. Zero is not a suit.
+const (
+	Clubs Suit = iota + 1
+	Diamonds
+	Hearts
+	Spades
+)
+
+// A Card is a playing card. Rank runs from 1 (ace) to 13 (king).
+type Card struct {
+	Rank int
+	Suit Suit
+}
+
+const cardRanks = "A23456789TJQK"
+
+func (c Card) valid() bool {
+	return c.Rank >= 1 && c.Rank <= 13 && c.Suit >= Clubs && c.Suit <= Spades
+}
+
+func (c Card) String() string {
+	if !c.valid() {
+		return "?"
+	}
+	return cardRanks[c.Rank-1:c.Rank] + "CDHS"[c.Suit-1:c.Suit]
+}
+
+// ParseCard parses a card written as a rank, one of A, 2-10, J, Q and K
+// (or T for ten), followed by a suit, one of C, D, H and S. Case is ignored.
+func ParseCard(s string) (Card, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) < 2 {
+		return Card{}, errors.New("panda: malformed card " + strconv.Quote(s))
+	}
+	rank, suit := s[:len(s)-1], s[len(s)-1]
+	if rank == "10" {
+		rank = "T"
+	}
+	var c Card
+	if len(rank) == 1 {
+		c.Rank = strings.IndexByte(cardRanks, rank[0]) + 1
+	}
+	c.Suit = Suit(strings.IndexByte("CDHS", suit) + 1)
+	if c.Rank == 0 || c.Suit == 0 {
+		return Card{}, errors.New("panda: malformed card " + strconv.Quote(s))
+	}
+	return c, nil
+}
+
+// A SharedSecret combines a memorable phrase with other material that both
+// parties hold, such as cards from a shuffled deck, and optionally limits
+// the secret to a period of time. Encode turns it into the secret for New.
+type SharedSecret struct {
+	// Phrase is normalized with NormalizeSecret when encoded.
+	Phrase string
+	// Cards may be listed in any order.
+	Cards []Card
+	// Year, Month and Day scope the secret to a year, month or day. Each
+	// is zero if unset, and Month and Day may only be set if the larger
+	// units are too.
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// Validate checks that s is complete and consistent: it must have a phrase
+// or cards, the cards must be valid and distinct, and the date must be
+// valid.
+func (s *SharedSecret) Validate() error {
+	if len(strings.TrimSpace(s.Phrase)) == 0 && len(s.Cards) == 0 {
+		return errors.New("panda: shared secret has neither a phrase nor cards")
+	}
+	seen := make(map[Card]bool)
+	for _, c := range s.Cards {
+		if !c.valid() {
+			return errors.New("panda: shared secret contains an invalid card")
+		}
+		if seen[c] {
+			return errors.New("panda: shared secret contains the card " + c.String() + " twice")
+		}
+		seen[c] = true
+	}
+
+	switch {
+	case s.Year < 0 || s.Year > 9999:
+		return errors.New("panda: shared secret year out of range")
+	case s.Month < 0 || s.Month > time.December:
+		return errors.New("panda: shared secret month out of range")
+	case s.Month != 0 && s.Year == 0:
+		return errors.New("panda: shared secret has a month but no year")
+	case s.Day != 0 && s.Month == 0:
+		return errors.New("panda: shared secret has a day but no month")
+	case s.Day < 0 || s.Day != 0 && time.Date(s.Year, s.Month, s.Day, 0, 0, 0, 0, time.UTC).Day() != s.Day:
+		return errors.New("panda: shared secret day isn't in its month")
+	}
+	return nil
+}
+
+// sharedSecretContext begins every encoded SharedSecret so that the encoding
+// can't collide with a plain secret.
+const sharedSecretContext = "PANDA shared secret v1\x00"
+
+// Encode validates s and returns its canonical encoding, for use as the
+// secret passed to New. Both parties get the same bytes whatever the order of
+// the cards or the form of the phrase. The encoding includes a version, so a
+// SharedSecret never encodes to the same bytes as a plain secret.
+func (s *SharedSecret) Encode() ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	var phrase []byte
+	if len(strings.TrimSpace(s.Phrase)) > 0 {
+		var err error
+		if phrase, err = NormalizeSecret([]byte(s.Phrase)); err != nil {
+			return nil, err
+		}
+	}
+
+	cards := make([]Card, len(s.Cards))
+	copy(cards, s.Cards)
+	sort.Slice(cards, func(i, j int) bool {
+		if cards[i].Suit != cards[j].Suit {
+			return cards[i].Suit < cards[j].Suit
+		}
+		return cards[i].Rank < cards[j].Rank
+	})
+
+	var lenBytes [binary.MaxVarintLen64]byte
+	out := []byte(sharedSecretContext)
+	out = append(out, lenBytes[:binary.PutUvarint(lenBytes[:], uint64(len(phrase)))]...)
+	out = append(out, phrase...)
+	out = append(out, byte(len(cards)))
+	for _, c := range cards {
+		out = append(out, byte(c.Suit), byte(c.Rank))
+	}
+	out = append(out, byte(s.Year>>8), byte(s.Year), byte(s.Month), byte(s.Day))
+	return out, nil
+}
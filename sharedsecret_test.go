@@ -0,0 +1,149 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestParseCard(t *testing.T) {
+	for in, want := range map[string]Card{
+		"AS":  {1, Spades},
+		"10h": {10, Hearts},
+		"td":  {10, Diamonds},
+		" Qc": {12, Clubs},
+		"7D":  {7, Diamonds},
+	} {
+		c, err := ParseCard(in)
+		if err != nil {
+			t.Errorf("%q: %v", in, err)
+			continue
+		}
+		if c != want {
+			t.Errorf("%q: got %v, want %v", in, c, want)
+		}
+	}
+	for _, in := range []string{"", "S", "1S", "11H", "KX", "AAS"} {
+		if _, err := ParseCard(in); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestSharedSecretEncoding(t *testing.T) {
+	a := &SharedSecret{
+		Phrase: "Café  1234",
+		Cards:  []Card{{1, Spades}, {10, Hearts}, {2, Clubs}},
+		Year:   2014,
+		Month:  time.March,
+		Day:    1,
+	}
+	b := &SharedSecret{
+		Phrase: " café 1234",
+		Cards:  []Card{{2, Clubs}, {1, Spades}, {10, Hearts}},
+		Year:   2014,
+		Month:  time.March,
+		Day:    1,
+	}
+	aBytes, err := a.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bBytes, err := b.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aBytes, bBytes) {
+		t.Errorf("equivalent shared secrets encoded differently:\n%x\n%x", aBytes, bBytes)
+	}
+	if a.Cards[0] != (Card{1, Spades}) {
+		t.Errorf("Encode reordered the caller's cards")
+	}
+
+	// Each component must change the encoding.
+	for _, change := range []func(*SharedSecret){
+		func(s *SharedSecret) { s.Phrase = "café 1235" },
+		func(s *SharedSecret) { s.Cards = s.Cards[1:] },
+		func(s *SharedSecret) { s.Cards[0].Suit = Diamonds },
+		func(s *SharedSecret) { s.Day = 2 },
+		func(s *SharedSecret) { s.Day = 0 },
+		func(s *SharedSecret) { s.Year = 2015 },
+	} {
+		c := *b
+		c.Cards = append([]Card(nil), b.Cards...)
+		change(&c)
+		cBytes, err := c.Encode()
+		if err != nil {
+			t.Errorf("%+v: %v", c, err)
+			continue
+		}
+		if bytes.Equal(cBytes, bBytes) {
+			t.Errorf("%+v encoded the same as %+v", c, b)
+		}
+	}
+
+	// A phrase alone doesn't encode to the phrase itself.
+	phraseOnly, err := (&SharedSecret{Phrase: "foo"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(phraseOnly) == "foo" {
+		t.Errorf("shared secret encoded as a plain secret")
+	}
+}
+
+func TestSharedSecretValidate(t *testing.T) {
+	for _, s := range []SharedSecret{
+		{},
+		{Phrase: "  "},
+		{Phrase: "foo", Cards: []Card{{1, Spades}, {1, Spades}}},
+		{Cards: []Card{{14, Spades}}},
+		{Cards: []Card{{1, 0}}},
+		{Phrase: "foo", Month: time.May},
+		{Phrase: "foo", Year: 2014, Day: 3},
+		{Phrase: "foo", Year: 2014, Month: time.February, Day: 30},
+		{Phrase: "foo", Year: 2014, Month: 13},
+		{Phrase: "foo", Year: -1},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%+v: no error", s)
+		}
+		if _, err := s.Encode(); err == nil {
+			t.Errorf("%+v: encoded", s)
+		}
+	}
+	for _, s := range []SharedSecret{
+		{Phrase: "foo"},
+		{Cards: []Card{{13, Clubs}}},
+		{Phrase: "foo", Year: 2016, Month: time.February, Day: 29},
+		{Phrase: "foo", Year: 2014},
+	} {
+		if err := s.Validate(); err != nil {
+			t.Errorf("%+v: %v", s, err)
+		}
+	}
+}
+
+func TestSharedSecretExchange(t *testing.T) {
+	aSecret, err := (&SharedSecret{Phrase: "Foo", Cards: []Card{{5, Hearts}, {6, Hearts}}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSecret, err := (&SharedSecret{Phrase: "foo", Cards: []Card{{6, Hearts}, {5, Hearts}}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(rand.Reader, aSecret, []byte("a"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, bSecret, []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
@@ -0,0 +1,269 @@
+// Package statedir stores serialized PANDA exchanges in a directory, one file
+// per exchange. Every write is atomic: after a crash a state file contains
+// either its old or its new contents, never a mixture.
+package statedir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/agl/panda"
+)
+
+const (
+	stateSuffix  = ".state"
+	tempPrefix   = ".tmp-"
+	hashedPrefix = "sha256-"
+)
+
+// maxHexIDLen is the longest id, in bytes, whose file is named by the id in
+// lowercase hex, which is safe on case-insensitive filesystems. Longer ids
+// would exceed NAME_MAX, so their files are named by the SHA-256 hash of the
+// id instead and begin with the id itself, preceded by its length in four
+// big-endian bytes.
+const maxHexIDLen = 100
+
+// A Store is a directory of serialized exchanges, each identified by an
+// arbitrary, non-empty string.
+type Store struct {
+	dir string
+	now func() time.Time
+}
+
+// Info describes a stored exchange.
+type Info struct {
+	ID string
+	panda.StateInfo
+	// ModTime is when the exchange was last saved.
+	ModTime time.Time
+	// Err is set if the file couldn't be read or parsed, in which case
+	// only ID, if it could be recovered from the filename, and ModTime may
+	// be set.
+	Err error
+}
+
+// Open returns a Store for dir, creating it if needed. Temporary files left by
+// a write that was interrupted are removed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, tempPrefix) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Store{dir, time.Now}, nil
+}
+
+// filename returns the path of the file holding the exchange with the given
+// id. Ids are encoded so that any string maps to a single, safe filename.
+func (s *Store) filename(id string) (string, error) {
+	if len(id) == 0 {
+		return "", errors.New("statedir: empty id")
+	}
+	if len(id) > maxHexIDLen {
+		h := sha256.Sum256([]byte(id))
+		return filepath.Join(s.dir, hashedPrefix+hex.EncodeToString(h[:])+stateSuffix), nil
+	}
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(id))+stateSuffix), nil
+}
+
+// Save stores the state of ex under id, replacing any previous state.
+func (s *Store) Save(id string, ex *panda.Exchange) error {
+	filename, err := s.filename(id)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if len(id) > maxHexIDLen {
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(id))))
+		buf.WriteString(id)
+	}
+	if err := ex.MarshalTo(&buf); err != nil {
+		return err
+	}
+	temp, err := s.writeTemp(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(temp, filename); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return s.syncDir()
+}
+
+// writeTemp writes data to a new temporary file in the store's directory and
+// syncs it to disk. It returns the file's path.
+func (s *Store) writeTemp(data []byte) (string, error) {
+	f, err := ioutil.TempFile(s.dir, tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// syncDir syncs the store's directory so that renames and removals are
+// durable.
+func (s *Store) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Load returns the exchange stored under id. If there is none, the error
+// satisfies os.IsNotExist.
+func (s *Store) Load(id string) (*panda.Exchange, error) {
+	filename, err := s.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	storedID, state, err := readStateFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if storedID != id {
+		return nil, errors.New("statedir: file for id holds another id")
+	}
+	return panda.Unmarshal(state)
+}
+
+// readStateFile returns the id and serialized exchange held in the state file
+// at path.
+func readStateFile(path string) (id string, state []byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	name := filepath.Base(path)
+	if !isStateName(name) {
+		return "", nil, errors.New("statedir: not a state file name")
+	}
+	name = strings.TrimSuffix(name, stateSuffix)
+	if !strings.HasPrefix(name, hashedPrefix) {
+		decoded, _ := hex.DecodeString(name)
+		return string(decoded), data, nil
+	}
+	if len(data) < 4 || uint64(len(data)-4) < uint64(binary.BigEndian.Uint32(data)) {
+		return "", nil, errors.New("statedir: truncated id in state file")
+	}
+	n := binary.BigEndian.Uint32(data)
+	id = string(data[4 : 4+n])
+	h := sha256.Sum256([]byte(id))
+	if len(id) <= maxHexIDLen || name != hashedPrefix+hex.EncodeToString(h[:]) {
+		return "", nil, errors.New("statedir: id in state file doesn't match its name")
+	}
+	return id, data[4+n:], nil
+}
+
+// isStateName returns whether name could be that of a state file, as given
+// by filename.
+func isStateName(name string) bool {
+	if !strings.HasSuffix(name, stateSuffix) {
+		return false
+	}
+	name = strings.TrimSuffix(name, stateSuffix)
+	hashed := strings.HasPrefix(name, hashedPrefix)
+	if hashed {
+		name = strings.TrimPrefix(name, hashedPrefix)
+	}
+	decoded, err := hex.DecodeString(name)
+	if err != nil || hex.EncodeToString(decoded) != name {
+		return false
+	}
+	if hashed {
+		return len(decoded) == sha256.Size
+	}
+	return len(decoded) > 0 && len(decoded) <= maxHexIDLen
+}
+
+// Delete removes the exchange stored under id. It is not an error if there is
+// none.
+func (s *Store) Delete(id string) error {
+	filename, err := s.filename(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.syncDir()
+}
+
+// List describes every exchange in the store. Files that can't be read or
+// parsed are listed with Err set rather than skipped, so that one corrupt
+// file doesn't hide the rest.
+func (s *Store) List() ([]Info, error) {
+	names, err := readDirNames(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for _, name := range names {
+		if !isStateName(name) {
+			continue
+		}
+		infos = append(infos, s.info(name))
+	}
+	return infos, nil
+}
+
+// info describes the state file with the given name.
+func (s *Store) info(name string) Info {
+	path := filepath.Join(s.dir, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Info{Err: errors.New("statedir: " + name + ": " + err.Error())}
+	}
+	id, data, err := readStateFile(path)
+	if err != nil {
+		return Info{ModTime: fi.ModTime(), Err: errors.New("statedir: " + name + ": " + err.Error())}
+	}
+	info := Info{ID: id, ModTime: fi.ModTime()}
+	if info.StateInfo, err = panda.PeekStateInfo(data); err != nil {
+		info.Err = errors.New("statedir: " + name + ": " + err.Error())
+	}
+	return info
+}
+
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
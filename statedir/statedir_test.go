@@ -0,0 +1,156 @@
+package statedir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/agl/panda"
+)
+
+// newExchange returns an exchange that uses a cheap KDF so that tests run
+// quickly.
+func newExchange(t *testing.T, message string) *panda.Exchange {
+	ex, err := panda.New(rand.Reader, []byte("secret"), []byte(message), panda.WithKDF(panda.KDFBalloon), panda.WithBalloonCost(16, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ex
+}
+
+func tempStore(t *testing.T) (*Store, string) {
+	dir, err := ioutil.TempDir("", "statedir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestSaveLoadDelete(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	ex := newExchange(t, "hello")
+	if err := ex.SetAppData("nickname", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	// "a" and "Y", and "i" and "I", differ only in case, which some
+	// filesystems ignore.
+	ids := []string{"alice", "../../etc/passwd", "bob/κ", "a", "Y", "i", "I", strings.Repeat("long id ", 100)}
+	for _, id := range ids {
+		if err := s.Save(id, ex); err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+	}
+
+	for _, id := range []string{"../../etc/passwd", ids[len(ids)-1]} {
+		loaded, err := s.Load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(loaded.Marshal(), ex.Marshal()) {
+			t.Errorf("loaded state differs from saved state")
+		}
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lowered := make(map[string]bool)
+	for _, name := range names {
+		if len(name) > 255 {
+			t.Errorf("filename %q is too long", name)
+		}
+		lowered[strings.ToLower(name)] = true
+	}
+	if len(lowered) != len(ids) {
+		t.Errorf("got %d filenames that differ other than in case, want %d", len(lowered), len(ids))
+	}
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(ids) {
+		t.Fatalf("got %d entries, want %d", len(infos), len(ids))
+	}
+	listed := make(map[string]bool)
+	for _, info := range infos {
+		listed[info.ID] = true
+		if info.Err != nil || info.Stage != panda.StageRoundOne || info.Failed || info.ModTime.IsZero() || info.AppData["nickname"] != "Alice" {
+			t.Errorf("unexpected info: %+v", info)
+		}
+	}
+
+	for _, id := range ids {
+		if !listed[id] {
+			t.Errorf("%q wasn't listed", id)
+		}
+	}
+
+	if err := s.Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load("alice"); !os.IsNotExist(err) {
+		t.Errorf("got %v after deleting", err)
+	}
+	if err := s.Delete("alice"); err != nil {
+		t.Errorf("second delete failed: %s", err)
+	}
+	if err := s.Save("", ex); err == nil {
+		t.Errorf("empty id was accepted")
+	}
+}
+
+func TestInterruptedWrite(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	old := newExchange(t, "old")
+	if err := s.Save("id", old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate crashes between writing and renaming, both after a complete
+	// write and part way through one.
+	newer := newExchange(t, "new").Marshal()
+	if _, err := s.writeTemp(newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.writeTemp(newer[:len(newer)/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Until the store is reopened, the temporary files must not be visible.
+	if infos, err := s.List(); err != nil || len(infos) != 1 {
+		t.Errorf("got %v, %v from List with temporary files present", infos, err)
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.Load("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Marshal(), old.Marshal()) {
+		t.Errorf("state changed by an interrupted write")
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("temporary files remain after Open: %q", names)
+	}
+}
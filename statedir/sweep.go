@@ -0,0 +1,122 @@
+package statedir
+
+import (
+	"os"
+	"time"
+
+	"github.com/agl/panda"
+)
+
+// A Policy determines which exchanges Sweep removes. Decisions are made from
+// each exchange's stage and the time that it was last saved, so no state is
+// ever decrypted or parsed beyond what PeekStateInfo reads.
+type Policy struct {
+	// CompletedRetention is how long a completed exchange is kept after it
+	// was last saved. If zero, completed exchanges are kept.
+	CompletedRetention time.Duration
+	// AbandonedRetention is how long a failed or unfinished exchange is
+	// kept after it was last saved. If zero, such exchanges are kept.
+	AbandonedRetention time.Duration
+	// DryRun causes Sweep to report what it would remove without removing
+	// anything.
+	DryRun bool
+}
+
+// A SweepResult describes an exchange selected by Sweep.
+type SweepResult struct {
+	Info
+	// Reason is "completed" or "abandoned", or empty if the exchange's
+	// file couldn't be read or parsed.
+	Reason string
+	// Err is the error, if any, from removing the exchange or, if Reason
+	// is empty, from reading it.
+	Err error
+}
+
+// Sweep removes the exchanges selected by p. Before a state file is removed,
+// its contents are overwritten. That is only a best effort: journaling and
+// copy-on-write filesystems may keep the old blocks. Files that can't be read
+// or parsed are kept and reported with their error, and the sweep continues.
+func (s *Store) Sweep(p Policy) ([]SweepResult, error) {
+	infos, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.now()
+	var results []SweepResult
+	for _, info := range infos {
+		if info.Err != nil {
+			results = append(results, SweepResult{Info: info, Err: info.Err})
+			continue
+		}
+		age := now.Sub(info.ModTime)
+		var reason string
+		switch {
+		case info.Stage == panda.StageComplete:
+			if p.CompletedRetention > 0 && age > p.CompletedRetention {
+				reason = "completed"
+			}
+		case p.AbandonedRetention > 0 && age > p.AbandonedRetention:
+			reason = "abandoned"
+		}
+		if len(reason) == 0 {
+			continue
+		}
+
+		result := SweepResult{Info: info, Reason: reason}
+		if !p.DryRun {
+			result.Err = s.destroy(info.ID)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// destroy overwrites and then removes the exchange stored under id.
+func (s *Store) destroy(id string) error {
+	filename, err := s.filename(id)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, fi.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(id)
+}
+
+// StartSweeper calls Sweep with p every interval until the returned function
+// is called. The results of each sweep are passed to report, which may be nil.
+func (s *Store) StartSweeper(p Policy, interval time.Duration, report func([]SweepResult, error)) (stop func()) {
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				results, err := s.Sweep(p)
+				if report != nil {
+					report(results, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,169 @@
+package statedir
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agl/panda"
+)
+
+// completedExchange runs an exchange to completion against an in-memory
+// meeting place and returns one side of it.
+func completedExchange(t *testing.T) *panda.Exchange {
+	a, b := newExchange(t, "a"), newExchange(t, "b")
+	posted := make(map[string][][]byte)
+	transact := func(ex *panda.Exchange) bool {
+		tag, body := ex.NextRequest()
+		bodies := append(posted[string(tag)], body)
+		posted[string(tag)] = bodies
+		result, err := ex.ProcessAny(bodies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.RoundConsumed == 2
+	}
+	for i := 0; ; i++ {
+		if i > 10 {
+			t.Fatal("exchange did not complete")
+		}
+		aDone, bDone := transact(a), transact(b)
+		if aDone {
+			return a
+		}
+		if bDone {
+			return b
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	failed := newExchange(t, "failed")
+	failed.Fail(errors.New("user cancelled"))
+	exchanges := map[string]*panda.Exchange{
+		"pending":   newExchange(t, "pending"),
+		"failed":    failed,
+		"completed": completedExchange(t),
+	}
+	for id, ex := range exchanges {
+		if err := s.Save(id, ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	policy := Policy{CompletedRetention: time.Hour, AbandonedRetention: 24 * time.Hour}
+
+	tests := []struct {
+		after     time.Duration
+		dryRun    bool
+		swept     map[string]string
+		remaining int
+	}{
+		{time.Minute, false, nil, 3},
+		{2 * time.Hour, true, map[string]string{"completed": "completed"}, 3},
+		{2 * time.Hour, false, map[string]string{"completed": "completed"}, 2},
+		{23 * time.Hour, false, nil, 2},
+		{25 * time.Hour, false, map[string]string{"pending": "abandoned", "failed": "abandoned"}, 0},
+	}
+
+	for i, test := range tests {
+		s.now = func() time.Time { return start.Add(test.after) }
+		p := policy
+		p.DryRun = test.dryRun
+		results, err := s.Sweep(p)
+		if err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+		if len(results) != len(test.swept) {
+			t.Errorf("#%d: swept %d exchanges, want %d", i, len(results), len(test.swept))
+		}
+		for _, result := range results {
+			if result.Err != nil || test.swept[result.ID] != result.Reason {
+				t.Errorf("#%d: unexpected result %+v", i, result)
+			}
+		}
+		infos, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != test.remaining {
+			t.Errorf("#%d: %d exchanges remain, want %d", i, len(infos), test.remaining)
+		}
+	}
+}
+
+func TestSweepCorrupt(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	if err := s.Save("completed", completedExchange(t)); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, hex.EncodeToString([]byte("corrupt"))+stateSuffix)
+	if err := ioutil.WriteFile(corrupt, []byte("not a state"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	results, err := s.Sweep(Policy{CompletedRetention: time.Hour, AbandonedRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var swept, failed int
+	for _, result := range results {
+		switch {
+		case result.ID == "completed" && result.Reason == "completed" && result.Err == nil:
+			swept++
+		case result.ID == "corrupt" && len(result.Reason) == 0 && result.Err != nil:
+			failed++
+		default:
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+	if swept != 1 || failed != 1 {
+		t.Errorf("got %+v, want one exchange swept and one error", results)
+	}
+	if _, err := s.Load("completed"); !os.IsNotExist(err) {
+		t.Errorf("swept exchange still present: %v", err)
+	}
+	if _, err := os.Stat(corrupt); err != nil {
+		t.Errorf("corrupt file was removed: %v", err)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	s, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	if err := s.Save("completed", completedExchange(t)); err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	reports := make(chan []SweepResult, 1)
+	stop := s.StartSweeper(Policy{CompletedRetention: time.Hour}, time.Millisecond, func(results []SweepResult, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		select {
+		case reports <- results:
+		default:
+		}
+	})
+	results := <-reports
+	stop()
+
+	if len(results) != 1 || results[0].ID != "completed" {
+		t.Errorf("got %+v from background sweep", results)
+	}
+	if _, err := s.Load("completed"); !os.IsNotExist(err) {
+		t.Errorf("swept exchange still present: %v", err)
+	}
+}
@@ -13,12 +13,65 @@ var _ = &json.SyntaxError{}
 var _ = math.Inf
 
 type State struct {
-	Key              []byte `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
-	Message          []byte `protobuf:"bytes,2,req,name=message" json:"message,omitempty"`
-	XBytes           []byte `protobuf:"bytes,3,req,name=x_bytes" json:"x_bytes,omitempty"`
-	PublicBytes      []byte `protobuf:"bytes,4,req,name=public_bytes" json:"public_bytes,omitempty"`
-	SharedKey        []byte `protobuf:"bytes,5,opt,name=shared_key" json:"shared_key,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	Key                []byte                `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Message            []byte                `protobuf:"bytes,2,req,name=message" json:"message,omitempty"`
+	XBytes             []byte                `protobuf:"bytes,3,req,name=x_bytes" json:"x_bytes,omitempty"`
+	PublicBytes        []byte                `protobuf:"bytes,4,req,name=public_bytes" json:"public_bytes,omitempty"`
+	SharedKey          []byte                `protobuf:"bytes,5,opt,name=shared_key" json:"shared_key,omitempty"`
+	FailureCode        *int32                `protobuf:"varint,6,opt,name=failure_code" json:"failure_code,omitempty"`
+	FailureMessage     *string               `protobuf:"bytes,7,opt,name=failure_message" json:"failure_message,omitempty"`
+	Kdf                *int32                `protobuf:"varint,8,opt,name=kdf" json:"kdf,omitempty"`
+	BalloonSpaceCost   *uint32               `protobuf:"varint,9,opt,name=balloon_space_cost" json:"balloon_space_cost,omitempty"`
+	BalloonTimeCost    *uint32               `protobuf:"varint,10,opt,name=balloon_time_cost" json:"balloon_time_cost,omitempty"`
+	Complete           *bool                 `protobuf:"varint,11,opt,name=complete" json:"complete,omitempty"`
+	ServerId           *string               `protobuf:"bytes,12,opt,name=server_id" json:"server_id,omitempty"`
+	AppData            []*State_AppDataEntry `protobuf:"bytes,13,rep,name=app_data" json:"app_data,omitempty"`
+	PeerMessageHash    []byte                `protobuf:"bytes,14,opt,name=peer_message_hash" json:"peer_message_hash,omitempty"`
+	ScryptN            *uint32               `protobuf:"varint,15,opt,name=scrypt_n" json:"scrypt_n,omitempty"`
+	ScryptR            *uint32               `protobuf:"varint,16,opt,name=scrypt_r" json:"scrypt_r,omitempty"`
+	ScryptP            *uint32               `protobuf:"varint,17,opt,name=scrypt_p" json:"scrypt_p,omitempty"`
+	Argon2Time         *uint32               `protobuf:"varint,18,opt,name=argon2_time" json:"argon2_time,omitempty"`
+	Argon2Memory       *uint32               `protobuf:"varint,19,opt,name=argon2_memory" json:"argon2_memory,omitempty"`
+	Argon2Threads      *uint32               `protobuf:"varint,20,opt,name=argon2_threads" json:"argon2_threads,omitempty"`
+	NormalizeSecret    *bool                 `protobuf:"varint,21,opt,name=normalize_secret" json:"normalize_secret,omitempty"`
+	ValidityWindow     *string               `protobuf:"bytes,22,opt,name=validity_window" json:"validity_window,omitempty"`
+	KeyDeriver         *string               `protobuf:"bytes,23,opt,name=key_deriver" json:"key_deriver,omitempty"`
+	PepperHash         []byte                `protobuf:"bytes,24,opt,name=pepper_hash" json:"pepper_hash,omitempty"`
+	Suite              *int32                `protobuf:"varint,25,opt,name=suite" json:"suite,omitempty"`
+	AugmentedRole      *int32                `protobuf:"varint,26,opt,name=augmented_role" json:"augmented_role,omitempty"`
+	W1                 []byte                `protobuf:"bytes,27,opt,name=w1" json:"w1,omitempty"`
+	VerifierL          []byte                `protobuf:"bytes,28,opt,name=verifier_l" json:"verifier_l,omitempty"`
+	KeyConfirmation    *bool                 `protobuf:"varint,29,opt,name=key_confirmation" json:"key_confirmation,omitempty"`
+	PeerConfirmation   []byte                `protobuf:"bytes,30,opt,name=peer_confirmation" json:"peer_confirmation,omitempty"`
+	ProtocolVersion    *int32                `protobuf:"varint,31,opt,name=protocol_version" json:"protocol_version,omitempty"`
+	BodyHash           []byte                `protobuf:"bytes,32,opt,name=body_hash" json:"body_hash,omitempty"`
+	GroupP             []byte                `protobuf:"bytes,33,opt,name=group_p" json:"group_p,omitempty"`
+	GroupG             []byte                `protobuf:"bytes,34,opt,name=group_g" json:"group_g,omitempty"`
+	GroupN             []byte                `protobuf:"bytes,35,opt,name=group_n" json:"group_n,omitempty"`
+	AppLabel           *string               `protobuf:"bytes,36,opt,name=app_label" json:"app_label,omitempty"`
+	HybridKem          *bool                 `protobuf:"varint,37,opt,name=hybrid_kem" json:"hybrid_kem,omitempty"`
+	KemSeed            []byte                `protobuf:"bytes,38,opt,name=kem_seed" json:"kem_seed,omitempty"`
+	KemCiphertext      []byte                `protobuf:"bytes,39,opt,name=kem_ciphertext" json:"kem_ciphertext,omitempty"`
+	KemSecret          []byte                `protobuf:"bytes,40,opt,name=kem_secret" json:"kem_secret,omitempty"`
+	BodySize           *int32                `protobuf:"varint,41,opt,name=body_size" json:"body_size,omitempty"`
+	Fragmentation      *bool                 `protobuf:"varint,42,opt,name=fragmentation" json:"fragmentation,omitempty"`
+	Fragmented         *bool                 `protobuf:"varint,43,opt,name=fragmented" json:"fragmented,omitempty"`
+	PeerFragmentHeader []byte                `protobuf:"bytes,44,opt,name=peer_fragment_header" json:"peer_fragment_header,omitempty"`
+	PeerRoundTwoKey    []byte                `protobuf:"bytes,45,opt,name=peer_round_two_key" json:"peer_round_two_key,omitempty"`
+	Fragments          []*State_Fragment     `protobuf:"bytes,46,rep,name=fragments" json:"fragments,omitempty"`
+	KeyOnly            *bool                 `protobuf:"varint,47,opt,name=key_only" json:"key_only,omitempty"`
+	PeerKeyOnly        *bool                 `protobuf:"varint,48,opt,name=peer_key_only" json:"peer_key_only,omitempty"`
+	PeerAcknowledged   *bool                 `protobuf:"varint,49,opt,name=peer_acknowledged" json:"peer_acknowledged,omitempty"`
+	Compression        *bool                 `protobuf:"varint,50,opt,name=compression" json:"compression,omitempty"`
+	Compressed         *bool                 `protobuf:"varint,51,opt,name=compressed" json:"compressed,omitempty"`
+	EncodedMessage     []byte                `protobuf:"bytes,52,opt,name=encoded_message" json:"encoded_message,omitempty"`
+	AssociatedDataHash []byte                `protobuf:"bytes,53,opt,name=associated_data_hash" json:"associated_data_hash,omitempty"`
+	Messages           []*State_Item         `protobuf:"bytes,54,rep,name=messages" json:"messages,omitempty"`
+	PeerMessageIds     []uint32              `protobuf:"varint,55,rep,name=peer_message_ids" json:"peer_message_ids,omitempty"`
+	ReceivedMessages   []*State_Item         `protobuf:"bytes,56,rep,name=received_messages" json:"received_messages,omitempty"`
+	SkipEntropyCheck   *bool                 `protobuf:"varint,57,opt,name=skip_entropy_check" json:"skip_entropy_check,omitempty"`
+	PeerBodySizes      []int32               `protobuf:"varint,58,rep,name=peer_body_sizes" json:"peer_body_sizes,omitempty"`
+	XXX_unrecognized   []byte                `json:"-"`
 }
 
 func (this *State) Reset()         { *this = State{} }
@@ -60,5 +113,496 @@ func (this *State) GetSharedKey() []byte {
 	return nil
 }
 
+func (this *State) GetFailureCode() int32 {
+	if this != nil && this.FailureCode != nil {
+		return *this.FailureCode
+	}
+	return 0
+}
+
+func (this *State) GetFailureMessage() string {
+	if this != nil && this.FailureMessage != nil {
+		return *this.FailureMessage
+	}
+	return ""
+}
+
+func (this *State) GetKdf() int32 {
+	if this != nil && this.Kdf != nil {
+		return *this.Kdf
+	}
+	return 0
+}
+
+func (this *State) GetBalloonSpaceCost() uint32 {
+	if this != nil && this.BalloonSpaceCost != nil {
+		return *this.BalloonSpaceCost
+	}
+	return 0
+}
+
+func (this *State) GetBalloonTimeCost() uint32 {
+	if this != nil && this.BalloonTimeCost != nil {
+		return *this.BalloonTimeCost
+	}
+	return 0
+}
+
+func (this *State) GetComplete() bool {
+	if this != nil && this.Complete != nil {
+		return *this.Complete
+	}
+	return false
+}
+
+func (this *State) GetServerId() string {
+	if this != nil && this.ServerId != nil {
+		return *this.ServerId
+	}
+	return ""
+}
+
+func (this *State) GetAppData() []*State_AppDataEntry {
+	if this != nil {
+		return this.AppData
+	}
+	return nil
+}
+
+func (this *State) GetPeerMessageHash() []byte {
+	if this != nil {
+		return this.PeerMessageHash
+	}
+	return nil
+}
+
+func (this *State) GetScryptN() uint32 {
+	if this != nil && this.ScryptN != nil {
+		return *this.ScryptN
+	}
+	return 0
+}
+
+func (this *State) GetScryptR() uint32 {
+	if this != nil && this.ScryptR != nil {
+		return *this.ScryptR
+	}
+	return 0
+}
+
+func (this *State) GetScryptP() uint32 {
+	if this != nil && this.ScryptP != nil {
+		return *this.ScryptP
+	}
+	return 0
+}
+
+func (this *State) GetArgon2Time() uint32 {
+	if this != nil && this.Argon2Time != nil {
+		return *this.Argon2Time
+	}
+	return 0
+}
+
+func (this *State) GetArgon2Memory() uint32 {
+	if this != nil && this.Argon2Memory != nil {
+		return *this.Argon2Memory
+	}
+	return 0
+}
+
+func (this *State) GetArgon2Threads() uint32 {
+	if this != nil && this.Argon2Threads != nil {
+		return *this.Argon2Threads
+	}
+	return 0
+}
+
+func (this *State) GetNormalizeSecret() bool {
+	if this != nil && this.NormalizeSecret != nil {
+		return *this.NormalizeSecret
+	}
+	return false
+}
+
+func (this *State) GetValidityWindow() string {
+	if this != nil && this.ValidityWindow != nil {
+		return *this.ValidityWindow
+	}
+	return ""
+}
+
+func (this *State) GetKeyDeriver() string {
+	if this != nil && this.KeyDeriver != nil {
+		return *this.KeyDeriver
+	}
+	return ""
+}
+
+func (this *State) GetPepperHash() []byte {
+	if this != nil {
+		return this.PepperHash
+	}
+	return nil
+}
+
+func (this *State) GetSuite() int32 {
+	if this != nil && this.Suite != nil {
+		return *this.Suite
+	}
+	return 0
+}
+
+func (this *State) GetAugmentedRole() int32 {
+	if this != nil && this.AugmentedRole != nil {
+		return *this.AugmentedRole
+	}
+	return 0
+}
+
+func (this *State) GetW1() []byte {
+	if this != nil {
+		return this.W1
+	}
+	return nil
+}
+
+func (this *State) GetVerifierL() []byte {
+	if this != nil {
+		return this.VerifierL
+	}
+	return nil
+}
+
+func (this *State) GetKeyConfirmation() bool {
+	if this != nil && this.KeyConfirmation != nil {
+		return *this.KeyConfirmation
+	}
+	return false
+}
+
+func (this *State) GetPeerConfirmation() []byte {
+	if this != nil {
+		return this.PeerConfirmation
+	}
+	return nil
+}
+
+func (this *State) GetProtocolVersion() int32 {
+	if this != nil && this.ProtocolVersion != nil {
+		return *this.ProtocolVersion
+	}
+	return 0
+}
+
+func (this *State) GetBodyHash() []byte {
+	if this != nil {
+		return this.BodyHash
+	}
+	return nil
+}
+
+func (this *State) GetGroupP() []byte {
+	if this != nil {
+		return this.GroupP
+	}
+	return nil
+}
+
+func (this *State) GetGroupG() []byte {
+	if this != nil {
+		return this.GroupG
+	}
+	return nil
+}
+
+func (this *State) GetGroupN() []byte {
+	if this != nil {
+		return this.GroupN
+	}
+	return nil
+}
+
+func (this *State) GetAppLabel() string {
+	if this != nil && this.AppLabel != nil {
+		return *this.AppLabel
+	}
+	return ""
+}
+
+func (this *State) GetHybridKem() bool {
+	if this != nil && this.HybridKem != nil {
+		return *this.HybridKem
+	}
+	return false
+}
+
+func (this *State) GetKemSeed() []byte {
+	if this != nil {
+		return this.KemSeed
+	}
+	return nil
+}
+
+func (this *State) GetKemCiphertext() []byte {
+	if this != nil {
+		return this.KemCiphertext
+	}
+	return nil
+}
+
+func (this *State) GetKemSecret() []byte {
+	if this != nil {
+		return this.KemSecret
+	}
+	return nil
+}
+
+func (this *State) GetBodySize() int32 {
+	if this != nil && this.BodySize != nil {
+		return *this.BodySize
+	}
+	return 0
+}
+
+func (this *State) GetFragmentation() bool {
+	if this != nil && this.Fragmentation != nil {
+		return *this.Fragmentation
+	}
+	return false
+}
+
+func (this *State) GetFragmented() bool {
+	if this != nil && this.Fragmented != nil {
+		return *this.Fragmented
+	}
+	return false
+}
+
+func (this *State) GetPeerFragmentHeader() []byte {
+	if this != nil {
+		return this.PeerFragmentHeader
+	}
+	return nil
+}
+
+func (this *State) GetPeerRoundTwoKey() []byte {
+	if this != nil {
+		return this.PeerRoundTwoKey
+	}
+	return nil
+}
+
+func (this *State) GetFragments() []*State_Fragment {
+	if this != nil {
+		return this.Fragments
+	}
+	return nil
+}
+
+func (this *State) GetKeyOnly() bool {
+	if this != nil && this.KeyOnly != nil {
+		return *this.KeyOnly
+	}
+	return false
+}
+
+func (this *State) GetPeerKeyOnly() bool {
+	if this != nil && this.PeerKeyOnly != nil {
+		return *this.PeerKeyOnly
+	}
+	return false
+}
+
+func (this *State) GetPeerAcknowledged() bool {
+	if this != nil && this.PeerAcknowledged != nil {
+		return *this.PeerAcknowledged
+	}
+	return false
+}
+
+func (this *State) GetCompression() bool {
+	if this != nil && this.Compression != nil {
+		return *this.Compression
+	}
+	return false
+}
+
+func (this *State) GetCompressed() bool {
+	if this != nil && this.Compressed != nil {
+		return *this.Compressed
+	}
+	return false
+}
+
+func (this *State) GetEncodedMessage() []byte {
+	if this != nil {
+		return this.EncodedMessage
+	}
+	return nil
+}
+
+func (this *State) GetAssociatedDataHash() []byte {
+	if this != nil {
+		return this.AssociatedDataHash
+	}
+	return nil
+}
+
+func (this *State) GetMessages() []*State_Item {
+	if this != nil {
+		return this.Messages
+	}
+	return nil
+}
+
+func (this *State) GetPeerMessageIds() []uint32 {
+	if this != nil {
+		return this.PeerMessageIds
+	}
+	return nil
+}
+
+func (this *State) GetReceivedMessages() []*State_Item {
+	if this != nil {
+		return this.ReceivedMessages
+	}
+	return nil
+}
+
+func (this *State) GetSkipEntropyCheck() bool {
+	if this != nil && this.SkipEntropyCheck != nil {
+		return *this.SkipEntropyCheck
+	}
+	return false
+}
+
+func (this *State) GetPeerBodySizes() []int32 {
+	if this != nil {
+		return this.PeerBodySizes
+	}
+	return nil
+}
+
+type State_AppDataEntry struct {
+	Key              *string `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *State_AppDataEntry) Reset()         { *this = State_AppDataEntry{} }
+func (this *State_AppDataEntry) String() string { return proto.CompactTextString(this) }
+func (*State_AppDataEntry) ProtoMessage()       {}
+
+func (this *State_AppDataEntry) GetKey() string {
+	if this != nil && this.Key != nil {
+		return *this.Key
+	}
+	return ""
+}
+
+func (this *State_AppDataEntry) GetValue() string {
+	if this != nil && this.Value != nil {
+		return *this.Value
+	}
+	return ""
+}
+
+type State_Fragment struct {
+	Index            *uint32 `protobuf:"varint,1,req,name=index" json:"index,omitempty"`
+	Data             []byte  `protobuf:"bytes,2,req,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *State_Fragment) Reset()         { *this = State_Fragment{} }
+func (this *State_Fragment) String() string { return proto.CompactTextString(this) }
+func (*State_Fragment) ProtoMessage()       {}
+
+func (this *State_Fragment) GetIndex() uint32 {
+	if this != nil && this.Index != nil {
+		return *this.Index
+	}
+	return 0
+}
+
+func (this *State_Fragment) GetData() []byte {
+	if this != nil {
+		return this.Data
+	}
+	return nil
+}
+
+type State_Item struct {
+	Id               *uint32 `protobuf:"varint,1,req,name=id" json:"id,omitempty"`
+	Data             []byte  `protobuf:"bytes,2,req,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *State_Item) Reset()         { *this = State_Item{} }
+func (this *State_Item) String() string { return proto.CompactTextString(this) }
+func (*State_Item) ProtoMessage()       {}
+
+func (this *State_Item) GetId() uint32 {
+	if this != nil && this.Id != nil {
+		return *this.Id
+	}
+	return 0
+}
+
+func (this *State_Item) GetData() []byte {
+	if this != nil {
+		return this.Data
+	}
+	return nil
+}
+
+type Derivation struct {
+	Options          []byte  `protobuf:"bytes,1,req,name=options" json:"options,omitempty"`
+	Done             *bool   `protobuf:"varint,2,opt,name=done" json:"done,omitempty"`
+	Input            []byte  `protobuf:"bytes,3,opt,name=input" json:"input,omitempty"`
+	Blocks           []byte  `protobuf:"bytes,4,opt,name=blocks" json:"blocks,omitempty"`
+	LanesDone        *uint32 `protobuf:"varint,5,opt,name=lanes_done" json:"lanes_done,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *Derivation) Reset()         { *this = Derivation{} }
+func (this *Derivation) String() string { return proto.CompactTextString(this) }
+func (*Derivation) ProtoMessage()       {}
+
+func (this *Derivation) GetOptions() []byte {
+	if this != nil {
+		return this.Options
+	}
+	return nil
+}
+
+func (this *Derivation) GetDone() bool {
+	if this != nil && this.Done != nil {
+		return *this.Done
+	}
+	return false
+}
+
+func (this *Derivation) GetInput() []byte {
+	if this != nil {
+		return this.Input
+	}
+	return nil
+}
+
+func (this *Derivation) GetBlocks() []byte {
+	if this != nil {
+		return this.Blocks
+	}
+	return nil
+}
+
+func (this *Derivation) GetLanesDone() uint32 {
+	if this != nil && this.LanesDone != nil {
+		return *this.LanesDone
+	}
+	return 0
+}
+
 func init() {
 }
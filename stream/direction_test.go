@@ -0,0 +1,58 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/agl/panda"
+)
+
+func TestDirectionKeys(t *testing.T) {
+	opts := []panda.Option{panda.WithKDF(panda.KDFBalloon), panda.WithBalloonCost(16, 1)}
+	aMsg, bMsg := []byte("hello"), []byte("world")
+	a, err := panda.New(rand.Reader, []byte("foo"), aMsg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := panda.New(rand.Reader, []byte("foo"), bMsg, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 2; round++ {
+		_, aBody := a.NextRequest()
+		_, bBody := b.NextRequest()
+		if _, err := a.Process(bBody); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Process(aBody); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aSend, aReceive, err := DirectionKeys(a, aMsg, bMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSend, bReceive, err := DirectionKeys(b, bMsg, aMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aSend != bReceive || bSend != aReceive || aSend == aReceive {
+		t.Fatalf("direction keys don't pair up")
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(aSend, &buf)
+	w.Write([]byte("a large backup"))
+	w.Close()
+	plaintext, err := ioutil.ReadAll(NewReader(bReceive, &buf))
+	if err != nil || string(plaintext) != "a large backup" {
+		t.Errorf("got %q, %v", plaintext, err)
+	}
+
+	if _, _, err := DirectionKeys(a, aMsg, aMsg); err == nil {
+		t.Errorf("identical messages were accepted")
+	}
+}
@@ -0,0 +1,200 @@
+// Package stream encrypts data of any length with a key established by a
+// PANDA exchange.
+//
+// A stream is split into chunks, each sealed with secretbox under a nonce
+// made from a counter and a flag marking the last chunk. Chunks therefore
+// can't be reordered, dropped or altered, and a stream that is cut short is
+// detected rather than accepted as complete. Memory use is bounded by the
+// chunk size, which the writer and reader must agree on.
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"github.com/agl/panda"
+)
+
+// DefaultChunkSize is the amount of plaintext in each chunk when using
+// NewWriter and NewReader.
+const DefaultChunkSize = 64 << 10
+
+// ErrCorrupt is returned by a Reader when the stream fails to authenticate,
+// including when it has been truncated.
+var ErrCorrupt = errors.New("stream: corrupt or truncated stream")
+
+func chunkNonce(counter uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	binary.BigEndian.PutUint64(nonce[:], counter)
+	if last {
+		nonce[23] = 1
+	}
+	return &nonce
+}
+
+// DirectionKeys derives a pair of keys from a completed exchange so that
+// each party can send a stream to the other without the two ever sharing a
+// key. ourMessage is the message that we sent in the exchange and
+// peerMessage the one that we received; the peer passes them the other way
+// around and so gets the same keys with send and receive swapped. The
+// messages must differ.
+func DirectionKeys(ex *panda.Exchange, ourMessage, peerMessage []byte) (send, receive [32]byte, err error) {
+	ourHash, peerHash := sha256.Sum256(ourMessage), sha256.Sum256(peerMessage)
+	if ourHash == peerHash {
+		return send, receive, errors.New("stream: both messages are the same")
+	}
+	sendKey, err := ex.ExportKeyingMaterial("stream from "+string(ourHash[:]), 32)
+	if err != nil {
+		return send, receive, err
+	}
+	receiveKey, err := ex.ExportKeyingMaterial("stream from "+string(peerHash[:]), 32)
+	if err != nil {
+		return send, receive, err
+	}
+	copy(send[:], sendKey)
+	copy(receive[:], receiveKey)
+	return send, receive, nil
+}
+
+// A Writer encrypts a stream. Close must be called to write the final chunk;
+// without it the reader will report the stream as truncated.
+type Writer struct {
+	key     [32]byte
+	w       io.Writer
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+// NewWriter returns a Writer that encrypts to w with key using
+// DefaultChunkSize.
+func NewWriter(key [32]byte, w io.Writer) *Writer {
+	return NewWriterSize(key, w, DefaultChunkSize)
+}
+
+// NewWriterSize is like NewWriter but with the given chunk size.
+func NewWriterSize(key [32]byte, w io.Writer, chunkSize int) *Writer {
+	return &Writer{
+		key: key,
+		w:   w,
+		buf: make([]byte, 0, chunkSize),
+	}
+}
+
+func (w *Writer) seal(last bool) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(secretbox.Seal(nil, w.buf, chunkNonce(w.counter, last), &w.key))
+	w.counter++
+	w.buf = w.buf[:0]
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && w.err == nil {
+		// A full chunk is only sealed once more data arrives, since until
+		// then it might be the last.
+		if len(w.buf) == cap(w.buf) {
+			w.seal(false)
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, w.err
+}
+
+// Close writes the final chunk. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err == nil {
+		w.seal(true)
+		if w.err == nil {
+			w.err = errors.New("stream: write after Close")
+			return nil
+		}
+	}
+	return w.err
+}
+
+// A Reader decrypts a stream written by a Writer. It returns io.EOF only
+// after the final chunk has been authenticated.
+type Reader struct {
+	key       [32]byte
+	r         io.Reader
+	buf       []byte
+	out       []byte
+	plaintext []byte
+	// carry is true if buf[0] holds a byte read ahead of the current chunk.
+	carry   bool
+	counter uint64
+	err     error
+}
+
+// NewReader returns a Reader that decrypts r with key using
+// DefaultChunkSize.
+func NewReader(key [32]byte, r io.Reader) *Reader {
+	return NewReaderSize(key, r, DefaultChunkSize)
+}
+
+// NewReaderSize is like NewReader but with the given chunk size, which must
+// match that of the Writer.
+func NewReaderSize(key [32]byte, r io.Reader, chunkSize int) *Reader {
+	return &Reader{
+		key: key,
+		r:   r,
+		// One byte beyond a chunk is read so that the last chunk can be
+		// recognized.
+		buf: make([]byte, chunkSize+secretbox.Overhead+1),
+		out: make([]byte, 0, chunkSize),
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 && r.err == nil {
+		r.next()
+	}
+	if len(r.plaintext) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk.
+func (r *Reader) next() {
+	start := 0
+	if r.carry {
+		start = 1
+	}
+	n, err := io.ReadFull(r.r, r.buf[start:])
+	n += start
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.err = err
+		return
+	}
+
+	boxLen := len(r.buf) - 1
+	last := n <= boxLen
+	if !last {
+		n = boxLen
+	}
+	plaintext, ok := secretbox.Open(r.out[:0], r.buf[:n], chunkNonce(r.counter, last), &r.key)
+	if !ok {
+		r.err = ErrCorrupt
+		return
+	}
+	r.counter++
+	r.plaintext = plaintext
+	if last {
+		r.err = io.EOF
+	} else {
+		r.buf[0] = r.buf[boxLen]
+		r.carry = true
+	}
+}
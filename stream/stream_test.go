@@ -0,0 +1,130 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var testKey = [32]byte{1, 2, 3}
+
+func encrypt(t *testing.T, plaintext []byte, chunkSize int) []byte {
+	var buf bytes.Buffer
+	w := NewWriterSize(testKey, &buf, chunkSize)
+	// Write in odd-sized pieces so that chunk boundaries fall within them.
+	for len(plaintext) > 0 {
+		n := 7
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		if _, err := w.Write(plaintext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	const chunkSize = 64
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 1000} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		decrypted, err := ioutil.ReadAll(NewReaderSize(testKey, bytes.NewReader(encrypt(t, plaintext, chunkSize)), chunkSize))
+		if err != nil {
+			t.Errorf("size %d: %s", size, err)
+		} else if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: plaintext differs", size)
+		}
+	}
+}
+
+func TestFailsClosed(t *testing.T) {
+	const chunkSize = 64
+	const boxSize = chunkSize + 16
+	plaintext := make([]byte, 4*chunkSize+10)
+	rand.Read(plaintext)
+	ciphertext := encrypt(t, plaintext, chunkSize)
+
+	flipped := append([]byte(nil), ciphertext...)
+	flipped[boxSize+5] ^= 1
+	var reordered []byte
+	reordered = append(reordered, ciphertext[boxSize:2*boxSize]...)
+	reordered = append(reordered, ciphertext[:boxSize]...)
+	reordered = append(reordered, ciphertext[2*boxSize:]...)
+	var otherKey [32]byte
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		key        [32]byte
+	}{
+		{"empty", nil, testKey},
+		{"truncated mid-chunk", ciphertext[:len(ciphertext)-3], testKey},
+		{"truncated at chunk boundary", ciphertext[:4*boxSize], testKey},
+		{"missing chunk", append(append([]byte(nil), ciphertext[:boxSize]...), ciphertext[2*boxSize:]...), testKey},
+		{"trailing data", append(append([]byte(nil), ciphertext...), 0), testKey},
+		{"bit flip", flipped, testKey},
+		{"reordered", reordered, testKey},
+		{"wrong key", ciphertext, otherKey},
+	}
+
+	for _, test := range tests {
+		decrypted, err := ioutil.ReadAll(NewReaderSize(test.key, bytes.NewReader(test.ciphertext), chunkSize))
+		if err != ErrCorrupt {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if !bytes.HasPrefix(plaintext, decrypted) {
+			t.Errorf("%s: unauthenticated data was returned", test.name)
+		}
+	}
+}
+
+// TestLongStream streams a large amount of data through a pipe so that
+// neither side holds more than a chunk.
+func TestLongStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long stream in short mode")
+	}
+	const total = 256 << 20
+	pattern := make([]byte, 1<<20)
+	rand.Read(pattern)
+
+	pr, pw := io.Pipe()
+	wantHash := make(chan []byte, 1)
+	go func() {
+		h := sha256.New()
+		w := NewWriter(testKey, pw)
+		for written := 0; written < total; written += len(pattern) {
+			h.Write(pattern)
+			if _, err := w.Write(pattern); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err := w.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		wantHash <- h.Sum(nil)
+		pw.Close()
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(h, NewReader(testKey, pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != total {
+		t.Errorf("read %d bytes, want %d", n, total)
+	}
+	if !bytes.Equal(h.Sum(nil), <-wantHash) {
+		t.Errorf("plaintext differs")
+	}
+}
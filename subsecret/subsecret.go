@@ -0,0 +1,52 @@
+// Package subsecret derives many PANDA secrets from a single master secret.
+//
+// Each sub-secret is named by a path of strings, such as ("device",
+// "laptop-7"). Starting from the master, each component of the path is
+// applied in turn as an HKDF-SHA256 step:
+//
+//	key = HKDF-SHA256(secret: key, salt: none, info: "PANDA subsecret v1\x00" || uvarint(len(component)) || component)
+//
+// with a 32-byte output, and the final key is the sub-secret. Anyone who holds
+// the master, or the sub-secret for a prefix of a path, can derive the
+// sub-secret for that path. Without one of those, a sub-secret reveals
+// nothing about its siblings, its parent or the master.
+//
+// Sub-secrets are uniformly random and so can't be guessed, but the
+// expensive key derivation in panda.New still runs: this package makes
+// agreeing on secrets easier, not exchanges cheaper.
+package subsecret
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/hkdf"
+)
+
+const context = "PANDA subsecret v1\x00"
+
+// DeriveSubSecret returns the sub-secret of master named by path, suitable for
+// passing to panda.New.
+func DeriveSubSecret(master []byte, path ...string) ([]byte, error) {
+	if len(master) == 0 {
+		return nil, errors.New("subsecret: empty master secret")
+	}
+	if len(path) == 0 {
+		return nil, errors.New("subsecret: empty path")
+	}
+
+	key := master
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, component := range path {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(component)))
+		info := append(append([]byte(context), lenBuf[:n]...), component...)
+		next := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, info), next); err != nil {
+			return nil, err
+		}
+		key = next
+	}
+	return key, nil
+}
@@ -0,0 +1,77 @@
+package subsecret
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+var master = []byte("a well-guarded master secret")
+
+// TestVectors pins the derivation so that other implementations can check
+// against it.
+func TestVectors(t *testing.T) {
+	vectors := []struct {
+		path []string
+		hex  string
+	}{
+		{[]string{"device"}, "51659305087c365e322bd926855e65eb982019e03aac857978102ef1624a7c39"},
+		{[]string{"device", "laptop-7"}, "3293f79e6268373320b1e3462b0673de9514a14b449e9bc26c6ec75050b0f3bc"},
+		{[]string{"device", "laptop-8"}, "dc304110049b473140cc5958b3d3bd72011151a99ea6b58c4c4bc5f239c1c00a"},
+		{[]string{"", "device"}, "03816d2a3058955f8a6f1051ff1f540f2563ebdb4e378f7169d8567c1c83fec0"},
+	}
+
+	for _, v := range vectors {
+		secret, err := DeriveSubSecret(master, v.path...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(secret); got != v.hex {
+			t.Errorf("%q: got %s, want %s", v.path, got, v.hex)
+		}
+	}
+}
+
+func TestIndependence(t *testing.T) {
+	derive := func(path ...string) []byte {
+		secret, err := DeriveSubSecret(master, path...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+
+	secrets := [][]byte{
+		derive("device", "laptop-7"),
+		derive("device", "laptop-8"),
+		derive("laptop-7", "device"),
+		derive("device"),
+		derive("devicelaptop-7"),
+		derive("device", "laptop-7", ""),
+	}
+	for i := range secrets {
+		for j := i + 1; j < len(secrets); j++ {
+			if bytes.Equal(secrets[i], secrets[j]) {
+				t.Errorf("secrets %d and %d are equal", i, j)
+			}
+		}
+	}
+
+	// Holding the sub-secret for a prefix is equivalent to holding the
+	// master for everything below it.
+	intermediate := derive("device")
+	below, err := DeriveSubSecret(intermediate, "laptop-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(below, derive("device", "laptop-7")) {
+		t.Errorf("derivation from an intermediate secret differs")
+	}
+
+	if _, err := DeriveSubSecret(master); err == nil {
+		t.Errorf("empty path was accepted")
+	}
+	if _, err := DeriveSubSecret(nil, "device"); err == nil {
+		t.Errorf("empty master was accepted")
+	}
+}
@@ -0,0 +1,158 @@
+package panda
+
+import (
+	"crypto/sha512"
+	"errors"
+	"io"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/panda/stateproto"
+	"github.com/gtank/ristretto255"
+)
+
+// A Suite identifies the group in which an exchange runs SPAKE2. Both parties
+// must use the same suite, and exchanges in different suites never share
+// tags.
+type Suite int32
+
+const (
+	// SuiteMODP4096 is the 4096-bit MODP group of RFC 3526, the original
+	// protocol. It is the default.
+	SuiteMODP4096 Suite = 1
+	// SuiteRistretto255 is the ristretto255 group, which makes New and
+	// Process much faster and the serialized state much smaller.
+	SuiteRistretto255 Suite = 2
+	// SuiteP256 is the NIST P-256 curve with the SPAKE2 points of RFC 9382,
+	// and seals bodies with AES-256-GCM rather than XSalsa20-Poly1305, for
+	// deployments limited to NIST algorithms. The KDF is chosen separately.
+	SuiteP256 Suite = 3
+	// SuiteMODP2048 is the 2048-bit MODP group of RFC 3526, which makes New
+	// and Process several times faster than SuiteMODP4096, for constrained
+	// devices, at the cost of a smaller security margin.
+	SuiteMODP2048 Suite = 4
+)
+
+// WithSuite selects the group used for SPAKE2.
+func WithSuite(suite Suite) Option {
+	return func(c *config) {
+		c.suite = suite
+	}
+}
+
+// validateSuite returns an error if suite is unknown.
+func validateSuite(suite Suite) error {
+	switch suite {
+	case SuiteMODP4096, SuiteRistretto255, SuiteP256, SuiteMODP2048:
+		return nil
+	}
+	return errors.New("panda: unknown suite")
+}
+
+// label returns a prefix for the contexts used to derive values from the
+// exchange key. As with kdfParams.label, it is empty for the default.
+func (suite Suite) label() string {
+	switch suite {
+	case SuiteRistretto255:
+		return "ristretto255 "
+	case SuiteP256:
+		return "p256 "
+	case SuiteMODP2048:
+		return "modp2048 "
+	}
+	return ""
+}
+
+// isMODP reports whether suite performs SPAKE2 in a MODP group.
+func (suite Suite) isMODP() bool {
+	return suite == SuiteMODP4096 || suite == SuiteMODP2048
+}
+
+// roundOneKey returns the key that seals first round bodies. For suites other
+// than the original, it's derived with the suite's label so that an exchange
+// in one suite can't even open the bodies of another.
+func (ex *Exchange) roundOneKey() *[32]byte {
+	if ex.suite == SuiteMODP4096 && ex.version == ProtocolVersion1 {
+		return ex.bindAssociatedData(&ex.key)
+	}
+	var key [32]byte
+	var keySlice []byte
+	if ex.version >= ProtocolVersion2 {
+		keySlice = ex.scheduleKey(&ex.key, labelBoxRoundOne, 32)
+	} else {
+		keySlice = deriveKey(&ex.key, ex.context("round one box"))
+	}
+	copy(key[:], keySlice)
+	wipe(keySlice)
+	return ex.bindAssociatedData(&key)
+}
+
+// marshalSuite records suite in s, unless it's the default.
+func marshalSuite(suite Suite, s *stateproto.State) {
+	if suite != SuiteMODP4096 {
+		s.Suite = proto.Int32(int32(suite))
+	}
+}
+
+// unmarshalSuite returns the suite recorded in s.
+func unmarshalSuite(s *stateproto.State) Suite {
+	if s.Suite == nil {
+		return SuiteMODP4096
+	}
+	return Suite(*s.Suite)
+}
+
+// ristrettoN is the element that masks SPAKE2 public values in
+// SuiteRistretto255. Its discrete log is unknown because it's the result of
+// hashing a fixed string to the group.
+var ristrettoN = func() *ristretto255.Element {
+	h := sha512.Sum512([]byte("PANDA SPAKE2 ristretto255 N"))
+	return ristretto255.NewElement().FromUniformBytes(h[:])
+}()
+
+// scalarLen is the length of the encoded secret scalar in the elliptic-curve
+// suites, which is stored at the start of keyMaterial.xBytes.
+const scalarLen = 32
+
+// ristrettoPW returns the password scalar, derived from the exchange key.
+func (ex *Exchange) ristrettoPW() *ristretto255.Scalar {
+	seed := ex.spakeSeed(true)
+	defer wipe(seed)
+	return ristretto255.NewScalar().FromUniformBytes(seed)
+}
+
+// generateRistretto picks a new secret scalar and computes the corresponding
+// public SPAKE2 value.
+func (ex *Exchange) generateRistretto(r io.Reader) error {
+	var uniform [64]byte
+	if _, err := io.ReadFull(r, uniform[:]); err != nil {
+		return err
+	}
+	x := ristretto255.NewScalar().FromUniformBytes(uniform[:])
+	wipe(uniform[:])
+	x.Encode(ex.xBytes[:0])
+
+	X := ristretto255.NewElement().ScalarBaseMult(x)
+	X.Add(X, ristretto255.NewElement().ScalarMult(ex.ristrettoPW(), ex.ristrettoMask()))
+	ex.public = X.Encode(nil)
+	return nil
+}
+
+// ristrettoShared returns the SPAKE2 shared value given the peer's public
+// value.
+func (ex *Exchange) ristrettoShared(peer []byte) ([]byte, error) {
+	Y := ristretto255.NewElement()
+	if err := Y.Decode(peer); err != nil {
+		return nil, ErrInvalidPeerElement
+	}
+	unmaskedY := Y.Subtract(Y, ristretto255.NewElement().ScalarMult(ex.ristrettoPW(), ex.ristrettoMask()))
+	x := ristretto255.NewScalar()
+	if err := x.Decode(ex.xBytes[:scalarLen]); err != nil {
+		return nil, err
+	}
+	shared := ristretto255.NewElement().ScalarMult(x, unmaskedY)
+	x.Zero()
+	if shared.Equal(ristretto255.NewIdentityElement()) == 1 {
+		return nil, ErrInvalidPeerElement
+	}
+	return shared.Encode(nil), nil
+}
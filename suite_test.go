@@ -0,0 +1,180 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestRistretto255(t *testing.T) {
+	opts := []Option{WithSuite(SuiteRistretto255), fastKDF}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.public) != 32 {
+		t.Errorf("public value is %d bytes, want 32", len(a.public))
+	}
+	modp, err := New(rand.Reader, []byte("foo"), []byte("c"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, m := len(a.Marshal()), len(modp.Marshal()); n >= m-512 {
+		t.Errorf("serialized state is %d bytes, compared to %d for MODP", n, m)
+	}
+
+	a = marshalUnmarshal(a)
+	if a.suite != SuiteRistretto255 {
+		t.Errorf("suite was lost in serialization")
+	}
+	if info, err := PeekStateInfo(a.Marshal()); err != nil || info.Suite != SuiteRistretto255 {
+		t.Errorf("PeekStateInfo reported suite %d, %v", info.Suite, err)
+	}
+	aTag, aBody := a.NextRequest()
+
+	// An exchange in the other suite, with the same secret, must never
+	// match.
+	modpTag, modpBody := modp.NextRequest()
+	if bytes.Equal(aTag, modpTag) {
+		t.Errorf("exchanges in different suites share a tag")
+	}
+	if _, err := modp.Process(aBody); err == nil {
+		t.Errorf("MODP exchange accepted a ristretto255 body")
+	}
+	if _, err := b.Process(modpBody); err == nil {
+		t.Errorf("ristretto255 exchange accepted a MODP body")
+	}
+
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+	if a.sharedKey != b.sharedKey {
+		t.Errorf("shared keys differ")
+	}
+
+	c, err := New(rand.Reader, []byte("bar"), []byte("c"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(rand.Reader, []byte("foo"), []byte("d"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give c d's tag to simulate a collision with a different secret.
+	_, cBody := c.NextRequest()
+	_, dBody := d.NextRequest()
+	if _, err := d.Process(cBody); err == nil {
+		t.Errorf("body from a different secret was accepted")
+	}
+	if _, err := c.Process(dBody); err == nil {
+		t.Errorf("body from a different secret was accepted")
+	}
+
+	if _, err := New(rand.Reader, []byte("foo"), nil, WithSuite(5), fastKDF); err == nil {
+		t.Errorf("unknown suite was accepted")
+	}
+}
+
+func TestRistretto255Key(t *testing.T) {
+	opts := []Option{WithSuite(SuiteRistretto255), fastKDF}
+	key, err := PrecomputeKey([]byte("foo"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err = UnmarshalKey(key.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewFromKey(rand.Reader, key, []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RederiveSecret(rand.Reader, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
+
+func TestMODP2048(t *testing.T) {
+	opts := []Option{WithSuite(SuiteMODP2048), fastKDF}
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.public) > 256 {
+		t.Errorf("public value is %d bytes, want at most 256", len(a.public))
+	}
+	a = marshalUnmarshal(a)
+	if a.suite != SuiteMODP2048 {
+		t.Errorf("suite was lost in serialization")
+	}
+	aTag, aBody := a.NextRequest()
+	if len(aBody) != bodySize {
+		t.Errorf("body is %d bytes, want %d", len(aBody), bodySize)
+	}
+
+	modp, err := New(rand.Reader, []byte("foo"), []byte("c"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modpTag, modpBody := modp.NextRequest()
+	if bytes.Equal(aTag, modpTag) {
+		t.Errorf("exchanges in the 2048 and 4096-bit groups share a tag")
+	}
+	if _, err := modp.Process(aBody); err == nil {
+		t.Errorf("MODP4096 exchange accepted a MODP2048 body")
+	}
+	if _, err := b.Process(modpBody); err == nil {
+		t.Errorf("MODP2048 exchange accepted a MODP4096 body")
+	}
+
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+}
+
+func BenchmarkProcessMODP2048(b *testing.B) {
+	benchmarkProcess(b, WithSuite(SuiteMODP2048))
+}
+
+func BenchmarkProcessRistretto255(b *testing.B) {
+	benchmarkProcess(b, WithSuite(SuiteRistretto255))
+}
+
+func BenchmarkProcessMODP4096(b *testing.B) {
+	benchmarkProcess(b, WithSuite(SuiteMODP4096))
+}
+
+func benchmarkProcess(b *testing.B, suite Option) {
+	peer, err := New(rand.Reader, []byte("foo"), nil, suite, fastKDF)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, body := peer.NextRequest()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ex, err := New(rand.Reader, []byte("foo"), nil, suite, fastKDF)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ex.Process(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
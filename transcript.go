@@ -0,0 +1,173 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+)
+
+// A Disposition classifies a body in a transcript.
+type Disposition int
+
+const (
+	// DispositionInvalid is a body that doesn't authenticate, or that
+	// authenticates but isn't consistent with the exchange.
+	DispositionInvalid Disposition = iota
+	// DispositionOurs is the body that we posted.
+	DispositionOurs
+	// DispositionPeer is an authentic body from the peer.
+	DispositionPeer
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case DispositionOurs:
+		return "ours"
+	case DispositionPeer:
+		return "peer"
+	}
+	return "invalid"
+}
+
+// A BodyReport describes a single body in a transcript.
+type BodyReport struct {
+	// Round is one or two.
+	Round int
+	// Index is the position of the body within its round.
+	Index       int
+	Disposition Disposition
+	// Detail explains an invalid disposition.
+	Detail string
+}
+
+func (r BodyReport) String() string {
+	s := "round " + strconv.Itoa(r.Round) + " body " + strconv.Itoa(r.Index) + ": " + r.Disposition.String()
+	if len(r.Detail) > 0 {
+		s += " (" + r.Detail + ")"
+	}
+	return s
+}
+
+// A TranscriptReport is the result of VerifyTranscript.
+type TranscriptReport struct {
+	Bodies []BodyReport
+	// PeerMessage is the message from the peer's second round body. In
+	// fragmented exchanges it is nil, since the body holds only the first
+	// fragment, and the hash that the fragment carries is checked instead.
+	PeerMessage []byte
+	// Verified is true if each round contained exactly one peer body,
+	// consistent with the state, and the peer's message is the one that
+	// the state records as received.
+	Verified bool
+}
+
+// VerifyTranscript checks that the bodies retained from an exchange are
+// consistent with its completed, serialized state. It identifies which bodies
+// were ours and which the peer's, and checks that the peer's message is the
+// one that the exchange received. Only keys already held in the state are
+// used, so it can't confirm anything that the state's holder couldn't have
+// forged. An error is returned only if the state itself is unusable.
+func VerifyTranscript(state []byte, roundOneBodies, roundTwoBodies [][]byte) (*TranscriptReport, error) {
+	ex, err := Unmarshal(state)
+	if err != nil {
+		return nil, err
+	}
+	if !ex.complete {
+		return nil, errors.New("panda: transcript state is not from a completed exchange")
+	}
+	if ex.peerMessageHash == [32]byte{} {
+		return nil, errors.New("panda: transcript state doesn't record the received message")
+	}
+	if ex.multi() {
+		return nil, errors.New("panda: transcripts of exchanges of several messages can't be verified")
+	}
+
+	report := new(TranscriptReport)
+	peerBodies := [2]int{}
+
+	ourRoundOne, err := ex.box(1, ex.roundOneKey(), ex.roundOnePayload())
+	if err != nil {
+		return nil, err
+	}
+	for i, body := range roundOneBodies {
+		r := BodyReport{Round: 1, Index: i}
+		if err := ex.checkReplyLen(len(body)); err != nil {
+			r.Detail = err.Error()
+			report.Bodies = append(report.Bodies, r)
+			continue
+		}
+		switch payload, err := unbox(ex.suite, ex.version, ex.roundOneKey(), body); {
+		case bytes.Equal(body, ourRoundOne):
+			r.Disposition = DispositionOurs
+		case err != nil:
+			r.Detail = err.Error()
+		default:
+			peer, err := ex.splitRoundOne(payload)
+			var sharedKey *[32]byte
+			if err == nil {
+				err = ex.hashBodies(body)
+			}
+			if err == nil {
+				sharedKey, err = ex.agree(peer.public)
+			}
+			if err != nil {
+				r.Detail = err.Error()
+			} else if subtle.ConstantTimeCompare(sharedKey[:], ex.sharedKey[:]) != 1 {
+				r.Detail = "peer's value doesn't produce the recorded shared key"
+			} else {
+				r.Disposition = DispositionPeer
+				peerBodies[0]++
+			}
+			if sharedKey != nil {
+				*sharedKey = [32]byte{}
+			}
+		}
+		report.Bodies = append(report.Bodies, r)
+	}
+
+	ourRoundTwo, err := ex.roundTwoBody()
+	if err != nil {
+		return nil, err
+	}
+	for i, body := range roundTwoBodies {
+		r := BodyReport{Round: 2, Index: i}
+		if err := ex.checkReplyLen(len(body)); err != nil {
+			r.Detail = err.Error()
+			report.Bodies = append(report.Bodies, r)
+			continue
+		}
+		switch message, err := ex.openRoundTwo(body); {
+		case bytes.Equal(body, ourRoundTwo):
+			r.Disposition = DispositionOurs
+		case err != nil:
+			r.Detail = err.Error()
+		default:
+			h := sha256.Sum256(message)
+			if ex.fragmented {
+				// The first fragment carries the hash of the
+				// whole message.
+				if header, _, err := splitFragmentHeader(message); err == nil {
+					copy(h[:], header[4:])
+				}
+				message = nil
+			}
+			if subtle.ConstantTimeCompare(h[:], ex.peerMessageHash[:]) != 1 {
+				r.Detail = "peer's message isn't the one that was received"
+			} else {
+				r.Disposition = DispositionPeer
+				if message != nil {
+					// It matches the message received, so
+					// it decodes.
+					report.PeerMessage, _ = ex.peerMessageFrom(message)
+				}
+				peerBodies[1]++
+			}
+		}
+		report.Bodies = append(report.Bodies, r)
+	}
+
+	report.Verified = peerBodies[0] == 1 && peerBodies[1] == 1
+	return report, nil
+}
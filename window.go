@@ -0,0 +1,74 @@
+package panda
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// WithValidityWindow scopes the exchange to an agreed period, named by an
+// arbitrary label such as the result of ISOWeekWindow or a date. The label is
+// mixed into both the KDF input and the derivation of every tag and key, so
+// posts made under one window can't be matched under another, and someone who
+// later learns the secret must also know, or guess, the window. Both parties
+// must use the same label. The window is recorded in serialized state.
+func WithValidityWindow(window string) Option {
+	return func(c *config) {
+		c.window = window
+	}
+}
+
+// ISOWeekWindow returns a validity window naming the ISO 8601 week that
+// contains t, for example "2014-W09".
+func ISOWeekWindow(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", year, week)
+}
+
+// AdjacentISOWeekWindows returns the windows for the week before t, the week
+// containing t, and the week after, for use with WindowTags when the parties'
+// clocks may disagree about which week it is.
+func AdjacentISOWeekWindows(t time.Time) []string {
+	const week = 7 * 24 * time.Hour
+	return []string{ISOWeekWindow(t.Add(-week)), ISOWeekWindow(t), ISOWeekWindow(t.Add(week))}
+}
+
+// windowSecret returns the KDF input for secret in the given window. The
+// result is always a new buffer, which the caller should wipe.
+func windowSecret(secret []byte, window string) []byte {
+	if len(window) == 0 {
+		return append([]byte(nil), secret...)
+	}
+	prefix := "PANDA window " + strconv.Itoa(len(window)) + ":" + window + "\x00"
+	return append([]byte(prefix), secret...)
+}
+
+// WindowTags returns, for each of the given windows, the tag under which an
+// exchange with this secret and these options would post its first round. An
+// application unsure which window its peer used can poll these tags and
+// start its exchange in whichever window has a post. Any window set in opts
+// is ignored. The KDF is run once for each window.
+func WindowTags(secret []byte, windows []string, opts ...Option) ([][]byte, error) {
+	config := newConfig(opts)
+	if config.wipeSecret {
+		defer wipe(secret)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	tags := make([][]byte, len(windows))
+	for i, window := range windows {
+		config.window = window
+		key, err := precomputeKey(context.Background(), secret, config)
+		if err != nil {
+			return nil, err
+		}
+		ex := config.exchange(nil)
+		ex.keyMaterial = &keyMaterial{key: key.key}
+		ex.augmentKey()
+		tags[i] = ex.roundTag(1)
+		key.Wipe()
+	}
+	return tags, nil
+}
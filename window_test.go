@@ -0,0 +1,86 @@
+package panda
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestISOWeekWindow(t *testing.T) {
+	for _, test := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2014, time.March, 1, 12, 0, 0, 0, time.UTC), "2014-W09"},
+		// ISO weeks can belong to the neighbouring year.
+		{time.Date(2014, time.December, 29, 0, 0, 0, 0, time.UTC), "2015-W01"},
+		{time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC), "2015-W53"},
+	} {
+		if got := ISOWeekWindow(test.t); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.t, got, test.want)
+		}
+	}
+
+	windows := AdjacentISOWeekWindows(time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC))
+	if want := []string{"2014-W52", "2015-W01", "2015-W02"}; len(windows) != 3 || windows[0] != want[0] || windows[1] != want[1] || windows[2] != want[2] {
+		t.Errorf("got %q, want %q", windows, want)
+	}
+}
+
+func TestValidityWindow(t *testing.T) {
+	a, err := New(rand.Reader, []byte("foo"), []byte("a"), WithValidityWindow("2014-W09"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), WithValidityWindow("2014-W09"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = marshalUnmarshal(a)
+	if a.window != "2014-W09" {
+		t.Errorf("window lost in round trip: %q", a.window)
+	}
+	if info, _ := PeekStateInfo(a.Marshal()); info.Window != "2014-W09" {
+		t.Errorf("PeekStateInfo reported window %q", info.Window)
+	}
+	aTag, _ := a.NextRequest()
+
+	tags, err := WindowTags([]byte("foo"), AdjacentISOWeekWindows(time.Date(2014, time.March, 1, 0, 0, 0, 0, time.UTC)), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tags[1]) != string(aTag) {
+		t.Errorf("WindowTags didn't match the exchange's tag for the current window")
+	}
+	if string(tags[0]) == string(aTag) || string(tags[2]) == string(aTag) || string(tags[0]) == string(tags[2]) {
+		t.Errorf("adjacent windows share a tag")
+	}
+
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	for _, opts := range [][]Option{nil, {WithValidityWindow("2014-W10")}} {
+		c, err := New(rand.Reader, []byte("foo"), []byte("c"), append(opts, fastKDF)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cTag, _ := c.NextRequest(); string(cTag) == string(aTag) {
+			t.Errorf("%d options: exchange outside the window shares a tag", len(opts))
+		}
+	}
+
+	// RederiveSecret stays in the window.
+	d, err := New(rand.Reader, []byte("bar"), []byte("d"), WithValidityWindow("2014-W09"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = marshalUnmarshal(d)
+	if err := d.RederiveSecret(rand.Reader, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if dTag, _ := d.NextRequest(); string(dTag) != string(aTag) {
+		t.Errorf("RederiveSecret left the validity window")
+	}
+}
@@ -0,0 +1,91 @@
+package panda
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+)
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSecretWiping(t *testing.T) {
+	secret := []byte("foo")
+	a, err := New(rand.Reader, secret, []byte("a"), fastKDF, WithSecretWiping())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(secret) {
+		t.Errorf("New didn't wipe the secret")
+	}
+	b, err := New(rand.Reader, []byte("foo"), []byte("b"), fastKDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aResult, bResult := runExchange(t, a, b)
+	if string(aResult) != "b" || string(bResult) != "a" {
+		t.Errorf("got %q and %q", aResult, bResult)
+	}
+
+	secret = []byte("foo")
+	if _, err := New(rand.Reader, secret, nil, fastKDF, WithMinSecretBits(DefaultMinSecretBits), WithSecretWiping()); err == nil {
+		t.Fatal("weak secret was accepted")
+	}
+	if !isZero(secret) {
+		t.Errorf("New didn't wipe the secret after failing")
+	}
+
+	secret = []byte("foo")
+	if _, err := PrecomputeKey(secret, fastKDF, WithSecretWiping()); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(secret) {
+		t.Errorf("PrecomputeKey didn't wipe the secret")
+	}
+
+	secret = []byte("foo")
+	if _, err := New(rand.Reader, secret, nil, fastKDF, WithSecretNormalization()); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "foo" {
+		t.Errorf("secret was changed without WithSecretWiping")
+	}
+}
+
+func TestKDFInputWiped(t *testing.T) {
+	for _, window := range []string{"", "2014-W09"} {
+		config := newConfig([]Option{WithValidityWindow(window)})
+		secret := []byte("foo")
+		input, err := config.kdfInput(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wipe(input)
+		if string(secret) != "foo" {
+			t.Errorf("window %q: kdfInput returned the caller's buffer", window)
+		}
+	}
+
+	cancelable, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The derivation runs in another goroutine if ctx can be canceled.
+	for _, ctx := range []context.Context{context.Background(), cancelable} {
+		input := []byte("foo")
+		key, err := deriveContext(ctx, testDeriver{}, defaultKDFParams(), input, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isZero(input) {
+			t.Errorf("deriveContext didn't wipe its input")
+		}
+		if isZero(key) {
+			t.Errorf("deriveContext returned a zero key")
+		}
+	}
+}